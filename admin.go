@@ -0,0 +1,141 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	helper "gopherdrop/helper"
+	server "gopherdrop/server"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+func runAdmin(sec helper.GoDropConfig, db *gorm.DB, args []string) error {
+	if len(args) == 0 {
+		return errors.New(usage)
+	}
+	need := func(n int) error {
+		if len(args) < n+1 {
+			return fmt.Errorf("admin %s: missing arguments\n\n%s", args[0], usage)
+		}
+		return nil
+	}
+
+	switch args[0] {
+	// grant and revoke work on the database directly, they are how the
+	// first admin comes to be.
+	case "grant", "revoke":
+		if err := need(1); err != nil {
+			return err
+		}
+		res := db.Model(&server.User{}).Where("username = ?", args[1]).Update("is_admin", args[0] == "grant")
+		if res.Error != nil {
+			return res.Error
+		}
+		if res.RowsAffected == 0 {
+			return fmt.Errorf("user %q not found", args[1])
+		}
+		fmt.Printf("%s: is_admin=%v\n", args[1], args[0] == "grant")
+		return nil
+
+	case "users":
+		query := url.Values{}
+		if len(args) > 1 {
+			query.Set("q", args[1])
+		}
+		return adminCall(sec, http.MethodGet, "/users?"+query.Encode(), nil)
+	case "rename":
+		if err := need(2); err != nil {
+			return err
+		}
+		return adminCall(sec, http.MethodPut, "/users/"+args[1], map[string]any{"username": args[2]})
+	case "delete":
+		if err := need(1); err != nil {
+			return err
+		}
+		return adminCall(sec, http.MethodDelete, "/users/"+args[1], nil)
+	case "sessions":
+		return adminCall(sec, http.MethodGet, "/sessions", nil)
+	case "disconnect":
+		if err := need(1); err != nil {
+			return err
+		}
+		return adminCall(sec, http.MethodDelete, "/sessions/"+args[1], nil)
+	case "bans":
+		return adminCall(sec, http.MethodGet, "/bans", nil)
+	case "ban":
+		if err := need(1); err != nil {
+			return err
+		}
+		return adminCall(sec, http.MethodPost, "/bans", map[string]any{"public_key": args[1], "reason": strings.Join(args[2:], " ")})
+	case "unban":
+		if err := need(1); err != nil {
+			return err
+		}
+		return adminCall(sec, http.MethodDelete, "/bans", map[string]any{"public_key": args[1]})
+	case "transactions":
+		return adminCall(sec, http.MethodGet, "/transactions", nil)
+	default:
+		return fmt.Errorf("unknown admin command %q\n\n%s", args[0], usage)
+	}
+}
+
+// adminCall sends one request to the admin API and prints the data of the
+// response as indented JSON.
+func adminCall(sec helper.GoDropConfig, method string, path string, body any) error {
+	if sec.AdminToken == "" {
+		return errors.New("GDROP_ADMIN_TOKEN must be set for this command")
+	}
+
+	var reader io.Reader
+	if body != nil {
+		raw, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reader = bytes.NewReader(raw)
+	}
+	req, err := http.NewRequest(method, strings.TrimSuffix(sec.AdminURL, "/")+"/api/v1/admin"+path, reader)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+sec.AdminToken)
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	client := http.Client{Timeout: 10 * time.Second}
+	res, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	var ret struct {
+		Success bool            `json:"success"`
+		Message string          `json:"message"`
+		Data    json.RawMessage `json:"data"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&ret); err != nil {
+		return fmt.Errorf("%s: %w", res.Status, err)
+	}
+	if !ret.Success {
+		return fmt.Errorf("%s: %s", res.Status, ret.Message)
+	}
+	if len(ret.Data) == 0 || string(ret.Data) == "null" {
+		fmt.Println(ret.Message)
+		return nil
+	}
+	var out bytes.Buffer
+	if err := json.Indent(&out, ret.Data, "", "  "); err != nil {
+		return err
+	}
+	fmt.Println(out.String())
+	return nil
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	helper "gopherdrop/helper"
+	server "gopherdrop/server"
+	"strconv"
+
+	"gorm.io/gorm"
+)
+
+const usage = `usage: gopherdrop [command]
+
+Without a command the server is started.
+
+commands:
+  migrate [up [version]]    apply pending migrations (up to version)
+  migrate down [version]    roll back the newest migration (down to version)
+  migrate status            list migrations and whether they are applied
+
+  admin grant <username>    give a user the admin role
+  admin revoke <username>   take the admin role away
+
+  The admin commands below talk to the running server (GDROP_ADMIN_URL)
+  with GDROP_ADMIN_TOKEN:
+  admin users [query]             list users
+  admin rename <id> <username>    rename a user
+  admin delete <id>               delete a user and their data
+  admin sessions                  list connected sockets
+  admin disconnect <conn_id>      close a socket
+  admin bans                      list banned keys
+  admin ban <public_key> [reason] ban a key and end its sessions
+  admin unban <public_key>        lift a ban
+  admin transactions              list live transactions
+
+  The transfer commands log in to GDROP_SERVER_URL with the key kept in
+  GDROP_IDENTITY, which is made and registered on first use:
+  send -to <user> [-to <user>]... <path>...
+                            send files and whole folders to users, by
+                            username or public key
+  receive [-dir <dir>] [-y] wait for one transfer and write it under dir,
+                            folders are rebuilt with their times and modes`
+
+// clientCommands talk to a server as a user, they don't need the database.
+var clientCommands = map[string]func(helper.GoDropConfig, []string) error{
+	"send":    runSend,
+	"receive": runReceive,
+}
+
+// runCommand runs a CLI subcommand against db.
+func runCommand(sec helper.GoDropConfig, db *gorm.DB, args []string) error {
+	switch args[0] {
+	case "migrate":
+		return runMigrate(db, args[1:])
+	case "admin":
+		return runAdmin(sec, db, args[1:])
+	case "help", "-h", "--help":
+		fmt.Println(usage)
+		return nil
+	default:
+		return fmt.Errorf("unknown command %q\n\n%s", args[0], usage)
+	}
+}
+
+func runMigrate(db *gorm.DB, args []string) error {
+	action := "up"
+	if len(args) > 0 {
+		action = args[0]
+	}
+	version := -1
+	if len(args) > 1 {
+		v, err := strconv.Atoi(args[1])
+		if err != nil || v < 0 {
+			return fmt.Errorf("invalid version %q", args[1])
+		}
+		version = v
+	}
+
+	current, err := server.CurrentVersion(db)
+	if err != nil {
+		return err
+	}
+
+	switch action {
+	case "up":
+		if version < 0 {
+			version = server.LatestVersion()
+		}
+		if err := server.MigrateUp(db, version); err != nil {
+			return err
+		}
+	case "down":
+		if version < 0 {
+			version = max(current-1, 0)
+		}
+		if err := server.MigrateDown(db, version); err != nil {
+			return err
+		}
+	case "status":
+		states, err := server.MigrationStatus(db)
+		if err != nil {
+			return err
+		}
+		for _, st := range states {
+			applied := "pending"
+			if st.AppliedAt != nil {
+				applied = st.AppliedAt.Format("2006-01-02 15:04:05")
+			}
+			fmt.Printf("%4d  %-30s %s\n", st.Version, st.Name, applied)
+		}
+		return nil
+	default:
+		return errors.New(usage)
+	}
+
+	after, err := server.CurrentVersion(db)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("schema version %d -> %d\n", current, after)
+	return nil
+}
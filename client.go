@@ -0,0 +1,272 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	helper "gopherdrop/helper"
+	server "gopherdrop/server"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fasthttp/websocket"
+)
+
+// identity is the key pair `send` and `receive` log in with, kept in
+// GDROP_IDENTITY. The first run registers it under Username.
+type identity struct {
+	Username   string `json:"username"`
+	PrivateKey string `json:"private_key"` // base64 ed25519 seed
+}
+
+func loadIdentity(path string, username string) (ed25519.PrivateKey, string, bool, error) {
+	var id identity
+	raw, err := os.ReadFile(path)
+	if err == nil {
+		if err := json.Unmarshal(raw, &id); err != nil {
+			return nil, "", false, fmt.Errorf("%s: %w", path, err)
+		}
+		seed, err := base64.StdEncoding.DecodeString(id.PrivateKey)
+		if err != nil || len(seed) != ed25519.SeedSize {
+			return nil, "", false, fmt.Errorf("%s: invalid private key", path)
+		}
+		return ed25519.NewKeyFromSeed(seed), id.Username, false, nil
+	}
+	if !errors.Is(err, os.ErrNotExist) {
+		return nil, "", false, err
+	}
+
+	if username == "" {
+		if username, err = os.Hostname(); err != nil || username == "" {
+			username = "gopher"
+		}
+	}
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, "", false, err
+	}
+	id = identity{Username: username, PrivateKey: base64.StdEncoding.EncodeToString(key.Seed())}
+	if raw, err = json.MarshalIndent(id, "", "  "); err != nil {
+		return nil, "", false, err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+		return nil, "", false, err
+	}
+	return key, username, true, os.WriteFile(path, raw, 0o600)
+}
+
+// wsEvent is a message from the server, Data is decoded by whoever
+// waits for its type.
+type wsEvent struct {
+	Type server.WSType   `json:"type"`
+	Data json.RawMessage `json:"data"`
+}
+
+// client is a logged in user with an open WebSocket.
+type client struct {
+	base      string
+	key       ed25519.PrivateKey
+	publicKey string
+	refresh   string
+
+	conn    *websocket.Conn
+	writeMu sync.Mutex
+	events  chan wsEvent
+	closed  chan struct{}
+	err     error // why the socket closed, set before closed is
+}
+
+// connect logs in with the identity in sec.IdentityFile, registering it
+// first if the file doesn't exist yet, and opens the WebSocket.
+func connect(sec helper.GoDropConfig, username string) (*client, error) {
+	key, name, created, err := loadIdentity(sec.IdentityFile, username)
+	if err != nil {
+		return nil, err
+	}
+	c := &client{
+		base:      strings.TrimSuffix(sec.ServerURL, "/"),
+		key:       key,
+		publicKey: base64.StdEncoding.EncodeToString(key.Public().(ed25519.PublicKey)),
+		events:    make(chan wsEvent, 64),
+		closed:    make(chan struct{}),
+	}
+
+	if created {
+		if err := c.signed("/register", map[string]any{"username": name}, nil); err != nil {
+			os.Remove(sec.IdentityFile)
+			return nil, fmt.Errorf("register: %w", err)
+		}
+		fmt.Printf("registered as %s, identity saved to %s\n", name, sec.IdentityFile)
+	}
+	var pair server.TokenPair
+	if err := c.signed("/login", nil, &pair); err != nil {
+		return nil, fmt.Errorf("login: %w", err)
+	}
+	c.refresh = pair.RefreshToken
+
+	wsURL, err := url.Parse(c.base + "/api/v1/protected/ws")
+	if err != nil {
+		return nil, err
+	}
+	wsURL.Scheme = strings.Replace(wsURL.Scheme, "http", "ws", 1)
+	wsURL.RawQuery = url.Values{"token": {pair.AccessToken}}.Encode()
+	c.conn, _, err = websocket.DefaultDialer.Dial(wsURL.String(), nil)
+	if err != nil {
+		return nil, fmt.Errorf("websocket: %w", err)
+	}
+	go c.read()
+	return c, nil
+}
+
+// signed answers a fresh challenge with the identity key on path, body
+// gets the public key, challenge and signature added.
+func (c *client) signed(path string, body map[string]any, out any) error {
+	var challenge string
+	if err := c.call(http.MethodGet, "/challenge", nil, &challenge); err != nil {
+		return err
+	}
+	raw, err := base64.StdEncoding.DecodeString(challenge)
+	if err != nil {
+		return err
+	}
+	if body == nil {
+		body = map[string]any{}
+	}
+	body["public_key"] = c.publicKey
+	body["challenge"] = challenge
+	body["signature"] = base64.StdEncoding.EncodeToString(ed25519.Sign(c.key, raw))
+	return c.call(http.MethodPost, path, body, out)
+}
+
+// call sends one request to the public API and decodes the data of the
+// response into out.
+func (c *client) call(method string, path string, body any, out any) error {
+	var reader io.Reader
+	if body != nil {
+		raw, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reader = bytes.NewReader(raw)
+	}
+	req, err := http.NewRequest(method, c.base+"/api/v1"+path, reader)
+	if err != nil {
+		return err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	httpClient := http.Client{Timeout: 10 * time.Second}
+	res, err := httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	var ret struct {
+		Success bool            `json:"success"`
+		Message string          `json:"message"`
+		Data    json.RawMessage `json:"data"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&ret); err != nil {
+		return fmt.Errorf("%s: %w", res.Status, err)
+	}
+	if !ret.Success {
+		return fmt.Errorf("%s: %s", res.Status, ret.Message)
+	}
+	if out == nil {
+		return nil
+	}
+	return json.Unmarshal(ret.Data, out)
+}
+
+// read hands the server's messages to events until the socket closes.
+// Token renewals are answered here, a transfer may outlive its token.
+func (c *client) read() {
+	defer close(c.closed)
+	for {
+		var ev wsEvent
+		if err := c.conn.ReadJSON(&ev); err != nil {
+			c.err = err
+			return
+		}
+		if ev.Type == server.REAUTH {
+			var warning string
+			if json.Unmarshal(ev.Data, &warning) == nil {
+				go c.reauth()
+			}
+			continue
+		}
+		c.events <- ev
+	}
+}
+
+func (c *client) reauth() {
+	var pair server.TokenPair
+	if err := c.call(http.MethodPost, "/refresh", map[string]string{"refresh_token": c.refresh}, &pair); err != nil {
+		fmt.Fprintln(os.Stderr, "token refresh failed:", err)
+		return
+	}
+	c.refresh = pair.RefreshToken
+	c.send(server.REAUTH, pair.AccessToken)
+}
+
+func (c *client) send(t server.WSType, data any) error {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	return c.conn.WriteJSON(server.WSMessage{WSType: t, Data: data})
+}
+
+// next waits for the next message from the server.
+func (c *client) next() (wsEvent, error) {
+	select {
+	case ev := <-c.events:
+		return ev, nil
+	case <-c.closed:
+		return wsEvent{}, fmt.Errorf("connection closed: %w", c.err)
+	}
+}
+
+// expect waits for the answer of type t and decodes it into out. Other
+// messages are skipped, an ERROR fails.
+func (c *client) expect(t server.WSType, out any) error {
+	for {
+		ev, err := c.next()
+		if err != nil {
+			return err
+		}
+		switch ev.Type {
+		case t:
+			if out == nil {
+				return nil
+			}
+			return json.Unmarshal(ev.Data, out)
+		case server.ERROR:
+			return serverError(ev)
+		}
+	}
+}
+
+func serverError(ev wsEvent) error {
+	var msg string
+	json.Unmarshal(ev.Data, &msg)
+	return fmt.Errorf("server: %s", msg)
+}
+
+func (c *client) Close() error {
+	c.writeMu.Lock()
+	c.conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""))
+	c.writeMu.Unlock()
+	return c.conn.Close()
+}
@@ -1,5 +1,6 @@
-import { initAuth } from "./auth.js";
+import { initAuth, refreshSession, openShareLink, openGuestSession } from "./auth.js";
 import { loadComponent } from "./helper.js";
+import { codeWords, nameplateOf, spake2Start, spake2Finish, confirmationFor, checkConfirmation, fingerprintMac, checkFingerprintMac } from "./pake.js";
 
 // ==========================================
 // CONFIGURATION & CONSTANTS
@@ -28,7 +29,20 @@ const WS_TYPE = {
     FILE_SHARE_TARGET: 9,
     START_TRANSACTION: 10,
     TRANSACTION_SHARE_ACCEPT: 11,
-    WEBRTC_SIGNAL: 12
+    WEBRTC_SIGNAL: 12,
+    REAUTH: 16,
+    SERVER_GOING_AWAY: 17,
+    SHARE_TEXT: 18,
+    SHARE_TEXT_ACCEPT: 19,
+    CANCEL_TRANSFER: 20,
+    REQUEST_FILES: 21,
+    REQUEST_FILES_STATUS: 22,
+    CODE_ROOM: 23,
+    CODE_ROOM_JOIN: 24,
+    CODE_ROOM_PAKE: 25,
+    CODE_ROOM_CONFIRM: 26,
+    SHARE_LINK: 27,
+    SHARE_LINK_JOIN: 28
 };
 
 // Konfigurasi Server STUN (Google Gratis)
@@ -51,6 +65,7 @@ let signalingSocket = null;
 let isSocketConnected = false;
 let currentTransactionId = null;
 let discoveryInterval = null;
+let reconnectDelay = 3000; // the server may hint a different delay when it shuts down
 let pendingTransactionId = null;
 let hasRespondedToPendingTransaction = false;
 
@@ -67,9 +82,15 @@ let pendingTransferFiles = [];
 // Pending targets to send after FILE_SHARE_TARGET confirmed
 let pendingTargetPublicKeys = null;
 
+// File request yang sedang dijawab oleh transaksi berikutnya
+let pendingRequestId = null;
+
 // File Transfer State (Sender)
 let transferStates = {};
 
+// File indexes each receiver accepted (public key -> [index]), absent = all files
+let fileSelections = {};
+
 // Progress tracking for ETA calculation
 let transferStartTime = null;
 let totalBytesToSend = 0;
@@ -120,7 +141,21 @@ async function initializeApp() {
     }
 
     // Auth & Connection (Menjaga status tetap "Online" di semua page)
-    const token = await initAuth();
+    // Dibuka dari share link atau dengan ?guest: masuk sebagai guest, tanpa registrasi
+    const params = new URLSearchParams(window.location.search);
+    const linkToken = params.get('link');
+    let token;
+    if (linkToken) token = await joinAsGuest(linkToken);
+    else if (params.has('guest')) token = await startGuestSession(params.get('guest'));
+    else {
+        token = await initAuth();
+        // Group yang dibuat sebelum ada sinkronisasi ikut terkirim sekali
+        if (token && window.syncContacts) {
+            try {
+                window.syncContacts(JSON.parse(localStorage.getItem('gdrop_saved_groups') || '[]'));
+            } catch { /* group rusak, diabaikan */ }
+        }
+    }
     if (token) {
         connectToSignalingServer(token);
     }
@@ -253,11 +288,14 @@ function connectToSignalingServer(token) {
         // Update status online
         isSocketConnected = true;
 
-        // Check discoverable state
-        const isDiscoverable = localStorage.getItem('gdrop_is_discoverable') !== 'false';
+        // Guest dari share link hanya menunggu offer
+        if (isLinkGuest) return;
 
-        // Pooling who is online
-        sendSignalingMessage(WS_TYPE.CONFIG_DISCOVERABLE, isDiscoverable);
+        // Check discoverable state (guest tidak punya akun, tidak bisa diubah)
+        if (!isGuestSession) {
+            const isDiscoverable = localStorage.getItem('gdrop_is_discoverable') !== 'false';
+            sendSignalingMessage(WS_TYPE.CONFIG_DISCOVERABLE, isDiscoverable);
+        }
 
         // Start sharing
         sendSignalingMessage(WS_TYPE.START_SHARING, null);
@@ -286,11 +324,12 @@ function connectToSignalingServer(token) {
         signalingSocket = null;
         if (discoveryInterval) clearInterval(discoveryInterval);
 
-        // Auto Reconnect dalam 3 detik
-        setTimeout(() => {
-            const token = localStorage.getItem('gdrop_token');
+        // Auto Reconnect dalam 3 detik (token mungkin sudah expired, refresh dulu)
+        setTimeout(async () => {
+            const token = await refreshSession();
             if (token) connectToSignalingServer(token);
-        }, 3000);
+        }, reconnectDelay);
+        reconnectDelay = 3000;
     };
 }
 
@@ -319,6 +358,16 @@ function handleSignalingMessage(msg) {
 
         // New Transaction Created - Receiver / Response Handler
         case WS_TYPE.TRANSACTION_SHARE_ACCEPT:
+            // Offline recipient: request is kept in their inbox
+            if (msg.data && msg.data.type === 'queued_notification') {
+                showToast(`${msg.data.username} is offline, they will get the request when they come back.`, 'info');
+                return;
+            }
+            if (msg.data && msg.data.type === 'recipient_online') {
+                showToast(`${msg.data.username} is online and got your transfer request.`, 'info');
+                return;
+            }
+
             // 1. PRIORITAS UTAMA: Cek Decline Notification DULUAN
             // Kalau tipe pesannya 'decline_notification', langsung tangani dan stop
             if (msg.data && msg.data.type === 'decline_notification' && msg.data.declined) {
@@ -342,11 +391,16 @@ function handleSignalingMessage(msg) {
                 const responderName = msg.data.username || "Recipient";
                 const responderKey = msg.data.sender_public_key;
 
-                showToast(`${responderName} accepted! Starting transfer...`, 'success');
+                showToast(msg.data.auto
+                    ? `${responderName} auto-accepted. Starting transfer...`
+                    : `${responderName} accepted! Starting transfer...`, 'success');
 
                 // Auto-start transaction process
                 if (currentTransactionId && responderKey) {
                     acceptedPublicKeys.add(responderKey);
+                    if (Array.isArray(msg.data.files)) {
+                        fileSelections[responderKey] = new Set(msg.data.files);
+                    }
                     isInitiatorRole = true;
                     sessionStorage.setItem('gdrop_is_sender', 'true');
 
@@ -566,20 +620,540 @@ function handleSignalingMessage(msg) {
 
         case WS_TYPE.ERROR: // ERROR Handling
             if (msg.data !== "invalid websocket message") {
-                showToast(msg.data, 'error');
+                // Structured errors (e.g. rate limits) carry { code, message }
+                showToast(msg.data?.message || msg.data, 'error');
             }
             break;
 
+        // Server asks for a fresh token before the current one expires
+        case WS_TYPE.REAUTH:
+            if (msg.data === "token expiring" && !isGuestSession) {
+                refreshSession().then(token => {
+                    if (token) sendSignalingMessage(WS_TYPE.REAUTH, token);
+                });
+            }
+            break;
+
+        // Server is restarting, reconnect after the hinted delay
+        case WS_TYPE.SERVER_GOING_AWAY:
+            reconnectDelay = msg.data?.reconnect_after_ms || 3000;
+            break;
+
+        // One side stopped a transfer (receiver quit, or sender dropped a target)
+        case WS_TYPE.CANCEL_TRANSFER:
+            handleTransferCancelled(msg.data);
+            break;
+
+        // File requests (someone asks us for files, or news about ours)
+        case WS_TYPE.REQUEST_FILES:
+            handleFileRequest(msg.data);
+            break;
+
+        case WS_TYPE.REQUEST_FILES_STATUS:
+            handleFileRequestStatus(msg.data);
+            break;
+
+        // Share link: link baru/dicabut, atau guest bergabung lewat link
+        case WS_TYPE.SHARE_LINK:
+            handleShareLink(msg.data);
+            break;
+
+        case WS_TYPE.SHARE_LINK_JOIN:
+            if (msg.data?.user) showToast(`${msg.data.user.username} opened your link.`, 'info');
+            break;
+
+        // Code room: pairing pakai kode, tanpa harus saling discoverable
+        case WS_TYPE.CODE_ROOM:
+            handleCodeRoomOpened(msg.data);
+            break;
+
+        case WS_TYPE.CODE_ROOM_JOIN:
+            handleCodeRoomJoined(msg.data);
+            break;
+
+        case WS_TYPE.CODE_ROOM_PAKE:
+            handleCodeRoomPake(msg.data);
+            break;
+
+        case WS_TYPE.CODE_ROOM_CONFIRM:
+            handleCodeRoomConfirmed(msg.data);
+            break;
+
+        // Text / link sharing
+        case WS_TYPE.SHARE_TEXT:
+            handleTextShare(msg.data);
+            break;
+
+        case WS_TYPE.SHARE_TEXT_ACCEPT:
+            handleTextShareAnswer(msg.data);
+            break;
+
         case 0: // INFO / KEEPALIVE
             break;
     }
 }
 
+// Batalkan transfer: receiver membatalkan bagiannya sendiri (tanpa publicKey),
+// sender membatalkan satu penerima (dengan publicKey)
+function cancelTransferPart(publicKey, reason) {
+    const transactionId = publicKey ? currentTransactionId : (pendingTransactionId || currentTransactionId);
+    if (!transactionId) return;
+    sendSignalingMessage(WS_TYPE.CANCEL_TRANSFER, {
+        transaction_id: transactionId,
+        public_key: publicKey,
+        reason: reason
+    });
+}
+
+function handleTransferCancelled(data) {
+    if (!data || !data.public_key) return;
+    const myPublicKey = localStorage.getItem('gdrop_public_key');
+
+    // Receiver: bagian kita dibatalkan
+    if (data.public_key === myPublicKey) {
+        if (data.by === 'sender') {
+            showToast(`${data.cancelled_by} cancelled the transfer.`, 'warning');
+        }
+        resetTransferState();
+        return;
+    }
+
+    // Sender: satu penerima berhenti, tutup koneksinya saja
+    const pc = peerConnections[data.public_key];
+    if (pc && pc.connectionState !== 'closed') pc.close();
+    delete peerConnections[data.public_key];
+    delete dataChannels[data.public_key];
+    delete transferStates[data.public_key];
+    delete fileSelections[data.public_key];
+    acceptedPublicKeys.delete(data.public_key);
+
+    if (data.by === 'receiver') {
+        showToast(`${data.username} cancelled the transfer.`, 'warning');
+    }
+    if (acceptedPublicKeys.size === 0) {
+        resetTransferState();
+        return;
+    }
+    checkAllPeersDone();
+}
+
+// ==========================================
+// FILE REQUESTS
+// ==========================================
+
+// Request terbuka yang ditujukan ke kita, dijawab lewat transaksi baru
+const openFileRequests = {};
+
+// Minta file ke user lain; types berisi ".ext", "image/*" atau MIME type
+function requestFiles(publicKey, note, types, maxSize) {
+    sendSignalingMessage(WS_TYPE.REQUEST_FILES, {
+        public_key: publicKey,
+        note: note || '',
+        types: types || [],
+        max_size: maxSize || 0
+    });
+}
+
+function handleFileRequest(data) {
+    if (!data || !data.id) return;
+    const myPublicKey = localStorage.getItem('gdrop_public_key');
+
+    // Echo untuk requester
+    if (data.requester_key === myPublicKey) {
+        showToast(`File request sent to ${data.target_name}.`, 'info');
+        return;
+    }
+
+    openFileRequests[data.id] = data;
+    const note = data.note ? `\n\n"${data.note}"` : '';
+    const send = confirm(`${data.requester_name} is asking you for files.${note}\n\nSend files now?`);
+    if (!send) {
+        answerFileRequest(data.id, 'declined');
+        return;
+    }
+    pendingRequestId = data.id;
+    showToast(`Pick the files for ${data.requester_name} and send them.`, 'info');
+}
+
+function answerFileRequest(requestId, status, reason) {
+    sendSignalingMessage(WS_TYPE.REQUEST_FILES_STATUS, { request_id: requestId, status, reason });
+    delete openFileRequests[requestId];
+    if (pendingRequestId === requestId) pendingRequestId = null;
+}
+
+function handleFileRequestStatus(data) {
+    if (!data || !data.id) return;
+    const myPublicKey = localStorage.getItem('gdrop_public_key');
+    delete openFileRequests[data.id];
+    if (pendingRequestId === data.id) pendingRequestId = null;
+    // Back to pending: the transfer answering it was cancelled
+    if (data.status === 'pending' && data.target_key === myPublicKey) {
+        openFileRequests[data.id] = data;
+        return;
+    }
+    if (data.requester_key !== myPublicKey) return;
+
+    switch (data.status) {
+        case 'pending':
+            showToast(`The transfer was cancelled, your request to ${data.target_name} is open again.`, 'info');
+            break;
+        case 'fulfilled':
+            showToast(`${data.target_name} is sending the files you asked for.`, 'success');
+            break;
+        case 'declined':
+            showToast(`${data.target_name} declined your file request.`, 'error');
+            break;
+        case 'expired':
+            showToast(`Your file request to ${data.target_name} expired.`, 'warning');
+            break;
+    }
+}
+
+// ==========================================
+// SHARE LINKS
+// ==========================================
+
+// Sesi guest: tidak ada akun, token tidak bisa di-refresh. Guest dari
+// share link juga tidak ikut discovery.
+let isGuestSession = false;
+let isLinkGuest = false;
+
+// Sender: buat link untuk transaksi yang sedang disiapkan
+// options: { maxUses, ttl (detik), password }
+function createShareLink(options = {}) {
+    if (!currentTransactionId) {
+        showToast('Select files first, then create a link.', 'warning');
+        return;
+    }
+    sendSignalingMessage(WS_TYPE.SHARE_LINK, {
+        transaction_id: currentTransactionId,
+        max_uses: options.maxUses || 0,
+        ttl: options.ttl || 0,
+        password: options.password || ''
+    });
+}
+
+function revokeShareLink(linkId) {
+    if (!currentTransactionId || !linkId) return;
+    sendSignalingMessage(WS_TYPE.SHARE_LINK, { transaction_id: currentTransactionId, revoke: linkId });
+}
+
+function handleShareLink(data) {
+    if (!data) return;
+    if (data.revoked) {
+        showToast('Link revoked.', 'info');
+        return;
+    }
+    const url = `${window.location.origin}${window.location.pathname}?link=${encodeURIComponent(data.token)}`;
+    lastShareLink = { ...data, url };
+    navigator.clipboard?.writeText(url)
+        .then(() => showToast('Link copied to clipboard.', 'success'))
+        .catch(() => showToast('Link created.', 'success'));
+}
+
+let lastShareLink = null;
+
+// Receiver tanpa akun: tukar token link dengan token guest
+async function joinAsGuest(linkToken) {
+    let password = '';
+    for (let attempt = 0; attempt < 3; attempt++) {
+        try {
+            const guest = await openShareLink(linkToken, password);
+            isGuestSession = true;
+            isLinkGuest = true;
+            showToast(`Connected as ${guest.user.username}, waiting for the files...`, 'info');
+            return guest.access_token;
+        } catch (error) {
+            if (error.status !== 401) {
+                showToast(error.message, 'error');
+                return null;
+            }
+            password = prompt(attempt === 0 ? 'This link is protected, enter the password:' : 'Wrong password, try again:');
+            if (password === null) return null;
+        }
+    }
+    showToast('Too many wrong passwords.', 'error');
+    return null;
+}
+
+// Guest tanpa link: bisa kirim dan terima dengan limit lebih kecil,
+// semua transaksinya hilang saat tab ditutup
+async function startGuestSession(username) {
+    try {
+        const guest = await openGuestSession(username || undefined);
+        isGuestSession = true;
+        showToast(`Connected as ${guest.user.username} (guest).`, 'info');
+        return guest.access_token;
+    } catch (error) {
+        showToast(error.message, 'error');
+        return null;
+    }
+}
+
+// ==========================================
+// CODE ROOMS
+// ==========================================
+
+// Room aktif per nameplate: { code, role, pake, key, peer, transactionId, verification }
+const codeRooms = {};
+// Kunci PAKE per public key pihak lain, dipakai sekali untuk MAC fingerprint
+// DTLS di offer/answer WebRTC berikutnya: { key, role }
+const codeBindings = new Map();
+// Receiver: hasil verifikasi sender per transaksi dari code room, offer
+// baru ditampilkan setelah konfirmasi kunci sender cocok
+const codeVerifications = new Map();
+let activeCode = null;
+
+// Sender: minta nameplate untuk transaksi yang sedang disiapkan
+function openCodeRoom() {
+    if (!currentTransactionId) {
+        showToast('Select files first, then create a code.', 'warning');
+        return;
+    }
+    sendSignalingMessage(WS_TYPE.CODE_ROOM, { transaction_id: currentTransactionId });
+}
+
+// Receiver: gabung dengan kode dari sender
+async function joinWithCode(code) {
+    const nameplate = nameplateOf(code);
+    if (!nameplate || code.trim().split('-').length < 3) {
+        showToast('Invalid code, it looks like 7-guitar-orbit.', 'error');
+        return;
+    }
+    const normalized = code.trim().toLowerCase();
+    codeRooms[nameplate] = { code: normalized, role: 'B', pake: await spake2Start('B', normalized) };
+    sendSignalingMessage(WS_TYPE.CODE_ROOM_JOIN, { nameplate });
+}
+
+async function handleCodeRoomOpened(data) {
+    if (!data || !data.nameplate) return;
+    const code = [data.nameplate, ...codeWords()].join('-');
+    codeRooms[data.nameplate] = {
+        code, role: 'A', transactionId: data.transaction_id, pake: await spake2Start('A', code)
+    };
+    activeCode = code;
+    showToast(`Your code: ${code}`, 'success');
+}
+
+function handleCodeRoomJoined(data) {
+    const room = data && codeRooms[data.nameplate];
+    if (!room) return;
+    room.peer = data.user;
+    // Sender memakai transaksi miliknya sendiri, receiver yang dari server
+    room.transactionId = room.transactionId || data.transaction_id;
+    sendSignalingMessage(WS_TYPE.CODE_ROOM_PAKE, {
+        nameplate: data.nameplate,
+        payload: JSON.stringify({ pake: room.pake.message })
+    });
+}
+
+// Pesan PAKE: pertama nilai SPAKE2, lalu MAC konfirmasi dari pihak lain.
+// Receiver mengirim konfirmasi duluan, sender baru mengonfirmasi room ke
+// server kalau konfirmasi receiver cocok.
+async function handleCodeRoomPake(data) {
+    const room = data && codeRooms[data.nameplate];
+    if (!room) return;
+    let payload;
+    try {
+        payload = JSON.parse(data.payload);
+    } catch {
+        return failCodeRoom(data.nameplate);
+    }
+
+    if (payload.pake) {
+        try {
+            const myKey = localStorage.getItem('gdrop_public_key');
+            const peerKey = room.peer?.public_key;
+            room.key = await spake2Finish(room.pake, payload.pake, {
+                transactionId: room.transactionId,
+                senderKey: room.role === 'A' ? myKey : peerKey,
+                receiverKey: room.role === 'A' ? peerKey : myKey
+            });
+        } catch {
+            return failCodeRoom(data.nameplate);
+        }
+        if (room.role === 'B') {
+            sendSignalingMessage(WS_TYPE.CODE_ROOM_PAKE, {
+                nameplate: data.nameplate,
+                payload: JSON.stringify({ confirm: await confirmationFor(room.key, 'B') })
+            });
+        }
+        return;
+    }
+
+    if (payload.confirm && room.key) {
+        const peerRole = room.role === 'A' ? 'B' : 'A';
+        room.verification = checkConfirmation(room.key, peerRole, payload.confirm);
+        if (!(await room.verification)) {
+            return failCodeRoom(data.nameplate);
+        }
+        if (room.role === 'A') {
+            sendSignalingMessage(WS_TYPE.CODE_ROOM_PAKE, {
+                nameplate: data.nameplate,
+                payload: JSON.stringify({ confirm: await confirmationFor(room.key, 'A') })
+            });
+            sendSignalingMessage(WS_TYPE.CODE_ROOM_CONFIRM, { nameplate: data.nameplate, ok: true });
+        }
+    }
+}
+
+function failCodeRoom(nameplate) {
+    sendSignalingMessage(WS_TYPE.CODE_ROOM_CONFIRM, { nameplate, ok: false });
+}
+
+function handleCodeRoomConfirmed(data) {
+    const room = data && codeRooms[data.nameplate];
+    if (!room) return;
+    delete codeRooms[data.nameplate];
+    if (room.role === 'A') activeCode = null;
+
+    const peerName = room.peer?.username || 'The other device';
+    if (!data.ok) {
+        showToast('Code did not match, ask for a new code.', 'error');
+        return;
+    }
+    if (room.key && room.peer?.public_key) {
+        codeBindings.set(room.peer.public_key, { key: room.key, role: room.role });
+    }
+    if (room.role === 'A') {
+        showToast(`${peerName} joined with your code.`, 'success');
+        return;
+    }
+    // MAC sender datang sebelum CONFIRM, tapi verifikasinya async
+    const verification = (room.verification || Promise.resolve(false)).then(ok => {
+        if (!ok) showToast('Could not verify the sender of this code.', 'error');
+        return ok;
+    });
+    codeVerifications.set(data.transaction_id, verification);
+}
+
+// ==========================================
+// TEXT & LINK SHARING
+// ==========================================
+
+// Riwayat text share disimpan lokal (server tidak menyimpan isi text)
+const TEXT_HISTORY_KEY = 'gdrop_text_history';
+const TEXT_HISTORY_LIMIT = 50;
+
+// Text yang menunggu share_id dari server, urut sesuai pengiriman
+const pendingTextShares = [];
+
+function loadTextHistory() {
+    try {
+        return JSON.parse(localStorage.getItem(TEXT_HISTORY_KEY) || '[]');
+    } catch (e) {
+        return [];
+    }
+}
+
+function saveTextHistory(history) {
+    localStorage.setItem(TEXT_HISTORY_KEY, JSON.stringify(history.slice(0, TEXT_HISTORY_LIMIT)));
+}
+
+function addTextHistory(entry) {
+    const history = loadTextHistory();
+    history.unshift({ ...entry, at: Date.now() });
+    saveTextHistory(history);
+}
+
+function updateTextHistory(shareId, peerKey, changes) {
+    const history = loadTextHistory();
+    const entry = history.find(e => e.share_id === shareId && e.peer_key === peerKey);
+    if (entry) {
+        Object.assign(entry, changes);
+        saveTextHistory(history);
+    }
+}
+
+// Kirim text atau link ke public key tujuan, penerima harus accept dulu
+function shareText(publicKeys, text) {
+    const trimmed = text.trim();
+    const kind = /^https?:\/\/\S+$/i.test(trimmed) ? 'url' : 'text';
+    const payload = kind === 'url' ? trimmed : text;
+    pendingTextShares.push({ kind, text: payload });
+    sendSignalingMessage(WS_TYPE.SHARE_TEXT, { public_keys: publicKeys, kind, text: payload });
+}
+
+function handleTextShare(data) {
+    if (!data || !data.share_id) return;
+
+    // Sender: server confirms the offer went out
+    if (data.targets) {
+        const sent = pendingTextShares.shift();
+        if (!sent) return;
+        data.targets.forEach(target => addTextHistory({
+            share_id: data.share_id,
+            direction: 'sent',
+            peer: target.username,
+            peer_key: target.public_key,
+            kind: sent.kind,
+            text: sent.text,
+            status: 'pending'
+        }));
+        showToast('Text sent, waiting for the recipient...', 'info');
+        return;
+    }
+
+    // Receiver: incoming offer
+    const what = data.kind === 'url' ? 'a link' : 'a text';
+    const accept = window.confirm(`${data.sender.username} wants to send you ${what} (${data.size} bytes). Accept?`);
+    sendSignalingMessage(WS_TYPE.SHARE_TEXT_ACCEPT, { share_id: data.share_id, accept });
+    if (!accept) {
+        addTextHistory({
+            share_id: data.share_id,
+            direction: 'received',
+            peer: data.sender.username,
+            peer_key: data.sender.public_key,
+            kind: data.kind,
+            status: 'declined'
+        });
+    }
+}
+
+function handleTextShareAnswer(data) {
+    if (!data || typeof data !== 'object') return;
+
+    // Sender: a recipient answered
+    if (data.type === 'accept_notification' || data.type === 'decline_notification') {
+        updateTextHistory(data.share_id, data.public_key, { status: data.accepted ? 'accepted' : 'declined' });
+        showToast(`${data.username} ${data.accepted ? 'received' : 'declined'} your text.`, data.accepted ? 'success' : 'error');
+        return;
+    }
+
+    // Receiver: the accepted text arrives
+    if (data.text !== undefined) {
+        addTextHistory({
+            share_id: data.share_id,
+            direction: 'received',
+            peer: data.sender.username,
+            peer_key: data.sender.public_key,
+            kind: data.kind,
+            text: data.text,
+            encrypted: data.encrypted,
+            status: 'accepted'
+        });
+        if (data.encrypted) {
+            showToast(`Encrypted text from ${data.sender.username} saved to history.`, 'success');
+            return;
+        }
+        navigator.clipboard?.writeText(data.text)
+            .then(() => showToast(`${data.kind === 'url' ? 'Link' : 'Text'} from ${data.sender.username} copied to clipboard.`, 'success'))
+            .catch(() => showToast(`${data.kind === 'url' ? 'Link' : 'Text'} from ${data.sender.username} saved to history.`, 'success'));
+    }
+}
+
 // ==========================================
 // TRANSACTION LOGIC
 // ==========================================
 
 function createNewTransaction() {
+    if (pendingRequestId) {
+        // Transaksi ini menjawab file request, server mengecek batasannya
+        sendSignalingMessage(WS_TYPE.NEW_TRANSACTION, { request_id: pendingRequestId });
+        delete openFileRequests[pendingRequestId];
+        pendingRequestId = null;
+        return;
+    }
     sendSignalingMessage(WS_TYPE.NEW_TRANSACTION, null);
 }
 
@@ -618,7 +1192,10 @@ function handleTransactionCreated(data) {
             const filesMeta = fileQueue.map(f => ({
                 name: f.name,
                 size: f.size,
-                type: f.type || 'application/octet-stream'
+                type: f.type || 'application/octet-stream',
+                // Folder picks keep their structure (relative to the picked folder)
+                path: f.webkitRelativePath || undefined,
+                mtime: f.lastModified || undefined
             }));
 
             // Store targets to be sent after FILE_SHARE_TARGET is confirmed
@@ -649,6 +1226,24 @@ function handleTransactionCreated(data) {
 function handleIncomingTransferOffer(data) {
     if (!data || !data.transaction) return;
 
+    // Offer dari code room: tunggu verifikasi kunci sender dulu
+    const verification = codeVerifications.get(data.transaction.id);
+    if (verification) {
+        codeVerifications.delete(data.transaction.id);
+        verification.then(ok => {
+            if (ok) {
+                handleIncomingTransferOffer(data);
+                return;
+            }
+            sendSignalingMessage(WS_TYPE.TRANSACTION_SHARE_ACCEPT, {
+                transaction_id: data.transaction.id,
+                accept: false,
+                reason: 'code_mismatch'
+            });
+        });
+        return;
+    }
+
     // Auto reject if the receiver is still in another transfer
     // Cek apakah user sedang dalam proses transfer (Progress Bar)
     const progressOverlay = document.getElementById('transfer-progress-overlay');
@@ -702,7 +1297,8 @@ function handleIncomingTransferOffer(data) {
     }
 }
 
-window.respondToInvitation = function (isAccepted) {
+// selectedFiles (optional): indexes of the offered files to receive, default all
+window.respondToInvitation = function (isAccepted, selectedFiles) {
     if (!pendingTransactionId) return;
 
     // Prevent duplicate responses to the same transaction
@@ -715,7 +1311,8 @@ window.respondToInvitation = function (isAccepted) {
     // If Accept then send the accept signal for creating WebRTC connection
     sendSignalingMessage(WS_TYPE.TRANSACTION_SHARE_ACCEPT, {
         transaction_id: pendingTransactionId,
-        accept: isAccepted
+        accept: isAccepted,
+        files: isAccepted ? selectedFiles : undefined
     });
 
     if (window.closeIncomingModal) window.closeIncomingModal();
@@ -842,7 +1439,7 @@ async function startWebRTCConnection(isInitiator, targetKey) {
         sendSignalingMessage(WS_TYPE.WEBRTC_SIGNAL, {
             transaction_id: currentTransactionId,
             target_key: targetKey,
-            data: { type: 'offer', sdp: offer }
+            data: { type: 'offer', sdp: offer, ...await bindFingerprint(targetKey, offer) }
         });
     } else {
         // RECEIVER: Tunggu channel dari Sender
@@ -857,6 +1454,27 @@ async function startWebRTCConnection(isInitiator, targetKey) {
     }
 }
 
+// Peer dari code room: fingerprint DTLS di SDP di-MAC dengan kunci PAKE,
+// supaya server tidak bisa menukar sertifikatnya
+async function bindFingerprint(peerKey, description) {
+    const binding = codeBindings.get(peerKey);
+    if (!binding) return {};
+    return { fingerprint_mac: await fingerprintMac(binding.key, binding.role, description.sdp) };
+}
+
+async function checkBoundFingerprint(peerKey, data) {
+    const binding = codeBindings.get(peerKey);
+    if (!binding) return true;
+    const peerRole = binding.role === 'A' ? 'B' : 'A';
+    if (await checkFingerprintMac(binding.key, peerRole, data.sdp?.sdp, data.fingerprint_mac)) return true;
+
+    codeBindings.delete(peerKey);
+    peerConnections[peerKey]?.close();
+    delete peerConnections[peerKey];
+    showToast('Could not verify the connection to the code peer, transfer stopped.', 'error');
+    return false;
+}
+
 async function handleWebRTCSignal(signal) {
     const remoteKey = signal.from_key; // Public key dari user lain
     const data = signal.data; // Data dari signal
@@ -881,18 +1499,23 @@ async function handleWebRTCSignal(signal) {
     try {
         if (data.type === 'offer') {
             // Receiver Handle Offer
+            if (!(await checkBoundFingerprint(remoteKey, data))) return;
             await pc.setRemoteDescription(new RTCSessionDescription(data.sdp));
             const answer = await pc.createAnswer();
             await pc.setLocalDescription(answer);
 
+            const fingerprint = await bindFingerprint(remoteKey, answer);
+            codeBindings.delete(remoteKey);
             sendSignalingMessage(WS_TYPE.WEBRTC_SIGNAL, {
                 transaction_id: pendingTransactionId,
                 target_key: remoteKey,
-                data: { type: 'answer', sdp: answer }
+                data: { type: 'answer', sdp: answer, ...fingerprint }
             });
 
         } else if (data.type === 'answer') {
             // Sender Handle Answer
+            if (!(await checkBoundFingerprint(remoteKey, data))) return;
+            codeBindings.delete(remoteKey);
             await pc.setRemoteDescription(new RTCSessionDescription(data.sdp));
         } else if (data.type === 'candidate') {
             // Handle ICE Candidate
@@ -943,6 +1566,12 @@ async function sendFileTo(key) {
     const state = transferStates[key];
     if (!state) return;
 
+    // Lewati file yang tidak dipilih receiver ini
+    const selection = fileSelections[key];
+    while (selection && state.index < fileQueue.length && !selection.has(state.index)) {
+        state.index++;
+    }
+
     // Cek Queue User Ini
     if (state.index >= fileQueue.length) {
         checkAllPeersDone();
@@ -1194,6 +1823,11 @@ window.endTransferSession = async function () {
     // Determine if we are the sender
     const was_sender = isInitiatorRole;
 
+    // Receiver leaving mid-transfer: tell the sender to stop
+    if (!was_sender && window.isTransferActive) {
+        cancelTransferPart(null, 'cancelled');
+    }
+
     // Reset State
     if (window.resetTransferState) window.resetTransferState(was_sender);
 
@@ -1297,6 +1931,7 @@ function resetTransferState(clearFiles = false) {
     dataChannels = {};
     acceptedPublicKeys.clear();
     transferStates = {};
+    fileSelections = {};
 
     // Reset progress tracking
     transferStartTime = null;
@@ -1370,6 +2005,18 @@ window.updateNetworkSpeed = (mbps) => { currentSpeedMbps = mbps; };
 window.startTransferProcess = createNewTransaction;
 window.resetTransferState = resetTransferState;
 window.getFileQueueLength = () => fileQueue.length;
+window.shareText = shareText;
+window.cancelTransferPart = cancelTransferPart;
+window.requestFiles = requestFiles;
+window.openCodeRoom = openCodeRoom;
+window.createShareLink = createShareLink;
+window.revokeShareLink = revokeShareLink;
+window.getShareLink = () => lastShareLink;
+window.joinWithCode = joinWithCode;
+window.getActiveCode = () => activeCode;
+window.answerFileRequest = answerFileRequest;
+window.getOpenFileRequests = () => Object.values(openFileRequests);
+window.getTextHistory = loadTextHistory;
 
 // Run App
 document.addEventListener('DOMContentLoaded', initializeApp);
\ No newline at end of file
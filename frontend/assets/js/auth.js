@@ -8,7 +8,13 @@ import {
 const ENDPOINTS = {
     REGISTER: `${API_BASE_URL}/register`,
     CHALLENGE: `${API_BASE_URL}/challenge`,
-    LOGIN: `${API_BASE_URL}/login`
+    LOGIN: `${API_BASE_URL}/login`,
+    REFRESH: `${API_BASE_URL}/refresh`,
+    LINK: `${API_BASE_URL}/link`,
+    GUEST: `${API_BASE_URL}/guest`,
+    ACCOUNT: `${API_BASE_URL}/protected/account`,
+    AUTO_ACCEPT: `${API_BASE_URL}/protected/auto-accept`,
+    CONTACTS: `${API_BASE_URL}/protected/contacts`
 };
 
 // ==========================================
@@ -59,13 +65,21 @@ async function performRegistration() {
     await saveKeys(keyPair);
     await initDeviceIdentity(); // Set ID & Name
 
+    // Prove we own the key: sign a fresh challenge
+    const challengeRes = await fetch(ENDPOINTS.CHALLENGE, { headers: API_HEADERS });
+    if (!challengeRes.ok) throw new Error('Network error: Failed to get challenge');
+    const challengeBase64 = (await challengeRes.json()).data;
+    const signature = await signData(challengeBase64, await importPrivateKey());
+
     // Send Public Key to Server
     const response = await fetch(ENDPOINTS.REGISTER, {
         method: 'POST',
         headers: API_HEADERS,
         body: JSON.stringify({
             username: getDeviceName(),
-            public_key: getPublicKey()
+            public_key: getPublicKey(),
+            challenge: challengeBase64,
+            signature: signature
         })
     });
 
@@ -107,6 +121,142 @@ async function performLogin(publicKey) {
     }
 
     // Save Token
-    localStorage.setItem(STORAGE_KEYS.TOKEN, loginData.data);
-    return loginData.data;
-}
\ No newline at end of file
+    return saveTokens(loginData.data);
+}
+
+// ==========================================
+// Helper: Token Storage & Refresh
+// ==========================================
+function saveTokens(pair) {
+    localStorage.setItem(STORAGE_KEYS.TOKEN, pair.access_token);
+    localStorage.setItem(STORAGE_KEYS.REFRESH_TOKEN, pair.refresh_token);
+    return pair.access_token;
+}
+
+// Trade the stored refresh token for a new pair, falls back to a full login.
+export async function refreshSession() {
+    const refreshToken = localStorage.getItem(STORAGE_KEYS.REFRESH_TOKEN);
+    if (refreshToken) {
+        const res = await fetch(ENDPOINTS.REFRESH, {
+            method: 'POST',
+            headers: API_HEADERS,
+            body: JSON.stringify({ refresh_token: refreshToken })
+        });
+        const data = await res.json();
+        if (res.ok && data.success) {
+            return saveTokens(data.data);
+        }
+    }
+    return initAuth();
+}
+
+// ==========================================
+// Share Links (Guest)
+// ==========================================
+
+// Buka share link sebagai guest, tanpa registrasi. Token guest tidak
+// disimpan di localStorage supaya identitas device tidak tertimpa.
+export async function openShareLink(linkToken, password, username) {
+    const res = await fetch(ENDPOINTS.LINK, {
+        method: 'POST',
+        headers: API_HEADERS,
+        body: JSON.stringify({ token: linkToken, password, username })
+    });
+    const data = await res.json();
+    if (!res.ok || !data.success) {
+        const error = new Error(data.message || 'Failed to open link');
+        error.status = res.status;
+        throw error;
+    }
+    return data.data;
+}
+
+// Sesi guest tanpa share link: identitas sementara, hilang saat disconnect.
+// Sama seperti share link, token tidak disimpan di localStorage.
+export async function openGuestSession(username) {
+    const res = await fetch(ENDPOINTS.GUEST, {
+        method: 'POST',
+        headers: API_HEADERS,
+        body: JSON.stringify({ username })
+    });
+    const data = await res.json();
+    if (!res.ok || !data.success) throw new Error(data.message || 'Failed to start guest session');
+    return data.data;
+}
+
+// ==========================================
+// Account: Data Export & Deletion
+// ==========================================
+export async function exportAccount() {
+    const token = localStorage.getItem(STORAGE_KEYS.TOKEN) || await refreshSession();
+    const res = await fetch(`${ENDPOINTS.ACCOUNT}/export`, {
+        headers: { ...API_HEADERS, 'Authorization': `Bearer ${token}` }
+    });
+    const data = await res.json();
+    if (!res.ok || !data.success) throw new Error(data.message || 'Export failed');
+    return data.data;
+}
+
+// Deleting needs a freshly signed challenge on top of the token.
+export async function deleteAccount() {
+    const token = localStorage.getItem(STORAGE_KEYS.TOKEN) || await refreshSession();
+
+    const challengeRes = await fetch(ENDPOINTS.CHALLENGE, { headers: API_HEADERS });
+    if (!challengeRes.ok) throw new Error('Network error: Failed to get challenge');
+    const challengeBase64 = (await challengeRes.json()).data;
+    const signature = await signData(challengeBase64, await importPrivateKey());
+
+    const res = await fetch(ENDPOINTS.ACCOUNT, {
+        method: 'DELETE',
+        headers: { ...API_HEADERS, 'Authorization': `Bearer ${token}` },
+        body: JSON.stringify({ challenge: challengeBase64, signature: signature })
+    });
+    const data = await res.json();
+    if (!res.ok || !data.success) throw new Error(data.message || 'Deletion failed');
+}
+
+// ==========================================
+// Auto-accept rules
+// ==========================================
+// Rule: { from: [public key], contacts: bool, groups: ['Team'],
+// types: ['image/*', '.pdf'], max_size: bytes }.
+// Offer yang cocok langsung di-accept server, tanpa prompt.
+async function autoAcceptRequest(path, method, body, endpoint = ENDPOINTS.AUTO_ACCEPT) {
+    const token = localStorage.getItem(STORAGE_KEYS.TOKEN) || await refreshSession();
+    const res = await fetch(`${endpoint}${path}`, {
+        method,
+        headers: { ...API_HEADERS, 'Authorization': `Bearer ${token}` },
+        body: body ? JSON.stringify(body) : undefined
+    });
+    const data = await res.json();
+    if (!res.ok || !data.success) throw new Error(data.message || 'Request failed');
+    return data.data;
+}
+
+export const listAutoAcceptRules = () => autoAcceptRequest('', 'GET');
+export const addAutoAcceptRule = (rule) => autoAcceptRequest('', 'POST', rule);
+export const removeAutoAcceptRule = (id) => autoAcceptRequest(`/${encodeURIComponent(id)}`, 'DELETE');
+
+// ==========================================
+// Contacts
+// ==========================================
+// Group disimpan di localStorage (groups.js), server menyimpan salinannya
+// sebagai contacts supaya rule auto-accept bisa cocok per group.
+export const listContacts = () => autoAcceptRequest('', 'GET', null, ENDPOINTS.CONTACTS);
+
+export function saveContacts(groups) {
+    const contacts = new Map();
+    for (const group of groups || []) {
+        const name = String(group.name || '').trim().slice(0, 64);
+        for (const device of group.devices || []) {
+            if (!device.id || device.id.startsWith('guest:')) continue;
+            const contact = contacts.get(device.id) || { public_key: device.id, username: device.name || '', groups: [] };
+            if (name && !contact.groups.includes(name)) contact.groups.push(name);
+            contacts.set(device.id, contact);
+        }
+    }
+    return autoAcceptRequest('', 'PUT', { contacts: [...contacts.values()] }, ENDPOINTS.CONTACTS);
+}
+
+// groups.js bukan module, jadi sinkronisasi lewat window
+window.syncContacts = (groups) => saveContacts(groups).catch(e => console.warn('Contact sync failed:', e.message));
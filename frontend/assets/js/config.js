@@ -26,5 +26,6 @@ export const STORAGE_KEYS = {
     DEVICE_NAME: 'gdrop_device_name',
     THEME: 'gopherdrop-theme',
     TOKEN: 'gdrop_token',
+    REFRESH_TOKEN: 'gdrop_refresh_token',
     DISCOVERABLE: 'gdrop_is_discoverable'
 };
\ No newline at end of file
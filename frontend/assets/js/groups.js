@@ -51,6 +51,8 @@ function loadGroupsFromStorage() {
 function saveGroupsToStorage(groups) {
     try {
         localStorage.setItem(GROUPS_STORAGE_KEY, JSON.stringify(groups));
+        // Salinan di server dipakai rule auto-accept per group
+        if (window.syncContacts) window.syncContacts(groups);
         return true;
     } catch (e) {
         return false;
@@ -0,0 +1,182 @@
+// ==========================================
+// SPAKE2 untuk code room (pairing pakai kode)
+// ==========================================
+// Kode seperti "7-guitar-orbit": nameplate (angka) dikirim ke server,
+// kata-katanya hanya dipakai di sini sebagai password PAKE. Transcript-nya
+// mengikat transaction id dan public key kedua pihak, dan kuncinya dipakai
+// lagi untuk MAC fingerprint DTLS di SDP, jadi server yang tidak tahu kodenya
+// tidak bisa menyisipkan diri di pairing maupun di koneksi WebRTC-nya.
+//
+// Grup: RFC 3526 MODP 2048-bit (grup 14), g = 2 membangkitkan subgroup
+// berorde q = (p - 1) / 2. M dan N di-hash ke subgroup itu sehingga tidak
+// ada yang tahu logaritma diskretnya.
+
+const P = BigInt('0x' +
+    'FFFFFFFFFFFFFFFFC90FDAA22168C234C4C6628B80DC1CD1' +
+    '29024E088A67CC74020BBEA63B139B22514A08798E3404DD' +
+    'EF9519B3CD3A431B302B0A6DF25F14374FE1356D6D51C245' +
+    'E485B576625E7EC6F44C42E9A637ED6B0BFF5CB6F406B7ED' +
+    'EE386BFB5A899FA5AE9F24117C4B1FE649286651ECE45B3D' +
+    'C2007CB8A163BF0598DA48361C55D39A69163FA8FD24CF5F' +
+    '83655D23DCA3AD961C62F356208552BB9ED529077096966D' +
+    '670C354E4ABC9804F1746C08CA18217C32905E462E36CE3B' +
+    'E39E772C180E86039B2783A2EC07A28FB5C55DF06F4C52C9' +
+    'DE2BCBF6955817183995497CEA956AE515D2261898FA0510' +
+    '15728E5A8AACAA68FFFFFFFFFFFFFFFF');
+const Q = (P - 1n) / 2n;
+const G = 2n;
+
+const encoder = new TextEncoder();
+
+// Daftar kata untuk kode, cukup pendek untuk diucapkan
+const WORDS = [
+    'acid', 'amber', 'anchor', 'apple', 'arrow', 'atlas', 'bacon', 'badge',
+    'bamboo', 'banjo', 'beacon', 'berry', 'bison', 'blade', 'bloom', 'bonsai',
+    'breeze', 'brick', 'bridge', 'bubble', 'cactus', 'camel', 'canoe', 'canyon',
+    'carbon', 'castle', 'cedar', 'cherry', 'cipher', 'citrus', 'clover', 'cobalt',
+    'comet', 'copper', 'coral', 'cosmos', 'cotton', 'crater', 'crystal', 'dagger',
+    'delta', 'denim', 'desert', 'dolphin', 'dragon', 'drum', 'eagle', 'echo',
+    'ember', 'falcon', 'fern', 'fiddle', 'flint', 'forest', 'fossil', 'galaxy',
+    'garlic', 'gecko', 'ginger', 'glacier', 'gopher', 'granite', 'guitar', 'harbor',
+    'hazel', 'helium', 'hermit', 'honey', 'icicle', 'indigo', 'island', 'ivory',
+    'jacket', 'jaguar', 'jasmine', 'jungle', 'kayak', 'kernel', 'kiwi', 'koala',
+    'lagoon', 'lantern', 'lemon', 'lilac', 'lizard', 'lotus', 'magnet', 'mango',
+    'maple', 'marble', 'meadow', 'meteor', 'mint', 'mosaic', 'nebula', 'nectar',
+    'noodle', 'oasis', 'ocean', 'olive', 'onyx', 'orbit', 'orchid', 'otter',
+    'paddle', 'panda', 'papaya', 'pebble', 'pepper', 'piano', 'pixel', 'planet',
+    'plasma', 'pollen', 'prism', 'pumpkin', 'quartz', 'quiver', 'radar', 'raven',
+    'reef', 'ribbon', 'rocket', 'saddle', 'saffron', 'salmon', 'sapphire', 'shadow'
+];
+
+// Dua kata acak untuk melengkapi nameplate dari server
+export function codeWords(count = 2) {
+    const random = crypto.getRandomValues(new Uint32Array(count));
+    return Array.from(random, n => WORDS[n % WORDS.length]);
+}
+
+// Nameplate adalah bagian pertama kode, sisanya tidak pernah dikirim
+export function nameplateOf(code) {
+    const nameplate = String(code || '').trim().split('-')[0];
+    return /^\d+$/.test(nameplate) ? nameplate : null;
+}
+
+function modPow(base, exp, mod) {
+    let result = 1n;
+    base %= mod;
+    while (exp > 0n) {
+        if (exp & 1n) result = (result * base) % mod;
+        base = (base * base) % mod;
+        exp >>= 1n;
+    }
+    return result;
+}
+
+function bytesToBigInt(bytes) {
+    let hex = '';
+    for (const b of bytes) hex += b.toString(16).padStart(2, '0');
+    return BigInt('0x' + (hex || '0'));
+}
+
+function bigIntToHex(n) {
+    return n.toString(16).padStart(512, '0');
+}
+
+// SHA-256 yang diperpanjang jadi 288 byte supaya hasil mod p tidak bias
+async function wideHash(label) {
+    const parts = [];
+    for (let i = 0; i < 9; i++) {
+        parts.push(new Uint8Array(await crypto.subtle.digest('SHA-256', encoder.encode(`${label}|${i}`))));
+    }
+    const out = new Uint8Array(parts.length * 32);
+    parts.forEach((part, i) => out.set(part, i * 32));
+    return bytesToBigInt(out);
+}
+
+async function hashToGroup(label) {
+    const h = await wideHash(label) % P;
+    return modPow(h, 2n, P); // kuadrat: masuk subgroup berorde q
+}
+
+function randomScalar() {
+    return bytesToBigInt(crypto.getRandomValues(new Uint8Array(64))) % Q;
+}
+
+// Elemen dari pihak lain harus berada di subgroup dan bukan elemen trivial
+function validElement(n) {
+    return n > 1n && n < P - 1n && modPow(n, Q, P) === 1n;
+}
+
+// Mulai SPAKE2. role 'A' untuk sender, 'B' untuk receiver. Hasilnya berisi
+// pesan yang dikirim ke pihak lain lewat CODE_ROOM_PAKE.
+export async function spake2Start(role, code) {
+    const [M, N] = await Promise.all([hashToGroup('gopherdrop-spake2-M'), hashToGroup('gopherdrop-spake2-N')]);
+    const w = await wideHash(`gopherdrop-spake2-code|${code}`) % Q;
+    const x = randomScalar();
+    const mask = role === 'A' ? M : N;
+    const own = (modPow(G, x, P) * modPow(mask, w, P)) % P;
+    return { role, w, x, M, N, own, message: bigIntToHex(own) };
+}
+
+// Selesaikan SPAKE2 dengan pesan pihak lain, hasilnya kunci bersama
+// (CryptoKey HMAC) untuk konfirmasi. context berisi transactionId,
+// senderKey dan receiverKey seperti yang dilihat pihak ini; kalau server
+// memberi versi yang berbeda ke kedua pihak, kuncinya tidak akan cocok.
+export async function spake2Finish(state, peerHex, context) {
+    if (!/^[0-9a-f]{512}$/i.test(peerHex || '')) throw new Error('invalid pake message');
+    const peer = BigInt('0x' + peerHex);
+    if (!validElement(peer)) throw new Error('invalid pake message');
+
+    const peerMask = state.role === 'A' ? state.N : state.M;
+    const unmasked = (peer * modPow(modPow(peerMask, state.w, P), P - 2n, P)) % P;
+    const K = modPow(unmasked, state.x, P);
+
+    const [X, Y] = state.role === 'A' ? [state.own, peer] : [peer, state.own];
+    const { transactionId, senderKey, receiverKey } = context || {};
+    if (!transactionId || !senderKey || !receiverKey) throw new Error('missing pake context');
+    const transcript = [
+        'gopherdrop-spake2', transactionId, senderKey, receiverKey,
+        bigIntToHex(X), bigIntToHex(Y), bigIntToHex(K), state.w.toString(16)
+    ].join('|');
+    const secret = await crypto.subtle.digest('SHA-256', encoder.encode(transcript));
+    return crypto.subtle.importKey('raw', secret, { name: 'HMAC', hash: 'SHA-256' }, false, ['sign', 'verify']);
+}
+
+// Konfirmasi kunci: masing-masing pihak membuktikan punya kunci yang sama
+export async function confirmationFor(key, role) {
+    return macHex(key, `confirm-${role}`);
+}
+
+export async function checkConfirmation(key, role, mac) {
+    return checkMac(key, `confirm-${role}`, mac);
+}
+
+// Fingerprint DTLS dari SDP, diurutkan supaya urutan baris tidak berpengaruh
+function fingerprintsOf(sdp) {
+    const lines = String(sdp || '').match(/^a=fingerprint:.+$/gm) || [];
+    return [...new Set(lines.map(l => l.slice('a=fingerprint:'.length).trim().toLowerCase()))].sort().join(',');
+}
+
+// MAC fingerprint SDP milik role, dikirim bersama offer/answer supaya pihak
+// lain tahu sertifikat DTLS-nya benar dari pemegang kode, bukan dari server
+export async function fingerprintMac(key, role, sdp) {
+    const fingerprints = fingerprintsOf(sdp);
+    if (!fingerprints) throw new Error('sdp has no fingerprint');
+    return macHex(key, `fingerprint-${role}|${fingerprints}`);
+}
+
+export async function checkFingerprintMac(key, role, sdp, mac) {
+    const fingerprints = fingerprintsOf(sdp);
+    if (!fingerprints) return false;
+    return checkMac(key, `fingerprint-${role}|${fingerprints}`, mac);
+}
+
+async function macHex(key, label) {
+    const mac = await crypto.subtle.sign('HMAC', key, encoder.encode(label));
+    return Array.from(new Uint8Array(mac), b => b.toString(16).padStart(2, '0')).join('');
+}
+
+async function checkMac(key, label, hex) {
+    if (!/^[0-9a-f]{64}$/i.test(hex || '')) return false;
+    const mac = new Uint8Array(hex.match(/../g).map(h => parseInt(h, 16)));
+    return crypto.subtle.verify('HMAC', key, mac, encoder.encode(label));
+}
@@ -1,4 +1,4 @@
-import { initAuth } from "./auth.js";
+import { initAuth, exportAccount, deleteAccount, listAutoAcceptRules, addAutoAcceptRule, removeAutoAcceptRule } from "./auth.js";
 import { setTheme, updateProfileUI } from "./helper.js";
 import { API_BASE_URL, STORAGE_KEYS } from "./config.js";
 
@@ -394,4 +394,68 @@ window.closeRestoreModal = function () {
         if (modal) modal.classList.add('hidden');
         if (input) input.value = '';
     }, 200);
-};
\ No newline at end of file
+};
+
+// ==========================================
+// AUTO-ACCEPT RULES
+// ==========================================
+window.getAutoAcceptRules = listAutoAcceptRules;
+
+window.addAutoAcceptRule = async function (rule) {
+    try {
+        const saved = await addAutoAcceptRule(rule);
+        if (window.showToast) window.showToast('Auto-accept rule added.', 'success');
+        return saved;
+    } catch (e) {
+        if (window.showToast) window.showToast('Failed to add rule: ' + e.message, 'error');
+        return null;
+    }
+};
+
+window.removeAutoAcceptRule = async function (id) {
+    try {
+        await removeAutoAcceptRule(id);
+        if (window.showToast) window.showToast('Auto-accept rule removed.', 'success');
+    } catch (e) {
+        if (window.showToast) window.showToast('Failed to remove rule: ' + e.message, 'error');
+    }
+};
+
+// ==========================================
+// ACCOUNT: EXPORT & DELETE
+// ==========================================
+window.exportAccountData = async function () {
+    try {
+        const data = await exportAccount();
+        const blob = new Blob([JSON.stringify(data, null, 2)], { type: "application/json" });
+        const url = URL.createObjectURL(blob);
+
+        const a = document.createElement('a');
+        a.href = url;
+        a.download = `gopherdrop-account-${new Date().toLocaleDateString('en-CA')}.json`;
+        document.body.appendChild(a);
+        a.click();
+        document.body.removeChild(a);
+        URL.revokeObjectURL(url);
+
+        if (window.showToast) window.showToast('Account data downloaded!', 'success');
+    } catch (e) {
+        console.error(e);
+        if (window.showToast) window.showToast('Failed to export: ' + e.message, 'error');
+    }
+};
+
+window.deleteAccountData = async function () {
+    if (!window.confirm('Delete your account? Your key, history and pending transfers are removed from the server. This cannot be undone.')) {
+        return;
+    }
+    try {
+        await deleteAccount();
+        localStorage.clear();
+        if (window.showToast) window.showToast('Account deleted. Reloading...', 'success');
+        setTimeout(() => window.location.reload(), 1500);
+    } catch (e) {
+        console.error(e);
+        if (window.showToast) window.showToast('Failed to delete: ' + e.message, 'error');
+    }
+};
@@ -0,0 +1,8 @@
+// Package frontend holds the web client. It is embedded into the server
+// binary so it runs from any working directory.
+package frontend
+
+import "embed"
+
+//go:embed index.html assets components pages
+var Files embed.FS
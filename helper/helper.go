@@ -2,12 +2,24 @@ package helper
 
 import (
 	"crypto/ed25519"
+	"crypto/pbkdf2"
 	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
 	"encoding/base64"
+	"encoding/hex"
 	"errors"
+	"fmt"
+	"log/slog"
+	"math/big"
 	"os"
 	"os/exec"
+	"path/filepath"
+	"strconv"
 	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
 
 	"github.com/gofiber/fiber/v2"
 	"github.com/gofiber/websocket/v2"
@@ -16,10 +28,154 @@ import (
 
 const letterBytes = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ1234567890"
 
+const defaultCORSOrigins = "https://dev-gopherdrop.vercel.app,http://localhost:3000,http://localhost:5173"
+const defaultCORSHeaders = "Origin, Content-Type, Accept, Authorization, Upgrade, Connection, ngrok-skip-browser-warning"
+
 type GoDropConfig struct {
 	Url      string
 	DBPath   string
 	Password string
+
+	// DBDriver is sqlite (DBPath), postgres or mysql (DBDSN). With
+	// DBAutoMigrate off the schema is only changed by `gopherdrop migrate`.
+	DBDriver      string
+	DBDSN         string
+	DBAutoMigrate bool
+
+	// CORS: origins may be exact ("https://a.com"), wildcard subdomains
+	// ("https://*.a.com") or "*". LAN mode also allows any port on the host
+	// the server was reached at.
+	CORSOrigins     []string
+	CORSHeaders     string
+	CORSCredentials bool
+	CORSLanMode     bool
+
+	AccessTTL  time.Duration
+	RefreshTTL time.Duration
+
+	// JWTAlg is EdDSA, ES256 or HS256 (signs with Password, no rotation).
+	JWTAlg         string
+	JWTRotateEvery time.Duration
+
+	// Token buckets, rates are per second.
+	IPRate        float64
+	IPBurst       int
+	KeyRate       float64
+	KeyBurst      int
+	WSMsgRate     float64
+	WSMsgBurst    int
+	MaxChallenges int
+
+	// WebSocket payload limits, sizes in bytes.
+	WSReadLimit       int64
+	MaxFiles          int
+	MaxTargets        int
+	MaxFilenameLength int
+	MaxSignalSize     int
+	MaxTextSize       int
+
+	// InboxTTL is how long an offer to an offline user waits for them,
+	// RequestTTL how long a REQUEST_FILES stays open.
+	InboxTTL   time.Duration
+	RequestTTL time.Duration
+
+	// LinkMaxTTL caps how long a share link stays valid, GuestTTL is the
+	// lifetime of a guest's access token (guests can't refresh).
+	LinkMaxTTL time.Duration
+	GuestTTL   time.Duration
+
+	// Guest sessions: whether POST /guest is open, and the tighter limits
+	// guests get instead of MaxFiles, MaxTargets and the WS rate.
+	GuestsEnabled   bool
+	GuestMaxFiles   int
+	GuestMaxTargets int
+	GuestWSMsgRate  float64
+	GuestWSMsgBurst int
+
+	// FrontendDir serves the web client from disk instead of the copy
+	// embedded in the binary.
+	FrontendDir string
+
+	// MetricsToken is required as Bearer token on /metrics, which is off
+	// without one.
+	MetricsToken string
+
+	// AdminToken, when set, is accepted as Bearer token on /api/v1/admin
+	// besides the JWT of an admin user. AdminURL is where `gopherdrop admin`
+	// finds the running server.
+	AdminToken string
+	AdminURL   string
+
+	// ServerURL is the server `gopherdrop send` and `receive` connect to,
+	// as the user whose key is kept in IdentityFile.
+	ServerURL    string
+	IdentityFile string
+
+	LogFormat string // "text" or "json"
+	LogLevel  slog.Level
+
+	// Graceful shutdown: how long clients get to leave on their own and the
+	// base reconnect hint sent to them.
+	DrainTimeout   time.Duration
+	ReconnectAfter time.Duration
+
+	// Clustering: Backplane is "memory" (single node) or "redis". NodeID
+	// names this process in the cluster, random when unset.
+	Backplane string
+	RedisURL  string
+	NodeID    string
+}
+
+// GetEnvList splits a comma separated env var, falling back to def when unset.
+func GetEnvList(key string, def string) []string {
+	value := os.Getenv(key)
+	if value == "" {
+		value = def
+	}
+	var out []string
+	for _, item := range strings.Split(value, ",") {
+		item = strings.TrimSpace(item)
+		if item != "" {
+			out = append(out, item)
+		}
+	}
+	return out
+}
+
+// GetEnvDuration parses a duration env var ("15m", "720h"), falling back to def when unset or invalid.
+func GetEnvDuration(key string, def time.Duration) time.Duration {
+	value, err := time.ParseDuration(os.Getenv(key))
+	if err != nil || value <= 0 {
+		return def
+	}
+	return value
+}
+
+// GetEnvInt parses an integer env var, falling back to def when unset or invalid.
+func GetEnvInt(key string, def int) int {
+	value, err := strconv.Atoi(os.Getenv(key))
+	if err != nil || value <= 0 {
+		return def
+	}
+	return value
+}
+
+// GetEnvFloat parses a float env var, falling back to def when unset or invalid.
+func GetEnvFloat(key string, def float64) float64 {
+	value, err := strconv.ParseFloat(os.Getenv(key), 64)
+	if err != nil || value <= 0 {
+		return def
+	}
+	return value
+}
+
+// GetEnvBool parses a boolean env var, falling back to def when unset or invalid.
+func GetEnvBool(key string, def bool) bool {
+	value, err := strconv.ParseBool(os.Getenv(key))
+	if err != nil {
+		return def
+	}
+	return value
 }
 
 func GetConfigFromEnv() GoDropConfig {
@@ -35,14 +191,159 @@ func GetConfigFromEnv() GoDropConfig {
 	if dbpath == "" {
 		dbpath = "./db/data.db"
 	}
+	logFormat := os.Getenv("GDROP_LOG_FORMAT")
+	if logFormat == "" {
+		logFormat = "text"
+	}
+	var logLevel slog.Level
+	if err := logLevel.UnmarshalText([]byte(os.Getenv("GDROP_LOG_LEVEL"))); err != nil {
+		logLevel = slog.LevelInfo
+	}
+	jwtAlg := os.Getenv("GDROP_JWT_ALG")
+	if jwtAlg == "" {
+		jwtAlg = "EdDSA"
+	}
+	headers := os.Getenv("GDROP_CORS_HEADERS")
+	if headers == "" {
+		headers = defaultCORSHeaders
+	}
+	adminURL := os.Getenv("GDROP_ADMIN_URL")
+	if adminURL == "" {
+		adminURL = "http://" + strings.Replace(url, "0.0.0.0", "127.0.0.1", 1)
+	}
+	serverURL := os.Getenv("GDROP_SERVER_URL")
+	if serverURL == "" {
+		serverURL = adminURL
+	}
+	identity := os.Getenv("GDROP_IDENTITY")
+	if identity == "" {
+		if dir, err := os.UserConfigDir(); err == nil {
+			identity = filepath.Join(dir, "gopherdrop", "identity.json")
+		} else {
+			identity = "identity.json"
+		}
+	}
+	dbDriver := os.Getenv("GDROP_DB_DRIVER")
+	if dbDriver == "" {
+		dbDriver = "sqlite"
+	}
+	dbDSN := os.Getenv("GDROP_DB_DSN")
+	if dbDSN == "" && dbDriver == "sqlite" {
+		dbDSN = dbpath
+	}
+	backplane := os.Getenv("GDROP_BACKPLANE")
+	if backplane == "" {
+		backplane = "memory"
+	}
+	redisURL := os.Getenv("GDROP_REDIS_URL")
+	if redisURL == "" {
+		redisURL = "redis://localhost:6379/0"
+	}
 	sec := GoDropConfig{
 		Url:      url,
 		Password: password,
 		DBPath:   dbpath,
+
+		DBDriver:      dbDriver,
+		DBDSN:         dbDSN,
+		DBAutoMigrate: GetEnvBool("GDROP_DB_AUTO_MIGRATE", true),
+
+		CORSOrigins:     GetEnvList("GDROP_CORS_ORIGINS", defaultCORSOrigins),
+		CORSHeaders:     headers,
+		CORSCredentials: GetEnvBool("GDROP_CORS_CREDENTIALS", true),
+		CORSLanMode:     GetEnvBool("GDROP_CORS_LAN", false),
+
+		AccessTTL:  GetEnvDuration("GDROP_ACCESS_TTL", 15*time.Minute),
+		RefreshTTL: GetEnvDuration("GDROP_REFRESH_TTL", 30*24*time.Hour),
+
+		JWTAlg:         jwtAlg,
+		JWTRotateEvery: GetEnvDuration("GDROP_JWT_ROTATE", 30*24*time.Hour),
+
+		IPRate:        GetEnvFloat("GDROP_RATE_IP", 1),
+		IPBurst:       GetEnvInt("GDROP_RATE_IP_BURST", 30),
+		KeyRate:       GetEnvFloat("GDROP_RATE_KEY", 0.2),
+		KeyBurst:      GetEnvInt("GDROP_RATE_KEY_BURST", 10),
+		WSMsgRate:     GetEnvFloat("GDROP_RATE_WS", 20),
+		WSMsgBurst:    GetEnvInt("GDROP_RATE_WS_BURST", 60),
+		MaxChallenges: GetEnvInt("GDROP_MAX_CHALLENGES", 10000),
+
+		WSReadLimit:       int64(GetEnvInt("GDROP_WS_READ_LIMIT", 256*1024)),
+		MaxFiles:          GetEnvInt("GDROP_MAX_FILES", 1000),
+		MaxTargets:        GetEnvInt("GDROP_MAX_TARGETS", 50),
+		MaxFilenameLength: GetEnvInt("GDROP_MAX_FILENAME", 255),
+		MaxSignalSize:     GetEnvInt("GDROP_MAX_SIGNAL", 16*1024),
+		MaxTextSize:       GetEnvInt("GDROP_MAX_TEXT", 64*1024),
+
+		InboxTTL:   GetEnvDuration("GDROP_INBOX_TTL", 7*24*time.Hour),
+		RequestTTL: GetEnvDuration("GDROP_REQUEST_TTL", 7*24*time.Hour),
+
+		LinkMaxTTL: GetEnvDuration("GDROP_LINK_MAX_TTL", 7*24*time.Hour),
+		GuestTTL:   GetEnvDuration("GDROP_GUEST_TTL", time.Hour),
+
+		GuestsEnabled:   GetEnvBool("GDROP_GUESTS", false),
+		GuestMaxFiles:   GetEnvInt("GDROP_GUEST_MAX_FILES", 100),
+		GuestMaxTargets: GetEnvInt("GDROP_GUEST_MAX_TARGETS", 5),
+		GuestWSMsgRate:  GetEnvFloat("GDROP_GUEST_RATE_WS", 5),
+		GuestWSMsgBurst: GetEnvInt("GDROP_GUEST_RATE_WS_BURST", 20),
+
+		FrontendDir: os.Getenv("GDROP_FRONTEND_DIR"),
+
+		MetricsToken: os.Getenv("GDROP_METRICS_TOKEN"),
+
+		AdminToken: os.Getenv("GDROP_ADMIN_TOKEN"),
+		AdminURL:   adminURL,
+
+		ServerURL:    serverURL,
+		IdentityFile: identity,
+
+		LogFormat: logFormat,
+		LogLevel:  logLevel,
+
+		DrainTimeout:   GetEnvDuration("GDROP_DRAIN_TIMEOUT", 10*time.Second),
+		ReconnectAfter: GetEnvDuration("GDROP_RECONNECT_AFTER", 2*time.Second),
+
+		Backplane: backplane,
+		RedisURL:  redisURL,
+		NodeID:    os.Getenv("GDROP_NODE_ID"),
 	}
 	return sec
 }
 
+// Log attributes that must never be written in full.
+var secretLogKeys = map[string]bool{
+	"token": true, "access_token": true, "refresh_token": true,
+	"signature": true, "password": true, "recovery_code": true,
+}
+var publicKeyLogKeys = map[string]bool{
+	"public_key": true, "pubkey": true, "old_key": true, "target_key": true, "from_key": true,
+}
+
+// redactLogAttr hides secrets and shortens public keys to a prefix that is
+// still good enough to correlate log lines.
+func redactLogAttr(groups []string, a slog.Attr) slog.Attr {
+	switch {
+	case secretLogKeys[a.Key]:
+		return slog.String(a.Key, "[REDACTED]")
+	case publicKeyLogKeys[a.Key]:
+		if key := a.Value.String(); len(key) > 8 {
+			return slog.String(a.Key, key[:8]+"...")
+		}
+	}
+	return a
+}
+
+// NewLogger builds the process logger from the config (format, level, redaction).
+func NewLogger(sec GoDropConfig) *slog.Logger {
+	opts := &slog.HandlerOptions{
+		Level:       sec.LogLevel,
+		ReplaceAttr: redactLogAttr,
+	}
+	if sec.LogFormat == "json" {
+		return slog.New(slog.NewJSONHandler(os.Stderr, opts))
+	}
+	return slog.New(slog.NewTextHandler(os.Stderr, opts))
+}
+
 func GenerateChallenge() (string, error) {
 	b := make([]byte, 32)
 	if _, err := rand.Read(b); err != nil {
@@ -51,6 +352,102 @@ func GenerateChallenge() (string, error) {
 	return base64.StdEncoding.EncodeToString(b), nil
 }
 
+// GenerateToken returns a random url-safe token for things like refresh tokens.
+func GenerateToken() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// GenerateRecoveryCode returns a human typeable "xxxxx-xxxxx" code.
+func GenerateRecoveryCode() (string, error) {
+	code := make([]byte, 0, 11)
+	for i := 0; i < 10; i++ {
+		if i == 5 {
+			code = append(code, '-')
+		}
+		n, err := rand.Int(rand.Reader, big.NewInt(int64(len(letterBytes))))
+		if err != nil {
+			return "", err
+		}
+		code = append(code, letterBytes[n.Int64()])
+	}
+	return string(code), nil
+}
+
+// HashToken is what gets stored for secrets we hand out, never the token itself.
+func HashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// passwordIterations is the PBKDF2-SHA256 work factor of HashPassword.
+const passwordIterations = 600000
+
+// HashPassword is for secrets users pick themselves, which unlike our
+// tokens can be guessed: salted and slow, "pbkdf2-sha256$iter$salt$hash".
+func HashPassword(password string) (string, error) {
+	salt := make([]byte, 16)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+	key, err := pbkdf2.Key(sha256.New, password, salt, passwordIterations, 32)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("pbkdf2-sha256$%d$%s$%s", passwordIterations,
+		base64.RawStdEncoding.EncodeToString(salt), base64.RawStdEncoding.EncodeToString(key)), nil
+}
+
+// CheckPassword compares password with a HashPassword result.
+func CheckPassword(hash string, password string) bool {
+	parts := strings.Split(hash, "$")
+	if len(parts) != 4 || parts[0] != "pbkdf2-sha256" {
+		return false
+	}
+	iter, err := strconv.Atoi(parts[1])
+	if err != nil || iter <= 0 {
+		return false
+	}
+	salt, err1 := base64.RawStdEncoding.DecodeString(parts[2])
+	want, err2 := base64.RawStdEncoding.DecodeString(parts[3])
+	if err1 != nil || err2 != nil {
+		return false
+	}
+	key, err := pbkdf2.Key(sha256.New, password, salt, iter, len(want))
+	return err == nil && subtle.ConstantTimeCompare(key, want) == 1
+}
+
+const MaxUsernameLength = 64
+
+// ValidateUsername trims name and checks it is 1-64 letters, digits, spaces or ._-'
+func ValidateUsername(name string) (string, error) {
+	name = strings.TrimSpace(name)
+	if name == "" {
+		return "", errors.New("username is required")
+	}
+	if utf8.RuneCountInString(name) > MaxUsernameLength {
+		return "", errors.New("username is too long")
+	}
+	for _, r := range name {
+		if !unicode.IsLetter(r) && !unicode.IsDigit(r) && !strings.ContainsRune(" ._-'", r) {
+			return "", errors.New("username contains invalid characters")
+		}
+	}
+	return name, nil
+}
+
+// ValidatePublicKey checks the key is standard base64 of a raw Ed25519 public key.
+func ValidatePublicKey(pubKeyBase64 string) error {
+	pubKey, err := base64.StdEncoding.DecodeString(pubKeyBase64)
+	if err != nil || len(pubKey) != ed25519.PublicKeySize {
+		return errors.New("invalid public key")
+	}
+	return nil
+}
+
 func VerifySignature(pubKeyBase64, messageBase64, sigBase64 string) (bool, error) {
 	pubKey, err := base64.StdEncoding.DecodeString(pubKeyBase64)
 	if err != nil || len(pubKey) != ed25519.PublicKeySize {
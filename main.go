@@ -2,27 +2,71 @@ package main
 
 // pion
 import (
+	"fmt"
 	helper "gopherdrop/helper"
 	server "gopherdrop/server"
-	"log"
+	"log/slog"
+	"os"
 )
 
 func main() {
 	sec := helper.GetConfigFromEnv()
+	slog.SetDefault(helper.NewLogger(sec))
 
-	db, err := server.OpenDB(sec.DBPath)
+	if len(os.Args) > 1 {
+		if run, ok := clientCommands[os.Args[1]]; ok {
+			if err := run(sec, os.Args[2:]); err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				os.Exit(1)
+			}
+			return
+		}
+	}
+
+	db, err := server.OpenDB(sec.DBDriver, sec.DBDSN)
 	if err != nil {
-		log.Printf("Failed to open the db: %v", err)
+		slog.Error("Failed to open the db", "err", err)
+		os.Exit(1)
+	}
+
+	if len(os.Args) > 1 {
+		if err := runCommand(sec, db, os.Args[1:]); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
 		return
 	}
-	err = server.MigrateDB(db)
+
+	if sec.DBAutoMigrate {
+		err = server.MigrateDB(db)
+	} else {
+		err = server.CheckSchema(db)
+	}
 	if err != nil {
-		log.Printf("Failed to mirgrate the db: %v", err)
+		slog.Error("Failed to migrate the db", "err", err)
 		return
 	}
 
-	ser := server.InitServer(sec.Url, sec.Password)
+	ser, err := server.InitServer(sec)
+	if err != nil {
+		slog.Error("Invalid configuration", "err", err)
+		os.Exit(1)
+	}
 	ser.DB = db
+	ser.Backplane, err = server.NewBackplane(sec)
+	if err != nil {
+		slog.Error("Failed to connect the backplane", "err", err)
+		return
+	}
+	ser.Keys, err = server.NewKeyring(db, sec)
+	if err != nil {
+		slog.Error("Failed to load JWT signing keys", "err", err)
+		return
+	}
+	if err = server.LoadRevocations(ser); err != nil {
+		slog.Error("Failed to load token revocations", "err", err)
+		return
+	}
 	server.StartJanitor(ser)
 	ser.SetupAllEndPoint()
 	ser.StartServer()
@@ -0,0 +1,450 @@
+package server
+
+import (
+	"errors"
+	"gopherdrop/helper"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+const RecoveryCodeCount = 8
+
+const (
+	KeyChangeRotate   = "rotate"
+	KeyChangeRecovery = "recovery"
+)
+
+var (
+	ErrChallengeInvalid = errors.New("Invalid challenge")
+	ErrChallengeExpired = errors.New("Challenge expired")
+	ErrRecoveryInvalid  = errors.New("Invalid recovery code")
+	ErrKeyInUse         = errors.New("Public key already registered")
+	ErrUsernameTaken    = errors.New("Username already taken")
+	ErrKeyBanned        = errors.New("Public key banned")
+)
+
+// CheckUsername validates name and makes sure no other user (case
+// insensitive) has it. exceptID is the user being renamed, 0 for new users.
+func CheckUsername(db *gorm.DB, name string, exceptID int) (string, error) {
+	name, err := helper.ValidateUsername(name)
+	if err != nil {
+		return "", err
+	}
+	var count int64
+	if err := db.Model(&User{}).Where("LOWER(username) = LOWER(?) AND id <> ?", name, exceptID).Count(&count).Error; err != nil {
+		return "", err
+	}
+	if count > 0 {
+		return "", ErrUsernameTaken
+	}
+	return name, nil
+}
+
+// IssueChallenge hands out a login/registration challenge valid for two
+// minutes. The table is capped: expired entries go first, then the oldest.
+func (s *Server) IssueChallenge() (string, error) {
+	challenge, err := helper.GenerateChallenge()
+	if err != nil {
+		return "", err
+	}
+
+	now := time.Now()
+	var count int64
+	s.DB.Model(&Challenge{}).Count(&count)
+	if count >= int64(s.Config.MaxChallenges) {
+		s.DB.Where("expires_at < ?", now).Delete(&Challenge{})
+		s.DB.Model(&Challenge{}).Count(&count)
+		var oldest Challenge
+		if count >= int64(s.Config.MaxChallenges) && s.DB.Order("expires_at").First(&oldest).Error == nil {
+			s.DB.Delete(&oldest)
+		}
+	}
+
+	if err := s.DB.Create(&Challenge{Challenge: challenge, ExpiresAt: now.Add(2 * time.Minute)}).Error; err != nil {
+		return "", err
+	}
+	return challenge, nil
+}
+
+// ConsumeChallenge spends a challenge from `/challenge`, each one works once
+// whichever node it is spent on.
+func (s *Server) ConsumeChallenge(challenge string) error {
+	var ch Challenge
+	if err := s.DB.Where("challenge = ?", challenge).First(&ch).Error; err != nil {
+		return ErrChallengeInvalid
+	}
+	// Only one caller gets to delete it.
+	res := s.DB.Where("challenge = ?", challenge).Delete(&Challenge{})
+	if res.Error != nil || res.RowsAffected == 0 {
+		return ErrChallengeInvalid
+	}
+	if time.Now().After(ch.ExpiresAt) {
+		return ErrChallengeExpired
+	}
+	return nil
+}
+
+// GenerateRecoveryCodes replaces every recovery code of the user with a
+// fresh set. Only the hashes are stored, the plain codes are returned once.
+func GenerateRecoveryCodes(db *gorm.DB, userID int) ([]string, error) {
+	codes := make([]string, 0, RecoveryCodeCount)
+	rows := make([]RecoveryCode, 0, RecoveryCodeCount)
+	for i := 0; i < RecoveryCodeCount; i++ {
+		code, err := helper.GenerateRecoveryCode()
+		if err != nil {
+			return nil, err
+		}
+		codes = append(codes, code)
+		rows = append(rows, RecoveryCode{
+			UserID:    userID,
+			CodeHash:  helper.HashToken(code),
+			CreatedAt: time.Now(),
+		})
+	}
+
+	err := db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("user_id = ?", userID).Delete(&RecoveryCode{}).Error; err != nil {
+			return err
+		}
+		return tx.Create(&rows).Error
+	})
+	if err != nil {
+		return nil, err
+	}
+	return codes, nil
+}
+
+// UseRecoveryCode finds the user owning an unused code and marks it used.
+func UseRecoveryCode(db *gorm.DB, username string, code string) (User, error) {
+	var user User
+	err := db.Transaction(func(tx *gorm.DB) error {
+		var rc RecoveryCode
+		err := tx.Joins("JOIN users ON users.id = recovery_codes.user_id").
+			Where("LOWER(users.username) = LOWER(?) AND recovery_codes.code_hash = ? AND recovery_codes.used_at IS NULL", username, helper.HashToken(code)).
+			First(&rc).Error
+		if err != nil {
+			return ErrRecoveryInvalid
+		}
+		res := tx.Model(&RecoveryCode{}).Where("id = ? AND used_at IS NULL", rc.ID).Update("used_at", time.Now())
+		if res.Error != nil || res.RowsAffected == 0 {
+			return ErrRecoveryInvalid
+		}
+		return tx.First(&user, rc.UserID).Error
+	})
+	return user, err
+}
+
+// ChangePublicKey binds newKey to the account, records it in the audit
+// table and revokes every session that was opened with the old key.
+func (s *Server) ChangePublicKey(user User, newKey string, method string, ip string) (User, error) {
+	err := s.DB.Transaction(func(tx *gorm.DB) error {
+		return changePublicKey(tx, user, newKey, method, ip)
+	})
+	if err != nil {
+		return user, err
+	}
+	return s.keyChanged(user, newKey, method, ip)
+}
+
+// RecoverAccount spends a recovery code of username and binds newKey to the
+// account. The code is only used up if the key can be swapped.
+func (s *Server) RecoverAccount(username string, code string, newKey string, ip string) (User, error) {
+	var user User
+	err := s.DB.Transaction(func(tx *gorm.DB) error {
+		var err error
+		if user, err = UseRecoveryCode(tx, username, code); err != nil {
+			return err
+		}
+		return changePublicKey(tx, user, newKey, KeyChangeRecovery, ip)
+	})
+	if err != nil {
+		return user, err
+	}
+	return s.keyChanged(user, newKey, KeyChangeRecovery, ip)
+}
+
+// changePublicKey does the checks and writes of a key change within tx.
+func changePublicKey(tx *gorm.DB, user User, newKey string, method string, ip string) error {
+	// A banned account must not escape the ban by swapping keys.
+	if isBanned(tx, user.PublicKey) || isBanned(tx, newKey) {
+		return ErrKeyBanned
+	}
+
+	var count int64
+	tx.Model(&User{}).Where("public_key = ?", newKey).Count(&count)
+	if count > 0 {
+		return ErrKeyInUse
+	}
+
+	if err := tx.Model(&User{}).Where("id = ?", user.ID).Update("public_key", newKey).Error; err != nil {
+		return err
+	}
+	return tx.Create(&KeyChange{
+		UserID:       user.ID,
+		OldPublicKey: user.PublicKey,
+		NewPublicKey: newKey,
+		Method:       method,
+		IP:           ip,
+		CreatedAt:    time.Now(),
+	}).Error
+}
+
+// keyChanged ends the sessions of the old key once the change is committed.
+func (s *Server) keyChanged(user User, newKey string, method string, ip string) (User, error) {
+	if err := s.RevokeAllSessions(user); err != nil {
+		return user, err
+	}
+	s.Log.Info("Public key changed", "user", user.Username, "method", method, "old_key", user.PublicKey, "public_key", newKey, "ip", ip)
+	user.PublicKey = newKey
+	return user, nil
+}
+
+func (s *Server) IsBanned(publicKey string) bool {
+	return isBanned(s.DB, publicKey)
+}
+
+func isBanned(db *gorm.DB, publicKey string) bool {
+	var count int64
+	db.Model(&BannedKey{}).Where("public_key = ?", publicKey).Count(&count)
+	return count > 0
+}
+
+// BanKey bans a public key and, if an account uses it, ends its sessions.
+func (s *Server) BanKey(publicKey string, reason string) error {
+	if err := s.DB.Save(&BannedKey{PublicKey: publicKey, Reason: reason, CreatedAt: time.Now()}).Error; err != nil {
+		return err
+	}
+	var user User
+	if err := s.DB.Where("public_key = ?", publicKey).First(&user).Error; err == nil {
+		if err := s.RevokeAllSessions(user); err != nil {
+			return err
+		}
+	}
+	s.Log.Info("Public key banned", "public_key", publicKey, "reason", reason)
+	return nil
+}
+
+func (s *Server) UnbanKey(publicKey string) error {
+	res := s.DB.Where("public_key = ?", publicKey).Delete(&BannedKey{})
+	if res.Error != nil {
+		return res.Error
+	}
+	if res.RowsAffected == 0 {
+		return gorm.ErrRecordNotFound
+	}
+	s.Log.Info("Public key unbanned", "public_key", publicKey)
+	return nil
+}
+
+// RenameUser changes the username and updates the open sessions of the user.
+func (s *Server) RenameUser(user User, name string) (User, error) {
+	name, err := CheckUsername(s.DB, name, user.ID)
+	if err != nil {
+		return user, err
+	}
+	if err := s.DB.Model(&User{}).Where("id = ?", user.ID).Update("username", name).Error; err != nil {
+		return user, err
+	}
+
+	var renamed []*ManagedUser
+	s.MUserMu.Lock()
+	for _, muser := range s.MUser {
+		if muser.User.PublicKey == user.PublicKey {
+			muser.MinUser.Username = name
+			muser.User.Username = name
+			renamed = append(renamed, muser)
+		}
+	}
+	s.MUserMu.Unlock()
+	for _, muser := range renamed {
+		announce(s, muser)
+	}
+
+	user.Username = name
+	return user, nil
+}
+
+// DeleteAccount removes a user with everything stored for them, drops the
+// transactions they take part in and closes their sockets, on every node.
+func (s *Server) DeleteAccount(user User) error {
+	err := s.DB.Transaction(func(tx *gorm.DB) error {
+		for _, model := range []any{&RefreshToken{}, &RecoveryCode{}, &KeyChange{}, &AutoAcceptRule{}, &Contact{}} {
+			if err := tx.Where("user_id = ?", user.ID).Delete(model).Error; err != nil {
+				return err
+			}
+		}
+		if err := tx.Where("sender_key = ? OR recipient_key = ?", user.PublicKey, user.PublicKey).Delete(&PendingOffer{}).Error; err != nil {
+			return err
+		}
+		if err := tx.Where("requester_key = ? OR target_key = ?", user.PublicKey, user.PublicKey).Delete(&FileRequest{}).Error; err != nil {
+			return err
+		}
+		if err := tx.Where("owner_key = ?", user.PublicKey).Delete(&ShareLink{}).Error; err != nil {
+			return err
+		}
+		if err := forgetSender(tx, user.PublicKey); err != nil {
+			return err
+		}
+		return tx.Delete(&User{}, user.ID).Error
+	})
+	if err != nil {
+		return err
+	}
+
+	// Access tokens still out there die with the account, on every node.
+	r := revocation{PublicKey: user.PublicKey, Until: time.Now(), Deleted: true}
+	s.applyRevocation(r)
+	if err := s.broadcastRevocation(r); err != nil {
+		s.Log.Error("Failed to broadcast account deletion", "public_key", user.PublicKey, "err", err)
+	}
+
+	s.Log.Info("Account deleted", "user", user.Username, "public_key", user.PublicKey)
+	return nil
+}
+
+// dropTransactions deletes the transactions sent by publicKey (telling the
+// targets) and takes it off the target list of the others. Text shares
+// are dropped the same way, without notice.
+func dropTransactions(s *Server, publicKey string) {
+	type notice struct {
+		user *ManagedUser
+		id   string
+	}
+	var notices []notice
+	var dropped []string
+	// requested are the transactions fulfilling a file request that
+	// lost their requester (or all of their targets) here.
+	var requested []*Transaction
+
+	s.TransactionMu.Lock()
+	for id, tx := range s.Transactions {
+		if tx.Sender.MinUser.PublicKey == publicKey {
+			for _, target := range tx.Targets {
+				notices = append(notices, notice{target.User, id})
+			}
+			tx.Unsubscribe()
+			delete(s.Transactions, id)
+			dropRooms(s, id)
+			dropped = append(dropped, id)
+			if tx.RequestID != "" {
+				requested = append(requested, tx)
+			}
+			continue
+		}
+		kept := tx.Targets[:0]
+		for _, target := range tx.Targets {
+			if target.User.MinUser.PublicKey != publicKey {
+				kept = append(kept, target)
+			}
+		}
+		if len(kept) < len(tx.Targets) && tx.RequestID != "" {
+			requested = append(requested, tx)
+		}
+		tx.Targets = kept
+	}
+	for id, share := range s.TextShares {
+		if share.Sender.MinUser.PublicKey == publicKey {
+			share.Unsubscribe()
+			delete(s.TextShares, id)
+			continue
+		}
+		delete(share.Texts, publicKey)
+		kept := share.Targets[:0]
+		for _, target := range share.Targets {
+			if target.User.MinUser.PublicKey != publicKey {
+				kept = append(kept, target)
+			}
+		}
+		share.Targets = kept
+	}
+	for id, room := range s.CodeRooms {
+		if room.Sender.MinUser.PublicKey == publicKey || (room.Receiver != nil && room.Receiver.MinUser.PublicKey == publicKey) {
+			room.Unsubscribe()
+			delete(s.CodeRooms, id)
+		}
+	}
+	s.TransactionMu.Unlock()
+
+	for _, id := range dropped {
+		dropOffers(s, id, "")
+	}
+	for _, tx := range requested {
+		if tx.Sender.MinUser.PublicKey == publicKey {
+			reopenRequest(s, tx, "")
+		} else {
+			reopenRequest(s, tx, publicKey)
+		}
+	}
+	for _, n := range notices {
+		sendUser(s, n.user, DELETE_TRANSACTION, n.id)
+	}
+}
+
+// AccountExport is everything stored about a user, for data export requests.
+type AccountExport struct {
+	ExportedAt      time.Time         `json:"exported_at"`
+	User            User              `json:"user"`
+	KeyChanges      []KeyChange       `json:"key_changes"`
+	RecoveryCodes   []RecoveryCode    `json:"recovery_codes"`
+	RefreshTokens   []RefreshToken    `json:"refresh_tokens"`
+	Sessions        []SessionInfo     `json:"sessions"`
+	Transactions    []TransactionInfo `json:"transactions"`
+	PendingOffers   []PendingOffer    `json:"pending_offers"`
+	FileRequests    []FileRequest     `json:"file_requests"`
+	ShareLinks      []ShareLink       `json:"share_links"`
+	AutoAcceptRules []AutoAcceptRule  `json:"auto_accept_rules"`
+	Contacts        []Contact         `json:"contacts"`
+}
+
+// ExportAccount collects the rows of user plus the live sessions and
+// transactions they are part of. Secrets (hashes, keys) are left out.
+func (s *Server) ExportAccount(user User) (AccountExport, error) {
+	export := AccountExport{ExportedAt: time.Now(), User: user}
+	if err := s.DB.Where("user_id = ?", user.ID).Order("created_at").Find(&export.KeyChanges).Error; err != nil {
+		return export, err
+	}
+	if err := s.DB.Where("user_id = ?", user.ID).Order("created_at").Find(&export.RecoveryCodes).Error; err != nil {
+		return export, err
+	}
+	if err := s.DB.Where("user_id = ?", user.ID).Order("created_at").Find(&export.RefreshTokens).Error; err != nil {
+		return export, err
+	}
+
+	if err := s.DB.Where("sender_key = ? OR recipient_key = ?", user.PublicKey, user.PublicKey).Order("created_at").Find(&export.PendingOffers).Error; err != nil {
+		return export, err
+	}
+
+	if err := s.DB.Where("requester_key = ? OR target_key = ?", user.PublicKey, user.PublicKey).Order("created_at").Find(&export.FileRequests).Error; err != nil {
+		return export, err
+	}
+
+	if err := s.DB.Where("owner_key = ?", user.PublicKey).Order("created_at").Find(&export.ShareLinks).Error; err != nil {
+		return export, err
+	}
+
+	if err := s.DB.Where("user_id = ?", user.ID).Order("created_at").Find(&export.AutoAcceptRules).Error; err != nil {
+		return export, err
+	}
+	if err := s.DB.Where("user_id = ?", user.ID).Order("created_at").Find(&export.Contacts).Error; err != nil {
+		return export, err
+	}
+
+	export.Sessions = []SessionInfo{}
+	for _, session := range s.Sessions() {
+		if session.PublicKey == user.PublicKey {
+			export.Sessions = append(export.Sessions, session)
+		}
+	}
+	export.Transactions = []TransactionInfo{}
+	for _, tx := range s.TransactionsInfo() {
+		involved := tx.Sender.PublicKey == user.PublicKey
+		for _, target := range tx.Targets {
+			involved = involved || target.User.PublicKey == user.PublicKey
+		}
+		if involved {
+			export.Transactions = append(export.Transactions, tx)
+		}
+	}
+	return export, nil
+}
@@ -0,0 +1,46 @@
+package server
+
+import (
+	"errors"
+	"testing"
+)
+
+// A recovery that can't swap the key must leave the code unused.
+func TestRecoverAccount(t *testing.T) {
+	s := newTestServer(t)
+	alice := newTestUser(t, s, "alice")
+	bob := newTestUser(t, s, "bob")
+	codes, err := GenerateRecoveryCodes(s.DB, alice.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.BanKey("banned-key", "test"); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name     string
+		username string
+		code     string
+		newKey   string
+		want     error
+	}{
+		{"key in use", "alice", codes[0], bob.PublicKey, ErrKeyInUse},
+		{"key banned", "alice", codes[0], "banned-key", ErrKeyBanned},
+		{"wrong code", "alice", "nope", "new-key", ErrRecoveryInvalid},
+		{"other user", "bob", codes[1], "new-key", ErrRecoveryInvalid},
+		{"recovered", "Alice", codes[0], "new-key", nil}, // usernames are case-insensitive
+		{"code spent", "alice", codes[0], "newer-key", ErrRecoveryInvalid},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			user, err := s.RecoverAccount(tt.username, tt.code, tt.newKey, "127.0.0.1")
+			if !errors.Is(err, tt.want) {
+				t.Fatalf("got %v, want %v", err, tt.want)
+			}
+			if err == nil && user.PublicKey != tt.newKey {
+				t.Fatalf("public key is %q, want %q", user.PublicKey, tt.newKey)
+			}
+		})
+	}
+}
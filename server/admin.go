@@ -0,0 +1,306 @@
+package server
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/gofiber/websocket/v2"
+	"gorm.io/gorm"
+)
+
+// SessionInfo is one connected socket as shown to admins. Sockets held by
+// other nodes only carry what the cluster presence knows.
+type SessionInfo struct {
+	ConnID         string     `json:"conn_id,omitempty"`
+	Node           string     `json:"node"`
+	Username       string     `json:"username"`
+	PublicKey      string     `json:"public_key"`
+	IP             string     `json:"ip,omitempty"`
+	ConnectedAt    *time.Time `json:"connected_at,omitempty"`
+	TokenExpiresAt *time.Time `json:"token_expires_at,omitempty"`
+	Guest          bool       `json:"guest,omitempty"`
+}
+
+type TransactionTargetInfo struct {
+	User   MinimalUser  `json:"user"`
+	Status TargetStatus `json:"status"`
+	Files  []int        `json:"files,omitempty"`
+}
+
+// TransactionInfo is a live transaction as shown to admins.
+type TransactionInfo struct {
+	ID        string                  `json:"id"`
+	Sender    MinimalUser             `json:"sender"`
+	Targets   []TransactionTargetInfo `json:"targets"`
+	Files     int                     `json:"files"`
+	Bytes     int64                   `json:"bytes"`
+	Started   bool                    `json:"started"`
+	CreatedAt time.Time               `json:"created_at"`
+}
+
+// AdminGate lets through the JWT of a user with the admin flag, or the
+// static GDROP_ADMIN_TOKEN used by `gopherdrop admin`.
+func AdminGate(s *Server) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		raw, ok := strings.CutPrefix(c.Get(fiber.HeaderAuthorization), "Bearer ")
+		if !ok || raw == "" {
+			return resp(c, cret(false, "Missing token", nil), fiber.StatusUnauthorized)
+		}
+
+		if s.Config.AdminToken != "" && subtle.ConstantTimeCompare([]byte(raw), []byte(s.Config.AdminToken)) == 1 {
+			c.Locals("admin", "token")
+			return c.Next()
+		}
+
+		claims, err := s.ParseAccessToken(raw)
+		if err != nil {
+			return resp(c, cret(false, err.Error(), nil), fiber.StatusUnauthorized)
+		}
+		var user User
+		if err := s.DB.Where("public_key = ?", claims["public_key"]).First(&user).Error; err != nil || !user.IsAdmin {
+			return resp(c, cret(false, "Admin only", nil), fiber.StatusForbidden)
+		}
+		c.Locals("admin", user.Username)
+		return c.Next()
+	}
+}
+
+// Sessions lists the sockets of this node followed by those of other nodes.
+func (s *Server) Sessions() []SessionInfo {
+	s.MUserMu.RLock()
+	list := make([]SessionInfo, 0, len(s.MUser))
+	for _, muser := range s.MUser {
+		connected, expires := muser.ConnectedAt, muser.JWTExpiry
+		list = append(list, SessionInfo{
+			ConnID:         muser.ConnID,
+			Node:           s.NodeID,
+			Username:       muser.MinUser.Username,
+			PublicKey:      muser.MinUser.PublicKey,
+			IP:             muser.IP,
+			ConnectedAt:    &connected,
+			TokenExpiresAt: &expires,
+			Guest:          muser.Guest,
+		})
+	}
+	s.MUserMu.RUnlock()
+
+	presences, err := s.Backplane.Presences()
+	if err != nil {
+		s.Log.Error("Failed to read cluster presence", "err", err)
+		return list
+	}
+	for _, p := range presences {
+		if p.Node == s.NodeID {
+			continue
+		}
+		for _, connID := range p.ConnIDs {
+			list = append(list, SessionInfo{ConnID: connID, Node: p.Node, Username: p.User.Username, PublicKey: p.User.PublicKey, Guest: isGuestKey(p.User.PublicKey)})
+		}
+	}
+	return list
+}
+
+// Disconnect closes the socket with the given conn_id, asking the node
+// that holds it over the backplane if it isn't this one.
+func (s *Server) Disconnect(connID string) bool {
+	const reason = "disconnected by admin"
+	s.MUserMu.RLock()
+	for _, muser := range s.MUser {
+		if muser.ConnID == connID {
+			closeWS(s, muser.Conn, websocket.ClosePolicyViolation, reason)
+			s.MUserMu.RUnlock()
+			return true
+		}
+	}
+	s.MUserMu.RUnlock()
+
+	presences, err := s.Backplane.Presences()
+	if err != nil {
+		s.Log.Error("Failed to read cluster presence", "err", err)
+		return false
+	}
+	for _, p := range presences {
+		if p.Node != s.NodeID && slices.Contains(p.ConnIDs, connID) {
+			return closeRemote(s, p.User.PublicKey, CloseNotice{ConnID: connID, Reason: reason})
+		}
+	}
+	return false
+}
+
+// closeRemote has the nodes holding sockets of publicKey close them.
+func closeRemote(s *Server, publicKey string, notice CloseNotice) bool {
+	payload, err := json.Marshal(Envelope{Node: s.NodeID, Close: &notice})
+	if err != nil {
+		return false
+	}
+	n, err := s.Backplane.Publish(userTopic(publicKey), payload)
+	if err != nil {
+		s.Log.Error("Backplane publish failed", "public_key", publicKey, "err", err)
+	}
+	return n > 0
+}
+
+// TransactionsInfo lists the transactions owned by this node.
+func (s *Server) TransactionsInfo() []TransactionInfo {
+	s.TransactionMu.RLock()
+	defer s.TransactionMu.RUnlock()
+	list := make([]TransactionInfo, 0, len(s.Transactions))
+	for _, tx := range s.Transactions {
+		info := TransactionInfo{
+			ID:        tx.ID,
+			Sender:    tx.Sender.MinUser,
+			Targets:   make([]TransactionTargetInfo, 0, len(tx.Targets)),
+			Files:     len(tx.Files),
+			Started:   tx.Started,
+			CreatedAt: tx.CreatedAt,
+		}
+		for _, target := range tx.Targets {
+			info.Targets = append(info.Targets, TransactionTargetInfo{target.User.MinUser, target.Status, target.Files})
+		}
+		for _, f := range tx.Files {
+			info.Bytes += f.Size
+		}
+		list = append(list, info)
+	}
+	return list
+}
+
+func adminUser(s *Server, c *fiber.Ctx) (User, error) {
+	id, err := c.ParamsInt("id")
+	if err != nil {
+		return User{}, err
+	}
+	var user User
+	err = s.DB.First(&user, id).Error
+	return user, err
+}
+
+func SetupAdminUsers(s *Server, group fiber.Router) {
+	group.Get("/users", func(c *fiber.Ctx) error {
+		limit := min(max(c.QueryInt("limit", 100), 1), 1000)
+		offset := max(c.QueryInt("offset", 0), 0)
+
+		query := s.DB.Model(&User{})
+		if q := c.Query("q"); q != "" {
+			query = query.Where("LOWER(username) LIKE LOWER(?) OR public_key = ?", "%"+q+"%", q)
+		}
+		var total int64
+		if err := query.Count(&total).Error; err != nil {
+			return resp(c, cret(false, "Failed to list users", nil), fiber.StatusInternalServerError)
+		}
+		var users []User
+		if err := query.Order("id").Limit(limit).Offset(offset).Find(&users).Error; err != nil {
+			return resp(c, cret(false, "Failed to list users", nil), fiber.StatusInternalServerError)
+		}
+		return resp(c, cret(true, "users", fiber.Map{"total": total, "users": users}), fiber.StatusOK)
+	})
+
+	group.Put("/users/:id", func(c *fiber.Ctx) error {
+		var b struct {
+			Username *string `json:"username"`
+			IsAdmin  *bool   `json:"is_admin"`
+		}
+		if err := c.BodyParser(&b); err != nil {
+			return resp(c, cret(false, "Invalid body", nil), fiber.StatusBadRequest)
+		}
+		user, err := adminUser(s, c)
+		if err != nil {
+			return resp(c, cret(false, "User not found", nil), fiber.StatusNotFound)
+		}
+
+		if b.Username != nil {
+			if user, err = s.RenameUser(user, *b.Username); err != nil {
+				return resp(c, cret(false, err.Error(), nil), fiber.StatusBadRequest)
+			}
+		}
+		if b.IsAdmin != nil {
+			if err := s.DB.Model(&User{}).Where("id = ?", user.ID).Update("is_admin", *b.IsAdmin).Error; err != nil {
+				return resp(c, cret(false, "Failed to update user", nil), fiber.StatusInternalServerError)
+			}
+			user.IsAdmin = *b.IsAdmin
+		}
+
+		s.Log.Info("Admin updated user", "admin", c.Locals("admin"), "user", user.Username, "is_admin", user.IsAdmin)
+		return resp(c, cret(true, "user", user), fiber.StatusOK)
+	})
+
+	group.Delete("/users/:id", func(c *fiber.Ctx) error {
+		user, err := adminUser(s, c)
+		if err != nil {
+			return resp(c, cret(false, "User not found", nil), fiber.StatusNotFound)
+		}
+		if err := s.DeleteAccount(user); err != nil {
+			return resp(c, cret(false, "Failed to delete user", nil), fiber.StatusInternalServerError)
+		}
+		s.Log.Info("Admin deleted user", "admin", c.Locals("admin"), "user", user.Username)
+		return resp(c, cret(true, "User deleted", nil), fiber.StatusOK)
+	})
+}
+
+func SetupAdminSessions(s *Server, group fiber.Router) {
+	group.Get("/sessions", func(c *fiber.Ctx) error {
+		return resp(c, cret(true, "sessions", s.Sessions()), fiber.StatusOK)
+	})
+
+	group.Delete("/sessions/:conn_id", func(c *fiber.Ctx) error {
+		if !s.Disconnect(c.Params("conn_id")) {
+			return resp(c, cret(false, "Session not found", nil), fiber.StatusNotFound)
+		}
+		s.Log.Info("Admin disconnected session", "admin", c.Locals("admin"), "conn_id", c.Params("conn_id"))
+		return resp(c, cret(true, "Session disconnected", nil), fiber.StatusOK)
+	})
+}
+
+func SetupAdminBans(s *Server, group fiber.Router) {
+	group.Get("/bans", func(c *fiber.Ctx) error {
+		var bans []BannedKey
+		if err := s.DB.Order("created_at desc").Find(&bans).Error; err != nil {
+			return resp(c, cret(false, "Failed to list bans", nil), fiber.StatusInternalServerError)
+		}
+		return resp(c, cret(true, "bans", bans), fiber.StatusOK)
+	})
+
+	group.Post("/bans", func(c *fiber.Ctx) error {
+		var b struct {
+			PublicKey string `json:"public_key"`
+			Reason    string `json:"reason"`
+		}
+		if err := c.BodyParser(&b); err != nil || b.PublicKey == "" {
+			return resp(c, cret(false, "Invalid body", nil), fiber.StatusBadRequest)
+		}
+		if err := s.BanKey(b.PublicKey, b.Reason); err != nil {
+			return resp(c, cret(false, "Failed to ban key", nil), fiber.StatusInternalServerError)
+		}
+		s.Log.Info("Admin banned key", "admin", c.Locals("admin"), "public_key", b.PublicKey)
+		return resp(c, cret(true, "Key banned", nil), fiber.StatusOK)
+	})
+
+	group.Delete("/bans", func(c *fiber.Ctx) error {
+		var b struct {
+			PublicKey string `json:"public_key"`
+		}
+		if err := c.BodyParser(&b); err != nil || b.PublicKey == "" {
+			return resp(c, cret(false, "Invalid body", nil), fiber.StatusBadRequest)
+		}
+		err := s.UnbanKey(b.PublicKey)
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return resp(c, cret(false, "Key is not banned", nil), fiber.StatusNotFound)
+		}
+		if err != nil {
+			return resp(c, cret(false, "Failed to unban key", nil), fiber.StatusInternalServerError)
+		}
+		s.Log.Info("Admin unbanned key", "admin", c.Locals("admin"), "public_key", b.PublicKey)
+		return resp(c, cret(true, "Key unbanned", nil), fiber.StatusOK)
+	})
+}
+
+func SetupAdminTransactions(s *Server, group fiber.Router) {
+	group.Get("/transactions", func(c *fiber.Ctx) error {
+		return resp(c, cret(true, "transactions", s.TransactionsInfo()), fiber.StatusOK)
+	})
+}
@@ -0,0 +1,307 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"gopherdrop/helper"
+	"math"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/gofiber/websocket/v2"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/google/uuid"
+)
+
+type TokenPair struct {
+	AccessToken  string `json:"access_token"`
+	RefreshToken string `json:"refresh_token"`
+	ExpiresAt    int64  `json:"expires_at"`
+}
+
+var (
+	ErrRefreshInvalid = errors.New("invalid refresh token")
+	ErrRefreshReused  = errors.New("refresh token reuse detected")
+	ErrTokenRevoked   = errors.New("token revoked")
+)
+
+// issuedAt is the iat claim of a token issued at t. It keeps the
+// milliseconds: a token issued in the same second as a revoke-all, but
+// after it, must not be caught by it.
+func issuedAt(t time.Time) float64 {
+	return float64(t.UnixMilli()) / 1000
+}
+
+func (s *Server) issueAccessToken(user User) (string, time.Time, error) {
+	now := time.Now()
+	exp := now.Add(s.Config.AccessTTL)
+	claims := jwt.MapClaims{
+		"username":   user.Username,
+		"public_key": user.PublicKey,
+		"jti":        uuid.New().String(),
+		"iat":        issuedAt(now),
+		"exp":        exp.Unix(),
+	}
+	t, err := s.Keys.Sign(claims)
+	return t, exp, err
+}
+
+func (s *Server) issueRefreshToken(user User, family string) (string, error) {
+	raw, err := helper.GenerateToken()
+	if err != nil {
+		return "", err
+	}
+	if family == "" {
+		family = uuid.New().String()
+	}
+	rt := RefreshToken{
+		UserID:    user.ID,
+		TokenHash: helper.HashToken(raw),
+		Family:    family,
+		ExpiresAt: time.Now().Add(s.Config.RefreshTTL),
+		CreatedAt: time.Now(),
+	}
+	if err := s.DB.Create(&rt).Error; err != nil {
+		return "", err
+	}
+	return raw, nil
+}
+
+// IssueTokenPair starts a new refresh family, used on login.
+func (s *Server) IssueTokenPair(user User) (TokenPair, error) {
+	return s.issueTokenPair(user, "")
+}
+
+func (s *Server) issueTokenPair(user User, family string) (TokenPair, error) {
+	access, exp, err := s.issueAccessToken(user)
+	if err != nil {
+		return TokenPair{}, err
+	}
+	refresh, err := s.issueRefreshToken(user, family)
+	if err != nil {
+		return TokenPair{}, err
+	}
+	return TokenPair{access, refresh, exp.Unix()}, nil
+}
+
+// RotateRefreshToken spends a refresh token and returns the next pair.
+func (s *Server) RotateRefreshToken(raw string) (TokenPair, error) {
+	var rt RefreshToken
+	if err := s.DB.Where("token_hash = ?", helper.HashToken(raw)).First(&rt).Error; err != nil {
+		return TokenPair{}, ErrRefreshInvalid
+	}
+	if rt.Revoked {
+		s.DB.Model(&RefreshToken{}).Where("family = ?", rt.Family).Update("revoked", true)
+		return TokenPair{}, ErrRefreshReused
+	}
+	if time.Now().After(rt.ExpiresAt) {
+		return TokenPair{}, ErrRefreshInvalid
+	}
+
+	// Only one caller may win the rotation of a given token.
+	res := s.DB.Model(&RefreshToken{}).Where("id = ? AND revoked = ?", rt.ID, false).Update("revoked", true)
+	if res.Error != nil || res.RowsAffected == 0 {
+		return TokenPair{}, ErrRefreshInvalid
+	}
+
+	var user User
+	if err := s.DB.First(&user, rt.UserID).Error; err != nil {
+		return TokenPair{}, ErrRefreshInvalid
+	}
+	return s.issueTokenPair(user, rt.Family)
+}
+
+// RevokeRefreshToken revokes the refresh family raw belongs to, if it is owned by userID.
+func (s *Server) RevokeRefreshToken(userID int, raw string) error {
+	var rt RefreshToken
+	if err := s.DB.Where("token_hash = ? AND user_id = ?", helper.HashToken(raw), userID).First(&rt).Error; err != nil {
+		return ErrRefreshInvalid
+	}
+	return s.DB.Model(&RefreshToken{}).Where("family = ?", rt.Family).Update("revoked", true).Error
+}
+
+// RevokeJTI puts an access token on the deny-list and drops the sockets
+// opened with it, on every node.
+func (s *Server) RevokeJTI(jti string, exp time.Time) error {
+	if jti == "" {
+		return nil
+	}
+	if err := s.DB.Save(&RevokedToken{JTI: jti, ExpiresAt: exp}).Error; err != nil {
+		return err
+	}
+	s.applyRevocation(revocation{JTI: jti, Until: exp})
+	return s.broadcastRevocation(revocation{JTI: jti, Until: exp})
+}
+
+// RevokeAllSessions invalidates every refresh and access token of user and
+// disconnects all of their sockets, on every node.
+func (s *Server) RevokeAllSessions(user User) error {
+	now := time.Now()
+	if err := s.DB.Model(&User{}).Where("id = ?", user.ID).Update("tokens_revoked_at", now).Error; err != nil {
+		return err
+	}
+	if err := s.DB.Model(&RefreshToken{}).Where("user_id = ?", user.ID).Update("revoked", true).Error; err != nil {
+		return err
+	}
+	s.applyRevocation(revocation{PublicKey: user.PublicKey, Until: now})
+	return s.broadcastRevocation(revocation{PublicKey: user.PublicKey, Until: now})
+}
+
+// revocation tells the other nodes to update their deny-list: either one
+// jti until it expires, or every token of a public key issued until then.
+// Deleted says the account is gone, its transactions go with it.
+type revocation struct {
+	Node      string    `json:"node"`
+	JTI       string    `json:"jti,omitempty"`
+	PublicKey string    `json:"public_key,omitempty"`
+	Until     time.Time `json:"until"`
+	Deleted   bool      `json:"deleted,omitempty"`
+}
+
+const revocationTopic = "revocations"
+
+func (s *Server) broadcastRevocation(r revocation) error {
+	r.Node = s.NodeID
+	payload, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+	_, err = s.Backplane.Publish(revocationTopic, payload)
+	return err
+}
+
+// applyRevocation updates the in-memory deny-list and closes the local
+// sockets the revocation covers.
+func (s *Server) applyRevocation(r revocation) {
+	s.DeniedMu.Lock()
+	if r.JTI != "" {
+		s.DeniedJTI[r.JTI] = r.Until
+	} else {
+		s.RevokedBefore[r.PublicKey] = r.Until
+	}
+	s.DeniedMu.Unlock()
+
+	reason := "all sessions revoked"
+	if r.Deleted {
+		dropTransactions(s, r.PublicKey)
+		reason = "account deleted"
+	}
+
+	s.MUserMu.RLock()
+	for _, muser := range s.MUser {
+		switch {
+		case r.JTI != "" && muser.JTI == r.JTI:
+			closeWS(s, muser.Conn, websocket.ClosePolicyViolation, "token revoked")
+		case r.JTI == "" && muser.User.PublicKey == r.PublicKey:
+			closeWS(s, muser.Conn, websocket.ClosePolicyViolation, reason)
+		}
+	}
+	s.MUserMu.RUnlock()
+}
+
+// IsTokenRevoked checks claims against the jti deny-list and the per-user
+// "revoke all sessions" timestamp.
+func (s *Server) IsTokenRevoked(claims jwt.MapClaims) bool {
+	jti, _ := claims["jti"].(string)
+	pubkey, _ := claims["public_key"].(string)
+	iat, _ := claims["iat"].(float64)
+
+	s.DeniedMu.RLock()
+	defer s.DeniedMu.RUnlock()
+
+	// Tokens from before jti existed cannot be revoked one by one.
+	if jti != "" {
+		if _, denied := s.DeniedJTI[jti]; denied {
+			return true
+		}
+	}
+	if before, ok := s.RevokedBefore[pubkey]; ok && int64(math.Round(iat*1000)) <= before.UnixMilli() {
+		return true
+	}
+	return false
+}
+
+// ParseAccessToken validates a raw access token, including revocation.
+func (s *Server) ParseAccessToken(raw string) (jwt.MapClaims, error) {
+	token, err := jwt.Parse(raw, s.Keys.KeyFunc)
+	if err != nil || !token.Valid {
+		return nil, errors.New("JWT token not valid")
+	}
+	claims := token.Claims.(jwt.MapClaims)
+	if claims["typ"] == "link" {
+		return nil, errors.New("JWT token not valid")
+	}
+	if s.IsTokenRevoked(claims) {
+		return nil, ErrTokenRevoked
+	}
+	return claims, nil
+}
+
+// JWTRevocationGate runs after jwtware accepted the token and rejects revoked ones.
+func JWTRevocationGate(s *Server) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		claims, err := helper.GetJWT(c)
+		if err != nil || s.IsTokenRevoked(claims) {
+			return resp(c, cret(false, "Token revoked", nil), fiber.StatusUnauthorized)
+		}
+		// Share link tokens aren't access tokens, guest ones only open the WebSocket.
+		switch claims["typ"] {
+		case "link":
+			return resp(c, cret(false, "Not an access token", nil), fiber.StatusUnauthorized)
+		case "guest":
+			if !websocket.IsWebSocketUpgrade(c) {
+				return resp(c, cret(false, "Not available to guests", nil), fiber.StatusForbidden)
+			}
+		}
+		return c.Next()
+	}
+}
+
+// LoadRevocations fills the in-memory deny-list from the DB on startup and
+// keeps it in sync with the revocations made on other nodes.
+func LoadRevocations(s *Server) error {
+	_, err := s.Backplane.Subscribe(revocationTopic, func(payload []byte) {
+		var r revocation
+		if json.Unmarshal(payload, &r) == nil && r.Node != s.NodeID {
+			s.applyRevocation(r)
+		}
+	})
+	if err != nil {
+		return err
+	}
+
+	var revoked []RevokedToken
+	if err := s.DB.Where("expires_at > ?", time.Now()).Find(&revoked).Error; err != nil {
+		return err
+	}
+	var users []User
+	if err := s.DB.Where("tokens_revoked_at IS NOT NULL").Find(&users).Error; err != nil {
+		return err
+	}
+
+	s.DeniedMu.Lock()
+	defer s.DeniedMu.Unlock()
+	for _, r := range revoked {
+		s.DeniedJTI[r.JTI] = r.ExpiresAt
+	}
+	for _, u := range users {
+		s.RevokedBefore[u.PublicKey] = *u.TokensRevokedAt
+	}
+	return nil
+}
+
+func purgeRevocations(s *Server) {
+	now := time.Now()
+	s.DeniedMu.Lock()
+	for jti, exp := range s.DeniedJTI {
+		if now.After(exp) {
+			delete(s.DeniedJTI, jti)
+		}
+	}
+	s.DeniedMu.Unlock()
+
+	if s.DB != nil {
+		s.DB.Where("expires_at < ?", now).Delete(&RevokedToken{})
+		s.DB.Where("expires_at < ?", now).Delete(&RefreshToken{})
+	}
+}
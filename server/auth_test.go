@@ -0,0 +1,123 @@
+package server
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestRotateRefreshToken(t *testing.T) {
+	s := newTestServer(t)
+	user := newTestUser(t, s, "alice")
+
+	first, err := s.IssueTokenPair(user)
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := s.RotateRefreshToken(first.RefreshToken)
+	if err != nil {
+		t.Fatalf("rotate: %v", err)
+	}
+	if second.RefreshToken == first.RefreshToken || second.AccessToken == "" {
+		t.Fatal("rotation did not issue a new pair")
+	}
+
+	tests := []struct {
+		name  string
+		token string
+		want  error
+	}{
+		{"unknown token", "not-a-token", ErrRefreshInvalid},
+		{"spent token", first.RefreshToken, ErrRefreshReused},
+		// The reuse above revoked the whole family.
+		{"family after reuse", second.RefreshToken, ErrRefreshReused},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := s.RotateRefreshToken(tt.token); !errors.Is(err, tt.want) {
+				t.Fatalf("got %v, want %v", err, tt.want)
+			}
+		})
+	}
+
+	// Other families of the same user are left alone.
+	other, err := s.IssueTokenPair(user)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.RotateRefreshToken(other.RefreshToken); err != nil {
+		t.Fatalf("rotate other family: %v", err)
+	}
+}
+
+func TestRotateRefreshTokenExpired(t *testing.T) {
+	s := newTestServer(t)
+	user := newTestUser(t, s, "alice")
+
+	pair, err := s.IssueTokenPair(user)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.DB.Model(&RefreshToken{}).Where("user_id = ?", user.ID).Update("expires_at", time.Now().Add(-time.Minute))
+	if _, err := s.RotateRefreshToken(pair.RefreshToken); !errors.Is(err, ErrRefreshInvalid) {
+		t.Fatalf("got %v, want %v", err, ErrRefreshInvalid)
+	}
+}
+
+func TestRevokeAllSessions(t *testing.T) {
+	s := newTestServer(t)
+	user := newTestUser(t, s, "alice")
+
+	before, err := s.IssueTokenPair(user)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.RevokeAllSessions(user); err != nil {
+		t.Fatal(err)
+	}
+	// Issued right after, within the same second but not the same millisecond.
+	time.Sleep(2 * time.Millisecond)
+	after, err := s.IssueTokenPair(user)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := s.ParseAccessToken(before.AccessToken); !errors.Is(err, ErrTokenRevoked) {
+		t.Fatalf("old access token: got %v, want %v", err, ErrTokenRevoked)
+	}
+	if _, err := s.RotateRefreshToken(before.RefreshToken); err == nil {
+		t.Fatal("old refresh token still rotates")
+	}
+	if _, err := s.ParseAccessToken(after.AccessToken); err != nil {
+		t.Fatalf("new access token: %v", err)
+	}
+}
+
+func TestRevokeJTI(t *testing.T) {
+	s := newTestServer(t)
+	user := newTestUser(t, s, "alice")
+
+	pair, err := s.IssueTokenPair(user)
+	if err != nil {
+		t.Fatal(err)
+	}
+	claims, err := s.ParseAccessToken(pair.AccessToken)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.RevokeJTI(claims["jti"].(string), time.Now().Add(time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.ParseAccessToken(pair.AccessToken); !errors.Is(err, ErrTokenRevoked) {
+		t.Fatalf("got %v, want %v", err, ErrTokenRevoked)
+	}
+
+	// A fresh node picks the deny-list up from the db.
+	s.DeniedJTI = make(map[string]time.Time)
+	if err := LoadRevocations(s); err != nil {
+		t.Fatal(err)
+	}
+	if !s.IsTokenRevoked(claims) {
+		t.Fatal("revocation not loaded from the db")
+	}
+}
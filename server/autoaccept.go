@@ -0,0 +1,252 @@
+package server
+
+import (
+	"encoding/json"
+	"gopherdrop/helper"
+	"slices"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+// Auto-accept rules let a user skip the TRANSACTION_SHARE_ACCEPT prompt,
+// for build bots and the like. When an offer matches one of the target's
+// rules the server answers it for them: the target is marked Accepted and
+// gets START_TRANSACTION right away, the sender the usual accept
+// notification. Offers from guests are never auto-accepted.
+const (
+	maxAutoAcceptRules = 20
+	maxRuleKeys        = 50
+)
+
+// matches says whether an offer of files from sender satisfies the rule.
+// contact is the rule owner's contact entry for sender, nil when sender
+// isn't one of their contacts.
+func (r AutoAcceptRule) matches(sender string, contact *Contact, files []*FileInfo) bool {
+	if len(r.FromKeys) > 0 && !slices.Contains(r.FromKeys, sender) {
+		return false
+	}
+	if (r.Contacts || len(r.Groups) > 0) && contact == nil {
+		return false
+	}
+	if len(r.Groups) > 0 && !slices.ContainsFunc(r.Groups, func(g string) bool { return slices.Contains(contact.Groups, g) }) {
+		return false
+	}
+	var total int64
+	for _, f := range files {
+		total += f.Size
+		if !f.IsDir && len(r.Types) > 0 && !matchesType(*f, r.Types) {
+			return false
+		}
+	}
+	return r.MaxSize == 0 || total <= r.MaxSize
+}
+
+// autoAccepts says whether the rules of the user with recipient take an
+// offer of files from sender.
+func autoAccepts(s *Server, recipient string, sender string, files []*FileInfo) bool {
+	if len(files) == 0 || isGuestKey(sender) || isGuestKey(recipient) {
+		return false
+	}
+	var rules []AutoAcceptRule
+	err := s.DB.Joins("JOIN users ON users.id = auto_accept_rules.user_id").
+		Where("users.public_key = ?", recipient).Find(&rules).Error
+	if err != nil {
+		s.Log.Error("Failed to load auto-accept rules", "public_key", recipient, "err", err)
+		return false
+	}
+	if len(rules) == 0 {
+		return false
+	}
+
+	var contact *Contact
+	var contacts []Contact
+	err = s.DB.Joins("JOIN users ON users.id = contacts.user_id").
+		Where("users.public_key = ? AND contacts.public_key = ?", recipient, sender).Limit(1).Find(&contacts).Error
+	if err != nil {
+		s.Log.Error("Failed to load contact", "public_key", recipient, "err", err)
+		return false
+	}
+	if len(contacts) > 0 {
+		contact = &contacts[0]
+	}
+	for _, rule := range rules {
+		if rule.matches(sender, contact, files) {
+			return true
+		}
+	}
+	return false
+}
+
+// autoAcceptTargets picks the connected targets of tx whose rules take the
+// offer. Offline ones are checked when their inbox is delivered.
+func autoAcceptTargets(s *Server, tx *Transaction, targets []*TransactionTarget, offline []*ManagedUser) map[*ManagedUser]bool {
+	s.TransactionMu.RLock()
+	sender, files := tx.Sender.MinUser.PublicKey, tx.Files
+	s.TransactionMu.RUnlock()
+
+	auto := make(map[*ManagedUser]bool)
+	for _, target := range targets {
+		if !slices.Contains(offline, target.User) && autoAccepts(s, target.User.MinUser.PublicKey, sender, files) {
+			auto[target.User] = true
+		}
+	}
+	return auto
+}
+
+// acceptFor answers the offer of transaction txID for user, the way a
+// TRANSACTION_SHARE_ACCEPT from their client would. The session, or the
+// envelope when the transaction lives on another node, marks the answer as
+// coming from a rule: the message itself is what clients send too.
+func acceptFor(s *Server, user *ManagedUser, txID string) {
+	msg := WSMessage{WSType: TRANSACTION_SHARE_ACCEPT, Data: map[string]any{"transaction_id": txID, "accept": true}}
+	user.Log.Info("Offer auto-accepted", "tx_id", txID)
+	if !forwardEnvelope(s, user, txID, Envelope{From: user.MinUser, Msg: msg, Auto: true}) {
+		(&wsSession{s: s, mUser: user, auto: true}).handle(msg)
+	}
+}
+
+// forgetSender takes a deleted public key out of everyone's contacts and
+// rules. A rule left without senders is removed rather than widened to
+// anyone.
+func forgetSender(tx *gorm.DB, publicKey string) error {
+	if err := tx.Where("public_key = ?", publicKey).Delete(&Contact{}).Error; err != nil {
+		return err
+	}
+	quoted, err := json.Marshal(publicKey)
+	if err != nil {
+		return err
+	}
+	var rules []AutoAcceptRule
+	if err := tx.Where("from_keys LIKE ?", "%"+string(quoted)+"%").Find(&rules).Error; err != nil {
+		return err
+	}
+	for _, rule := range rules {
+		keys := slices.DeleteFunc(slices.Clone(rule.FromKeys), func(k string) bool { return k == publicKey })
+		switch {
+		case len(keys) == len(rule.FromKeys):
+			continue
+		case len(keys) == 0:
+			err = tx.Delete(&rule).Error
+		default:
+			rule.FromKeys = keys
+			err = tx.Save(&rule).Error
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// SetupAutoAccept is /api/v1/protected/auto-accept: list, add and remove
+// the caller's auto-accept rules.
+func SetupAutoAccept(s *Server, group fiber.Router) {
+	group.Get("/auto-accept", func(c *fiber.Ctx) error {
+		claims, err := helper.GetJWT(c)
+		if err != nil {
+			return resp(c, cret(false, err.Error(), nil), fiber.StatusUnauthorized)
+		}
+
+		var user User
+		if err := s.DB.Where("public_key = ?", claims["public_key"]).First(&user).Error; err != nil {
+			return resp(c, cret(false, "User not found", nil), fiber.StatusBadRequest)
+		}
+
+		rules := []AutoAcceptRule{}
+		if err := s.DB.Where("user_id = ?", user.ID).Order("created_at").Find(&rules).Error; err != nil {
+			return resp(c, cret(false, "Failed to load rules", nil), fiber.StatusInternalServerError)
+		}
+		return resp(c, cret(true, "auto_accept_rules", rules), fiber.StatusOK)
+	})
+
+	group.Post("/auto-accept", func(c *fiber.Ctx) error {
+		claims, err := helper.GetJWT(c)
+		if err != nil {
+			return resp(c, cret(false, err.Error(), nil), fiber.StatusUnauthorized)
+		}
+
+		var user User
+		if err := s.DB.Where("public_key = ?", claims["public_key"]).First(&user).Error; err != nil {
+			return resp(c, cret(false, "User not found", nil), fiber.StatusBadRequest)
+		}
+
+		var b struct {
+			From     []string `json:"from"`
+			Contacts bool     `json:"contacts"`
+			Groups   []string `json:"groups"`
+			Types    []string `json:"types"`
+			MaxSize  int64    `json:"max_size"`
+		}
+		if err := c.BodyParser(&b); err != nil {
+			return resp(c, cret(false, "Invalid body", nil), fiber.StatusBadRequest)
+		}
+		if len(b.From) == 0 && !b.Contacts && len(b.Groups) == 0 && len(b.Types) == 0 && b.MaxSize == 0 {
+			return resp(c, cret(false, "A rule needs at least one condition", nil), fiber.StatusBadRequest)
+		}
+		if len(b.From) > maxRuleKeys || len(b.Groups) > maxContactGroups || len(b.Types) > maxRequestTypes || b.MaxSize < 0 {
+			return resp(c, cret(false, "Invalid rule", nil), fiber.StatusBadRequest)
+		}
+		for _, g := range b.Groups {
+			if !validGroupName(g) {
+				return resp(c, cret(false, "Invalid group name", nil), fiber.StatusBadRequest)
+			}
+		}
+		for _, key := range b.From {
+			if key == "" || len(key) > 255 || key == user.PublicKey {
+				return resp(c, cret(false, "Invalid public key in from", nil), fiber.StatusBadRequest)
+			}
+		}
+		for _, t := range b.Types {
+			if t == "" || len(t) > 255 {
+				return resp(c, cret(false, "Invalid file type", nil), fiber.StatusBadRequest)
+			}
+		}
+
+		var count int64
+		s.DB.Model(&AutoAcceptRule{}).Where("user_id = ?", user.ID).Count(&count)
+		if count >= maxAutoAcceptRules {
+			return resp(c, cret(false, "Too many rules", nil), fiber.StatusBadRequest)
+		}
+
+		rule := AutoAcceptRule{
+			ID:        uuid.New().String(),
+			UserID:    user.ID,
+			FromKeys:  b.From,
+			Contacts:  b.Contacts,
+			Groups:    b.Groups,
+			Types:     b.Types,
+			MaxSize:   b.MaxSize,
+			CreatedAt: time.Now(),
+		}
+		if err := s.DB.Create(&rule).Error; err != nil {
+			return resp(c, cret(false, "Failed to save rule", nil), fiber.StatusInternalServerError)
+		}
+		s.Log.Info("Auto-accept rule added", "user", user.Username, "rule_id", rule.ID, "from", len(rule.FromKeys), "contacts", rule.Contacts, "groups", len(rule.Groups), "types", len(rule.Types), "max_size", rule.MaxSize)
+		return resp(c, cret(true, "auto_accept_rule", rule), fiber.StatusOK)
+	})
+
+	group.Delete("/auto-accept/:id", func(c *fiber.Ctx) error {
+		claims, err := helper.GetJWT(c)
+		if err != nil {
+			return resp(c, cret(false, err.Error(), nil), fiber.StatusUnauthorized)
+		}
+
+		var user User
+		if err := s.DB.Where("public_key = ?", claims["public_key"]).First(&user).Error; err != nil {
+			return resp(c, cret(false, "User not found", nil), fiber.StatusBadRequest)
+		}
+
+		res := s.DB.Where("id = ? AND user_id = ?", c.Params("id"), user.ID).Delete(&AutoAcceptRule{})
+		if res.Error != nil {
+			return resp(c, cret(false, "Failed to delete rule", nil), fiber.StatusInternalServerError)
+		}
+		if res.RowsAffected == 0 {
+			return resp(c, cret(false, "Rule not found", nil), fiber.StatusNotFound)
+		}
+		s.Log.Info("Auto-accept rule removed", "user", user.Username, "rule_id", c.Params("id"))
+		return resp(c, cret(true, "Rule removed", nil), fiber.StatusOK)
+	})
+}
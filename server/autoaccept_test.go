@@ -0,0 +1,138 @@
+package server
+
+import (
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+func TestMatchesType(t *testing.T) {
+	photo := FileInfo{Name: "Beach.JPG", Type: "image/jpeg"}
+	for _, tc := range []struct {
+		types []string
+		want  bool
+	}{
+		{[]string{".jpg"}, true},
+		{[]string{".JPG"}, true},
+		{[]string{"image/*"}, true},
+		{[]string{"image/jpeg"}, true},
+		{[]string{"image/png"}, false},
+		{[]string{"video/*", ".pdf"}, false},
+		{[]string{".pdf", "IMAGE/*"}, true},
+		{[]string{"image"}, false},
+		{nil, false},
+	} {
+		if got := matchesType(photo, tc.types); got != tc.want {
+			t.Errorf("matchesType(%v) = %v, want %v", tc.types, got, tc.want)
+		}
+	}
+	if matchesType(FileInfo{Name: "notes", Type: ""}, []string{"text/*"}) {
+		t.Error("a file without type or extension matched text/*")
+	}
+}
+
+func TestRuleMatches(t *testing.T) {
+	pdf := []*FileInfo{{Name: "a.pdf", Type: "application/pdf", Size: 10}}
+	tree := []*FileInfo{{Name: "docs", IsDir: true}, {Name: "b.pdf", Path: "docs/b.pdf", Type: "application/pdf", Size: 20}}
+	friend := &Contact{PublicKey: "bob-key", Groups: []string{"Friends"}}
+	coworker := &Contact{PublicKey: "bob-key", Groups: []string{"Work", "Build"}}
+
+	for _, tc := range []struct {
+		name    string
+		rule    AutoAcceptRule
+		contact *Contact
+		files   []*FileInfo
+		want    bool
+	}{
+		{"from listed", AutoAcceptRule{FromKeys: []string{"bob-key"}}, nil, pdf, true},
+		{"from not listed", AutoAcceptRule{FromKeys: []string{"carol-key"}}, nil, pdf, false},
+		{"contacts", AutoAcceptRule{Contacts: true}, friend, pdf, true},
+		{"contacts, stranger", AutoAcceptRule{Contacts: true}, nil, pdf, false},
+		{"group", AutoAcceptRule{Groups: []string{"Work"}}, coworker, pdf, true},
+		{"group, other group", AutoAcceptRule{Groups: []string{"Work"}}, friend, pdf, false},
+		{"group, stranger", AutoAcceptRule{Groups: []string{"Work"}}, nil, pdf, false},
+		{"group names are exact", AutoAcceptRule{Groups: []string{"work"}}, coworker, pdf, false},
+		{"type", AutoAcceptRule{Types: []string{".pdf"}}, nil, pdf, true},
+		{"type, other", AutoAcceptRule{Types: []string{"image/*"}}, nil, pdf, false},
+		{"type skips dirs", AutoAcceptRule{Types: []string{".pdf"}}, nil, tree, true},
+		{"max size", AutoAcceptRule{MaxSize: 10}, nil, pdf, true},
+		{"max size, total over", AutoAcceptRule{MaxSize: 15}, nil, append(pdf, tree...), false},
+		{"all of them", AutoAcceptRule{FromKeys: []string{"bob-key"}, Groups: []string{"Build"}, Types: []string{".pdf"}, MaxSize: 100}, coworker, pdf, true},
+		{"all but one", AutoAcceptRule{FromKeys: []string{"bob-key"}, Groups: []string{"Build"}, Types: []string{".pdf"}, MaxSize: 5}, coworker, pdf, false},
+	} {
+		if got := tc.rule.matches("bob-key", tc.contact, tc.files); got != tc.want {
+			t.Errorf("%s: matches = %v, want %v", tc.name, got, tc.want)
+		}
+	}
+}
+
+// TestAutoAcceptByGroup has alice accept offers from her "Work" group and
+// checks a client can't pass its own answer off as a rule's.
+func TestAutoAcceptByGroup(t *testing.T) {
+	s := newTestServer(t)
+	alice := newTestClient(t, s, "alice")
+	bob := newTestClient(t, s, "bob")
+	carol := newTestClient(t, s, "carol")
+	s.DB.Create(&AutoAcceptRule{ID: uuid.New().String(), UserID: alice.mUser.User.ID, Groups: []string{"Work"}, CreatedAt: time.Now()})
+	s.DB.Create(&Contact{ID: uuid.New().String(), UserID: alice.mUser.User.ID, PublicKey: "bob-key", Groups: []string{"Work"}, CreatedAt: time.Now()})
+
+	files := []*FileInfo{{Name: "a.txt", Size: 1}}
+	if !autoAccepts(s, "alice-key", "bob-key", files) {
+		t.Error("offer from a Work contact not auto-accepted")
+	}
+	if autoAccepts(s, "alice-key", "carol-key", files) {
+		t.Error("offer from a stranger auto-accepted")
+	}
+
+	id := newTestTransaction(carol, []FileInfo{{Name: "a.txt", Size: 1}}, alice)
+	alice.send(TRANSACTION_SHARE_ACCEPT, map[string]any{"transaction_id": id, "accept": true, "auto": true})
+	if auto, _ := carol.expect(TRANSACTION_SHARE_ACCEPT).(map[string]any)["auto"].(bool); auto {
+		t.Error("client claimed auto in the accept notification")
+	}
+	if s.Transactions[id].Targets[0].AutoAccepted {
+		t.Error("client marked its own answer auto-accepted")
+	}
+
+	// The rule's answer is marked.
+	id = newTestTransaction(bob, []FileInfo{{Name: "a.txt", Size: 1}}, alice)
+	if auto, _ := bob.expect(TRANSACTION_SHARE_ACCEPT).(map[string]any)["auto"].(bool); !auto {
+		t.Error("rule's answer not marked auto")
+	}
+	if !s.Transactions[id].Targets[0].AutoAccepted {
+		t.Error("target not marked auto-accepted")
+	}
+}
+
+func TestDeleteAccountForgetsSender(t *testing.T) {
+	s := newTestServer(t)
+	alice := newTestUser(t, s, "alice")
+	bob := newTestUser(t, s, "bob")
+	rules := []AutoAcceptRule{
+		{ID: uuid.New().String(), UserID: alice.ID, FromKeys: []string{"bob-key"}},
+		{ID: uuid.New().String(), UserID: alice.ID, FromKeys: []string{"bob-key", "carol-key"}},
+		{ID: uuid.New().String(), UserID: alice.ID, FromKeys: []string{"carol-key"}},
+	}
+	s.DB.Create(&rules)
+	s.DB.Create(&Contact{ID: uuid.New().String(), UserID: alice.ID, PublicKey: "bob-key", CreatedAt: time.Now()})
+
+	if err := s.DeleteAccount(bob); err != nil {
+		t.Fatal(err)
+	}
+	var left []AutoAcceptRule
+	s.DB.Order("id").Find(&left)
+	if len(left) != 2 {
+		t.Fatalf("%d rules left, want 2: a rule only for bob must go, not match anyone", len(left))
+	}
+	for _, rule := range left {
+		if slices.Contains(rule.FromKeys, "bob-key") || len(rule.FromKeys) != 1 {
+			t.Errorf("rule %s from %v", rule.ID, rule.FromKeys)
+		}
+	}
+	var contacts int64
+	s.DB.Model(&Contact{}).Count(&contacts)
+	if contacts != 0 {
+		t.Errorf("%d contacts left", contacts)
+	}
+}
@@ -0,0 +1,202 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"gopherdrop/helper"
+	"sync"
+)
+
+// Backplane connects the nodes of a cluster. A node only holds the sockets
+// that were opened against it: messages for users connected elsewhere and
+// for transactions owned by another node travel over the backplane.
+type Backplane interface {
+	// Publish hands payload to every subscriber of topic on any node and
+	// says how many there were, 0 means nobody is listening.
+	Publish(topic string, payload []byte) (int, error)
+	// Subscribe calls handler, in publish order, for every payload on topic
+	// until the returned function is called.
+	Subscribe(topic string, handler func(payload []byte)) (func(), error)
+
+	// SetPresence announces (or updates) a user connected to p.Node.
+	SetPresence(p Presence) error
+	DelPresence(node string, publicKey string) error
+	// Presences lists the connected users of every live node.
+	Presences() ([]Presence, error)
+	// FindPresence looks up the node one user is connected to. With the
+	// user on several nodes any of them may come back.
+	FindPresence(publicKey string) (Presence, bool, error)
+
+	Close() error
+}
+
+// Presence is one connected user as seen by the whole cluster.
+type Presence struct {
+	Node         string      `json:"node"`
+	User         MinimalUser `json:"user"`
+	Discoverable bool        `json:"discoverable"`
+	ConnIDs      []string    `json:"conn_ids,omitempty"` // the user's sockets on Node
+}
+
+// Envelope is what nodes send each other: a WS message plus who it came from.
+// On a user topic Close asks for sockets to be closed instead. Auto marks a
+// TRANSACTION_SHARE_ACCEPT made by an auto-accept rule, clients can't set it.
+type Envelope struct {
+	Node  string       `json:"node"`
+	From  MinimalUser  `json:"from"`
+	Msg   WSMessage    `json:"msg"`
+	Auto  bool         `json:"auto,omitempty"`
+	Close *CloseNotice `json:"close,omitempty"`
+}
+
+// CloseNotice closes the socket ConnID of a user, or all of them when empty.
+type CloseNotice struct {
+	ConnID string `json:"conn_id,omitempty"`
+	Reason string `json:"reason"`
+}
+
+// Messages for a user go to the node holding their socket, messages about
+// a transaction to the node that owns it (where it was created).
+func userTopic(publicKey string) string { return "user:" + publicKey }
+func txTopic(id string) string          { return "tx:" + id }
+
+// NewBackplane picks the implementation from GDROP_BACKPLANE.
+func NewBackplane(sec helper.GoDropConfig) (Backplane, error) {
+	switch sec.Backplane {
+	case "", "memory":
+		return NewMemoryBackplane(), nil
+	case "redis":
+		return NewRedisBackplane(sec.RedisURL)
+	default:
+		return nil, fmt.Errorf("unknown backplane %q", sec.Backplane)
+	}
+}
+
+// publish wraps msg in an Envelope from this node and sends it on topic.
+func publish(s *Server, topic string, from MinimalUser, msg WSMessage) (int, error) {
+	return publishEnvelope(s, topic, Envelope{From: from, Msg: msg})
+}
+
+func publishEnvelope(s *Server, topic string, env Envelope) (int, error) {
+	env.Node = s.NodeID
+	payload, err := json.Marshal(env)
+	if err != nil {
+		return 0, err
+	}
+	return s.Backplane.Publish(topic, payload)
+}
+
+// MemoryBackplane is the single process backplane, it is the default and
+// what a lone node runs on.
+type MemoryBackplane struct {
+	mu       sync.RWMutex
+	nextID   int
+	subs     map[string]map[int]*memorySub
+	presence map[string]Presence // node + "/" + public key
+}
+
+type memorySub struct {
+	ch   chan []byte
+	done chan struct{}
+}
+
+func NewMemoryBackplane() *MemoryBackplane {
+	return &MemoryBackplane{
+		subs:     make(map[string]map[int]*memorySub),
+		presence: make(map[string]Presence),
+	}
+}
+
+func (m *MemoryBackplane) Publish(topic string, payload []byte) (int, error) {
+	m.mu.RLock()
+	subs := make([]*memorySub, 0, len(m.subs[topic]))
+	for _, sub := range m.subs[topic] {
+		subs = append(subs, sub)
+	}
+	m.mu.RUnlock()
+
+	for _, sub := range subs {
+		select {
+		case sub.ch <- payload:
+		case <-sub.done:
+		}
+	}
+	return len(subs), nil
+}
+
+func (m *MemoryBackplane) Subscribe(topic string, handler func(payload []byte)) (func(), error) {
+	sub := &memorySub{ch: make(chan []byte, 64), done: make(chan struct{})}
+
+	m.mu.Lock()
+	id := m.nextID
+	m.nextID++
+	if m.subs[topic] == nil {
+		m.subs[topic] = make(map[int]*memorySub)
+	}
+	m.subs[topic][id] = sub
+	m.mu.Unlock()
+
+	// One goroutine per subscription keeps the order of the payloads.
+	go func() {
+		for {
+			select {
+			case payload := <-sub.ch:
+				handler(payload)
+			case <-sub.done:
+				return
+			}
+		}
+	}()
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			m.mu.Lock()
+			delete(m.subs[topic], id)
+			if len(m.subs[topic]) == 0 {
+				delete(m.subs, topic)
+			}
+			m.mu.Unlock()
+			close(sub.done)
+		})
+	}, nil
+}
+
+func (m *MemoryBackplane) SetPresence(p Presence) error {
+	m.mu.Lock()
+	m.presence[p.Node+"/"+p.User.PublicKey] = p
+	m.mu.Unlock()
+	return nil
+}
+
+func (m *MemoryBackplane) DelPresence(node string, publicKey string) error {
+	m.mu.Lock()
+	delete(m.presence, node+"/"+publicKey)
+	m.mu.Unlock()
+	return nil
+}
+
+func (m *MemoryBackplane) Presences() ([]Presence, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	list := make([]Presence, 0, len(m.presence))
+	for _, p := range m.presence {
+		list = append(list, p)
+	}
+	return list, nil
+}
+
+func (m *MemoryBackplane) FindPresence(publicKey string) (Presence, bool, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	for _, p := range m.presence {
+		if p.User.PublicKey == publicKey {
+			return p, true, nil
+		}
+	}
+	return Presence{}, false, nil
+}
+
+func (m *MemoryBackplane) Close() error {
+	return nil
+}
@@ -0,0 +1,265 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+const redisPrefix = "gopherdrop:"
+
+// A node's presence hash expires unless it heartbeats, so users of a node
+// that died disappear from the share lists on their own.
+const presenceTTL = 30 * time.Second
+
+// RedisBackplane runs the cluster over Redis pub/sub. Presence lives in one
+// hash per node: gopherdrop:presence:<node> -> public key -> Presence, plus
+// gopherdrop:user:<public key> -> Presence to find a single user.
+type RedisBackplane struct {
+	client *redis.Client
+	pubsub *redis.PubSub
+
+	mu       sync.RWMutex
+	nextID   int
+	handlers map[string]map[int]func([]byte)
+	nodes    map[string]bool // nodes this process keeps presence for
+
+	done chan struct{}
+}
+
+func NewRedisBackplane(url string) (*RedisBackplane, error) {
+	opts, err := redis.ParseURL(url)
+	if err != nil {
+		return nil, err
+	}
+	client := redis.NewClient(opts)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := client.Ping(ctx).Err(); err != nil {
+		client.Close()
+		return nil, err
+	}
+
+	r := &RedisBackplane{
+		client:   client,
+		pubsub:   client.Subscribe(context.Background()),
+		handlers: make(map[string]map[int]func([]byte)),
+		nodes:    make(map[string]bool),
+		done:     make(chan struct{}),
+	}
+	go r.receive()
+	go r.heartbeat()
+	return r, nil
+}
+
+// receive dispatches incoming payloads. Handlers run one after the other so
+// the order of a topic is kept.
+func (r *RedisBackplane) receive() {
+	for msg := range r.pubsub.Channel() {
+		topic := strings.TrimPrefix(msg.Channel, redisPrefix)
+		r.mu.RLock()
+		handlers := make([]func([]byte), 0, len(r.handlers[topic]))
+		for _, h := range r.handlers[topic] {
+			handlers = append(handlers, h)
+		}
+		r.mu.RUnlock()
+
+		for _, h := range handlers {
+			h([]byte(msg.Payload))
+		}
+	}
+}
+
+func (r *RedisBackplane) heartbeat() {
+	ticker := time.NewTicker(presenceTTL / 3)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			r.mu.RLock()
+			nodes := make([]string, 0, len(r.nodes))
+			for node := range r.nodes {
+				nodes = append(nodes, node)
+			}
+			r.mu.RUnlock()
+			for _, node := range nodes {
+				r.refresh(node)
+			}
+		case <-r.done:
+			return
+		}
+	}
+}
+
+// refresh keeps the presence of node alive. The user keys are written
+// again too: one may have been taken over by another node the user left.
+func (r *RedisBackplane) refresh(node string) {
+	ctx := context.Background()
+	users, err := r.client.HGetAll(ctx, presenceKey(node)).Result()
+	if err != nil {
+		return
+	}
+	r.client.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.Expire(ctx, presenceKey(node), presenceTTL)
+		for publicKey, payload := range users {
+			pipe.Set(ctx, userPresenceKey(publicKey), payload, presenceTTL)
+		}
+		return nil
+	})
+}
+
+func presenceKey(node string) string {
+	return redisPrefix + "presence:" + node
+}
+
+func userPresenceKey(publicKey string) string {
+	return redisPrefix + "user:" + publicKey
+}
+
+func (r *RedisBackplane) Publish(topic string, payload []byte) (int, error) {
+	n, err := r.client.Publish(context.Background(), redisPrefix+topic, payload).Result()
+	return int(n), err
+}
+
+func (r *RedisBackplane) Subscribe(topic string, handler func(payload []byte)) (func(), error) {
+	r.mu.Lock()
+	id := r.nextID
+	r.nextID++
+	first := r.handlers[topic] == nil
+	if first {
+		r.handlers[topic] = make(map[int]func([]byte))
+	}
+	r.handlers[topic][id] = handler
+	r.mu.Unlock()
+
+	if first {
+		if err := r.pubsub.Subscribe(context.Background(), redisPrefix+topic); err != nil {
+			r.mu.Lock()
+			delete(r.handlers, topic)
+			r.mu.Unlock()
+			return nil, err
+		}
+	}
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			r.mu.Lock()
+			delete(r.handlers[topic], id)
+			last := len(r.handlers[topic]) == 0
+			if last {
+				delete(r.handlers, topic)
+			}
+			r.mu.Unlock()
+			if last {
+				r.pubsub.Unsubscribe(context.Background(), redisPrefix+topic)
+			}
+		})
+	}, nil
+}
+
+func (r *RedisBackplane) SetPresence(p Presence) error {
+	payload, err := json.Marshal(p)
+	if err != nil {
+		return err
+	}
+	r.mu.Lock()
+	r.nodes[p.Node] = true
+	r.mu.Unlock()
+
+	ctx := context.Background()
+	_, err = r.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.HSet(ctx, presenceKey(p.Node), p.User.PublicKey, payload)
+		pipe.Expire(ctx, presenceKey(p.Node), presenceTTL)
+		pipe.Set(ctx, userPresenceKey(p.User.PublicKey), payload, presenceTTL)
+		return nil
+	})
+	return err
+}
+
+func (r *RedisBackplane) DelPresence(node string, publicKey string) error {
+	if err := r.client.HDel(context.Background(), presenceKey(node), publicKey).Err(); err != nil {
+		return err
+	}
+	return r.delUserPresence(node, publicKey)
+}
+
+// delUserPresence drops the user key unless it points to another node.
+func (r *RedisBackplane) delUserPresence(node string, publicKey string) error {
+	ctx := context.Background()
+	key := userPresenceKey(publicKey)
+	err := r.client.Watch(ctx, func(tx *redis.Tx) error {
+		var p Presence
+		payload, err := tx.Get(ctx, key).Bytes()
+		if err == redis.Nil || (err == nil && json.Unmarshal(payload, &p) == nil && p.Node != node) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			pipe.Del(ctx, key)
+			return nil
+		})
+		return err
+	}, key)
+	if err == redis.TxFailedErr {
+		// Somebody wrote the key meanwhile, it's theirs now.
+		return nil
+	}
+	return err
+}
+
+func (r *RedisBackplane) FindPresence(publicKey string) (Presence, bool, error) {
+	payload, err := r.client.Get(context.Background(), userPresenceKey(publicKey)).Bytes()
+	if err == redis.Nil {
+		return Presence{}, false, nil
+	}
+	if err != nil {
+		return Presence{}, false, err
+	}
+	var p Presence
+	if err := json.Unmarshal(payload, &p); err != nil {
+		return Presence{}, false, err
+	}
+	return p, true, nil
+}
+
+func (r *RedisBackplane) Presences() ([]Presence, error) {
+	ctx := context.Background()
+	var list []Presence
+	iter := r.client.Scan(ctx, 0, presenceKey("*"), 100).Iterator()
+	for iter.Next(ctx) {
+		values, err := r.client.HVals(ctx, iter.Val()).Result()
+		if err != nil {
+			return nil, err
+		}
+		for _, v := range values {
+			var p Presence
+			if err := json.Unmarshal([]byte(v), &p); err == nil {
+				list = append(list, p)
+			}
+		}
+	}
+	return list, iter.Err()
+}
+
+// Close drops the presence of this process' nodes and disconnects.
+func (r *RedisBackplane) Close() error {
+	close(r.done)
+	r.mu.RLock()
+	for node := range r.nodes {
+		users, _ := r.client.HKeys(context.Background(), presenceKey(node)).Result()
+		for _, publicKey := range users {
+			r.delUserPresence(node, publicKey)
+		}
+		r.client.Del(context.Background(), presenceKey(node))
+	}
+	r.mu.RUnlock()
+	r.pubsub.Close()
+	return r.client.Close()
+}
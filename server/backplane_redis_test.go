@@ -0,0 +1,199 @@
+package server
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+)
+
+func newTestRedis(t *testing.T, mr *miniredis.Miniredis) *RedisBackplane {
+	t.Helper()
+	r, err := NewRedisBackplane("redis://" + mr.Addr() + "/0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { r.Close() })
+	return r
+}
+
+// eventually retries cond for a second, subscriptions and deliveries are
+// asynchronous.
+func eventually(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	for deadline := time.Now().Add(time.Second); time.Now().Before(deadline); time.Sleep(5 * time.Millisecond) {
+		if cond() {
+			return
+		}
+	}
+	t.Fatalf("timed out waiting for %s", what)
+}
+
+func TestRedisBackplanePubSub(t *testing.T) {
+	mr := miniredis.RunT(t)
+	a, b := newTestRedis(t, mr), newTestRedis(t, mr)
+
+	got := make(chan string, 10)
+	unsubscribe, err := b.Subscribe("tx:1", func(payload []byte) { got <- string(payload) })
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	eventually(t, "the subscription", func() bool {
+		n, err := a.Publish("tx:1", []byte("probe"))
+		return err == nil && n == 1
+	})
+	for _, payload := range []string{"one", "two", "three"} {
+		a.Publish("tx:1", []byte(payload))
+	}
+	var order []string
+	for len(order) < 3 {
+		select {
+		case p := <-got:
+			if p != "probe" {
+				order = append(order, p)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("got %v", order)
+		}
+	}
+	if order[0] != "one" || order[1] != "two" || order[2] != "three" {
+		t.Fatalf("out of order: %v", order)
+	}
+
+	unsubscribe()
+	eventually(t, "the unsubscription", func() bool {
+		n, _ := a.Publish("tx:1", []byte("late"))
+		return n == 0
+	})
+}
+
+func TestRedisBackplanePresence(t *testing.T) {
+	mr := miniredis.RunT(t)
+	a, b := newTestRedis(t, mr), newTestRedis(t, mr)
+	alice := MinimalUser{Username: "alice", PublicKey: "alice-key"}
+	bob := MinimalUser{Username: "bob", PublicKey: "bob-key"}
+
+	a.SetPresence(Presence{Node: "node-a", User: alice})
+	a.SetPresence(Presence{Node: "node-a", User: bob, Discoverable: true})
+	b.SetPresence(Presence{Node: "node-b", User: alice})
+
+	list, err := a.Presences()
+	if err != nil || len(list) != 3 {
+		t.Fatalf("got %d presences (%v), want 3", len(list), err)
+	}
+
+	steps := []struct {
+		name string
+		do   func()
+		user string
+		node string // "" for not found
+	}{
+		{"last announce wins", func() {}, "alice-key", "node-b"},
+		{"leaving node drops its key", func() { b.DelPresence("node-b", "alice-key") }, "alice-key", ""},
+		{"heartbeat restores the other node", func() { a.refresh("node-a") }, "alice-key", "node-a"},
+		{"other node's key is kept", func() { b.DelPresence("node-b", "bob-key") }, "bob-key", "node-a"},
+		{"dead node expires", func() { mr.FastForward(presenceTTL + time.Second) }, "bob-key", ""},
+	}
+	for _, step := range steps {
+		t.Run(step.name, func(t *testing.T) {
+			step.do()
+			p, ok, err := a.FindPresence(step.user)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if ok != (step.node != "") || p.Node != step.node {
+				t.Fatalf("got %q (found %v), want %q", p.Node, ok, step.node)
+			}
+		})
+	}
+	if list, _ := a.Presences(); len(list) != 0 {
+		t.Fatalf("%d presences left after expiry", len(list))
+	}
+}
+
+// Two nodes sharing a db and Redis, the way the README runs replicas.
+func TestRedisCluster(t *testing.T) {
+	mr := miniredis.RunT(t)
+	db := newTestDB(t)
+	a := newTestNode(t, db, newTestRedis(t, mr))
+	b := newTestNode(t, db, newTestRedis(t, mr))
+	alice := newTestUser(t, a, "alice")
+
+	t.Run("challenge spent once on any node", func(t *testing.T) {
+		challenge, err := a.IssueChallenge()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := b.ConsumeChallenge(challenge); err != nil {
+			t.Fatalf("first use: %v", err)
+		}
+		if err := a.ConsumeChallenge(challenge); !errors.Is(err, ErrChallengeInvalid) {
+			t.Fatalf("second use: got %v, want %v", err, ErrChallengeInvalid)
+		}
+	})
+
+	t.Run("token signed by one node verifies on the other", func(t *testing.T) {
+		pair, err := a.IssueTokenPair(alice)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := b.ParseAccessToken(pair.AccessToken); err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	t.Run("revocations reach the other node", func(t *testing.T) {
+		pair, err := b.IssueTokenPair(alice)
+		if err != nil {
+			t.Fatal(err)
+		}
+		claims, err := b.ParseAccessToken(pair.AccessToken)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// Wait for b's subscription before revoking on a.
+		eventually(t, "the revocation subscription", func() bool {
+			n, _ := a.Backplane.Publish(revocationTopic, []byte("{}"))
+			return n == 2
+		})
+		if err := a.RevokeJTI(claims["jti"].(string), time.Now().Add(time.Hour)); err != nil {
+			t.Fatal(err)
+		}
+		eventually(t, "the jti revocation", func() bool { return b.IsTokenRevoked(claims) })
+
+		other, err := b.IssueTokenPair(alice)
+		if err != nil {
+			t.Fatal(err)
+		}
+		otherClaims, _ := b.ParseAccessToken(other.AccessToken)
+		if err := a.RevokeAllSessions(alice); err != nil {
+			t.Fatal(err)
+		}
+		eventually(t, "the revoke-all", func() bool { return b.IsTokenRevoked(otherClaims) })
+	})
+
+	t.Run("account deletion reaches the other node", func(t *testing.T) {
+		bob := newTestUser(t, a, "bob")
+		pair, err := b.IssueTokenPair(bob)
+		if err != nil {
+			t.Fatal(err)
+		}
+		claims, _ := b.ParseAccessToken(pair.AccessToken)
+		if err := a.DeleteAccount(bob); err != nil {
+			t.Fatal(err)
+		}
+		eventually(t, "the deletion", func() bool { return b.IsTokenRevoked(claims) })
+	})
+
+	t.Run("user on another node is found", func(t *testing.T) {
+		a.Backplane.SetPresence(Presence{Node: a.NodeID, User: MinimalUser{Username: "alice", PublicKey: alice.PublicKey}})
+		if user := findUser(b, alice.PublicKey); user == nil || user.MinUser.Username != "alice" {
+			t.Fatalf("got %v", user)
+		}
+		if user := findUser(a, alice.PublicKey); user != nil {
+			t.Fatal("stale presence of a's own node taken for a remote user")
+		}
+	})
+}
@@ -0,0 +1,203 @@
+package server
+
+import (
+	"encoding/json"
+
+	"github.com/gofiber/websocket/v2"
+)
+
+// announce publishes the presence of a local user to the cluster.
+func announce(s *Server, mUser *ManagedUser) {
+	s.MUserMu.RLock()
+	p := Presence{Node: s.NodeID, User: mUser.MinUser, Discoverable: mUser.User.IsDiscoverable}
+	for _, other := range s.MUser {
+		if other.User.PublicKey == p.User.PublicKey {
+			p.ConnIDs = append(p.ConnIDs, other.ConnID)
+		}
+	}
+	s.MUserMu.RUnlock()
+	if err := s.Backplane.SetPresence(p); err != nil {
+		mUser.Log.Error("Failed to announce presence", "err", err)
+	}
+}
+
+// withdraw takes a user out of the cluster presence once their last socket
+// on this node is gone.
+func withdraw(s *Server, mUser *ManagedUser) {
+	if other := localUser(s, mUser.User.PublicKey); other != nil {
+		announce(s, other)
+		return
+	}
+	if err := s.Backplane.DelPresence(s.NodeID, mUser.User.PublicKey); err != nil {
+		mUser.Log.Error("Failed to withdraw presence", "err", err)
+	}
+}
+
+// subscribeUser delivers messages other nodes send to mUser to its socket.
+func subscribeUser(s *Server, mUser *ManagedUser) (func(), error) {
+	conn := mUser.Conn
+	return s.Backplane.Subscribe(userTopic(mUser.User.PublicKey), func(payload []byte) {
+		var env Envelope
+		if err := json.Unmarshal(payload, &env); err != nil {
+			return
+		}
+		if env.Close != nil {
+			if env.Close.ConnID == "" || env.Close.ConnID == mUser.ConnID {
+				closeWS(s, conn, websocket.ClosePolicyViolation, env.Close.Reason)
+			}
+			return
+		}
+		sendWS(s, conn, env.Msg.WSType, env.Msg.Data)
+	})
+}
+
+func localUser(s *Server, publicKey string) *ManagedUser {
+	s.MUserMu.RLock()
+	defer s.MUserMu.RUnlock()
+	for _, user := range s.MUser {
+		if user.User.PublicKey == publicKey {
+			return user
+		}
+	}
+	return nil
+}
+
+// remoteUser stands in for a user whose socket is on another node, sending
+// to it goes over the backplane.
+func remoteUser(s *Server, u MinimalUser, node string) *ManagedUser {
+	return &ManagedUser{
+		MinUser: u,
+		User:    User{Username: u.Username, PublicKey: u.PublicKey},
+		Log:     s.Log.With("user", u.Username, "public_key", u.PublicKey, "remote_node", node),
+	}
+}
+
+// findUser looks for a connected user on this node first, then in the
+// cluster presence.
+func findUser(s *Server, publicKey string) *ManagedUser {
+	if user := localUser(s, publicKey); user != nil {
+		return user
+	}
+	p, ok, err := s.Backplane.FindPresence(publicKey)
+	if err != nil {
+		s.Log.Error("Failed to read cluster presence", "err", err)
+		return nil
+	}
+	if !ok || p.Node == s.NodeID {
+		return nil
+	}
+	return remoteUser(s, p.User, p.Node)
+}
+
+// shareList is USER_SHARE_LIST: the discoverable users of this node plus
+// those of the other nodes.
+func shareList(s *Server) []*ManagedUser {
+	s.CachedUserMu.RLock()
+	list := make([]*ManagedUser, len(s.CachedUser))
+	copy(list, s.CachedUser)
+	s.CachedUserMu.RUnlock()
+
+	presences, err := s.Backplane.Presences()
+	if err != nil {
+		s.Log.Error("Failed to read cluster presence", "err", err)
+		return list
+	}
+	seen := make(map[string]bool, len(list))
+	for _, user := range list {
+		seen[user.MinUser.PublicKey] = true
+	}
+	for _, p := range presences {
+		if p.Node == s.NodeID || !p.Discoverable || seen[p.User.PublicKey] {
+			continue
+		}
+		seen[p.User.PublicKey] = true
+		list = append(list, &ManagedUser{MinUser: p.User})
+	}
+	return list
+}
+
+// transactionOf returns the transaction (text share, code room) a message is about,
+// "" when it is not about one.
+func transactionOf(msg WSMessage) string {
+	switch msg.WSType {
+	case INFO_TRANSACTION, DELETE_TRANSACTION:
+		id, _ := msg.Data.(string)
+		return id
+	case USER_SHARE_TARGET, FILE_SHARE_TARGET, TRANSACTION_SHARE_ACCEPT, START_TRANSACTION, TRANSACTION_HOST_RECV, CANCEL_TRANSFER, CODE_ROOM,
+		SHARE_LINK, SHARE_LINK_JOIN:
+		if data, ok := msg.Data.(map[string]any); ok {
+			id, _ := data["transaction_id"].(string)
+			return id
+		}
+	case SHARE_TEXT_ACCEPT:
+		// Text shares live on the sender's node like transactions.
+		if data, ok := msg.Data.(map[string]any); ok {
+			id, _ := data["share_id"].(string)
+			return id
+		}
+	case CODE_ROOM_JOIN, CODE_ROOM_PAKE, CODE_ROOM_CONFIRM:
+		// Rooms live on the node of their transaction.
+		if data, ok := msg.Data.(map[string]any); ok {
+			if nameplate, _ := data["nameplate"].(string); nameplate != "" {
+				return roomID(nameplate)
+			}
+		}
+	}
+	return ""
+}
+
+// forwardTransaction sends msg to the node owning transaction id. It
+// returns false when the transaction is local or nobody owns it, the
+// message is then handled (or rejected) here.
+func forwardTransaction(s *Server, mUser *ManagedUser, id string, msg WSMessage) bool {
+	return forwardEnvelope(s, mUser, id, Envelope{From: mUser.MinUser, Msg: msg})
+}
+
+// forwardEnvelope is forwardTransaction for an envelope with more than the
+// message in it.
+func forwardEnvelope(s *Server, mUser *ManagedUser, id string, env Envelope) bool {
+	msg := env.Msg
+	s.TransactionMu.RLock()
+	_, local := s.Transactions[id]
+	if _, ok := s.TextShares[id]; ok {
+		local = true
+	}
+	if _, ok := s.CodeRooms[id]; ok {
+		local = true
+	}
+	s.TransactionMu.RUnlock()
+	if local {
+		return false
+	}
+	n, err := publishEnvelope(s, txTopic(id), env)
+	if err != nil {
+		mUser.Log.Error("Backplane publish failed", "tx_id", id, "err", err)
+		return false
+	}
+	if n > 0 {
+		mUser.Log.Debug("Message forwarded to transaction owner", "tx_id", id, "type", msg.WSType.String())
+	}
+	return n > 0
+}
+
+// topicHeld says whether some node listens on topic, by probing it: nodes
+// ignore envelopes that aren't about anything. Errors count as held.
+func topicHeld(s *Server, topic string) bool {
+	n, err := publish(s, topic, MinimalUser{}, WSMessage{WSType: NONE})
+	return err != nil || n > 0
+}
+
+// handleEnvelope runs a message another node forwarded for one of our
+// transactions, on behalf of the user who sent it.
+func handleEnvelope(s *Server, payload []byte) {
+	var env Envelope
+	if err := json.Unmarshal(payload, &env); err != nil || transactionOf(env.Msg) == "" {
+		return
+	}
+	mUser := localUser(s, env.From.PublicKey)
+	if mUser == nil {
+		mUser = remoteUser(s, env.From, env.Node)
+	}
+	ws := &wsSession{s: s, mUser: mUser, auto: env.Auto}
+	ws.handle(env.Msg)
+}
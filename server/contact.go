@@ -0,0 +1,121 @@
+package server
+
+import (
+	"gopherdrop/helper"
+	"slices"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+// Contacts are the people a user saved and the groups they put them in.
+// The web client owns the list and replaces it as a whole on every change,
+// the server only keeps it for auto-accept rules to match on.
+const (
+	maxContacts      = 500
+	maxContactGroups = 50 // groups per contact, and per rule
+	maxGroupName     = 64
+)
+
+func validGroupName(name string) bool {
+	return name != "" && name == strings.TrimSpace(name) && utf8.RuneCountInString(name) <= maxGroupName
+}
+
+// SetupContacts is /api/v1/protected/contacts: read and replace the
+// caller's contacts.
+func SetupContacts(s *Server, group fiber.Router) {
+	group.Get("/contacts", func(c *fiber.Ctx) error {
+		claims, err := helper.GetJWT(c)
+		if err != nil {
+			return resp(c, cret(false, err.Error(), nil), fiber.StatusUnauthorized)
+		}
+
+		var user User
+		if err := s.DB.Where("public_key = ?", claims["public_key"]).First(&user).Error; err != nil {
+			return resp(c, cret(false, "User not found", nil), fiber.StatusBadRequest)
+		}
+
+		contacts := []Contact{}
+		if err := s.DB.Where("user_id = ?", user.ID).Order("created_at").Find(&contacts).Error; err != nil {
+			return resp(c, cret(false, "Failed to load contacts", nil), fiber.StatusInternalServerError)
+		}
+		return resp(c, cret(true, "contacts", contacts), fiber.StatusOK)
+	})
+
+	group.Put("/contacts", func(c *fiber.Ctx) error {
+		claims, err := helper.GetJWT(c)
+		if err != nil {
+			return resp(c, cret(false, err.Error(), nil), fiber.StatusUnauthorized)
+		}
+
+		var user User
+		if err := s.DB.Where("public_key = ?", claims["public_key"]).First(&user).Error; err != nil {
+			return resp(c, cret(false, "User not found", nil), fiber.StatusBadRequest)
+		}
+
+		var b struct {
+			Contacts []struct {
+				PublicKey string   `json:"public_key"`
+				Username  string   `json:"username"`
+				Groups    []string `json:"groups"`
+			} `json:"contacts"`
+		}
+		if err := c.BodyParser(&b); err != nil {
+			return resp(c, cret(false, "Invalid body", nil), fiber.StatusBadRequest)
+		}
+		if len(b.Contacts) > maxContacts {
+			return resp(c, cret(false, "Too many contacts", nil), fiber.StatusBadRequest)
+		}
+
+		now := time.Now()
+		contacts := make([]Contact, 0, len(b.Contacts))
+		seen := make(map[string]bool)
+		for i, in := range b.Contacts {
+			key := in.PublicKey
+			if key == "" || len(key) > 255 || key == user.PublicKey || isGuestKey(key) || seen[key] {
+				return resp(c, cret(false, "Invalid public key in contacts", nil), fiber.StatusBadRequest)
+			}
+			seen[key] = true
+			if len(in.Groups) > maxContactGroups || utf8.RuneCountInString(in.Username) > 255 {
+				return resp(c, cret(false, "Invalid contact", nil), fiber.StatusBadRequest)
+			}
+			groups := []string{}
+			for _, g := range in.Groups {
+				if !validGroupName(g) {
+					return resp(c, cret(false, "Invalid group name", nil), fiber.StatusBadRequest)
+				}
+				if !slices.Contains(groups, g) {
+					groups = append(groups, g)
+				}
+			}
+			contacts = append(contacts, Contact{
+				ID:        uuid.New().String(),
+				UserID:    user.ID,
+				PublicKey: key,
+				Username:  in.Username,
+				Groups:    groups,
+				CreatedAt: now.Add(time.Duration(i)), // keeps the client's order
+			})
+		}
+
+		err = s.DB.Transaction(func(tx *gorm.DB) error {
+			if err := tx.Where("user_id = ?", user.ID).Delete(&Contact{}).Error; err != nil {
+				return err
+			}
+			if len(contacts) == 0 {
+				return nil
+			}
+			return tx.Create(&contacts).Error
+		})
+		if err != nil {
+			s.Log.Error("Failed to save contacts", "user", user.Username, "err", err)
+			return resp(c, cret(false, "Failed to save contacts", nil), fiber.StatusInternalServerError)
+		}
+		s.Log.Info("Contacts saved", "user", user.Username, "contacts", len(contacts))
+		return resp(c, cret(true, "contacts", contacts), fiber.StatusOK)
+	})
+}
@@ -0,0 +1,88 @@
+package server
+
+import (
+	"net"
+	"net/url"
+	"strings"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// CORSPolicy decides which browser origins may talk to the server. The same
+// policy is used for normal HTTP requests and for WebSocket upgrades.
+type CORSPolicy struct {
+	AllowAll   bool
+	Exact      map[string]bool
+	Subdomains []string // "scheme://.suffix[:port]" from "scheme://*.suffix[:port]"
+	LanMode    bool
+}
+
+func NewCORSPolicy(origins []string, lanMode bool) *CORSPolicy {
+	p := &CORSPolicy{
+		Exact:   make(map[string]bool),
+		LanMode: lanMode,
+	}
+	for _, origin := range origins {
+		origin = strings.ToLower(strings.TrimRight(strings.TrimSpace(origin), "/"))
+		switch {
+		case origin == "*":
+			p.AllowAll = true
+		case strings.Contains(origin, "://*."):
+			p.Subdomains = append(p.Subdomains, strings.Replace(origin, "://*.", "://.", 1))
+		case origin != "":
+			p.Exact[origin] = true
+		}
+	}
+	return p
+}
+
+// Allowed reports whether origin may access the server when it was reached
+// through host (the request Host header, with or without port).
+func (p *CORSPolicy) Allowed(origin string, host string) bool {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	origin = strings.ToLower(strings.TrimRight(origin, "/"))
+	if origin == "" {
+		return false
+	}
+	if p.AllowAll || p.Exact[origin] {
+		return true
+	}
+
+	u, err := url.Parse(origin)
+	if err != nil || u.Host == "" {
+		return false
+	}
+
+	// The suffix is matched on the host name, a port in the pattern has to
+	// match too, without one any port goes.
+	hostname := u.Hostname()
+	for _, sub := range p.Subdomains {
+		scheme, suffix, _ := strings.Cut(sub, "://")
+		port := ""
+		if h, pt, err := net.SplitHostPort(suffix); err == nil {
+			suffix, port = h, pt
+		}
+		if u.Scheme == scheme && strings.HasSuffix(hostname, suffix) && len(hostname) > len(suffix) && (port == "" || u.Port() == port) {
+			return true
+		}
+	}
+
+	if p.LanMode && host != "" && strings.EqualFold(u.Hostname(), strings.Trim(host, "[]")) {
+		return true
+	}
+	return false
+}
+
+// OriginGate rejects WebSocket upgrades from browser origins the policy does
+// not allow. Non-browser clients send no Origin and are let through.
+func OriginGate(p *CORSPolicy) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		origin := c.Get(fiber.HeaderOrigin)
+		if origin != "" && !p.Allowed(origin, c.Hostname()) {
+			return fiber.ErrForbidden
+		}
+		return c.Next()
+	}
+}
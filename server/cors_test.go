@@ -0,0 +1,42 @@
+package server
+
+import (
+	"gopherdrop/helper"
+	"testing"
+)
+
+func TestCORSAllowed(t *testing.T) {
+	p := NewCORSPolicy([]string{"https://app.example.org", "https://*.example.com", "http://*.lan.test:8080"}, true)
+	for _, tc := range []struct {
+		origin, host string
+		want         bool
+	}{
+		{"https://app.example.org", "", true},
+		{"https://app.example.org/", "", true},
+		{"http://app.example.org", "", false},
+		{"https://a.example.com", "", true},
+		{"https://a.example.com:8443", "", true},
+		{"https://a.b.example.com", "", true},
+		{"https://example.com", "", false},
+		{"https://evilexample.com", "", false},
+		{"https://a.example.com.evil.org", "", false},
+		{"http://box.lan.test:8080", "", true},
+		{"http://box.lan.test:9090", "", false},
+		{"http://192.168.1.5:3000", "192.168.1.5:8080", true},
+		{"http://192.168.1.6:3000", "192.168.1.5:8080", false},
+		{"", "", false},
+	} {
+		if got := p.Allowed(tc.origin, tc.host); got != tc.want {
+			t.Errorf("Allowed(%q, %q) = %v, want %v", tc.origin, tc.host, got, tc.want)
+		}
+	}
+}
+
+func TestInitServerRefusesOpenCredentials(t *testing.T) {
+	sec := helper.GetConfigFromEnv()
+	sec.CORSOrigins = []string{"*"}
+	sec.CORSCredentials = true
+	if _, err := InitServer(sec); err == nil {
+		t.Fatal(`"*" with credentials accepted`)
+	}
+}
@@ -1,33 +1,183 @@
 package server
 
 import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"gorm.io/driver/mysql"
+	"gorm.io/driver/postgres"
 	"gorm.io/driver/sqlite"
 	"gorm.io/gorm"
-	"log"
-	"time"
 )
 
 type User struct {
 	ID             int       `gorm:"primaryKey" json:"id"`
-	Username       string    `gorm:"column:username" json:"username"`
-	PublicKey      string    `gorm:"column:public_key" json:"public_key"`
+	Username       string    `gorm:"column:username;size:255;uniqueIndex" json:"username"`
+	PublicKey      string    `gorm:"column:public_key;size:255;uniqueIndex" json:"public_key"`
 	IsDiscoverable bool      `gorm:"default:true;column:discoverable" json:"is_discoverable"`
-	CreatedAt      time.Time `gorm:"column:user_created_at;type:datetime"`
+	CreatedAt      time.Time `gorm:"column:user_created_at"`
+	// Access tokens issued at or before this time are rejected (revoke all sessions).
+	TokensRevokedAt *time.Time `gorm:"column:tokens_revoked_at" json:"-"`
+	IsAdmin         bool       `gorm:"column:is_admin;default:false" json:"is_admin"`
 }
 
-func OpenDB(dbFile string) (*gorm.DB, error) {
-	db, err := gorm.Open(sqlite.Open(dbFile), &gorm.Config{})
-	if err != nil {
-		return nil, err
-	}
-	return db, nil
+// RefreshToken is a long lived, single use token. Using one revokes it and
+// issues the next token in the same family; reusing a revoked one revokes the
+// whole family since it means the token leaked.
+type RefreshToken struct {
+	ID        int       `gorm:"primaryKey" json:"id"`
+	UserID    int       `gorm:"column:user_id;index" json:"user_id"`
+	TokenHash string    `gorm:"column:token_hash;size:64;uniqueIndex" json:"-"`
+	Family    string    `gorm:"column:family;size:36;index" json:"family"`
+	Revoked   bool      `gorm:"column:revoked;default:false" json:"revoked"`
+	ExpiresAt time.Time `gorm:"column:expires_at" json:"expires_at"`
+	CreatedAt time.Time `gorm:"column:created_at" json:"created_at"`
+}
+
+// RevokedToken is an access token `jti` on the deny-list, kept until the
+// token would have expired anyway.
+type RevokedToken struct {
+	JTI       string    `gorm:"primaryKey;column:jti;size:64" json:"jti"`
+	ExpiresAt time.Time `gorm:"column:expires_at" json:"expires_at"`
+}
+
+// Challenge is an outstanding `/challenge`. It lives in the db so that it
+// can be spent on any node, once.
+type Challenge struct {
+	Challenge string    `gorm:"primaryKey;column:challenge;size:64" json:"challenge"`
+	ExpiresAt time.Time `gorm:"column:expires_at;index" json:"expires_at"`
+}
+
+// JWTKey is a JWT signing key. Only the newest un-retired key signs, the
+// rest are kept around to verify tokens they signed earlier.
+type JWTKey struct {
+	KID        string     `gorm:"primaryKey;column:kid;size:36" json:"kid"`
+	Alg        string     `gorm:"column:alg" json:"alg"`
+	PrivateKey string     `gorm:"column:private_key" json:"-"`
+	CreatedAt  time.Time  `gorm:"column:created_at" json:"created_at"`
+	RetiredAt  *time.Time `gorm:"column:retired_at" json:"retired_at"`
+}
+
+// RecoveryCode is a one-time code handed out at registration that can bind
+// a new public key to the account when the old private key is lost.
+type RecoveryCode struct {
+	ID        int        `gorm:"primaryKey" json:"id"`
+	UserID    int        `gorm:"column:user_id;index" json:"user_id"`
+	CodeHash  string     `gorm:"column:code_hash;size:64;index" json:"-"`
+	UsedAt    *time.Time `gorm:"column:used_at" json:"used_at"`
+	CreatedAt time.Time  `gorm:"column:created_at" json:"created_at"`
+}
+
+// KeyChange is the audit trail of every public key swap on an account.
+type KeyChange struct {
+	ID           int       `gorm:"primaryKey" json:"id"`
+	UserID       int       `gorm:"column:user_id;index" json:"user_id"`
+	OldPublicKey string    `gorm:"column:old_public_key" json:"old_public_key"`
+	NewPublicKey string    `gorm:"column:new_public_key" json:"new_public_key"`
+	Method       string    `gorm:"column:method" json:"method"` // "rotate" or "recovery"
+	IP           string    `gorm:"column:ip" json:"ip"`
+	CreatedAt    time.Time `gorm:"column:created_at" json:"created_at"`
+}
+
+// BannedKey is a public key that may not register, log in, rotate or recover.
+type BannedKey struct {
+	PublicKey string    `gorm:"primaryKey;column:public_key;size:255" json:"public_key"`
+	Reason    string    `gorm:"column:reason" json:"reason"`
+	CreatedAt time.Time `gorm:"column:created_at" json:"created_at"`
+}
+
+// PendingOffer is a transfer offer to a user who was offline when it was
+// made. It is pushed to them each time they connect until they answer, the
+// transaction goes away or it expires.
+type PendingOffer struct {
+	ID            int       `gorm:"primaryKey" json:"id"`
+	TransactionID string    `gorm:"column:transaction_id;size:36;index" json:"transaction_id"`
+	SenderKey     string    `gorm:"column:sender_key;size:255;index" json:"sender_key"`
+	RecipientKey  string    `gorm:"column:recipient_key;size:255;index" json:"recipient_key"`
+	Payload       string    `gorm:"column:payload" json:"-"` // TRANSACTION_SHARE_ACCEPT data, JSON
+	CreatedAt     time.Time `gorm:"column:created_at" json:"created_at"`
+	ExpiresAt     time.Time `gorm:"column:expires_at;index" json:"expires_at"`
+}
+
+// ShareLink lets people without an account receive a transaction. The link
+// itself is a signed token naming the row, which tracks uses, the optional
+// password and revocation.
+type ShareLink struct {
+	ID            string     `gorm:"primaryKey;column:id;size:36" json:"id"`
+	TransactionID string     `gorm:"column:transaction_id;size:36;index" json:"transaction_id"`
+	OwnerKey      string     `gorm:"column:owner_key;size:255;index" json:"owner_key"`
+	MaxUses       int        `gorm:"column:max_uses" json:"max_uses"` // 0 for no limit
+	Uses          int        `gorm:"column:uses" json:"uses"`
+	PasswordHash  string     `gorm:"column:password_hash" json:"-"`
+	RevokedAt     *time.Time `gorm:"column:revoked_at" json:"revoked_at,omitempty"`
+	CreatedAt     time.Time  `gorm:"column:created_at" json:"created_at"`
+	ExpiresAt     time.Time  `gorm:"column:expires_at;index" json:"expires_at"`
+}
+
+// FileRequest is a REQUEST_FILES ask: the requester wants files from the
+// target, who answers with a transaction linked to it or declines.
+type FileRequest struct {
+	ID            string    `gorm:"primaryKey;column:id;size:36" json:"id"`
+	RequesterKey  string    `gorm:"column:requester_key;size:255;index" json:"requester_key"`
+	RequesterName string    `gorm:"column:requester_name" json:"requester_name"`
+	TargetKey     string    `gorm:"column:target_key;size:255;index" json:"target_key"`
+	TargetName    string    `gorm:"column:target_name" json:"target_name"`
+	Note          string    `gorm:"column:note" json:"note"`
+	Types         []string  `gorm:"column:types;serializer:json" json:"types,omitempty"` // MIME types ("image/*") or extensions (".pdf")
+	MaxSize       int64     `gorm:"column:max_size" json:"max_size,omitempty"`           // total bytes, 0 for no limit
+	Status        string    `gorm:"column:status;size:16;index" json:"status"`
+	TransactionID string    `gorm:"column:transaction_id;size:36" json:"transaction_id,omitempty"`
+	Reason        string    `gorm:"column:reason" json:"reason,omitempty"`
+	CreatedAt     time.Time `gorm:"column:created_at" json:"created_at"`
+	UpdatedAt     time.Time `gorm:"column:updated_at" json:"updated_at"`
+	ExpiresAt     time.Time `gorm:"column:expires_at;index" json:"expires_at"`
+}
+
+// AutoAcceptRule answers offers for its user when they match, see
+// autoaccept.go. Every condition that is set has to hold.
+type AutoAcceptRule struct {
+	ID        string    `gorm:"primaryKey;column:id;size:36" json:"id"`
+	UserID    int       `gorm:"column:user_id;index" json:"-"`
+	FromKeys  []string  `gorm:"column:from_keys;serializer:json" json:"from,omitempty"`     // sender public keys, empty for any registered user
+	Contacts  bool      `gorm:"column:contacts" json:"contacts,omitempty"`                  // sender must be one of the user's contacts
+	Groups    []string  `gorm:"column:group_names;serializer:json" json:"groups,omitempty"` // sender must be a contact in one of these groups
+	Types     []string  `gorm:"column:types;serializer:json" json:"types,omitempty"`        // like FileRequest.Types
+	MaxSize   int64     `gorm:"column:max_size" json:"max_size,omitempty"`                  // total bytes, 0 for no limit
+	CreatedAt time.Time `gorm:"column:created_at" json:"created_at"`
+}
+
+// Contact is someone a user saved, with the names of the groups they put
+// them in. The web client keeps its groups here so auto-accept rules can
+// match on them.
+type Contact struct {
+	ID        string    `gorm:"primaryKey;column:id;size:36" json:"-"`
+	UserID    int       `gorm:"column:user_id;uniqueIndex:idx_contact" json:"-"`
+	PublicKey string    `gorm:"column:public_key;size:255;uniqueIndex:idx_contact" json:"public_key"`
+	Username  string    `gorm:"column:username" json:"username"`
+	Groups    []string  `gorm:"column:group_names;serializer:json" json:"groups"`
+	CreatedAt time.Time `gorm:"column:created_at" json:"created_at"`
 }
 
-func MigrateDB(db *gorm.DB) error {
-	err := db.AutoMigrate(&User{})
-	if err != nil {
-		log.Fatal("failed to migrate database:", err)
-		return err
+// OpenDB connects to the configured database. SQLite takes a file path
+// (its directory is created if needed), PostgreSQL and MySQL take a DSN.
+func OpenDB(driver string, dsn string) (*gorm.DB, error) {
+	var dialector gorm.Dialector
+	switch driver {
+	case "", "sqlite":
+		if dir := filepath.Dir(dsn); dir != "" {
+			if err := os.MkdirAll(dir, 0o755); err != nil {
+				return nil, err
+			}
+		}
+		dialector = sqlite.Open(dsn)
+	case "postgres":
+		dialector = postgres.Open(dsn)
+	case "mysql":
+		dialector = mysql.Open(dsn)
+	default:
+		return nil, fmt.Errorf("unknown database driver %q", driver)
 	}
-	return nil
+	return gorm.Open(dialector, &gorm.Config{})
 }
@@ -0,0 +1,173 @@
+package server
+
+import (
+	"gopherdrop/helper"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/google/uuid"
+)
+
+// Guests have no account: they get a made up identity and an access token
+// with typ "guest" that is only good for the WebSocket. Nothing about them
+// is stored, the session ends with the token.
+const guestKeyPrefix = "guest:"
+
+// guestTypes are the WS messages a guest may send: sending and receiving
+// files and text, code rooms and share links. Everything that writes a row
+// (profile, discoverability, file requests, minting links) is left out.
+var guestTypes = map[WSType]bool{
+	NONE:                     true,
+	START_SHARING:            true,
+	USER_SHARE_LIST:          true,
+	NEW_TRANSACTION:          true,
+	DELETE_TRANSACTION:       true,
+	INFO_TRANSACTION:         true,
+	USER_SHARE_TARGET:        true,
+	FILE_SHARE_TARGET:        true,
+	START_TRANSACTION:        true,
+	TRANSACTION_SHARE_ACCEPT: true,
+	WEBRTC_SIGNAL:            true,
+	USER_INFO:                true,
+	TRANSACTION_HOST_RECV:    true,
+	REAUTH:                   true,
+	SHARE_TEXT:               true,
+	SHARE_TEXT_ACCEPT:        true,
+	CANCEL_TRANSFER:          true,
+	CODE_ROOM:                true,
+	CODE_ROOM_JOIN:           true,
+	CODE_ROOM_PAKE:           true,
+	CODE_ROOM_CONFIRM:        true,
+	SHARE_LINK_JOIN:          true,
+}
+
+// linkGuestTypes are the WS messages a guest that came through a share
+// link may send: only what receiving that one transaction takes. Those
+// naming a transaction must name the link's, see linkGuestAllowed.
+var linkGuestTypes = map[WSType]bool{
+	NONE:                     true,
+	REAUTH:                   true,
+	SHARE_LINK_JOIN:          true,
+	TRANSACTION_SHARE_ACCEPT: true,
+	WEBRTC_SIGNAL:            true,
+	CANCEL_TRANSFER:          true,
+}
+
+// linkGuestAllowed says whether a guest let into transaction txID by a
+// share link may send msg.
+func linkGuestAllowed(msg WSMessage, txID string) bool {
+	if !linkGuestTypes[msg.WSType] {
+		return false
+	}
+	if msg.WSType == NONE || msg.WSType == REAUTH {
+		return true
+	}
+	data, _ := msg.Data.(map[string]any)
+	id, _ := data["transaction_id"].(string)
+	return id == txID
+}
+
+// isGuestKey tells guest identities apart from registered public keys.
+func isGuestKey(publicKey string) bool {
+	return strings.HasPrefix(publicKey, guestKeyPrefix)
+}
+
+// issueGuestToken mints a guest identity named name. extra claims are
+// added to the token, a share link puts the transaction it joins there.
+func (s *Server) issueGuestToken(name string, extra jwt.MapClaims) (string, MinimalUser, time.Time, error) {
+	user := MinimalUser{Username: name, PublicKey: guestKeyPrefix + uuid.New().String()}
+	now := time.Now()
+	exp := now.Add(s.Config.GuestTTL)
+	claims := jwt.MapClaims{
+		"typ":        "guest",
+		"username":   user.Username,
+		"public_key": user.PublicKey,
+		"jti":        uuid.New().String(),
+		"iat":        issuedAt(now),
+		"exp":        exp.Unix(),
+	}
+	for k, v := range extra {
+		claims[k] = v
+	}
+	token, err := s.Keys.Sign(claims)
+	return token, user, exp, err
+}
+
+// guestName is what a guest is called when they didn't pick a name.
+func guestName() string {
+	return "Guest-" + strings.ToUpper(uuid.New().String()[:4])
+}
+
+// guestUsername checks the name a guest asked for, an empty one gets a
+// made up name.
+func guestUsername(name string) (string, error) {
+	if name == "" {
+		return guestName(), nil
+	}
+	return helper.ValidateUsername(name)
+}
+
+// maxTargets is how many targets the user with publicKey may send to at
+// once, guests get the tighter GuestMaxTargets.
+func maxTargets(s *Server, publicKey string) int {
+	if isGuestKey(publicKey) {
+		return min(s.Config.GuestMaxTargets, s.Config.MaxTargets)
+	}
+	return s.Config.MaxTargets
+}
+
+// maxFiles is how many files the user with publicKey may put in one
+// transaction.
+func maxFiles(s *Server, publicKey string) int {
+	if isGuestKey(publicKey) {
+		return min(s.Config.GuestMaxFiles, s.Config.MaxFiles)
+	}
+	return s.Config.MaxFiles
+}
+
+// dropGuest removes what a guest left behind once its last socket is gone:
+// its transactions, text shares and code rooms, and its place as a target
+// in everyone else's. Nothing was written to the DB.
+func dropGuest(s *Server, mUser *ManagedUser) {
+	if localUser(s, mUser.MinUser.PublicKey) != nil {
+		return // reconnected, the new socket keeps the session
+	}
+	dropTransactions(s, mUser.MinUser.PublicKey)
+	mUser.Log.Info("Guest session cleaned up")
+}
+
+// SetupGuestLogin is POST /api/v1/guest: start a guest session without
+// registering.
+func SetupGuestLogin(s *Server, group fiber.Router) {
+	group.Post("/guest", LimitByIP(s.IPLimiter), func(c *fiber.Ctx) error {
+		if !s.Config.GuestsEnabled {
+			return resp(c, cret(false, "Guest sessions are disabled", nil), fiber.StatusForbidden)
+		}
+		var body struct {
+			Username string `json:"username"`
+		}
+		if len(c.Body()) > 0 {
+			if err := c.BodyParser(&body); err != nil {
+				return resp(c, cret(false, "Invalid body", nil), fiber.StatusBadRequest)
+			}
+		}
+		name, err := guestUsername(body.Username)
+		if err != nil {
+			return resp(c, cret(false, err.Error(), nil), fiber.StatusBadRequest)
+		}
+
+		token, user, exp, err := s.issueGuestToken(name, nil)
+		if err != nil {
+			s.Log.Error("Failed to issue guest token", "err", err)
+			return resp(c, cret(false, "Failed to start guest session", nil), fiber.StatusInternalServerError)
+		}
+		s.Log.Info("Guest session started", "guest", user.PublicKey, "ip", c.IP())
+		return resp(c, cret(true, "guest", fiber.Map{
+			"access_token": token,
+			"expires_at":   exp.Unix(),
+			"user":         user,
+		}), fiber.StatusOK)
+	})
+}
@@ -0,0 +1,121 @@
+package server
+
+import (
+	"encoding/json"
+	"time"
+)
+
+// offlineUser stands in for a registered user who isn't connected anywhere.
+// Messages sent to it are lost, what they must see goes to the inbox.
+func offlineUser(s *Server, publicKey string) *ManagedUser {
+	var user User
+	if err := s.DB.Where("public_key = ?", publicKey).First(&user).Error; err != nil {
+		return nil
+	}
+	if s.IsBanned(publicKey) {
+		return nil
+	}
+	return &ManagedUser{
+		MinUser: MinimalUser{user.Username, user.PublicKey},
+		User:    user,
+		Log:     s.Log.With("user", user.Username, "public_key", user.PublicKey, "offline", true),
+	}
+}
+
+// queueOffer stores the offer of tx for an offline target. payload is the
+// TRANSACTION_SHARE_ACCEPT data online targets got.
+func queueOffer(s *Server, tx *Transaction, target *ManagedUser, payload any) error {
+	raw, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	return s.DB.Create(&PendingOffer{
+		TransactionID: tx.ID,
+		SenderKey:     tx.Sender.MinUser.PublicKey,
+		RecipientKey:  target.MinUser.PublicKey,
+		Payload:       string(raw),
+		ExpiresAt:     time.Now().Add(s.Config.InboxTTL),
+	}).Error
+}
+
+// deliverInbox pushes the offers waiting for a user who just connected and
+// tells their senders the recipient is back, then the open file requests.
+// Offers their auto-accept rules take are answered instead of pushed.
+// Offers whose transaction no node holds anymore are dropped unseen.
+func deliverInbox(s *Server, mUser *ManagedUser) {
+	var offers []PendingOffer
+	err := s.DB.Where("recipient_key = ? AND expires_at > ?", mUser.MinUser.PublicKey, time.Now()).
+		Order("created_at").Find(&offers).Error
+	if err != nil {
+		mUser.Log.Error("Failed to load inbox", "err", err)
+		return
+	}
+	delivered := 0
+	for _, offer := range offers {
+		if !transactionLive(s, offer.TransactionID) {
+			dropOffers(s, offer.TransactionID, "")
+			continue
+		}
+		delivered++
+
+		var payload struct {
+			Transaction struct {
+				Files []*FileInfo `json:"files"`
+			} `json:"transaction"`
+		}
+		_ = json.Unmarshal([]byte(offer.Payload), &payload)
+		auto := autoAccepts(s, mUser.MinUser.PublicKey, offer.SenderKey, payload.Transaction.Files)
+		if !auto {
+			sendUser(s, mUser, TRANSACTION_SHARE_ACCEPT, json.RawMessage(offer.Payload))
+		}
+		if sender := findUser(s, offer.SenderKey); sender != nil {
+			sendUser(s, sender, TRANSACTION_SHARE_ACCEPT, struct {
+				Type          string `json:"type"`
+				TransactionID string `json:"transaction_id"`
+				Username      string `json:"username"`
+				PublicKey     string `json:"public_key"`
+			}{"recipient_online", offer.TransactionID, mUser.MinUser.Username, mUser.MinUser.PublicKey})
+		}
+		if auto {
+			acceptFor(s, mUser, offer.TransactionID)
+		}
+	}
+	if len(offers) > 0 {
+		mUser.Log.Info("Inbox delivered", "offers", delivered, "dropped", len(offers)-delivered)
+	}
+	deliverRequests(s, mUser)
+}
+
+// dropOffers forgets the queued offers of a transaction, or only the one
+// for recipient when it is set.
+func dropOffers(s *Server, txID string, recipient string) {
+	query := s.DB.Where("transaction_id = ?", txID)
+	if recipient != "" {
+		query = query.Where("recipient_key = ?", recipient)
+	}
+	if err := query.Delete(&PendingOffer{}).Error; err != nil {
+		s.Log.Error("Failed to drop pending offers", "tx_id", txID, "err", err)
+	}
+}
+
+// liveSender points tx.Sender at the sender's current socket when the one
+// it was created on is gone. Offline targets may answer long after the
+// sender reconnected. Closed conns are pooled and handed to new sockets,
+// so the conn alone doesn't tell.
+func liveSender(s *Server, tx *Transaction) {
+	s.MUserMu.RLock()
+	connected := tx.Sender.Conn != nil && s.MUser[tx.Sender.Conn] == tx.Sender
+	s.MUserMu.RUnlock()
+	if connected {
+		return
+	}
+	if sender := findUser(s, tx.Sender.MinUser.PublicKey); sender != nil {
+		tx.Sender = sender
+	}
+}
+
+func purgeOffers(s *Server) {
+	if err := s.DB.Where("expires_at <= ?", time.Now()).Delete(&PendingOffer{}).Error; err != nil {
+		s.Log.Error("Failed to purge pending offers", "err", err)
+	}
+}
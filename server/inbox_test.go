@@ -0,0 +1,47 @@
+package server
+
+import "testing"
+
+func TestDeliverInboxDropsDeadOffers(t *testing.T) {
+	s := newTestServer(t)
+	alice := newTestClient(t, s, "alice")
+	bob := newTestClient(t, s, "bob")
+	bob.offline()
+	files := []FileInfo{{Name: "a.txt", Size: 1}}
+	dead := newTestTransaction(alice, files, bob)
+	live := newTestTransaction(alice, files, bob)
+
+	var queued int64
+	s.DB.Model(&PendingOffer{}).Count(&queued)
+	if queued != 2 {
+		t.Fatalf("%d offers queued, want 2", queued)
+	}
+
+	// The node holding dead went away without cleaning up.
+	s.TransactionMu.Lock()
+	s.Transactions[dead].Unsubscribe()
+	delete(s.Transactions, dead)
+	s.TransactionMu.Unlock()
+
+	// Messages to offline users are lost, the inbox has what they see.
+	bob.discard()
+	alice.discard()
+	bob.online()
+	deliverInbox(s, bob.mUser)
+
+	offer := bob.expect(TRANSACTION_SHARE_ACCEPT)
+	if tx, _ := offer.(map[string]any)["transaction"]; field(tx, "id") != live {
+		t.Fatalf("delivered %v, want %s", offer, live)
+	}
+	bob.expectNone(TRANSACTION_SHARE_ACCEPT)
+	if notice := alice.expect(TRANSACTION_SHARE_ACCEPT); field(notice, "type") != "recipient_online" || field(notice, "transaction_id") != live {
+		t.Fatalf("sender got %v", notice)
+	}
+	alice.expectNone(TRANSACTION_SHARE_ACCEPT)
+
+	var left []PendingOffer
+	s.DB.Find(&left)
+	if len(left) != 1 || left[0].TransactionID != live {
+		t.Fatalf("offers left = %+v", left)
+	}
+}
@@ -0,0 +1,321 @@
+package server
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"gopherdrop/helper"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+const (
+	AlgEdDSA = "EdDSA"
+	AlgES256 = "ES256"
+	AlgHS256 = "HS256"
+)
+
+type ringKey struct {
+	kid     string
+	alg     string
+	private crypto.Signer
+	public  crypto.PublicKey
+	created time.Time
+	retired *time.Time
+}
+
+// Keyring holds the key used to sign new JWTs plus every older key whose
+// tokens may still be alive. With HS256 it degrades to the single shared
+// secret and has nothing to publish.
+type Keyring struct {
+	mu          sync.RWMutex
+	db          *gorm.DB
+	alg         string
+	secret      []byte
+	rotateEvery time.Duration
+	overlap     time.Duration // retired keys keep verifying this long
+	signing     *ringKey
+	keys        map[string]*ringKey
+	loadedAt    time.Time
+}
+
+// Every node shares the keys through the jwt_keys table, so the ring is
+// re-read from there now and then to pick up rotations made elsewhere.
+const (
+	keyRefreshEvery = time.Minute     // before signing with a possibly retired key
+	keyRetryEvery   = 5 * time.Second // on a token signed with an unknown key
+)
+
+var errRotatedElsewhere = errors.New("signing key already rotated")
+
+func NewKeyring(db *gorm.DB, sec helper.GoDropConfig) (*Keyring, error) {
+	k := &Keyring{
+		db:          db,
+		alg:         sec.JWTAlg,
+		secret:      []byte(sec.Password),
+		rotateEvery: sec.JWTRotateEvery,
+		overlap:     sec.AccessTTL,
+		keys:        make(map[string]*ringKey),
+	}
+
+	switch k.alg {
+	case AlgHS256:
+		return k, nil
+	case AlgEdDSA, AlgES256:
+	default:
+		return nil, fmt.Errorf("unsupported JWT algorithm %q", k.alg)
+	}
+
+	if err := k.load(); err != nil {
+		return nil, err
+	}
+	k.prune()
+
+	if k.signing == nil || k.signing.alg != k.alg {
+		if err := k.Rotate(); err != nil {
+			return nil, err
+		}
+	}
+	return k, nil
+}
+
+// Rotate generates a new signing key. The previous one is retired but stays
+// in the ring for verification until its tokens have expired.
+func (k *Keyring) Rotate() error {
+	if k.alg == AlgHS256 {
+		return errors.New("HS256 keys cannot be rotated")
+	}
+
+	var private crypto.Signer
+	var err error
+	switch k.alg {
+	case AlgEdDSA:
+		_, private, err = ed25519.GenerateKey(rand.Reader)
+	case AlgES256:
+		private, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	}
+	if err != nil {
+		return err
+	}
+
+	der, err := x509.MarshalPKCS8PrivateKey(private)
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	row := JWTKey{
+		KID:        uuid.New().String(),
+		Alg:        k.alg,
+		PrivateKey: base64.StdEncoding.EncodeToString(der),
+		CreatedAt:  now,
+	}
+
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	// Retiring the current key is the lock: the row update only goes through
+	// on one node, the others back off and load the key the winner made.
+	err = k.db.Transaction(func(tx *gorm.DB) error {
+		if k.signing != nil {
+			res := tx.Model(&JWTKey{}).Where("kid = ? AND retired_at IS NULL", k.signing.kid).Update("retired_at", now)
+			if res.Error != nil {
+				return res.Error
+			}
+			if res.RowsAffected == 0 {
+				return errRotatedElsewhere
+			}
+		}
+		if err := tx.Model(&JWTKey{}).Where("retired_at IS NULL").Update("retired_at", now).Error; err != nil {
+			return err
+		}
+		return tx.Create(&row).Error
+	})
+	if err != nil && !errors.Is(err, errRotatedElsewhere) {
+		return err
+	}
+	return k.load()
+}
+
+// load replaces the ring with the keys stored in the db. The newest
+// un-retired key signs. Must be called with mu held (or before the ring is
+// shared).
+func (k *Keyring) load() error {
+	var stored []JWTKey
+	if err := k.db.Order("created_at asc").Find(&stored).Error; err != nil {
+		return err
+	}
+	keys := make(map[string]*ringKey, len(stored))
+	var signing *ringKey
+	for _, row := range stored {
+		key, err := row.decode()
+		if err != nil {
+			return fmt.Errorf("jwt key %s: %w", row.KID, err)
+		}
+		keys[key.kid] = key
+		if key.retired == nil && key.alg == k.alg {
+			signing = key
+		}
+	}
+	k.keys = keys
+	if signing != nil {
+		k.signing = signing
+	}
+	k.loadedAt = time.Now()
+	return nil
+}
+
+// reloadIfOlder re-reads the ring unless it was loaded less than age ago.
+func (k *Keyring) reloadIfOlder(age time.Duration) error {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	if time.Since(k.loadedAt) < age {
+		return nil
+	}
+	return k.load()
+}
+
+// RotateIfDue rotates once the signing key is older than the rotation period
+// and drops retired keys nothing can be signed with anymore.
+func (k *Keyring) RotateIfDue() error {
+	if k.alg == AlgHS256 {
+		return nil
+	}
+
+	k.mu.Lock()
+	if err := k.load(); err != nil {
+		k.mu.Unlock()
+		return err
+	}
+	k.prune()
+	due := k.rotateEvery > 0 && time.Since(k.signing.created) > k.rotateEvery
+	k.mu.Unlock()
+
+	if due {
+		return k.Rotate()
+	}
+	return nil
+}
+
+// prune must be called with mu held (or before the ring is shared). Other
+// nodes may sign with a retired key until their next refresh, hence the
+// extra margin.
+func (k *Keyring) prune() {
+	cutoff := time.Now().Add(-k.overlap - keyRefreshEvery)
+	for kid, key := range k.keys {
+		if key.retired != nil && key.retired.Before(cutoff) {
+			delete(k.keys, kid)
+		}
+	}
+	k.db.Where("retired_at < ?", cutoff).Delete(&JWTKey{})
+}
+
+func (k *Keyring) Sign(claims jwt.MapClaims) (string, error) {
+	if k.alg == AlgHS256 {
+		return jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString(k.secret)
+	}
+
+	// A failed refresh keeps signing with the key we have, which stays
+	// valid on every node for a while.
+	k.reloadIfOlder(keyRefreshEvery)
+
+	k.mu.RLock()
+	key := k.signing
+	k.mu.RUnlock()
+
+	token := jwt.NewWithClaims(jwt.GetSigningMethod(key.alg), claims)
+	token.Header["kid"] = key.kid
+	return token.SignedString(key.private)
+}
+
+// KeyFunc resolves the verification key for a token by its `kid` header.
+func (k *Keyring) KeyFunc(t *jwt.Token) (any, error) {
+	if k.alg == AlgHS256 {
+		if _, ok := t.Method.(*jwt.SigningMethodHMAC); !ok {
+			return nil, errors.New("unexpected signing method")
+		}
+		return k.secret, nil
+	}
+
+	kid, _ := t.Header["kid"].(string)
+	key, ok := k.lookup(kid)
+	if !ok && k.reloadIfOlder(keyRetryEvery) == nil {
+		// Maybe another node rotated since the last refresh.
+		key, ok = k.lookup(kid)
+	}
+	if !ok {
+		return nil, errors.New("unknown signing key")
+	}
+	if t.Method.Alg() != key.alg {
+		return nil, errors.New("unexpected signing method")
+	}
+	return key.public, nil
+}
+
+func (k *Keyring) lookup(kid string) (*ringKey, bool) {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	key, ok := k.keys[kid]
+	return key, ok
+}
+
+type JWK struct {
+	Kty string `json:"kty"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y,omitempty"`
+	Kid string `json:"kid"`
+	Alg string `json:"alg"`
+	Use string `json:"use"`
+}
+
+type JWKSet struct {
+	Keys []JWK `json:"keys"`
+}
+
+// JWKS returns every public key that can currently verify a token.
+func (k *Keyring) JWKS() JWKSet {
+	set := JWKSet{Keys: []JWK{}}
+
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	for _, key := range k.keys {
+		b64 := base64.RawURLEncoding.EncodeToString
+		switch pub := key.public.(type) {
+		case ed25519.PublicKey:
+			set.Keys = append(set.Keys, JWK{Kty: "OKP", Crv: "Ed25519", X: b64(pub), Kid: key.kid, Alg: key.alg, Use: "sig"})
+		case *ecdsa.PublicKey:
+			x := make([]byte, 32)
+			y := make([]byte, 32)
+			pub.X.FillBytes(x)
+			pub.Y.FillBytes(y)
+			set.Keys = append(set.Keys, JWK{Kty: "EC", Crv: "P-256", X: b64(x), Y: b64(y), Kid: key.kid, Alg: key.alg, Use: "sig"})
+		}
+	}
+	return set
+}
+
+func (row JWTKey) decode() (*ringKey, error) {
+	der, err := base64.StdEncoding.DecodeString(row.PrivateKey)
+	if err != nil {
+		return nil, err
+	}
+	parsed, err := x509.ParsePKCS8PrivateKey(der)
+	if err != nil {
+		return nil, err
+	}
+	private, ok := parsed.(crypto.Signer)
+	if !ok {
+		return nil, errors.New("key is not a signer")
+	}
+	return &ringKey{row.KID, row.Alg, private, private.Public(), row.CreatedAt, row.RetiredAt}, nil
+}
@@ -0,0 +1,126 @@
+package server
+
+import (
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+func TestKeyringRotate(t *testing.T) {
+	for _, alg := range []string{AlgEdDSA, AlgES256} {
+		t.Run(alg, func(t *testing.T) {
+			s := newTestServer(t)
+			sec := s.Config
+			sec.JWTAlg = alg
+			k, err := NewKeyring(s.DB, sec)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			old, err := k.Sign(jwt.MapClaims{"sub": "alice"})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := k.Rotate(); err != nil {
+				t.Fatal(err)
+			}
+			fresh, err := k.Sign(jwt.MapClaims{"sub": "alice"})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			// Both the retired and the new key verify, and both are published.
+			for _, raw := range []string{old, fresh} {
+				if _, err := jwt.Parse(raw, k.KeyFunc); err != nil {
+					t.Fatalf("parse: %v", err)
+				}
+			}
+			published := 0
+			for _, jwk := range k.JWKS().Keys {
+				if jwk.Alg != alg {
+					continue // the EdDSA key of newTestServer
+				}
+				if jwk.Use != "sig" || jwk.X == "" || (alg == AlgES256) != (jwk.Y != "") {
+					t.Fatalf("bad JWK %+v", jwk)
+				}
+				published++
+			}
+			if published != 2 {
+				t.Fatalf("JWKS has %d %s keys, want 2", published, alg)
+			}
+
+			// Once the overlap is over the retired key goes away.
+			s.DB.Model(&JWTKey{}).Where("retired_at IS NOT NULL").Update("retired_at", time.Now().Add(-2*(sec.AccessTTL+keyRefreshEvery)))
+			if err := k.RotateIfDue(); err != nil {
+				t.Fatal(err)
+			}
+			if len(k.JWKS().Keys) != 1 {
+				t.Fatalf("retired key not pruned")
+			}
+			if _, err := jwt.Parse(old, k.KeyFunc); err == nil {
+				t.Fatal("token of a pruned key still verifies")
+			}
+		})
+	}
+}
+
+func TestKeyringHS256(t *testing.T) {
+	s := newTestServer(t)
+	sec := s.Config
+	sec.JWTAlg = AlgHS256
+	k, err := NewKeyring(s.DB, sec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := k.Rotate(); err == nil {
+		t.Fatal("HS256 rotated")
+	}
+	if len(k.JWKS().Keys) != 0 {
+		t.Fatal("HS256 published a key")
+	}
+}
+
+// Two nodes share one db: a rotation made by one is picked up by the other,
+// and only one of them rotates at a time.
+func TestKeyringSharedDB(t *testing.T) {
+	s := newTestServer(t)
+	a := s.Keys
+	stale := a.signing
+	b, err := NewKeyring(s.DB, s.Config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := b.Rotate(); err != nil {
+		t.Fatal(err)
+	}
+	raw, err := b.Sign(jwt.MapClaims{"sub": "alice"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// a only looks the new key up again once the retry delay is over.
+	if _, err := jwt.Parse(raw, a.KeyFunc); err == nil {
+		t.Fatal("reloaded before the retry delay")
+	}
+	a.loadedAt = time.Now().Add(-keyRetryEvery)
+	if _, err := jwt.Parse(raw, a.KeyFunc); err != nil {
+		t.Fatalf("unknown kid not reloaded: %v", err)
+	}
+
+	// a still thinks its key is current: its rotation must back off.
+	a.signing = stale
+	if err := a.Rotate(); err != nil {
+		t.Fatal(err)
+	}
+	var rows, current int64
+	s.DB.Model(&JWTKey{}).Count(&rows)
+	s.DB.Model(&JWTKey{}).Where("retired_at IS NULL").Count(&current)
+	if rows != 2 || current != 1 {
+		t.Fatalf("got %d keys, %d current; want 2, 1", rows, current)
+	}
+	if a.signing.kid != b.signing.kid {
+		t.Fatal("a did not pick up the key b made")
+	}
+}
@@ -0,0 +1,277 @@
+package server
+
+import (
+	"errors"
+	"gopherdrop/helper"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/google/uuid"
+	"github.com/mitchellh/mapstructure"
+	"gorm.io/gorm"
+)
+
+// Links the sender doesn't give a lifetime last this long.
+const defaultLinkTTL = 24 * time.Hour
+
+// shareLinkInfo is what the sender gets back for a link.
+type shareLinkInfo struct {
+	ID            string    `json:"id"`
+	TransactionID string    `json:"transaction_id"`
+	Token         string    `json:"token,omitempty"`
+	MaxUses       int       `json:"max_uses"`
+	Password      bool      `json:"password"`
+	ExpiresAt     time.Time `json:"expires_at"`
+	Revoked       bool      `json:"revoked,omitempty"`
+}
+
+// shareLink handles SHARE_LINK: the sender of a transaction mints a link for
+// it, or revokes one with revoke.
+func (ws *wsSession) shareLink(msg WSMessage) {
+	s, mUser := ws.s, ws.mUser
+	var data struct {
+		TransactionID string `mapstructure:"transaction_id"`
+		MaxUses       int    `mapstructure:"max_uses"`
+		TTL           int64  `mapstructure:"ttl"` // seconds
+		Password      string `mapstructure:"password"`
+		Revoke        string `mapstructure:"revoke"`
+	}
+	if err := mapstructure.Decode(msg.Data, &data); err != nil {
+		sendUser(s, mUser, ERROR, "invalid data for SHARE_LINK")
+		return
+	}
+
+	s.TransactionMu.RLock()
+	tx, ok := s.Transactions[data.TransactionID]
+	s.TransactionMu.RUnlock()
+	if !ok {
+		sendUser(s, mUser, ERROR, "transaction not found or expired")
+		return
+	}
+	if !tx.Sender.Is(mUser) {
+		sendUser(s, mUser, ERROR, "not authorized to modify this transaction")
+		return
+	}
+
+	if data.Revoke != "" {
+		res := s.DB.Model(&ShareLink{}).
+			Where("id = ? AND transaction_id = ? AND revoked_at IS NULL", data.Revoke, tx.ID).
+			Update("revoked_at", time.Now())
+		if res.Error != nil || res.RowsAffected == 0 {
+			sendUser(s, mUser, ERROR, "link not found")
+			return
+		}
+		mUser.Log.Info("Share link revoked", "tx_id", tx.ID, "link_id", data.Revoke)
+		sendUser(s, mUser, SHARE_LINK, shareLinkInfo{ID: data.Revoke, TransactionID: tx.ID, Revoked: true})
+		return
+	}
+
+	ttl := min(defaultLinkTTL, s.Config.LinkMaxTTL)
+	if data.TTL > 0 {
+		ttl = time.Duration(data.TTL) * time.Second
+	}
+	if data.TTL < 0 || data.MaxUses < 0 || ttl > s.Config.LinkMaxTTL {
+		sendUser(s, mUser, ERROR, "invalid ttl or max_uses")
+		return
+	}
+	if len(data.Password) > 256 {
+		ws.tooLarge("password too long")
+		return
+	}
+
+	link := ShareLink{
+		ID:            uuid.New().String(),
+		TransactionID: tx.ID,
+		OwnerKey:      mUser.MinUser.PublicKey,
+		MaxUses:       data.MaxUses,
+		ExpiresAt:     time.Now().Add(ttl),
+	}
+	if data.Password != "" {
+		hash, err := helper.HashPassword(data.Password)
+		if err != nil {
+			sendUser(s, mUser, ERROR, "failed to create link")
+			return
+		}
+		link.PasswordHash = hash
+	}
+	token, err := s.Keys.Sign(jwt.MapClaims{
+		"typ": "link",
+		"lid": link.ID,
+		"iat": time.Now().Unix(),
+		"exp": link.ExpiresAt.Unix(),
+	})
+	if err == nil {
+		err = s.DB.Create(&link).Error
+	}
+	if err != nil {
+		mUser.Log.Error("Failed to create share link", "tx_id", tx.ID, "err", err)
+		sendUser(s, mUser, ERROR, "failed to create link")
+		return
+	}
+
+	mUser.Log.Info("Share link created", "tx_id", tx.ID, "link_id", link.ID, "max_uses", link.MaxUses, "expires_at", link.ExpiresAt)
+	sendUser(s, mUser, SHARE_LINK, shareLinkInfo{
+		ID:            link.ID,
+		TransactionID: tx.ID,
+		Token:         token,
+		MaxUses:       link.MaxUses,
+		Password:      link.PasswordHash != "",
+		ExpiresAt:     link.ExpiresAt,
+	})
+}
+
+var (
+	errLinkInvalid  = errors.New("invalid or expired link")
+	errLinkUsedUp   = errors.New("link has no uses left")
+	errLinkPassword = errors.New("wrong or missing password")
+)
+
+// redeemLink spends one use of the link in raw and returns its row.
+func redeemLink(s *Server, raw string, password string) (ShareLink, error) {
+	var link ShareLink
+	token, err := jwt.Parse(raw, s.Keys.KeyFunc)
+	if err != nil || !token.Valid {
+		return link, errLinkInvalid
+	}
+	claims := token.Claims.(jwt.MapClaims)
+	id, _ := claims["lid"].(string)
+	if claims["typ"] != "link" || id == "" {
+		return link, errLinkInvalid
+	}
+	if err := s.DB.Where("id = ?", id).First(&link).Error; err != nil {
+		return link, errLinkInvalid
+	}
+	if link.RevokedAt != nil || time.Now().After(link.ExpiresAt) || !transactionLive(s, link.TransactionID) {
+		return link, errLinkInvalid
+	}
+	if link.PasswordHash != "" && !helper.CheckPassword(link.PasswordHash, password) {
+		return link, errLinkPassword
+	}
+
+	res := s.DB.Model(&ShareLink{}).
+		Where("id = ? AND revoked_at IS NULL AND (max_uses = 0 OR uses < max_uses)", link.ID).
+		Update("uses", gorm.Expr("uses + 1"))
+	if res.Error != nil {
+		return link, res.Error
+	}
+	if res.RowsAffected == 0 {
+		return link, errLinkUsedUp
+	}
+	link.Uses++
+	return link, nil
+}
+
+// transactionLive says whether some node still holds transaction id.
+func transactionLive(s *Server, id string) bool {
+	s.TransactionMu.RLock()
+	_, ok := s.Transactions[id]
+	s.TransactionMu.RUnlock()
+	return ok || topicHeld(s, txTopic(id))
+}
+
+// joinLink handles SHARE_LINK_JOIN, sent for a guest when it connects with
+// the token it got from a link: the guest becomes a target of the link's
+// transaction and gets the offer. The token is checked again here since
+// the message may come from another node.
+func (ws *wsSession) joinLink(msg WSMessage) {
+	s, mUser := ws.s, ws.mUser
+	var data struct {
+		TransactionID string `mapstructure:"transaction_id"`
+		Token         string `mapstructure:"token"`
+	}
+	if err := mapstructure.Decode(msg.Data, &data); err != nil {
+		sendUser(s, mUser, ERROR, "invalid data for SHARE_LINK_JOIN")
+		return
+	}
+	claims, err := s.ParseAccessToken(data.Token)
+	if err != nil || claims["typ"] != "guest" || claims["public_key"] != mUser.MinUser.PublicKey || claims["tx"] != data.TransactionID {
+		sendUser(s, mUser, ERROR, "not invited to this transaction")
+		return
+	}
+	linkID, _ := claims["lid"].(string)
+
+	s.TransactionMu.Lock()
+	tx, ok := s.Transactions[data.TransactionID]
+	if !ok {
+		s.TransactionMu.Unlock()
+		sendUser(s, mUser, ERROR, "transaction not found or expired")
+		return
+	}
+	joined := false
+	for _, target := range tx.Targets {
+		joined = joined || target.User.Is(mUser)
+	}
+	if !joined && len(tx.Targets) >= maxTargets(s, tx.Sender.MinUser.PublicKey) {
+		s.TransactionMu.Unlock()
+		sendUser(s, mUser, ERROR, "transaction is full")
+		return
+	}
+	if !joined {
+		tx.Targets = append(tx.Targets, &TransactionTarget{User: mUser, Status: Pending, InvitedAt: time.Now()})
+	}
+	s.TransactionMu.Unlock()
+
+	mUser.Log.Info("Guest joined through share link", "tx_id", tx.ID, "link_id", linkID)
+	s.TransactionMu.RLock()
+	sendUser(s, mUser, TRANSACTION_SHARE_ACCEPT, struct {
+		Transaction *Transaction `json:"transaction"`
+		Sender      string       `json:"sender"`
+	}{tx, tx.Sender.MinUser.Username})
+	s.TransactionMu.RUnlock()
+
+	liveSender(s, tx)
+	sendUser(s, tx.Sender, SHARE_LINK_JOIN, struct {
+		TransactionID string      `json:"transaction_id"`
+		LinkID        string      `json:"link_id"`
+		User          MinimalUser `json:"user"`
+	}{tx.ID, linkID, mUser.MinUser})
+}
+
+// SetupShareLink is POST /api/v1/link: open a share link as a guest.
+func SetupShareLink(s *Server, group fiber.Router) {
+	group.Post("/link", LimitByIP(s.IPLimiter), func(c *fiber.Ctx) error {
+		var body struct {
+			Token    string `json:"token"`
+			Password string `json:"password"`
+			Username string `json:"username"`
+		}
+		if err := c.BodyParser(&body); err != nil || body.Token == "" {
+			return resp(c, cret(false, "Invalid body", nil), fiber.StatusBadRequest)
+		}
+		name, err := guestUsername(body.Username)
+		if err != nil {
+			return resp(c, cret(false, err.Error(), nil), fiber.StatusBadRequest)
+		}
+
+		link, err := redeemLink(s, body.Token, body.Password)
+		switch {
+		case errors.Is(err, errLinkPassword):
+			return resp(c, cret(false, err.Error(), nil), fiber.StatusUnauthorized)
+		case errors.Is(err, errLinkInvalid), errors.Is(err, errLinkUsedUp):
+			return resp(c, cret(false, err.Error(), nil), fiber.StatusGone)
+		case err != nil:
+			s.Log.Error("Failed to redeem share link", "err", err)
+			return resp(c, cret(false, "Failed to open link", nil), fiber.StatusInternalServerError)
+		}
+
+		token, user, exp, err := s.issueGuestToken(name, jwt.MapClaims{"tx": link.TransactionID, "lid": link.ID})
+		if err != nil {
+			s.Log.Error("Failed to issue guest token", "err", err)
+			return resp(c, cret(false, "Failed to open link", nil), fiber.StatusInternalServerError)
+		}
+		s.Log.Info("Share link opened", "link_id", link.ID, "tx_id", link.TransactionID, "uses", link.Uses, "guest", user.PublicKey)
+		return resp(c, cret(true, "guest", fiber.Map{
+			"access_token":   token,
+			"expires_at":     exp.Unix(),
+			"transaction_id": link.TransactionID,
+			"user":           user,
+		}), fiber.StatusOK)
+	})
+}
+
+func purgeShareLinks(s *Server) {
+	if err := s.DB.Where("expires_at <= ?", time.Now()).Delete(&ShareLink{}).Error; err != nil {
+		s.Log.Error("Failed to purge share links", "err", err)
+	}
+}
@@ -0,0 +1,43 @@
+package server
+
+import (
+	"log/slog"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// RequestLogger writes one structured line per HTTP request. Only the path is
+// logged since the query may carry a token (WebSocket upgrade).
+func RequestLogger(l *slog.Logger) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		start := time.Now()
+		err := c.Next()
+
+		status := c.Response().StatusCode()
+		if err != nil {
+			if e, ok := err.(*fiber.Error); ok {
+				status = e.Code
+			} else {
+				status = fiber.StatusInternalServerError
+			}
+		}
+
+		level := slog.LevelDebug
+		switch {
+		case status >= 500:
+			level = slog.LevelError
+		case status >= 400:
+			level = slog.LevelInfo
+		}
+		l.Log(c.Context(), level, "http request",
+			"request_id", c.Locals("requestid"),
+			"method", c.Method(),
+			"path", c.Path(),
+			"status", status,
+			"latency", time.Since(start),
+			"ip", c.IP(),
+		)
+		return err
+	}
+}
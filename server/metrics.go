@@ -0,0 +1,152 @@
+package server
+
+import (
+	"crypto/subtle"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/gofiber/fiber/v2/middleware/adaptor"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// Metrics are the Prometheus collectors of one Server. They live in their
+// own registry so several servers (tests) don't fight over the default one.
+type Metrics struct {
+	Registry *prometheus.Registry
+
+	WSMessages      *prometheus.CounterVec
+	SignalsRelayed  prometheus.Counter
+	Logins          *prometheus.CounterVec
+	Challenges      prometheus.Counter
+	WSWriteLatency  prometheus.Histogram
+	TxAcceptLatency prometheus.Histogram
+	TxStartLatency  prometheus.Histogram
+}
+
+func NewMetrics(s *Server) *Metrics {
+	m := &Metrics{
+		Registry: prometheus.NewRegistry(),
+		WSMessages: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "gopherdrop_ws_messages_total",
+			Help: "WebSocket messages received, by type.",
+		}, []string{"type"}),
+		SignalsRelayed: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "gopherdrop_signals_relayed_total",
+			Help: "WEBRTC_SIGNAL messages relayed to a target.",
+		}),
+		Logins: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "gopherdrop_logins_total",
+			Help: "Login attempts, by result.",
+		}, []string{"result"}),
+		Challenges: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "gopherdrop_challenges_issued_total",
+			Help: "Challenges handed out by /challenge.",
+		}),
+		WSWriteLatency: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Name:    "gopherdrop_ws_write_seconds",
+			Help:    "Time to write one WebSocket message, including waiting for the write lock.",
+			Buckets: prometheus.ExponentialBuckets(0.0001, 4, 8),
+		}),
+		TxAcceptLatency: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Name:    "gopherdrop_transaction_accept_seconds",
+			Help:    "Time from a target being invited to answering the transaction.",
+			Buckets: prometheus.ExponentialBuckets(0.5, 2, 10),
+		}),
+		TxStartLatency: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Name:    "gopherdrop_transaction_start_seconds",
+			Help:    "Time from a transaction being created to START_TRANSACTION.",
+			Buckets: prometheus.ExponentialBuckets(0.5, 2, 10),
+		}),
+	}
+
+	connected := prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "gopherdrop_connected_users",
+		Help: "WebSocket connections with a ManagedUser.",
+	}, func() float64 {
+		s.MUserMu.RLock()
+		defer s.MUserMu.RUnlock()
+		return float64(len(s.MUser))
+	})
+	discoverable := prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "gopherdrop_discoverable_users",
+		Help: "Connected users visible in the share list.",
+	}, func() float64 {
+		s.CachedUserMu.RLock()
+		defer s.CachedUserMu.RUnlock()
+		return float64(len(s.CachedUser))
+	})
+
+	m.Registry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		connected,
+		discoverable,
+		&transactionCollector{s},
+		m.WSMessages,
+		m.SignalsRelayed,
+		m.Logins,
+		m.Challenges,
+		m.WSWriteLatency,
+		m.TxAcceptLatency,
+		m.TxStartLatency,
+	)
+	return m
+}
+
+func (m *Metrics) LoginResult(success bool) {
+	if success {
+		m.Logins.WithLabelValues("success").Inc()
+	} else {
+		m.Logins.WithLabelValues("failure").Inc()
+	}
+}
+
+var transactionsDesc = prometheus.NewDesc(
+	"gopherdrop_transactions",
+	"Live transactions, by state.",
+	[]string{"state"}, nil,
+)
+
+// transactionCollector counts Transactions by state at scrape time.
+type transactionCollector struct {
+	s *Server
+}
+
+func (t *transactionCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- transactionsDesc
+}
+
+func (t *transactionCollector) Collect(ch chan<- prometheus.Metric) {
+	counts := map[string]int{"pending": 0, "started": 0}
+	t.s.TransactionMu.RLock()
+	for _, tx := range t.s.Transactions {
+		if tx.Started {
+			counts["started"]++
+		} else {
+			counts["pending"]++
+		}
+	}
+	t.s.TransactionMu.RUnlock()
+
+	for state, n := range counts {
+		ch <- prometheus.MustNewConstMetric(transactionsDesc, prometheus.GaugeValue, float64(n), state)
+	}
+}
+
+// SetupMetrics exposes the registry in the Prometheus text format to
+// scrapers sending GDROP_METRICS_TOKEN as a Bearer token. Without a token
+// the endpoint is not served at all.
+func SetupMetrics(s *Server) {
+	if s.Config.MetricsToken == "" {
+		return
+	}
+	want := []byte("Bearer " + s.Config.MetricsToken)
+	handler := adaptor.HTTPHandler(promhttp.HandlerFor(s.Metrics.Registry, promhttp.HandlerOpts{}))
+	s.App.Get("/metrics", func(c *fiber.Ctx) error {
+		if subtle.ConstantTimeCompare([]byte(c.Get(fiber.HeaderAuthorization)), want) != 1 {
+			return fiber.ErrUnauthorized
+		}
+		return handler(c)
+	})
+}
@@ -0,0 +1,362 @@
+package server
+
+import (
+	"fmt"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// Migration is one versioned schema change. Up and Down run inside a
+// transaction (MySQL commits DDL on its own, so keep them small there).
+// Migrations declare their own copies of the models so that later changes
+// to the structs in database.go don't rewrite history.
+type Migration struct {
+	Version int
+	Name    string
+	Up      func(tx *gorm.DB) error
+	Down    func(tx *gorm.DB) error
+}
+
+// SchemaMigration is a row of the schema table, one per applied migration.
+type SchemaMigration struct {
+	Version   int       `gorm:"primaryKey;autoIncrement:false;column:version"`
+	Name      string    `gorm:"column:name;size:255"`
+	AppliedAt time.Time `gorm:"column:applied_at"`
+}
+
+func (SchemaMigration) TableName() string { return "schema_migrations" }
+
+// Migrations in version order. Append only.
+var Migrations = []Migration{
+	{
+		Version: 1,
+		Name:    "initial schema",
+		// AutoMigrate rather than CreateTable so databases created before
+		// versioned migrations are adopted as they are.
+		Up: func(tx *gorm.DB) error {
+			type User struct {
+				ID              int       `gorm:"primaryKey"`
+				Username        string    `gorm:"column:username;size:255;uniqueIndex"`
+				PublicKey       string    `gorm:"column:public_key;size:255;uniqueIndex"`
+				IsDiscoverable  bool      `gorm:"default:true;column:discoverable"`
+				CreatedAt       time.Time `gorm:"column:user_created_at"`
+				TokensRevokedAt *time.Time
+			}
+			type RefreshToken struct {
+				ID        int    `gorm:"primaryKey"`
+				UserID    int    `gorm:"index"`
+				TokenHash string `gorm:"size:64;uniqueIndex"`
+				Family    string `gorm:"size:36;index"`
+				Revoked   bool   `gorm:"default:false"`
+				ExpiresAt time.Time
+				CreatedAt time.Time
+			}
+			type RevokedToken struct {
+				JTI       string `gorm:"primaryKey;column:jti;size:64"`
+				ExpiresAt time.Time
+			}
+			type JWTKey struct {
+				KID        string `gorm:"primaryKey;column:kid;size:36"`
+				Alg        string
+				PrivateKey string
+				CreatedAt  time.Time
+				RetiredAt  *time.Time
+			}
+			type RecoveryCode struct {
+				ID        int    `gorm:"primaryKey"`
+				UserID    int    `gorm:"index"`
+				CodeHash  string `gorm:"size:64;index"`
+				UsedAt    *time.Time
+				CreatedAt time.Time
+			}
+			type KeyChange struct {
+				ID           int `gorm:"primaryKey"`
+				UserID       int `gorm:"index"`
+				OldPublicKey string
+				NewPublicKey string
+				Method       string
+				IP           string
+				CreatedAt    time.Time
+			}
+			return tx.AutoMigrate(&User{}, &RefreshToken{}, &RevokedToken{}, &JWTKey{}, &RecoveryCode{}, &KeyChange{})
+		},
+		Down: func(tx *gorm.DB) error {
+			return tx.Migrator().DropTable("key_changes", "recovery_codes", "jwt_keys", "revoked_tokens", "refresh_tokens", "users")
+		},
+	},
+	{
+		Version: 2,
+		Name:    "admin role and key bans",
+		Up: func(tx *gorm.DB) error {
+			type User struct {
+				IsAdmin bool `gorm:"column:is_admin;default:false"`
+			}
+			type BannedKey struct {
+				PublicKey string `gorm:"primaryKey;column:public_key;size:255"`
+				Reason    string
+				CreatedAt time.Time
+			}
+			if err := tx.Migrator().AddColumn(&User{}, "IsAdmin"); err != nil {
+				return err
+			}
+			return tx.Migrator().CreateTable(&BannedKey{})
+		},
+		Down: func(tx *gorm.DB) error {
+			type User struct {
+				Username  string `gorm:"column:username;size:255;uniqueIndex"`
+				PublicKey string `gorm:"column:public_key;size:255;uniqueIndex"`
+				IsAdmin   bool   `gorm:"column:is_admin"`
+			}
+			if err := tx.Migrator().DropTable("banned_keys"); err != nil {
+				return err
+			}
+			if err := tx.Migrator().DropColumn(&User{}, "IsAdmin"); err != nil {
+				return err
+			}
+			// SQLite drops a column by rebuilding the table, which loses its indexes.
+			for _, field := range []string{"Username", "PublicKey"} {
+				if !tx.Migrator().HasIndex(&User{}, field) {
+					if err := tx.Migrator().CreateIndex(&User{}, field); err != nil {
+						return err
+					}
+				}
+			}
+			return nil
+		},
+	},
+	{
+		Version: 3,
+		Name:    "offline inbox",
+		Up: func(tx *gorm.DB) error {
+			type PendingOffer struct {
+				ID            int    `gorm:"primaryKey"`
+				TransactionID string `gorm:"column:transaction_id;size:36;index"`
+				SenderKey     string `gorm:"column:sender_key;size:255;index"`
+				RecipientKey  string `gorm:"column:recipient_key;size:255;index"`
+				Payload       string
+				CreatedAt     time.Time
+				ExpiresAt     time.Time `gorm:"index"`
+			}
+			return tx.Migrator().CreateTable(&PendingOffer{})
+		},
+		Down: func(tx *gorm.DB) error {
+			return tx.Migrator().DropTable("pending_offers")
+		},
+	},
+	{
+		Version: 4,
+		Name:    "file requests",
+		Up: func(tx *gorm.DB) error {
+			type FileRequest struct {
+				ID            string `gorm:"primaryKey;column:id;size:36"`
+				RequesterKey  string `gorm:"column:requester_key;size:255;index"`
+				RequesterName string
+				TargetKey     string `gorm:"column:target_key;size:255;index"`
+				TargetName    string
+				Note          string
+				Types         string
+				MaxSize       int64
+				Status        string `gorm:"size:16;index"`
+				TransactionID string `gorm:"size:36"`
+				Reason        string
+				CreatedAt     time.Time
+				UpdatedAt     time.Time
+				ExpiresAt     time.Time `gorm:"index"`
+			}
+			return tx.Migrator().CreateTable(&FileRequest{})
+		},
+		Down: func(tx *gorm.DB) error {
+			return tx.Migrator().DropTable("file_requests")
+		},
+	},
+	{
+		Version: 5,
+		Name:    "share links",
+		Up: func(tx *gorm.DB) error {
+			type ShareLink struct {
+				ID            string `gorm:"primaryKey;column:id;size:36"`
+				TransactionID string `gorm:"size:36;index"`
+				OwnerKey      string `gorm:"size:255;index"`
+				MaxUses       int
+				Uses          int
+				PasswordHash  string
+				RevokedAt     *time.Time
+				CreatedAt     time.Time
+				ExpiresAt     time.Time `gorm:"index"`
+			}
+			return tx.Migrator().CreateTable(&ShareLink{})
+		},
+		Down: func(tx *gorm.DB) error {
+			return tx.Migrator().DropTable("share_links")
+		},
+	},
+	{
+		Version: 6,
+		Name:    "auto-accept rules and contacts",
+		Up: func(tx *gorm.DB) error {
+			type AutoAcceptRule struct {
+				ID         string `gorm:"primaryKey;column:id;size:36"`
+				UserID     int    `gorm:"index"`
+				FromKeys   string
+				Contacts   bool
+				GroupNames string
+				Types      string
+				MaxSize    int64
+				CreatedAt  time.Time
+			}
+			type Contact struct {
+				ID         string `gorm:"primaryKey;column:id;size:36"`
+				UserID     int    `gorm:"uniqueIndex:idx_contact"`
+				PublicKey  string `gorm:"size:255;uniqueIndex:idx_contact"`
+				Username   string
+				GroupNames string
+				CreatedAt  time.Time
+			}
+			return tx.Migrator().CreateTable(&AutoAcceptRule{}, &Contact{})
+		},
+		Down: func(tx *gorm.DB) error {
+			return tx.Migrator().DropTable("contacts", "auto_accept_rules")
+		},
+	},
+	{
+		Version: 7,
+		Name:    "shared login challenges",
+		Up: func(tx *gorm.DB) error {
+			type Challenge struct {
+				Challenge string    `gorm:"primaryKey;column:challenge;size:64"`
+				ExpiresAt time.Time `gorm:"index"`
+			}
+			return tx.Migrator().CreateTable(&Challenge{})
+		},
+		Down: func(tx *gorm.DB) error {
+			return tx.Migrator().DropTable("challenges")
+		},
+	},
+}
+
+// MigrationState is a migration and whether it has been applied.
+type MigrationState struct {
+	Version   int
+	Name      string
+	AppliedAt *time.Time
+}
+
+func LatestVersion() int {
+	return Migrations[len(Migrations)-1].Version
+}
+
+func appliedMigrations(db *gorm.DB) (map[int]SchemaMigration, error) {
+	if err := db.AutoMigrate(&SchemaMigration{}); err != nil {
+		return nil, err
+	}
+	var rows []SchemaMigration
+	if err := db.Find(&rows).Error; err != nil {
+		return nil, err
+	}
+	applied := make(map[int]SchemaMigration, len(rows))
+	for _, r := range rows {
+		applied[r.Version] = r
+	}
+	return applied, nil
+}
+
+// MigrateDB brings the schema to the latest version.
+func MigrateDB(db *gorm.DB) error {
+	return MigrateUp(db, LatestVersion())
+}
+
+// MigrateUp applies every pending migration up to and including target.
+func MigrateUp(db *gorm.DB, target int) error {
+	applied, err := appliedMigrations(db)
+	if err != nil {
+		return err
+	}
+	for _, m := range Migrations {
+		if m.Version > target {
+			break
+		}
+		if _, ok := applied[m.Version]; ok {
+			continue
+		}
+		err := db.Transaction(func(tx *gorm.DB) error {
+			if err := m.Up(tx); err != nil {
+				return err
+			}
+			return tx.Create(&SchemaMigration{Version: m.Version, Name: m.Name, AppliedAt: time.Now()}).Error
+		})
+		if err != nil {
+			return fmt.Errorf("migration %d (%s): %w", m.Version, m.Name, err)
+		}
+	}
+	return nil
+}
+
+// MigrateDown rolls back applied migrations newer than target, newest first.
+func MigrateDown(db *gorm.DB, target int) error {
+	applied, err := appliedMigrations(db)
+	if err != nil {
+		return err
+	}
+	for i := len(Migrations) - 1; i >= 0; i-- {
+		m := Migrations[i]
+		if m.Version <= target {
+			break
+		}
+		if _, ok := applied[m.Version]; !ok {
+			continue
+		}
+		err := db.Transaction(func(tx *gorm.DB) error {
+			if err := m.Down(tx); err != nil {
+				return err
+			}
+			return tx.Delete(&SchemaMigration{}, m.Version).Error
+		})
+		if err != nil {
+			return fmt.Errorf("rollback %d (%s): %w", m.Version, m.Name, err)
+		}
+	}
+	return nil
+}
+
+// CurrentVersion is the newest applied migration, 0 for an empty database.
+func CurrentVersion(db *gorm.DB) (int, error) {
+	applied, err := appliedMigrations(db)
+	if err != nil {
+		return 0, err
+	}
+	current := 0
+	for v := range applied {
+		current = max(current, v)
+	}
+	return current, nil
+}
+
+// CheckSchema fails when migrations are pending, for servers that don't
+// migrate on startup.
+func CheckSchema(db *gorm.DB) error {
+	current, err := CurrentVersion(db)
+	if err != nil {
+		return err
+	}
+	if current < LatestVersion() {
+		return fmt.Errorf("schema is at version %d, %d is required: run `gopherdrop migrate`", current, LatestVersion())
+	}
+	return nil
+}
+
+func MigrationStatus(db *gorm.DB) ([]MigrationState, error) {
+	applied, err := appliedMigrations(db)
+	if err != nil {
+		return nil, err
+	}
+	states := make([]MigrationState, 0, len(Migrations))
+	for _, m := range Migrations {
+		st := MigrationState{Version: m.Version, Name: m.Name}
+		if r, ok := applied[m.Version]; ok {
+			st.AppliedAt = &r.AppliedAt
+		}
+		states = append(states, st)
+	}
+	return states, nil
+}
@@ -0,0 +1,83 @@
+package server
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+func TestMigrations(t *testing.T) {
+	db, err := OpenDB("sqlite", filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	sqlDB, _ := db.DB()
+	defer sqlDB.Close()
+
+	// What each version adds, checked going up and gone again going down.
+	tables := map[int][]string{
+		1: {"users", "refresh_tokens", "revoked_tokens", "jwt_keys", "recovery_codes", "key_changes"},
+		2: {"banned_keys"},
+		3: {"pending_offers"},
+		4: {"file_requests"},
+		5: {"share_links"},
+		6: {"auto_accept_rules", "contacts"},
+		7: {"challenges"},
+	}
+	if len(tables) != LatestVersion() {
+		t.Fatalf("tables of %d versions listed, latest is %d", len(tables), LatestVersion())
+	}
+	check := func(t *testing.T, version int) {
+		t.Helper()
+		if current, err := CurrentVersion(db); err != nil || current != version {
+			t.Fatalf("at version %d (%v), want %d", current, err, version)
+		}
+		for v, names := range tables {
+			for _, name := range names {
+				if has := db.Migrator().HasTable(name); has != (v <= version) {
+					t.Fatalf("at version %d: table %s exists: %v", version, name, has)
+				}
+			}
+		}
+		if has := db.Migrator().HasColumn(&User{}, "IsAdmin"); version >= 1 && has != (version >= 2) {
+			t.Fatalf("at version %d: users.is_admin exists: %v", version, has)
+		}
+	}
+
+	if err := CheckSchema(db); err == nil {
+		t.Fatal("empty db passed the schema check")
+	}
+	for v := 1; v <= LatestVersion(); v++ {
+		if err := MigrateUp(db, v); err != nil {
+			t.Fatal(err)
+		}
+		check(t, v)
+	}
+	if err := CheckSchema(db); err != nil {
+		t.Fatal(err)
+	}
+	// Applied migrations are skipped.
+	if err := MigrateDB(db); err != nil {
+		t.Fatal(err)
+	}
+
+	for v := LatestVersion() - 1; v >= 0; v-- {
+		if err := MigrateDown(db, v); err != nil {
+			t.Fatal(err)
+		}
+		check(t, v)
+	}
+
+	if err := MigrateDB(db); err != nil {
+		t.Fatal(err)
+	}
+	check(t, LatestVersion())
+	states, err := MigrationStatus(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, st := range states {
+		if st.AppliedAt == nil {
+			t.Fatalf("migration %d not applied", st.Version)
+		}
+	}
+}
@@ -0,0 +1,93 @@
+package server
+
+import (
+	"math"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// TokenBucket refills Rate tokens per second up to Burst. It is not safe for
+// concurrent use on its own, RateLimiter guards it.
+type TokenBucket struct {
+	Rate   float64
+	Burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func NewTokenBucket(rate float64, burst int) *TokenBucket {
+	return &TokenBucket{Rate: rate, Burst: float64(burst), tokens: float64(burst), last: time.Now()}
+}
+
+// Allow takes a token if there is one, otherwise it says how long until
+// the next token is available.
+func (b *TokenBucket) Allow() (bool, time.Duration) {
+	now := time.Now()
+	b.tokens = math.Min(b.Burst, b.tokens+now.Sub(b.last).Seconds()*b.Rate)
+	b.last = now
+	if b.tokens >= 1 {
+		b.tokens--
+		return true, 0
+	}
+	if b.Rate <= 0 {
+		return false, time.Minute
+	}
+	return false, time.Duration((1 - b.tokens) / b.Rate * float64(time.Second))
+}
+
+// RateLimiter keeps one token bucket per key (IP, public key, ...).
+type RateLimiter struct {
+	mu      sync.Mutex
+	rate    float64
+	burst   int
+	buckets map[string]*TokenBucket
+}
+
+func NewRateLimiter(rate float64, burst int) *RateLimiter {
+	return &RateLimiter{rate: rate, burst: burst, buckets: make(map[string]*TokenBucket)}
+}
+
+func (l *RateLimiter) Allow(key string) (bool, time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	b, ok := l.buckets[key]
+	if !ok {
+		b = NewTokenBucket(l.rate, l.burst)
+		l.buckets[key] = b
+	}
+	return b.Allow()
+}
+
+// Prune forgets buckets that have been idle long enough to be full again.
+func (l *RateLimiter) Prune() {
+	if l.rate <= 0 {
+		return
+	}
+	full := time.Duration(float64(l.burst) / l.rate * float64(time.Second))
+	l.mu.Lock()
+	for key, b := range l.buckets {
+		if time.Since(b.last) > full {
+			delete(l.buckets, key)
+		}
+	}
+	l.mu.Unlock()
+}
+
+func tooManyRequests(c *fiber.Ctx, retry time.Duration) error {
+	secs := int(math.Ceil(retry.Seconds()))
+	c.Set(fiber.HeaderRetryAfter, strconv.Itoa(secs))
+	return resp(c, cret(false, "Too many requests", fiber.Map{"retry_after": secs}), fiber.StatusTooManyRequests)
+}
+
+// LimitByIP throttles a route per client IP.
+func LimitByIP(l *RateLimiter) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		if ok, retry := l.Allow(c.IP()); !ok {
+			return tooManyRequests(c, retry)
+		}
+		return c.Next()
+	}
+}
@@ -0,0 +1,72 @@
+package server
+
+import (
+	"testing"
+	"time"
+)
+
+func TestTokenBucket(t *testing.T) {
+	tests := []struct {
+		name    string
+		rate    float64
+		burst   int
+		idle    time.Duration
+		idleAt  int // call the idle time passes before
+		calls   int
+		allowed int
+		retry   time.Duration // of the last call, if refused
+	}{
+		{"burst then refuse", 1, 3, 0, 0, 4, 3, time.Second},
+		{"refill over time", 2, 2, 500 * time.Millisecond, 2, 3, 3, 0},
+		{"refill capped at burst", 10, 2, time.Hour, 0, 3, 2, 100 * time.Millisecond},
+		{"zero rate never refills", 0, 1, time.Hour, 1, 2, 1, time.Minute},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := NewTokenBucket(tt.rate, tt.burst)
+			allowed := 0
+			var retry time.Duration
+			for i := 0; i < tt.calls; i++ {
+				if i == tt.idleAt {
+					// Fake the idle time instead of sleeping.
+					b.last = b.last.Add(-tt.idle)
+				}
+				var ok bool
+				if ok, retry = b.Allow(); ok {
+					allowed++
+				}
+			}
+			if allowed != tt.allowed {
+				t.Fatalf("allowed %d of %d, want %d", allowed, tt.calls, tt.allowed)
+			}
+			// Allow takes a few ns of refill into account, compare loosely.
+			if diff := tt.retry - retry; diff < 0 || diff > time.Millisecond {
+				t.Fatalf("retry after %v, want %v", retry, tt.retry)
+			}
+		})
+	}
+}
+
+func TestRateLimiter(t *testing.T) {
+	l := NewRateLimiter(1, 1)
+	if ok, _ := l.Allow("a"); !ok {
+		t.Fatal("first call of a refused")
+	}
+	if ok, _ := l.Allow("a"); ok {
+		t.Fatal("second call of a allowed")
+	}
+	// Keys have their own buckets.
+	if ok, _ := l.Allow("b"); !ok {
+		t.Fatal("first call of b refused")
+	}
+
+	// Only buckets idle long enough to be full again are pruned.
+	l.buckets["a"].last = time.Now().Add(-2 * time.Second)
+	l.Prune()
+	if _, ok := l.buckets["a"]; ok {
+		t.Fatal("idle bucket kept")
+	}
+	if _, ok := l.buckets["b"]; !ok {
+		t.Fatal("busy bucket pruned")
+	}
+}
@@ -0,0 +1,325 @@
+package server
+
+import (
+	"errors"
+	"path"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/google/uuid"
+	"github.com/mitchellh/mapstructure"
+)
+
+// FileRequest.Status values.
+const (
+	RequestPending   = "pending"
+	RequestFulfilled = "fulfilled"
+	RequestDeclined  = "declined"
+	RequestCancelled = "cancelled"
+	RequestExpired   = "expired"
+)
+
+// Limits of a REQUEST_FILES message.
+const (
+	maxRequestNote  = 1000 // characters
+	maxRequestTypes = 20
+)
+
+// requestFiles handles REQUEST_FILES: mUser asks the user with public_key
+// for files. The request is stored so it reaches the target on any node,
+// or on their next connect when they are offline.
+func (ws *wsSession) requestFiles(msg WSMessage) {
+	s, mUser := ws.s, ws.mUser
+	var data struct {
+		PublicKey string   `mapstructure:"public_key"`
+		Note      string   `mapstructure:"note"`
+		Types     []string `mapstructure:"types"`
+		MaxSize   int64    `mapstructure:"max_size"`
+	}
+	if err := mapstructure.Decode(msg.Data, &data); err != nil {
+		sendUser(s, mUser, ERROR, "invalid data for REQUEST_FILES")
+		return
+	}
+	if utf8.RuneCountInString(data.Note) > maxRequestNote || len(data.Types) > maxRequestTypes {
+		ws.tooLarge("request too large")
+		return
+	}
+	if data.MaxSize < 0 {
+		sendUser(s, mUser, ERROR, "invalid max_size")
+		return
+	}
+	for _, t := range data.Types {
+		if t == "" || len(t) > 255 {
+			sendUser(s, mUser, ERROR, "invalid file type")
+			return
+		}
+	}
+	if data.PublicKey == mUser.MinUser.PublicKey {
+		sendUser(s, mUser, ERROR, "cannot request files from yourself")
+		return
+	}
+	// A guest is gone with its socket, the request would outlive it.
+	if isGuestKey(data.PublicKey) {
+		sendUser(s, mUser, ERROR, "cannot request files from a guest")
+		return
+	}
+
+	target := findUser(s, data.PublicKey)
+	if target == nil {
+		target = offlineUser(s, data.PublicKey)
+	}
+	if target == nil {
+		sendUser(s, mUser, ERROR, "user not found")
+		return
+	}
+
+	req := FileRequest{
+		ID:            uuid.New().String(),
+		RequesterKey:  mUser.MinUser.PublicKey,
+		RequesterName: mUser.MinUser.Username,
+		TargetKey:     target.MinUser.PublicKey,
+		TargetName:    target.MinUser.Username,
+		Note:          data.Note,
+		Types:         data.Types,
+		MaxSize:       data.MaxSize,
+		Status:        RequestPending,
+		ExpiresAt:     time.Now().Add(s.Config.RequestTTL),
+	}
+	if err := s.DB.Create(&req).Error; err != nil {
+		mUser.Log.Error("Failed to store file request", "err", err)
+		sendUser(s, mUser, ERROR, "failed to create request")
+		return
+	}
+
+	mUser.Log.Info("Files requested", "request_id", req.ID, "target", req.TargetKey)
+	sendUser(s, target, REQUEST_FILES, req)
+	sendUser(s, mUser, REQUEST_FILES, req)
+}
+
+// answerRequest handles REQUEST_FILES_STATUS: the target declines, or the
+// requester cancels. Fulfilling goes through a linked transaction instead.
+func (ws *wsSession) answerRequest(msg WSMessage) {
+	s, mUser := ws.s, ws.mUser
+	var data struct {
+		RequestID string `mapstructure:"request_id"`
+		Status    string `mapstructure:"status"`
+		Reason    string `mapstructure:"reason"`
+	}
+	if err := mapstructure.Decode(msg.Data, &data); err != nil {
+		sendUser(s, mUser, ERROR, "invalid data for REQUEST_FILES_STATUS")
+		return
+	}
+
+	req, err := openRequest(s, data.RequestID)
+	if err != nil {
+		sendUser(s, mUser, ERROR, err.Error())
+		return
+	}
+	switch {
+	case data.Status == RequestDeclined && req.TargetKey == mUser.MinUser.PublicKey:
+	case data.Status == RequestCancelled && req.RequesterKey == mUser.MinUser.PublicKey:
+	default:
+		sendUser(s, mUser, ERROR, "not allowed to change this request")
+		return
+	}
+	if utf8.RuneCountInString(data.Reason) > maxRequestNote {
+		ws.tooLarge("reason too long")
+		return
+	}
+
+	req.Reason = data.Reason
+	if err := setRequestStatus(s, &req, data.Status); err != nil {
+		sendUser(s, mUser, ERROR, err.Error())
+		return
+	}
+	mUser.Log.Info("File request answered", "request_id", req.ID, "status", req.Status)
+}
+
+// openRequest loads a request that can still be fulfilled.
+func openRequest(s *Server, id string) (FileRequest, error) {
+	var req FileRequest
+	if err := s.DB.Where("id = ?", id).First(&req).Error; err != nil {
+		return req, errors.New("request not found")
+	}
+	if req.Status != RequestPending || time.Now().After(req.ExpiresAt) {
+		return req, errors.New("request is no longer open")
+	}
+	return req, nil
+}
+
+// setRequestStatus moves a pending request to status and tells both sides.
+// The update only applies while the request is pending, so two answers
+// racing each other can't both win.
+func setRequestStatus(s *Server, req *FileRequest, status string) error {
+	res := s.DB.Model(&FileRequest{}).
+		Where("id = ? AND status = ?", req.ID, RequestPending).
+		Updates(map[string]any{
+			"status":         status,
+			"reason":         req.Reason,
+			"transaction_id": req.TransactionID,
+			"updated_at":     time.Now(),
+		})
+	if res.Error != nil {
+		return errors.New("failed to update request")
+	}
+	if res.RowsAffected == 0 {
+		return errors.New("request is no longer open")
+	}
+	req.Status = status
+	notifyRequest(s, *req)
+	return nil
+}
+
+func notifyRequest(s *Server, req FileRequest) {
+	for _, key := range []string{req.RequesterKey, req.TargetKey} {
+		if user := findUser(s, key); user != nil {
+			sendUser(s, user, REQUEST_FILES_STATUS, req)
+		}
+	}
+}
+
+// linkRequest checks that mUser may answer request id with a new
+// transaction.
+func linkRequest(s *Server, mUser *ManagedUser, id string) error {
+	req, err := openRequest(s, id)
+	if err != nil {
+		return err
+	}
+	if req.TargetKey != mUser.MinUser.PublicKey {
+		return errors.New("request is not addressed to you")
+	}
+	return nil
+}
+
+// checkRequestFiles enforces the constraints of the request tx answers.
+func checkRequestFiles(s *Server, tx *Transaction, files []FileInfo) error {
+	req, err := openRequest(s, tx.RequestID)
+	if err != nil {
+		return err
+	}
+	var total int64
+	for _, f := range files {
+		total += f.Size
+		if !f.IsDir && len(req.Types) > 0 && !matchesType(f, req.Types) {
+			return errors.New(f.Name + " is not of a requested type")
+		}
+	}
+	if req.MaxSize > 0 && total > req.MaxSize {
+		return errors.New("files exceed the requested size")
+	}
+	return nil
+}
+
+// matchesType accepts exact MIME types, "type/*" wildcards and ".ext"
+// extensions (checked against the file name).
+func matchesType(f FileInfo, types []string) bool {
+	mime := strings.ToLower(f.Type)
+	ext := strings.ToLower(path.Ext(f.Name))
+	for _, t := range types {
+		t = strings.ToLower(t)
+		switch {
+		case strings.HasPrefix(t, "."):
+			if ext == t {
+				return true
+			}
+		case strings.HasSuffix(t, "/*"):
+			if strings.HasPrefix(mime, strings.TrimSuffix(t, "*")) {
+				return true
+			}
+		case mime == t:
+			return true
+		}
+	}
+	return false
+}
+
+// checkRequestTargets makes sure tx, answering a request, has files and
+// offers them to the requester. The request stays open until they accept.
+func checkRequestTargets(s *Server, tx *Transaction, targets []*TransactionTarget) error {
+	req, err := openRequest(s, tx.RequestID)
+	if err != nil {
+		return err
+	}
+	s.TransactionMu.RLock()
+	files := len(tx.Files)
+	s.TransactionMu.RUnlock()
+	if files == 0 {
+		return errors.New("the transaction of a request needs files first")
+	}
+	for _, target := range targets {
+		if target.User.MinUser.PublicKey == req.RequesterKey {
+			return nil
+		}
+	}
+	return errors.New("the transaction of a request must target the requester")
+}
+
+// fulfilRequest closes the request tx answers once its requester, key,
+// accepted the files. Another transaction may have been first.
+func fulfilRequest(s *Server, tx *Transaction, key string) {
+	req, err := openRequest(s, tx.RequestID)
+	if err != nil || req.RequesterKey != key {
+		return
+	}
+	req.TransactionID = tx.ID
+	if err := setRequestStatus(s, &req, RequestFulfilled); err != nil {
+		s.Log.Warn("File request not fulfilled", "request_id", req.ID, "tx_id", tx.ID, "err", err)
+	}
+}
+
+// reopenRequest puts the request fulfilled by tx back to pending when the
+// transfer to its requester, key, is cancelled: the files never arrived.
+// An empty key means the whole transaction is gone. A request past its
+// expiry expires instead.
+func reopenRequest(s *Server, tx *Transaction, key string) {
+	var req FileRequest
+	if err := s.DB.Where("id = ? AND transaction_id = ? AND status = ?", tx.RequestID, tx.ID, RequestFulfilled).First(&req).Error; err != nil {
+		return
+	}
+	if key != "" && req.RequesterKey != key {
+		return
+	}
+	status := RequestPending
+	if time.Now().After(req.ExpiresAt) {
+		status = RequestExpired
+	}
+	res := s.DB.Model(&FileRequest{}).
+		Where("id = ? AND status = ?", req.ID, RequestFulfilled).
+		Updates(map[string]any{"status": status, "transaction_id": "", "updated_at": time.Now()})
+	if res.Error != nil || res.RowsAffected == 0 {
+		return
+	}
+	req.Status, req.TransactionID = status, ""
+	s.Log.Info("File request reopened", "request_id", req.ID, "tx_id", tx.ID, "status", status)
+	notifyRequest(s, req)
+}
+
+// deliverRequests pushes the open requests addressed to a user who just
+// connected.
+func deliverRequests(s *Server, mUser *ManagedUser) {
+	var reqs []FileRequest
+	err := s.DB.Where("target_key = ? AND status = ? AND expires_at > ?", mUser.MinUser.PublicKey, RequestPending, time.Now()).
+		Order("created_at").Find(&reqs).Error
+	if err != nil {
+		mUser.Log.Error("Failed to load file requests", "err", err)
+		return
+	}
+	for _, req := range reqs {
+		sendUser(s, mUser, REQUEST_FILES, req)
+	}
+}
+
+// expireRequests closes the requests nobody answered in time.
+func expireRequests(s *Server) {
+	var reqs []FileRequest
+	if err := s.DB.Where("status = ? AND expires_at <= ?", RequestPending, time.Now()).Find(&reqs).Error; err != nil {
+		s.Log.Error("Failed to load expired file requests", "err", err)
+		return
+	}
+	for i := range reqs {
+		if err := setRequestStatus(s, &reqs[i], RequestExpired); err != nil {
+			s.Log.Error("Failed to expire file request", "request_id", reqs[i].ID, "err", err)
+		}
+	}
+}
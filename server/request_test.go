@@ -0,0 +1,86 @@
+package server
+
+import "testing"
+
+func TestRequestFollowsItsTransfer(t *testing.T) {
+	s := newTestServer(t)
+	alice := newTestClient(t, s, "alice")
+	bob := newTestClient(t, s, "bob")
+
+	alice.send(REQUEST_FILES, map[string]any{"public_key": bob.mUser.MinUser.PublicKey, "note": "the slides"})
+	reqID := field(alice.expect(REQUEST_FILES), "id")
+	status := func() string {
+		var req FileRequest
+		s.DB.Where("id = ?", reqID).First(&req)
+		return req.Status
+	}
+
+	bob.send(NEW_TRANSACTION, map[string]any{"request_id": reqID})
+	txID := field(bob.expect(NEW_TRANSACTION), "id")
+	target := map[string]any{"transaction_id": txID, "public_keys": []string{alice.mUser.MinUser.PublicKey}}
+
+	// Offering nothing doesn't answer the request.
+	bob.send(USER_SHARE_TARGET, target)
+	bob.expectError("needs files first")
+
+	bob.send(FILE_SHARE_TARGET, map[string]any{"transaction_id": txID, "files": []FileInfo{{Name: "slides.pdf", Size: 10}}})
+	bob.expect(FILE_SHARE_TARGET)
+	bob.send(USER_SHARE_TARGET, target)
+	bob.expect(USER_SHARE_TARGET)
+	if got := status(); got != RequestPending {
+		t.Fatalf("status after the offer = %s, want pending", got)
+	}
+
+	alice.send(TRANSACTION_SHARE_ACCEPT, map[string]any{"transaction_id": txID, "accept": true})
+	if got := field(alice.expect(REQUEST_FILES_STATUS), "status"); got != RequestFulfilled {
+		t.Fatalf("status after accepting = %s, want fulfilled", got)
+	}
+
+	// The files never arrived, bob may answer again.
+	bob.send(CANCEL_TRANSFER, map[string]any{"transaction_id": txID, "public_key": alice.mUser.MinUser.PublicKey})
+	reopened := bob.expect(REQUEST_FILES_STATUS)
+	for field(reopened, "status") == RequestFulfilled {
+		reopened = bob.expect(REQUEST_FILES_STATUS)
+	}
+	if field(reopened, "status") != RequestPending || field(reopened, "transaction_id") != "" {
+		t.Fatalf("after cancel: %v", reopened)
+	}
+	if got := status(); got != RequestPending {
+		t.Fatalf("status after cancel = %s, want pending", got)
+	}
+	bob.send(NEW_TRANSACTION, map[string]any{"request_id": reqID})
+	txID = field(bob.expect(NEW_TRANSACTION), "id")
+
+	// Deleting the transaction reopens it the same way.
+	bob.send(FILE_SHARE_TARGET, map[string]any{"transaction_id": txID, "files": []FileInfo{{Name: "slides.pdf", Size: 10}}})
+	bob.expect(FILE_SHARE_TARGET)
+	bob.send(USER_SHARE_TARGET, map[string]any{"transaction_id": txID, "public_keys": []string{alice.mUser.MinUser.PublicKey}})
+	bob.expect(USER_SHARE_TARGET)
+	alice.send(TRANSACTION_SHARE_ACCEPT, map[string]any{"transaction_id": txID, "accept": true})
+	bob.expect(TRANSACTION_SHARE_ACCEPT)
+	if got := status(); got != RequestFulfilled {
+		t.Fatalf("status after accepting again = %s, want fulfilled", got)
+	}
+	bob.send(DELETE_TRANSACTION, txID)
+	bob.expect(DELETE_TRANSACTION)
+	if got := status(); got != RequestPending {
+		t.Fatalf("status after delete = %s, want pending", got)
+	}
+}
+
+func TestRequestFromGuest(t *testing.T) {
+	s := newTestServer(t)
+	alice := newTestClient(t, s, "alice")
+	guest := MinimalUser{Username: "guest", PublicKey: guestKeyPrefix + "x"}
+	if err := s.Backplane.SetPresence(Presence{Node: "test-node", User: guest}); err != nil {
+		t.Fatal(err)
+	}
+
+	alice.send(REQUEST_FILES, map[string]any{"public_key": guest.PublicKey})
+	alice.expectError("cannot request files from a guest")
+	var n int64
+	s.DB.Model(&FileRequest{}).Count(&n)
+	if n != 0 {
+		t.Fatalf("%d requests stored", n)
+	}
+}
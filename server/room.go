@@ -0,0 +1,314 @@
+package server
+
+import (
+	"crypto/rand"
+	"errors"
+	"math/big"
+	"strconv"
+	"time"
+
+	"github.com/mitchellh/mapstructure"
+)
+
+// Code rooms pair a sender with someone who isn't on their share list, in
+// the style of magic-wormhole. The server only hands out the nameplate, the
+// number in front of a code like "7-guitar-orbit": the words are made up
+// by the sender's client and never reach the server. Both clients run a
+// PAKE over the full code through CODE_ROOM_PAKE, binding the transaction
+// id and both public keys from CODE_ROOM_JOIN into its transcript, and
+// confirm the key they derived. The same key MACs the DTLS fingerprints in
+// their WebRTC offer and answer. A server that relays wrong messages or
+// names the wrong peer only makes the pairing or the connection fail. A
+// nameplate can be claimed once, a wrong guess burns the room.
+const (
+	codeRoomTTL     = 10 * time.Minute
+	maxPakeMessage  = 4096 // bytes of an opaque CODE_ROOM_PAKE payload
+	nameplateTrials = 16   // per nameplate length before trying a longer one
+)
+
+// roomID is the key of a room in Server.CodeRooms and the backplane topic
+// suffix of its owner node.
+func roomID(nameplate string) string { return "room:" + nameplate }
+
+// codeRoomPeer is what each side of a room sees of the other. Both get the
+// transaction id, the clients bind it into the PAKE transcript.
+type codeRoomPeer struct {
+	Nameplate     string      `json:"nameplate"`
+	TransactionID string      `json:"transaction_id"`
+	User          MinimalUser `json:"user"`
+}
+
+// openRoom handles CODE_ROOM: the sender of a transaction asks for a
+// nameplate to build a code from.
+func (ws *wsSession) openRoom(msg WSMessage) {
+	s, mUser := ws.s, ws.mUser
+	var data struct {
+		TransactionID string `mapstructure:"transaction_id"`
+	}
+	if err := mapstructure.Decode(msg.Data, &data); err != nil {
+		sendUser(s, mUser, ERROR, "invalid data for CODE_ROOM")
+		return
+	}
+
+	s.TransactionMu.RLock()
+	tx, ok := s.Transactions[data.TransactionID]
+	s.TransactionMu.RUnlock()
+	if !ok {
+		sendUser(s, mUser, ERROR, "transaction not found or expired")
+		return
+	}
+	if !tx.Sender.Is(mUser) {
+		sendUser(s, mUser, ERROR, "not authorized to modify this transaction")
+		return
+	}
+
+	room, err := newRoom(s, tx, mUser)
+	if err != nil {
+		mUser.Log.Error("Failed to open code room", "tx_id", tx.ID, "err", err)
+		sendUser(s, mUser, ERROR, "failed to open code room")
+		return
+	}
+	mUser.Log.Info("Code room opened", "tx_id", tx.ID, "nameplate", room.Nameplate)
+	sendUser(s, mUser, CODE_ROOM, struct {
+		Nameplate     string    `json:"nameplate"`
+		TransactionID string    `json:"transaction_id"`
+		ExpiresAt     time.Time `json:"expires_at"`
+	}{room.Nameplate, tx.ID, room.CreatedAt.Add(codeRoomTTL)})
+}
+
+// newRoom picks a free nameplate, short ones first, and subscribes to it so
+// joins from other nodes find this one.
+func newRoom(s *Server, tx *Transaction, sender *ManagedUser) (*CodeRoom, error) {
+	for limit := int64(100); limit <= 100000; limit *= 10 {
+		for range nameplateTrials {
+			n, err := rand.Int(rand.Reader, big.NewInt(limit-1))
+			if err != nil {
+				return nil, err
+			}
+			nameplate := strconv.FormatInt(n.Int64()+1, 10)
+			id := roomID(nameplate)
+			if roomTaken(s, id) {
+				continue
+			}
+
+			// Subscribe before the room is listed, so closeRoom and
+			// purgeCodeRooms never see it without Unsubscribe.
+			unsubscribe, err := s.Backplane.Subscribe(txTopic(id), func(payload []byte) {
+				handleEnvelope(s, payload)
+			})
+			if err != nil {
+				return nil, err
+			}
+			room := &CodeRoom{
+				Nameplate:     nameplate,
+				TransactionID: tx.ID,
+				Sender:        sender,
+				CreatedAt:     time.Now(),
+				Unsubscribe:   unsubscribe,
+			}
+			s.TransactionMu.Lock()
+			if _, ok := s.CodeRooms[id]; ok {
+				s.TransactionMu.Unlock()
+				unsubscribe()
+				continue
+			}
+			s.CodeRooms[id] = room
+			s.TransactionMu.Unlock()
+			return room, nil
+		}
+	}
+	return nil, errors.New("no free nameplate")
+}
+
+// roomTaken says whether a node holds room id.
+func roomTaken(s *Server, id string) bool {
+	s.TransactionMu.RLock()
+	_, ok := s.CodeRooms[id]
+	s.TransactionMu.RUnlock()
+	return ok || topicHeld(s, txTopic(id))
+}
+
+// joinRoom handles CODE_ROOM_JOIN from the receiver, who typed the code and
+// sends its nameplate. Discoverability doesn't matter here.
+func (ws *wsSession) joinRoom(msg WSMessage) {
+	s, mUser := ws.s, ws.mUser
+	var data struct {
+		Nameplate string `mapstructure:"nameplate"`
+	}
+	if err := mapstructure.Decode(msg.Data, &data); err != nil {
+		sendUser(s, mUser, ERROR, "invalid data for CODE_ROOM_JOIN")
+		return
+	}
+
+	s.TransactionMu.Lock()
+	room, ok := s.CodeRooms[roomID(data.Nameplate)]
+	if !ok || room.Receiver != nil {
+		s.TransactionMu.Unlock()
+		sendUser(s, mUser, ERROR, "code not found or already used")
+		return
+	}
+	if room.Sender.Is(mUser) {
+		s.TransactionMu.Unlock()
+		sendUser(s, mUser, ERROR, "cannot join your own code room")
+		return
+	}
+	room.Receiver = mUser
+	s.TransactionMu.Unlock()
+
+	mUser.Log.Info("Code room joined", "nameplate", room.Nameplate, "tx_id", room.TransactionID)
+	sendUser(s, room.Sender, CODE_ROOM_JOIN, codeRoomPeer{room.Nameplate, room.TransactionID, mUser.MinUser})
+	sendUser(s, mUser, CODE_ROOM_JOIN, codeRoomPeer{room.Nameplate, room.TransactionID, room.Sender.MinUser})
+}
+
+// relayPake handles CODE_ROOM_PAKE, passing a PAKE or key confirmation
+// message to the other side of the room. The server can't read them.
+func (ws *wsSession) relayPake(msg WSMessage) {
+	s, mUser := ws.s, ws.mUser
+	var data struct {
+		Nameplate string `mapstructure:"nameplate"`
+		Payload   string `mapstructure:"payload"`
+	}
+	if err := mapstructure.Decode(msg.Data, &data); err != nil {
+		sendUser(s, mUser, ERROR, "invalid data for CODE_ROOM_PAKE")
+		return
+	}
+	if len(data.Payload) > maxPakeMessage {
+		ws.tooLarge("pake message too large")
+		return
+	}
+
+	room, peer := roomPeer(s, data.Nameplate, mUser)
+	if peer == nil {
+		sendUser(s, mUser, ERROR, "not a member of this code room")
+		return
+	}
+	sendUser(s, peer, CODE_ROOM_PAKE, struct {
+		Nameplate string `json:"nameplate"`
+		Payload   string `json:"payload"`
+	}{room.Nameplate, data.Payload})
+}
+
+// confirmRoom handles CODE_ROOM_CONFIRM. Once the sender checked the
+// receiver's key confirmation it sends ok and the receiver becomes a
+// target of the transaction. Either side ends the room with ok false when
+// the confirmation doesn't match.
+func (ws *wsSession) confirmRoom(msg WSMessage) {
+	s, mUser := ws.s, ws.mUser
+	var data struct {
+		Nameplate string `mapstructure:"nameplate"`
+		OK        bool   `mapstructure:"ok"`
+	}
+	if err := mapstructure.Decode(msg.Data, &data); err != nil {
+		sendUser(s, mUser, ERROR, "invalid data for CODE_ROOM_CONFIRM")
+		return
+	}
+
+	room, peer := roomPeer(s, data.Nameplate, mUser)
+	if peer == nil {
+		sendUser(s, mUser, ERROR, "not a member of this code room")
+		return
+	}
+	if data.OK && !room.Sender.Is(mUser) {
+		sendUser(s, mUser, ERROR, "only the sender confirms a code room")
+		return
+	}
+	closeRoom(s, room)
+
+	result := struct {
+		Nameplate     string `json:"nameplate"`
+		TransactionID string `json:"transaction_id"`
+		OK            bool   `json:"ok"`
+	}{room.Nameplate, room.TransactionID, data.OK}
+	if !data.OK {
+		mUser.Log.Warn("Code room key confirmation failed", "nameplate", room.Nameplate, "tx_id", room.TransactionID)
+		sendUser(s, room.Sender, CODE_ROOM_CONFIRM, result)
+		sendUser(s, room.Receiver, CODE_ROOM_CONFIRM, result)
+		return
+	}
+
+	s.TransactionMu.Lock()
+	tx, ok := s.Transactions[room.TransactionID]
+	full := ok && len(tx.Targets) >= maxTargets(s, tx.Sender.MinUser.PublicKey)
+	if ok && !full {
+		kept := tx.Targets[:0]
+		for _, target := range tx.Targets {
+			if !target.User.Is(room.Receiver) {
+				kept = append(kept, target)
+			}
+		}
+		tx.Targets = append(kept, &TransactionTarget{User: room.Receiver, Status: Pending, InvitedAt: time.Now()})
+	}
+	s.TransactionMu.Unlock()
+	if !ok || full {
+		result.OK = false
+		sendUser(s, room.Sender, CODE_ROOM_CONFIRM, result)
+		sendUser(s, room.Receiver, CODE_ROOM_CONFIRM, result)
+		if full {
+			ws.tooLarge("too many targets")
+		} else {
+			sendUser(s, mUser, ERROR, "transaction not found or expired")
+		}
+		return
+	}
+
+	mUser.Log.Info("Code room confirmed", "nameplate", room.Nameplate, "tx_id", tx.ID, "target", room.Receiver.MinUser.PublicKey)
+	sendUser(s, room.Sender, CODE_ROOM_CONFIRM, result)
+	sendUser(s, room.Receiver, CODE_ROOM_CONFIRM, result)
+
+	s.TransactionMu.RLock()
+	sendUser(s, room.Receiver, TRANSACTION_SHARE_ACCEPT, struct {
+		Transaction *Transaction `json:"transaction"`
+		Sender      string       `json:"sender"`
+	}{tx, tx.Sender.MinUser.Username})
+	s.TransactionMu.RUnlock()
+}
+
+// roomPeer returns the room with nameplate and the side of it that isn't
+// mUser, nil when mUser isn't in a paired room.
+func roomPeer(s *Server, nameplate string, mUser *ManagedUser) (*CodeRoom, *ManagedUser) {
+	s.TransactionMu.RLock()
+	defer s.TransactionMu.RUnlock()
+	room, ok := s.CodeRooms[roomID(nameplate)]
+	if !ok || room.Receiver == nil {
+		return nil, nil
+	}
+	switch {
+	case room.Sender.Is(mUser):
+		return room, room.Receiver
+	case room.Receiver.Is(mUser):
+		return room, room.Sender
+	}
+	return nil, nil
+}
+
+func closeRoom(s *Server, room *CodeRoom) {
+	s.TransactionMu.Lock()
+	defer s.TransactionMu.Unlock()
+	if s.CodeRooms[roomID(room.Nameplate)] == room {
+		room.Unsubscribe()
+		delete(s.CodeRooms, roomID(room.Nameplate))
+	}
+}
+
+// dropRooms closes the rooms pairing into transaction txID once it is
+// deleted. The caller holds TransactionMu.
+func dropRooms(s *Server, txID string) {
+	for id, room := range s.CodeRooms {
+		if room.TransactionID == txID {
+			room.Unsubscribe()
+			delete(s.CodeRooms, id)
+		}
+	}
+}
+
+// purgeCodeRooms drops rooms nobody finished pairing in time.
+func purgeCodeRooms(s *Server) {
+	s.TransactionMu.Lock()
+	defer s.TransactionMu.Unlock()
+	for id, room := range s.CodeRooms {
+		if time.Since(room.CreatedAt) > codeRoomTTL {
+			room.Unsubscribe()
+			delete(s.CodeRooms, id)
+		}
+	}
+}
@@ -2,14 +2,18 @@ package server
 
 import (
 	"fmt"
+	"gopherdrop/frontend"
 	"gopherdrop/helper"
-	"log"
+	"io/fs"
+	"os"
+	"strings"
 	"time"
 
 	jwtware "github.com/gofiber/contrib/jwt"
 	"github.com/gofiber/fiber/v2"
 	"github.com/gofiber/websocket/v2"
 	"github.com/golang-jwt/jwt/v5"
+	"github.com/google/uuid"
 )
 
 var Counter int = 0
@@ -31,10 +35,12 @@ func resp(c *fiber.Ctx, ret Ret, code int) error {
 }
 
 func SetupRegister(s *Server, group fiber.Router) {
-	group.Post("/register", func(c *fiber.Ctx) error {
+	group.Post("/register", LimitByIP(s.IPLimiter), func(c *fiber.Ctx) error {
 		var b struct {
 			Username  string `json:"username"`
 			PublicKey string `json:"public_key"`
+			Challenge string `json:"challenge"`
+			Signature string `json:"signature"`
 		}
 
 		if err := c.BodyParser(&b); err != nil {
@@ -45,57 +51,87 @@ func SetupRegister(s *Server, group fiber.Router) {
 			return resp(c, cret(false, "Username and PublicKey are required", nil), fiber.StatusBadRequest)
 		}
 
+		if ok, retry := s.KeyLimiter.Allow(b.PublicKey); !ok {
+			return tooManyRequests(c, retry)
+		}
+
+		if err := helper.ValidatePublicKey(b.PublicKey); err != nil {
+			return resp(c, cret(false, err.Error(), nil), fiber.StatusBadRequest)
+		}
+
+		// Proof of possession: the caller must sign a fresh challenge with
+		// the private key of the public key being registered.
+		if err := s.ConsumeChallenge(b.Challenge); err != nil {
+			return resp(c, cret(false, err.Error(), nil), fiber.StatusBadRequest)
+		}
+		valid, err := helper.VerifySignature(b.PublicKey, b.Challenge, b.Signature)
+		if err != nil || !valid {
+			return resp(c, cret(false, "Authentication failed", nil), fiber.StatusBadRequest)
+		}
+		if s.IsBanned(b.PublicKey) {
+			return resp(c, cret(false, ErrKeyBanned.Error(), nil), fiber.StatusForbidden)
+		}
+
+		username, err := CheckUsername(s.DB, b.Username, 0)
+		if err != nil {
+			return resp(c, cret(false, err.Error(), nil), fiber.StatusBadRequest)
+		}
+
 		newUser := User{
-			Username:       b.Username,
+			Username:       username,
 			PublicKey:      b.PublicKey,
 			CreatedAt:      time.Now(),
 			IsDiscoverable: true,
 		}
 
 		if err := s.DB.Create(&newUser).Error; err != nil {
-			return resp(c, cret(false, "Username might already exist", nil), fiber.StatusBadRequest)
+			return resp(c, cret(false, "Username or public key already registered", nil), fiber.StatusBadRequest)
+		}
+
+		codes, err := GenerateRecoveryCodes(s.DB, newUser.ID)
+		if err != nil {
+			return resp(c, cret(false, "Failed to generate recovery codes", nil), fiber.StatusInternalServerError)
 		}
 
-		return resp(c, cret(true, "user", newUser), fiber.StatusOK)
+		return resp(c, cret(true, "user", struct {
+			User          User     `json:"user"`
+			RecoveryCodes []string `json:"recovery_codes"`
+		}{newUser, codes}), fiber.StatusOK)
 	})
 }
 
 func SetupChallange(s *Server, group fiber.Router) {
-	if s.Challenges == nil {
-		s.Challenges = make(map[string]time.Time)
-	}
-	group.Get("/challenge", func(c *fiber.Ctx) error {
-		challenge, _ := helper.GenerateChallenge()
-		s.ChallengeMu.Lock()
-		s.Challenges[challenge] = time.Now().Add(2 * time.Minute)
-		s.ChallengeMu.Unlock()
+	group.Get("/challenge", LimitByIP(s.IPLimiter), func(c *fiber.Ctx) error {
+		challenge, err := s.IssueChallenge()
+		if err != nil {
+			return resp(c, cret(false, "Failed to generate challenge", nil), fiber.StatusInternalServerError)
+		}
+		s.Metrics.Challenges.Inc()
 		return resp(c, cret(true, "challenge", challenge), fiber.StatusOK)
 	})
 }
 
 func SetupLogin(s *Server, group fiber.Router) {
-	group.Post("/login", func(c *fiber.Ctx) error {
+	group.Post("/login", LimitByIP(s.IPLimiter), func(c *fiber.Ctx) error {
 		var b struct {
 			PubKey    string `json:"public_key"`
 			Challenge string `json:"challenge"`
 			Signature string `json:"signature"`
 		}
 
+		success := false
+		defer func() { s.Metrics.LoginResult(success) }()
+
 		if err := c.BodyParser(&b); err != nil {
 			return resp(c, cret(false, "Invalid body", nil), fiber.StatusBadRequest)
 		}
 
-		s.ChallengeMu.Lock()
-		expiry, exists := s.Challenges[b.Challenge]
-		if exists {
-			delete(s.Challenges, b.Challenge)
-		}
-		s.ChallengeMu.Unlock()
-		if !exists {
-			return resp(c, cret(false, "Invalid challenge", nil), fiber.StatusBadRequest)
+		if ok, retry := s.KeyLimiter.Allow(b.PubKey); !ok {
+			return tooManyRequests(c, retry)
 		}
-		if time.Now().After(expiry) {
-			return resp(c, cret(false, "Challenge expired", nil), fiber.StatusBadRequest)
+
+		if err := s.ConsumeChallenge(b.Challenge); err != nil {
+			return resp(c, cret(false, err.Error(), nil), fiber.StatusBadRequest)
 		}
 
 		var user User
@@ -108,20 +144,215 @@ func SetupLogin(s *Server, group fiber.Router) {
 		if err != nil || !valid {
 			return resp(c, cret(false, "Authentication failed", nil), fiber.StatusBadRequest)
 		}
-
-		claims := jwt.MapClaims{
-			"username":   user.Username,
-			"public_key": user.PublicKey,
-			"exp":        time.Now().Add(time.Hour * 72).Unix(),
+		if s.IsBanned(user.PublicKey) {
+			return resp(c, cret(false, ErrKeyBanned.Error(), nil), fiber.StatusForbidden)
 		}
-		token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
 
-		t, err := token.SignedString([]byte(s.Pass))
+		pair, err := s.IssueTokenPair(user)
 		if err != nil {
 			return resp(c, cret(false, fmt.Sprintf("Failed to generate JWT, %v", err), nil), fiber.StatusInternalServerError)
 		}
 
-		return resp(c, cret(true, "token", t), fiber.StatusOK)
+		success = true
+		s.Log.Info("User logged in", "user", user.Username, "public_key", user.PublicKey, "ip", c.IP())
+		return resp(c, cret(true, "token", pair), fiber.StatusOK)
+	})
+}
+
+func SetupRefresh(s *Server, group fiber.Router) {
+	group.Post("/refresh", LimitByIP(s.IPLimiter), func(c *fiber.Ctx) error {
+		var b struct {
+			RefreshToken string `json:"refresh_token"`
+		}
+
+		if err := c.BodyParser(&b); err != nil || b.RefreshToken == "" {
+			return resp(c, cret(false, "Invalid body", nil), fiber.StatusBadRequest)
+		}
+
+		pair, err := s.RotateRefreshToken(b.RefreshToken)
+		if err == ErrRefreshReused {
+			s.Log.Warn("Refresh token reuse detected, family revoked", "ip", c.IP())
+		}
+		if err != nil {
+			return resp(c, cret(false, err.Error(), nil), fiber.StatusUnauthorized)
+		}
+
+		return resp(c, cret(true, "token", pair), fiber.StatusOK)
+	})
+}
+
+func SetupLogout(s *Server, group fiber.Router) {
+	group.Post("/logout", func(c *fiber.Ctx) error {
+		claims, err := helper.GetJWT(c)
+		if err != nil {
+			return resp(c, cret(false, err.Error(), nil), fiber.StatusUnauthorized)
+		}
+
+		var b struct {
+			RefreshToken string `json:"refresh_token"`
+		}
+		_ = c.BodyParser(&b)
+
+		var user User
+		if err := s.DB.Where("public_key = ?", claims["public_key"]).First(&user).Error; err != nil {
+			return resp(c, cret(false, "User not found", nil), fiber.StatusBadRequest)
+		}
+
+		if b.RefreshToken != "" {
+			if err := s.RevokeRefreshToken(user.ID, b.RefreshToken); err != nil {
+				return resp(c, cret(false, err.Error(), nil), fiber.StatusBadRequest)
+			}
+		}
+
+		jti, _ := claims["jti"].(string)
+		exp, _ := claims["exp"].(float64)
+		if err := s.RevokeJTI(jti, time.Unix(int64(exp), 0)); err != nil {
+			return resp(c, cret(false, "Failed to revoke token", nil), fiber.StatusInternalServerError)
+		}
+
+		return resp(c, cret(true, "Logged out", nil), fiber.StatusOK)
+	})
+
+	group.Post("/logout/all", func(c *fiber.Ctx) error {
+		claims, err := helper.GetJWT(c)
+		if err != nil {
+			return resp(c, cret(false, err.Error(), nil), fiber.StatusUnauthorized)
+		}
+
+		var user User
+		if err := s.DB.Where("public_key = ?", claims["public_key"]).First(&user).Error; err != nil {
+			return resp(c, cret(false, "User not found", nil), fiber.StatusBadRequest)
+		}
+
+		if err := s.RevokeAllSessions(user); err != nil {
+			return resp(c, cret(false, "Failed to revoke sessions", nil), fiber.StatusInternalServerError)
+		}
+		s.Log.Info("All sessions revoked", "user", user.Username, "public_key", user.PublicKey)
+
+		return resp(c, cret(true, "All sessions revoked", nil), fiber.StatusOK)
+	})
+}
+
+func SetupKeyRotate(s *Server, group fiber.Router) {
+	group.Post("/key/rotate", LimitByIP(s.IPLimiter), func(c *fiber.Ctx) error {
+		var b struct {
+			PubKey       string `json:"public_key"`
+			NewPubKey    string `json:"new_public_key"`
+			Challenge    string `json:"challenge"`
+			Signature    string `json:"signature"`
+			NewSignature string `json:"new_signature"`
+		}
+
+		if err := c.BodyParser(&b); err != nil {
+			return resp(c, cret(false, "Invalid body", nil), fiber.StatusBadRequest)
+		}
+
+		if ok, retry := s.KeyLimiter.Allow(b.PubKey); !ok {
+			return tooManyRequests(c, retry)
+		}
+
+		if err := s.ConsumeChallenge(b.Challenge); err != nil {
+			return resp(c, cret(false, err.Error(), nil), fiber.StatusBadRequest)
+		}
+
+		var user User
+		if err := s.DB.Where("public_key = ?", b.PubKey).First(&user).Error; err != nil {
+			return resp(c, cret(false, "User not found", nil), fiber.StatusBadRequest)
+		}
+
+		// Both keys sign the same challenge: the old one authorizes the
+		// swap, the new one proves the caller actually holds it.
+		valid, err := helper.VerifySignature(user.PublicKey, b.Challenge, b.Signature)
+		if err != nil || !valid {
+			return resp(c, cret(false, "Authentication failed", nil), fiber.StatusBadRequest)
+		}
+		valid, err = helper.VerifySignature(b.NewPubKey, b.Challenge, b.NewSignature)
+		if err != nil || !valid {
+			return resp(c, cret(false, "New key signature invalid", nil), fiber.StatusBadRequest)
+		}
+
+		user, err = s.ChangePublicKey(user, b.NewPubKey, KeyChangeRotate, c.IP())
+		if err != nil {
+			return resp(c, cret(false, err.Error(), nil), fiber.StatusBadRequest)
+		}
+
+		return resp(c, cret(true, "user", user), fiber.StatusOK)
+	})
+}
+
+func SetupRecover(s *Server, group fiber.Router) {
+	group.Post("/recover", LimitByIP(s.IPLimiter), func(c *fiber.Ctx) error {
+		var b struct {
+			Username     string `json:"username"`
+			RecoveryCode string `json:"recovery_code"`
+			NewPubKey    string `json:"new_public_key"`
+			Challenge    string `json:"challenge"`
+			NewSignature string `json:"new_signature"`
+		}
+
+		if err := c.BodyParser(&b); err != nil {
+			return resp(c, cret(false, "Invalid body", nil), fiber.StatusBadRequest)
+		}
+
+		if ok, retry := s.KeyLimiter.Allow("recover:" + b.Username); !ok {
+			return tooManyRequests(c, retry)
+		}
+
+		if err := s.ConsumeChallenge(b.Challenge); err != nil {
+			return resp(c, cret(false, err.Error(), nil), fiber.StatusBadRequest)
+		}
+
+		valid, err := helper.VerifySignature(b.NewPubKey, b.Challenge, b.NewSignature)
+		if err != nil || !valid {
+			return resp(c, cret(false, "New key signature invalid", nil), fiber.StatusBadRequest)
+		}
+
+		user, err := s.RecoverAccount(b.Username, strings.TrimSpace(b.RecoveryCode), b.NewPubKey, c.IP())
+		if err != nil {
+			return resp(c, cret(false, err.Error(), nil), fiber.StatusBadRequest)
+		}
+
+		return resp(c, cret(true, "user", user), fiber.StatusOK)
+	})
+}
+
+func SetupRecoveryCodes(s *Server, group fiber.Router) {
+	group.Post("/recovery-codes", func(c *fiber.Ctx) error {
+		claims, err := helper.GetJWT(c)
+		if err != nil {
+			return resp(c, cret(false, err.Error(), nil), fiber.StatusUnauthorized)
+		}
+
+		var user User
+		if err := s.DB.Where("public_key = ?", claims["public_key"]).First(&user).Error; err != nil {
+			return resp(c, cret(false, "User not found", nil), fiber.StatusBadRequest)
+		}
+
+		codes, err := GenerateRecoveryCodes(s.DB, user.ID)
+		if err != nil {
+			return resp(c, cret(false, "Failed to generate recovery codes", nil), fiber.StatusInternalServerError)
+		}
+
+		return resp(c, cret(true, "recovery_codes", codes), fiber.StatusOK)
+	})
+
+	group.Get("/key/history", func(c *fiber.Ctx) error {
+		claims, err := helper.GetJWT(c)
+		if err != nil {
+			return resp(c, cret(false, err.Error(), nil), fiber.StatusUnauthorized)
+		}
+
+		var user User
+		if err := s.DB.Where("public_key = ?", claims["public_key"]).First(&user).Error; err != nil {
+			return resp(c, cret(false, "User not found", nil), fiber.StatusBadRequest)
+		}
+
+		var changes []KeyChange
+		if err := s.DB.Where("user_id = ?", user.ID).Order("created_at desc").Find(&changes).Error; err != nil {
+			return resp(c, cret(false, "Failed to load key history", nil), fiber.StatusInternalServerError)
+		}
+
+		return resp(c, cret(true, "key_history", changes), fiber.StatusOK)
 	})
 }
 
@@ -139,20 +370,104 @@ func SetupUpdateProfile(s *Server, group fiber.Router) {
 			return resp(c, cret(false, "Invalid body", nil), fiber.StatusBadRequest)
 		}
 
-		if b.Username == "" {
-			return resp(c, cret(false, "Username is required", nil), fiber.StatusBadRequest)
+		var user User
+		if err := s.DB.Where("public_key = ?", pubKey).First(&user).Error; err != nil {
+			return resp(c, cret(false, "User not found", nil), fiber.StatusBadRequest)
 		}
 
-		if err := s.DB.Model(&User{}).Where("public_key = ?", pubKey).Update("username", b.Username).Error; err != nil {
-			return resp(c, cret(false, "Failed to update profile", nil), fiber.StatusInternalServerError)
+		// RenameUser also updates the open sockets and the share lists of
+		// everyone who sees this user.
+		if _, err := s.RenameUser(user, b.Username); err != nil {
+			return resp(c, cret(false, err.Error(), nil), fiber.StatusBadRequest)
 		}
 
 		return resp(c, cret(true, "Profile updated", nil), fiber.StatusOK)
 	})
 }
 
+func SetupAccount(s *Server, group fiber.Router) {
+	group.Get("/account/export", func(c *fiber.Ctx) error {
+		claims, err := helper.GetJWT(c)
+		if err != nil {
+			return resp(c, cret(false, err.Error(), nil), fiber.StatusUnauthorized)
+		}
+
+		var user User
+		if err := s.DB.Where("public_key = ?", claims["public_key"]).First(&user).Error; err != nil {
+			return resp(c, cret(false, "User not found", nil), fiber.StatusBadRequest)
+		}
+
+		export, err := s.ExportAccount(user)
+		if err != nil {
+			return resp(c, cret(false, "Failed to export account", nil), fiber.StatusInternalServerError)
+		}
+
+		c.Set(fiber.HeaderContentDisposition, `attachment; filename="gopherdrop-account.json"`)
+		return resp(c, cret(true, "account", export), fiber.StatusOK)
+	})
+
+	group.Delete("/account", func(c *fiber.Ctx) error {
+		claims, err := helper.GetJWT(c)
+		if err != nil {
+			return resp(c, cret(false, err.Error(), nil), fiber.StatusUnauthorized)
+		}
+
+		var b struct {
+			Challenge string `json:"challenge"`
+			Signature string `json:"signature"`
+		}
+		if err := c.BodyParser(&b); err != nil {
+			return resp(c, cret(false, "Invalid body", nil), fiber.StatusBadRequest)
+		}
+
+		var user User
+		if err := s.DB.Where("public_key = ?", claims["public_key"]).First(&user).Error; err != nil {
+			return resp(c, cret(false, "User not found", nil), fiber.StatusBadRequest)
+		}
+
+		if ok, retry := s.KeyLimiter.Allow(user.PublicKey); !ok {
+			return tooManyRequests(c, retry)
+		}
+
+		// A stolen access token alone must not be enough to delete the
+		// account, the private key has to sign a fresh challenge too.
+		if err := s.ConsumeChallenge(b.Challenge); err != nil {
+			return resp(c, cret(false, err.Error(), nil), fiber.StatusBadRequest)
+		}
+		valid, err := helper.VerifySignature(user.PublicKey, b.Challenge, b.Signature)
+		if err != nil || !valid {
+			return resp(c, cret(false, "Authentication failed", nil), fiber.StatusBadRequest)
+		}
+
+		if err := s.DeleteAccount(user); err != nil {
+			return resp(c, cret(false, "Failed to delete account", nil), fiber.StatusInternalServerError)
+		}
+		return resp(c, cret(true, "Account deleted", nil), fiber.StatusOK)
+	})
+}
+
+// SetupJWKS publishes the public JWT keys so other services can verify our tokens
+func SetupJWKS(s *Server) {
+	s.App.Get("/.well-known/jwks.json", func(c *fiber.Ctx) error {
+		c.Set(fiber.HeaderCacheControl, "public, max-age=300")
+		return c.JSON(s.Keys.JWKS())
+	})
+}
+
+// SetupStaticFrontEnd serves the frontend embedded in the binary, or the
+// GDROP_FRONTEND_DIR directory when set (for working on the frontend).
 func SetupStaticFrontEnd(s *Server) {
-	s.App.Static("/", "./frontend")
+	var fsys fs.FS = frontend.Files
+	live := s.Config.FrontendDir != ""
+	if live {
+		fsys = os.DirFS(s.Config.FrontendDir)
+	}
+	site, err := NewStaticSite(fsys, live)
+	if err != nil {
+		s.Log.Error("Failed to load the frontend", "err", err)
+		return
+	}
+	s.App.Get("/*", site.Handler())
 }
 
 // SetupNetworkInfo provides endpoint for getting current network SSID
@@ -163,8 +478,48 @@ func SetupNetworkInfo(group fiber.Router) {
 	})
 }
 
+// SetupHealth provides liveness (process is up) and readiness (DB reachable
+// and not shutting down) probes
+func SetupHealth(s *Server) {
+	s.App.Get("/healthz", func(c *fiber.Ctx) error {
+		return resp(c, cret(true, "ok", nil), fiber.StatusOK)
+	})
+	s.App.Get("/readyz", func(c *fiber.Ctx) error {
+		if s.Draining.Load() {
+			return resp(c, cret(false, "shutting down", nil), fiber.StatusServiceUnavailable)
+		}
+		sqlDB, err := s.DB.DB()
+		if err == nil {
+			err = sqlDB.PingContext(c.Context())
+		}
+		if err != nil {
+			return resp(c, cret(false, "database unavailable", nil), fiber.StatusServiceUnavailable)
+		}
+		return resp(c, cret(true, "ready", nil), fiber.StatusOK)
+	})
+}
+
+// drainGate refuses new WebSocket upgrades once shutdown has started.
+func drainGate(s *Server) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		if s.Draining.Load() {
+			return fiber.ErrServiceUnavailable
+		}
+		return c.Next()
+	}
+}
+
 func SetupWebSocketEndPoint(s *Server, group fiber.Router) {
-	group.Use("/ws", helper.WebSocketJWTGate)
+	group.Use("/ws", drainGate(s), OriginGate(s.CORS), helper.WebSocketJWTGate, func(c *fiber.Ctx) error {
+		// The socket handler has no access to the request anymore.
+		c.Locals("ip", c.IP())
+		if raw, ok := strings.CutPrefix(c.Get(fiber.HeaderAuthorization), "Bearer "); ok {
+			c.Locals("token", raw)
+		} else {
+			c.Locals("token", c.Query("token"))
+		}
+		return c.Next()
+	})
 	group.Get("/ws", websocket.New(func(conn *websocket.Conn) {
 		claims, ok := conn.Locals("claims").(jwt.MapClaims)
 		if !ok {
@@ -174,6 +529,7 @@ func SetupWebSocketEndPoint(s *Server, group fiber.Router) {
 		pubkey := claims["public_key"].(string)
 		expUnix := int64(claims["exp"].(float64))
 		expTime := time.Unix(expUnix, 0)
+		jti, _ := claims["jti"].(string)
 
 		s.MUserMu.Lock()
 		for _, managedUser := range s.MUser {
@@ -189,32 +545,71 @@ func SetupWebSocketEndPoint(s *Server, group fiber.Router) {
 		}
 		s.MUserMu.Unlock()
 
+		// Guests have no row, their identity is the token.
+		guest := claims["typ"] == "guest"
 		var user User
-		if err := s.DB.Where("public_key = ?", pubkey).First(&user).Error; err != nil {
+		var linkTx string
+		if guest {
+			linkTx, _ = claims["tx"].(string)
+			username, _ := claims["username"].(string)
+			user = User{Username: username, PublicKey: pubkey}
+		} else if err := s.DB.Where("public_key = ?", pubkey).First(&user).Error; err != nil {
 			return
 		}
 
 		s.MUserMu.Lock()
 
+		connID := uuid.New().String()
 		muser := &ManagedUser{
-			MinUser:   MinimalUser{user.Username, user.PublicKey}, // to send to network
-			User:      user,
-			Conn:      conn,
-			JWTExpiry: expTime,
+			MinUser:     MinimalUser{user.Username, user.PublicKey}, // to send to network
+			User:        user,
+			Conn:        conn,
+			ConnID:      connID,
+			IP:          fmt.Sprint(conn.Locals("ip")),
+			ConnectedAt: time.Now(),
+			JWTExpiry:   expTime,
+			JTI:         jti,
+			Guest:       guest,
+			LinkTx:      linkTx,
+			Log: s.Log.With(
+				"conn_id", connID,
+				"request_id", conn.Locals("requestid"),
+				"user", user.Username,
+				"public_key", user.PublicKey,
+			),
 		}
 		s.MUser[conn] = muser
 
-		s.MUserMu.Unlock()
-
+		s.CachedUserMu.Lock()
 		if len(s.CachedUser) <= 0 {
 			CacheDiscoverableUser(s)
 		} else {
 			AddCachedUser(s, muser)
 		}
+		s.CachedUserMu.Unlock()
+
+		s.MUserMu.Unlock()
+
+		unsubscribe, err := subscribeUser(s, muser)
+		if err != nil {
+			muser.Log.Error("Failed to subscribe to the backplane", "err", err)
+			unsubscribe = func() {}
+		}
+		announce(s, muser)
+		muser.Log.Info("WS connected", "guest", guest)
+		if linkTx != "" {
+			// Guests from a share link join its transaction right away.
+			join := WSMessage{WSType: SHARE_LINK_JOIN, Data: map[string]any{"transaction_id": linkTx, "token": conn.Locals("token")}}
+			if !forwardTransaction(s, muser, linkTx, join) {
+				(&wsSession{s: s, mUser: muser}).handle(join)
+			}
+		} else if !guest {
+			deliverInbox(s, muser)
+		}
 
 		defer func() {
 			s.CachedUserMu.Lock()
-			DelCachedUser(s, s.MUser[conn].User.ID)
+			DelCachedConn(s, muser)
 			s.CachedUserMu.Unlock()
 
 			conn.Close()
@@ -223,7 +618,13 @@ func SetupWebSocketEndPoint(s *Server, group fiber.Router) {
 			delete(s.MUser, conn)
 			s.MUserMu.Unlock()
 
-			log.Println("WS disconnected user:", claims["username"])
+			unsubscribe()
+			withdraw(s, muser)
+			if guest {
+				dropGuest(s, muser)
+			}
+
+			muser.Log.Info("WS disconnected")
 		}()
 
 		HandleWS(s, muser)
@@ -233,17 +634,33 @@ func SetupWebSocketEndPoint(s *Server, group fiber.Router) {
 func (s *Server) SetupAllEndPoint() {
 	api_pub := s.App.Group("/api/v1/")
 	protected := api_pub.Group("/protected", jwtware.New(jwtware.Config{
-		SigningKey:  jwtware.SigningKey{Key: []byte(s.Pass)},
-		TokenLookup: "header:Authorization,query:token",
-		AuthScheme:  "Bearer",
+		KeyFunc:        s.Keys.KeyFunc,
+		TokenLookup:    "header:Authorization,query:token",
+		AuthScheme:     "Bearer",
+		SuccessHandler: JWTRevocationGate(s),
 	}))
+	admin := api_pub.Group("/admin", LimitByIP(s.IPLimiter), AdminGate(s))
+
+	// GET: /healthz, /readyz
+	// liveness and readiness probes
+	SetupHealth(s)
+
+	// GET: /metrics
+	// Prometheus metrics (Bearer GDROP_METRICS_TOKEN, off without it)
+	SetupMetrics(s)
+
+	// GET: /.well-known/jwks.json
+	// public keys (JWK Set) for verifying tokens issued by this server
+	SetupJWKS(s)
 
 	// GET: /
 	SetupStaticFrontEnd(s)
 
 	// POST: /api/v1/register
 	// to register from the name client provided
-	// - data: username: string
+	// - data: username, public_key, challenge, signature string
+	// NOTE: like login, `signature` is the challenge signed with the private key of `public_key`.
+	// NOTE: the response holds the recovery codes, they are never shown again.
 	SetupRegister(s, api_pub)
 
 	// POST: /api/v1/login
@@ -253,10 +670,38 @@ func (s *Server) SetupAllEndPoint() {
 	//       of sign with your private key is `signature`.
 	SetupLogin(s, api_pub)
 
+	// POST: /api/v1/refresh
+	// to trade a refresh token for a new access + refresh token pair
+	// - data: refresh_token string
+	// NOTE: refresh tokens are single use, reusing an old one revokes the whole chain.
+	SetupRefresh(s, api_pub)
+
+	// POST: /api/v1/key/rotate
+	// swap the account's public key for a new one
+	// - data: public_key, new_public_key, challenge, signature, new_signature string
+	// NOTE: `signature` is the challenge signed by the old key and `new_signature` by the new key.
+	SetupKeyRotate(s, api_pub)
+
+	// POST: /api/v1/recover
+	// bind a new public key using one of the recovery codes from registration
+	// - data: username, recovery_code, new_public_key, challenge, new_signature string
+	SetupRecover(s, api_pub)
+
 	// GET: /api/v1/challenge
 	// to get challenge for logging in
 	SetupChallange(s, api_pub)
 
+	// POST: /api/v1/link
+	// open a share link as a guest, answers with a guest access token for the WebSocket
+	// - data: token string, password string (when the link has one), username string (optional)
+	SetupShareLink(s, api_pub)
+
+	// POST: /api/v1/guest
+	// start a guest session without registering, answers with a guest access token for the WebSocket
+	// - data: username string (optional)
+	// NOTE: guests can't refresh, get tighter limits and everything they started goes away on disconnect.
+	SetupGuestLogin(s, api_pub)
+
 	// GET: /api/v1/network/ssid
 	// Get current network SSID (public endpoint)
 	SetupNetworkInfo(api_pub)
@@ -265,8 +710,72 @@ func (s *Server) SetupAllEndPoint() {
 	// Update user profile (username)
 	SetupUpdateProfile(s, protected)
 
+	// POST: /api/v1/protected/logout
+	// revoke the current access token (and optionally its refresh token)
+	// - data: refresh_token string (optional)
+	// POST: /api/v1/protected/logout/all
+	// revoke every token of the user and disconnect all their sockets
+	SetupLogout(s, protected)
+
+	// POST: /api/v1/protected/recovery-codes
+	// replace all recovery codes with a fresh set
+	// GET: /api/v1/protected/key/history
+	// audit log of the account's key changes
+	SetupRecoveryCodes(s, protected)
+
+	// GET: /api/v1/protected/account/export
+	// everything stored about the caller as JSON
+	// DELETE: /api/v1/protected/account
+	// delete the account: sessions are closed, transactions cancelled and all data purged
+	// - data: challenge, signature string
+	// NOTE: `signature` is a fresh challenge signed with the account's private key.
+	SetupAccount(s, protected)
+
+	// GET: /api/v1/protected/auto-accept
+	// the caller's auto-accept rules
+	// POST: /api/v1/protected/auto-accept
+	// add a rule, offers matching it are accepted by the server without a prompt
+	// - data: from []string (sender public keys), contacts bool, groups []string,
+	//   types []string, max_size int (bytes)
+	// DELETE: /api/v1/protected/auto-accept/:id
+	// remove a rule
+	SetupAutoAccept(s, protected)
+
+	// GET: /api/v1/protected/contacts
+	// the caller's contacts with the groups they are in
+	// PUT: /api/v1/protected/contacts
+	// replace the caller's contacts
+	// - data: contacts []{public_key, username, groups []string}
+	SetupContacts(s, protected)
+
 	// GET: /api/v1/protected/ws
 	// to upgrade the connection to websocket for later
 	// use (listing all the near ppl, conn to webrtc)
 	SetupWebSocketEndPoint(s, protected)
+
+	// Admin endpoints take the JWT of an admin user or Bearer GDROP_ADMIN_TOKEN.
+	// GET: /api/v1/admin/users?q=&limit=&offset=
+	// PUT: /api/v1/admin/users/:id
+	// - data: username string, is_admin bool (both optional)
+	// DELETE: /api/v1/admin/users/:id
+	// delete the account with everything stored for it
+	SetupAdminUsers(s, admin)
+
+	// GET: /api/v1/admin/sessions
+	// open sockets, this node's first
+	// DELETE: /api/v1/admin/sessions/:conn_id
+	// force-disconnect a socket, on whichever node holds it
+	SetupAdminSessions(s, admin)
+
+	// GET: /api/v1/admin/bans
+	// POST: /api/v1/admin/bans
+	// - data: public_key, reason string
+	// DELETE: /api/v1/admin/bans
+	// - data: public_key string
+	// NOTE: banning ends every session of the account using the key.
+	SetupAdminBans(s, admin)
+
+	// GET: /api/v1/admin/transactions
+	// live transactions owned by this node
+	SetupAdminTransactions(s, admin)
 }
@@ -1,13 +1,22 @@
 package server
 
 import (
-	"log"
+	"errors"
+	"gopherdrop/helper"
+	"log/slog"
+	"math/rand"
+	"os"
+	"os/signal"
 	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 
 	"github.com/gofiber/fiber/v2"
 	"github.com/gofiber/fiber/v2/middleware/cors"
+	"github.com/gofiber/fiber/v2/middleware/requestid"
 	"github.com/gofiber/websocket/v2"
+	"github.com/google/uuid"
 	"gorm.io/gorm"
 )
 
@@ -19,10 +28,23 @@ type MinimalUser struct {
 }
 
 type ManagedUser struct {
-	MinUser   MinimalUser     `json:"user"`
-	User      User            `json:"-"`
-	Conn      *websocket.Conn `json:"-"`
-	JWTExpiry time.Time       `json:"-"`
+	MinUser     MinimalUser     `json:"user"`
+	User        User            `json:"-"`
+	Conn        *websocket.Conn `json:"-"`
+	ConnID      string          `json:"-"`
+	IP          string          `json:"-"`
+	ConnectedAt time.Time       `json:"-"`
+	JWTExpiry   time.Time       `json:"-"`
+	JTI         string          `json:"-"`
+	Guest       bool            `json:"-"` // no account, see guest.go
+	LinkTx      string          `json:"-"` // the transaction a share link let this guest into
+	Log         *slog.Logger    `json:"-"` // tagged with conn_id and user
+}
+
+// Is tells whether both refer to the same account. Users connected to other
+// nodes are separate values, so pointers can't be compared.
+func (u *ManagedUser) Is(o *ManagedUser) bool {
+	return u.MinUser.PublicKey == o.MinUser.PublicKey
 }
 
 type Transaction struct {
@@ -31,25 +53,89 @@ type Transaction struct {
 	Targets []*TransactionTarget `json:"-"`
 	Files   []*FileInfo          `json:"files"`
 	Started bool                 `json:"started"`
+
+	RequestID string `json:"request_id,omitempty"` // the REQUEST_FILES it answers
+
+	CreatedAt   time.Time `json:"-"`
+	Unsubscribe func()    `json:"-"` // stops taking its messages from other nodes
+}
+
+// TextShare is a SHARE_TEXT offer waiting for its targets to answer. The
+// text only leaves the server for the targets that accept.
+type TextShare struct {
+	ID        string
+	Sender    *ManagedUser
+	Kind      string            // "text" or "url"
+	Encrypted bool              // opaque to the server, see SHARE_TEXT
+	Texts     map[string]string // target public key -> text
+	Targets   []*TransactionTarget
+
+	CreatedAt   time.Time
+	Unsubscribe func()
+}
+
+// CodeRoom pairs the sender of a transaction with whoever joins with its
+// nameplate, see room.go.
+type CodeRoom struct {
+	Nameplate     string
+	TransactionID string
+	Sender        *ManagedUser
+	Receiver      *ManagedUser // nil until someone joins
+
+	CreatedAt   time.Time
+	Unsubscribe func()
 }
 
 type TargetStatus int
 
 const (
-	Pending  TargetStatus = iota // 0
-	Accepted                     // 1
-	Declined                     // 2
+	Pending   TargetStatus = iota // 0
+	Accepted                      // 1
+	Declined                      // 2
+	Cancelled                     // 3, by either side with CANCEL_TRANSFER
 )
 
+// Active tells whether the target may still receive files.
+func (t *TransactionTarget) Active() bool {
+	return t.Status == Pending || t.Status == Accepted
+}
+
 type TransactionTarget struct {
 	User   *ManagedUser `json:"user"`
 	Status TargetStatus `json:"status"`
+	Files  []int        `json:"files,omitempty"` // indexes into Transaction.Files it accepted, nil for all
+
+	AutoAccepted bool      `json:"auto_accepted,omitempty"` // answered by one of its auto-accept rules
+	InvitedAt    time.Time `json:"-"`
+}
+
+// SelectedFiles is the part of files the target accepted. Indexes past the
+// end (the sender replaced the files since) are skipped.
+func (t *TransactionTarget) SelectedFiles(files []*FileInfo) []*FileInfo {
+	if t.Files == nil {
+		return files
+	}
+	selected := make([]*FileInfo, 0, len(t.Files))
+	for _, i := range t.Files {
+		if i < len(files) {
+			selected = append(selected, files[i])
+		}
+	}
+	return selected
 }
 
+// FileInfo is one entry of a transaction manifest. Folder transfers set
+// Path, the slash separated location relative to the shared folder (Name
+// is its last element), and list the directories themselves with IsDir so
+// that empty ones are kept.
 type FileInfo struct {
-	Name string `json:"name"`
-	Size int64  `json:"size"`
-	Type string `json:"type"`
+	Name    string `json:"name" mapstructure:"name"`
+	Size    int64  `json:"size" mapstructure:"size"`
+	Type    string `json:"type" mapstructure:"type"`
+	Path    string `json:"path,omitempty" mapstructure:"path"`
+	IsDir   bool   `json:"is_dir,omitempty" mapstructure:"is_dir"`
+	ModTime int64  `json:"mtime,omitempty" mapstructure:"mtime"` // unix milliseconds
+	Mode    uint32 `json:"mode,omitempty" mapstructure:"mode"`   // permission bits, 0o777 at most
 }
 
 type Server struct {
@@ -57,32 +143,66 @@ type Server struct {
 	App           *fiber.App
 	DB            *gorm.DB
 	Pass          string
-	Challenges    map[string]time.Time
-	ChallengeMu   sync.RWMutex
+	Config        helper.GoDropConfig
+	Keys          *Keyring
+	CORS          *CORSPolicy
 	MUser         map[*websocket.Conn]*ManagedUser
 	MUserMu       sync.RWMutex
 	CachedUser    []*ManagedUser
 	CachedUserMu  sync.RWMutex
 	Transactions  map[string]*Transaction
+	TextShares    map[string]*TextShare // guarded by TransactionMu
+	CodeRooms     map[string]*CodeRoom  // by roomID, guarded by TransactionMu
 	TransactionMu sync.RWMutex
 	WriteMu       sync.RWMutex
+	DeniedJTI     map[string]time.Time
+	RevokedBefore map[string]time.Time
+	DeniedMu      sync.RWMutex
+	IPLimiter     *RateLimiter
+	KeyLimiter    *RateLimiter
+	Metrics       *Metrics
+	Log           *slog.Logger
+	Draining      atomic.Bool // set on shutdown, refuses new WS upgrades
+	NodeID        string
+	Backplane     Backplane
 }
 
-func InitServer(url string, password string) *Server {
+func InitServer(sec helper.GoDropConfig) (*Server, error) {
 	// DB is initialized in main.go and assigned to Server.DB
 
 	app := fiber.New(fiber.Config{
 		AppName: "GopherDrop Backend Ow0",
 	})
 
+	nodeID := sec.NodeID
+	if nodeID == "" {
+		nodeID = uuid.New().String()
+	}
+	logger := slog.Default()
+	if sec.Backplane != "memory" {
+		logger = logger.With("node", nodeID)
+	}
+	app.Use(requestid.New())
+	app.Use(RequestLogger(logger))
+
+	policy := NewCORSPolicy(sec.CORSOrigins, sec.CORSLanMode)
+	// Every origin is echoed back, so "*" with credentials would let any
+	// site make credentialed requests. Fiber refuses the same setup.
+	if policy.AllowAll && sec.CORSCredentials {
+		return nil, errors.New(`insecure CORS setup: GDROP_CORS_ORIGINS is "*" while GDROP_CORS_CREDENTIALS is true`)
+	}
 	app.Use(cors.New(cors.Config{
+		// The policy needs the request host for LAN mode, so the decision is
+		// made in Next and AllowOriginsFunc only echoes what got through.
+		Next: func(c *fiber.Ctx) bool {
+			origin := c.Get(fiber.HeaderOrigin)
+			return origin != "" && !policy.Allowed(origin, c.Hostname())
+		},
 		AllowOriginsFunc: func(origin string) bool {
-			return origin == "https://dev-gopherdrop.vercel.app" ||
-				origin == "http://localhost:3000" ||
-				origin == "http://localhost:5173"
+			return true
 		},
-		AllowCredentials: true,
-		AllowHeaders:     "Origin, Content-Type, Accept, Authorization, Upgrade, Connection, ngrok-skip-browser-warning",
+		AllowCredentials: sec.CORSCredentials,
+		AllowHeaders:     sec.CORSHeaders,
 		AllowMethods:     "GET, POST, PUT, DELETE, OPTIONS",
 	}))
 
@@ -90,35 +210,137 @@ func InitServer(url string, password string) *Server {
 		return c.SendStatus(fiber.StatusNoContent)
 	})
 
-	return &Server{
+	s := &Server{
 		App:          app,
-		Url:          url,
+		Url:          sec.Url,
 		DB:           nil,
-		Pass:         password,
-		Challenges:   make(map[string]time.Time),
+		Pass:         sec.Password,
+		Config:       sec,
+		CORS:         policy,
 		MUser:        make(map[*websocket.Conn]*ManagedUser),
 		Transactions: make(map[string]*Transaction),
+		TextShares:   make(map[string]*TextShare),
+		CodeRooms:    make(map[string]*CodeRoom),
+
+		DeniedJTI:     make(map[string]time.Time),
+		RevokedBefore: make(map[string]time.Time),
+		IPLimiter:     NewRateLimiter(sec.IPRate, sec.IPBurst),
+		KeyLimiter:    NewRateLimiter(sec.KeyRate, sec.KeyBurst),
+		Log:           logger,
+		NodeID:        nodeID,
+		Backplane:     NewMemoryBackplane(),
 	}
+	s.Metrics = NewMetrics(s)
+	return s, nil
 }
 
+// StartServer listens until SIGINT/SIGTERM, then shuts down gracefully.
 func (s *Server) StartServer() {
-	log.Printf("Server starting at: %s\n", s.Url)
-	if err := s.App.Listen(s.Url); err != nil {
-		log.Fatal(err)
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, syscall.SIGINT, syscall.SIGTERM)
+
+	listenErr := make(chan error, 1)
+	go func() {
+		s.Log.Info("Server starting", "url", s.Url)
+		listenErr <- s.App.Listen(s.Url)
+	}()
+
+	select {
+	case err := <-listenErr:
+		if err != nil {
+			s.Log.Error("Server stopped", "err", err)
+			os.Exit(1)
+		}
+	case sig := <-stop:
+		s.Log.Info("Shutdown signal received", "signal", sig.String())
+		s.Shutdown()
 	}
 }
 
+// Shutdown stops new WebSocket upgrades, tells every connected client the
+// server is going away (with a reconnect hint), gives in-flight signaling
+// DrainTimeout to finish, then closes what is left and the DB.
+func (s *Server) Shutdown() {
+	s.Draining.Store(true)
+
+	s.MUserMu.RLock()
+	conns := make([]*ManagedUser, 0, len(s.MUser))
+	for _, muser := range s.MUser {
+		conns = append(conns, muser)
+	}
+	s.MUserMu.RUnlock()
+
+	hint := s.Config.ReconnectAfter
+	for _, muser := range conns {
+		// Spread the reconnects so the next instance isn't hit all at once.
+		jitter := time.Duration(rand.Int63n(int64(hint) + 1))
+		sendWS(s, muser.Conn, SERVER_GOING_AWAY, struct {
+			Message        string `json:"message"`
+			ReconnectAfter int64  `json:"reconnect_after_ms"`
+		}{"server going away", (hint + jitter).Milliseconds()})
+	}
+
+	deadline := time.Now().Add(s.Config.DrainTimeout)
+	for time.Now().Before(deadline) {
+		s.MUserMu.RLock()
+		left := len(s.MUser)
+		s.MUserMu.RUnlock()
+		if left == 0 {
+			break
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	s.MUserMu.RLock()
+	for _, muser := range s.MUser {
+		closeWS(s, muser.Conn, websocket.CloseGoingAway, "server going away")
+	}
+	s.MUserMu.RUnlock()
+
+	if err := s.App.ShutdownWithTimeout(5 * time.Second); err != nil {
+		s.Log.Error("HTTP shutdown failed", "err", err)
+	}
+
+	// The transactions die with this node, their queued offers with them.
+	if s.DB != nil {
+		s.TransactionMu.RLock()
+		for id := range s.Transactions {
+			dropOffers(s, id, "")
+		}
+		s.TransactionMu.RUnlock()
+	}
+
+	if err := s.Backplane.Close(); err != nil {
+		s.Log.Error("Backplane close failed", "err", err)
+	}
+
+	if s.DB != nil {
+		if sqlDB, err := s.DB.DB(); err == nil {
+			sqlDB.Close()
+		}
+	}
+	s.Log.Info("Server stopped")
+}
+
 func StartJanitor(s *Server) {
 	go func() {
 		for {
 			time.Sleep(5 * time.Minute)
-			s.ChallengeMu.Lock()
-			for ch, expiry := range s.Challenges {
-				if time.Now().After(expiry) {
-					delete(s.Challenges, ch)
+			s.DB.Where("expires_at < ?", time.Now()).Delete(&Challenge{})
+			purgeRevocations(s)
+			purgeTextShares(s)
+			purgeCodeRooms(s)
+			purgeOffers(s)
+			expireRequests(s)
+			purgeShareLinks(s)
+			s.IPLimiter.Prune()
+			s.KeyLimiter.Prune()
+
+			if s.Keys != nil {
+				if err := s.Keys.RotateIfDue(); err != nil {
+					s.Log.Error("Failed to rotate JWT signing key", "err", err)
 				}
 			}
-			s.ChallengeMu.Unlock()
 		}
 	}()
 }
@@ -138,6 +360,19 @@ func AddCachedUser(s *Server, user *ManagedUser) {
 	}
 }
 
+// DelCachedConn removes the cache entry of this connection only, a newer
+// socket of the same user keeps its own.
+func DelCachedConn(s *Server, user *ManagedUser) {
+	for i, cached := range s.CachedUser {
+		if cached == user {
+			s.CachedUser[i] = s.CachedUser[len(s.CachedUser)-1]
+			s.CachedUser[len(s.CachedUser)-1] = nil
+			s.CachedUser = s.CachedUser[:len(s.CachedUser)-1]
+			return
+		}
+	}
+}
+
 func DelCachedUser(s *Server, id int) {
 	for i, user := range s.CachedUser {
 		if user.User.ID == id {
@@ -0,0 +1,187 @@
+package server
+
+import (
+	"encoding/json"
+	"gopherdrop/helper"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// newTestServer is a Server on a fresh, migrated SQLite db in a temp dir.
+func newTestServer(t *testing.T) *Server {
+	t.Helper()
+	return newTestNode(t, newTestDB(t), NewMemoryBackplane())
+}
+
+func newTestDB(t *testing.T) *gorm.DB {
+	t.Helper()
+	db, err := OpenDB("sqlite", filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatalf("open db: %v", err)
+	}
+	sqlDB, _ := db.DB()
+	t.Cleanup(func() { sqlDB.Close() })
+	if err := MigrateDB(db); err != nil {
+		t.Fatalf("migrate: %v", err)
+	}
+	return db
+}
+
+// newTestNode is one node of a cluster sharing db and bp.
+func newTestNode(t *testing.T, db *gorm.DB, bp Backplane) *Server {
+	t.Helper()
+	s, err := InitServer(helper.GetConfigFromEnv())
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.DB = db
+	s.Backplane = bp
+	if s.Keys, err = NewKeyring(db, s.Config); err != nil {
+		t.Fatalf("keyring: %v", err)
+	}
+	if err := LoadRevocations(s); err != nil {
+		t.Fatalf("revocations: %v", err)
+	}
+	return s
+}
+
+// newTestUser registers a user with a made up public key.
+func newTestUser(t *testing.T, s *Server, name string) User {
+	t.Helper()
+	user := User{Username: name, PublicKey: name + "-key"}
+	if err := s.DB.Create(&user).Error; err != nil {
+		t.Fatalf("create user: %v", err)
+	}
+	return user
+}
+
+// testClient is a user connected to another node: what the server sends
+// them arrives on their user topic, where the test reads it.
+type testClient struct {
+	t     *testing.T
+	s     *Server
+	mUser *ManagedUser
+	msgs  chan WSMessage
+}
+
+func newTestClient(t *testing.T, s *Server, name string) *testClient {
+	t.Helper()
+	user := newTestUser(t, s, name)
+	c := &testClient{t: t, s: s, msgs: make(chan WSMessage, 64)}
+	c.mUser = remoteUser(s, MinimalUser{user.Username, user.PublicKey}, "test-node")
+	c.mUser.User = user
+	unsubscribe, err := s.Backplane.Subscribe(userTopic(user.PublicKey), func(payload []byte) {
+		var env Envelope
+		if json.Unmarshal(payload, &env) == nil && env.Close == nil {
+			c.msgs <- env.Msg
+		}
+	})
+	if err != nil {
+		t.Fatalf("subscribe: %v", err)
+	}
+	t.Cleanup(unsubscribe)
+	c.online()
+	return c
+}
+
+// online and offline set the client's cluster presence, findUser goes by it.
+func (c *testClient) online() {
+	if err := c.s.Backplane.SetPresence(Presence{Node: "test-node", User: c.mUser.MinUser, Discoverable: true}); err != nil {
+		c.t.Fatalf("presence: %v", err)
+	}
+}
+
+func (c *testClient) offline() {
+	if err := c.s.Backplane.DelPresence("test-node", c.mUser.MinUser.PublicKey); err != nil {
+		c.t.Fatalf("presence: %v", err)
+	}
+}
+
+// send handles msg as if it came over the socket, data goes through JSON
+// like it does on the wire.
+func (c *testClient) send(t WSType, data any) {
+	c.t.Helper()
+	raw, err := json.Marshal(WSMessage{t, data})
+	if err != nil {
+		c.t.Fatalf("marshal: %v", err)
+	}
+	var msg WSMessage
+	json.Unmarshal(raw, &msg)
+	(&wsSession{s: c.s, mUser: c.mUser}).handle(msg)
+}
+
+// expect returns the data of the next message of type t, skipping others.
+func (c *testClient) expect(t WSType) any {
+	c.t.Helper()
+	for {
+		select {
+		case msg := <-c.msgs:
+			if msg.WSType == t {
+				return msg.Data
+			}
+		case <-time.After(time.Second):
+			c.t.Fatalf("%s: no %s message", c.mUser.MinUser.Username, t)
+		}
+	}
+}
+
+// expectError waits for an ERROR containing text.
+func (c *testClient) expectError(text string) {
+	c.t.Helper()
+	if msg, _ := c.expect(ERROR).(string); !strings.Contains(msg, text) {
+		c.t.Fatalf("%s: error %q, want %q", c.mUser.MinUser.Username, msg, text)
+	}
+}
+
+// expectNone fails if a message of type t is waiting.
+func (c *testClient) expectNone(t WSType) {
+	c.t.Helper()
+	for {
+		select {
+		case msg := <-c.msgs:
+			if msg.WSType == t {
+				c.t.Fatalf("%s: unexpected %s: %v", c.mUser.MinUser.Username, t, msg.Data)
+			}
+		case <-time.After(50 * time.Millisecond):
+			return
+		}
+	}
+}
+
+// discard forgets the messages received so far.
+func (c *testClient) discard() {
+	for {
+		select {
+		case <-c.msgs:
+		case <-time.After(50 * time.Millisecond):
+			return
+		}
+	}
+}
+
+// newTestTransaction has sender offer files to targets and returns its id.
+func newTestTransaction(sender *testClient, files []FileInfo, targets ...*testClient) string {
+	sender.t.Helper()
+	sender.send(NEW_TRANSACTION, nil)
+	id := field(sender.expect(NEW_TRANSACTION), "id")
+	sender.send(FILE_SHARE_TARGET, map[string]any{"transaction_id": id, "files": files})
+	sender.expect(FILE_SHARE_TARGET)
+	keys := make([]string, len(targets))
+	for i, target := range targets {
+		keys[i] = target.mUser.MinUser.PublicKey
+	}
+	sender.send(USER_SHARE_TARGET, map[string]any{"transaction_id": id, "public_keys": keys})
+	sender.expect(USER_SHARE_TARGET)
+	return id
+}
+
+// field reads a string field out of decoded message data.
+func field(data any, name string) string {
+	m, _ := data.(map[string]any)
+	v, _ := m[name].(string)
+	return v
+}
@@ -0,0 +1,168 @@
+package server
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"io/fs"
+	"mime"
+	"net/http"
+	"path"
+	"strings"
+
+	"github.com/andybalholm/brotli"
+	"github.com/gofiber/fiber/v2"
+)
+
+// Files smaller than this are not worth compressing.
+const minCompressSize = 1024
+
+// staticAsset is one file of the frontend with its compressed variants,
+// built once on startup.
+type staticAsset struct {
+	contentType string
+	etag        string
+	body        []byte
+	gzip        []byte
+	brotli      []byte
+}
+
+// StaticSite serves a file tree. Embedded trees are loaded and compressed
+// once; an on-disk tree (GDROP_FRONTEND_DIR) is read on every request so
+// edits show up without a restart.
+type StaticSite struct {
+	fsys   fs.FS
+	live   bool
+	assets map[string]*staticAsset
+}
+
+func NewStaticSite(fsys fs.FS, live bool) (*StaticSite, error) {
+	site := &StaticSite{fsys: fsys, live: live, assets: make(map[string]*staticAsset)}
+	if live {
+		return site, nil
+	}
+	err := fs.WalkDir(fsys, ".", func(name string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		body, err := fs.ReadFile(fsys, name)
+		if err != nil {
+			return err
+		}
+		asset := newStaticAsset(name, body)
+		if compressible(asset.contentType) && len(body) >= minCompressSize {
+			asset.gzip = compressGzip(body)
+			asset.brotli = compressBrotli(body)
+		}
+		site.assets[name] = asset
+		return nil
+	})
+	return site, err
+}
+
+func newStaticAsset(name string, body []byte) *staticAsset {
+	contentType := mime.TypeByExtension(path.Ext(name))
+	if contentType == "" {
+		contentType = http.DetectContentType(body)
+	}
+	sum := sha256.Sum256(body)
+	return &staticAsset{
+		contentType: contentType,
+		etag:        `"` + hex.EncodeToString(sum[:16]) + `"`,
+		body:        body,
+	}
+}
+
+func compressible(contentType string) bool {
+	return strings.HasPrefix(contentType, "text/") ||
+		strings.Contains(contentType, "javascript") ||
+		strings.Contains(contentType, "json") ||
+		strings.Contains(contentType, "svg")
+}
+
+// The compressed variant is dropped when it doesn't save anything.
+func compressGzip(body []byte) []byte {
+	var buf bytes.Buffer
+	w, _ := gzip.NewWriterLevel(&buf, gzip.BestCompression)
+	w.Write(body)
+	w.Close()
+	if buf.Len() >= len(body) {
+		return nil
+	}
+	return buf.Bytes()
+}
+
+func compressBrotli(body []byte) []byte {
+	var buf bytes.Buffer
+	w := brotli.NewWriterLevel(&buf, brotli.BestCompression)
+	w.Write(body)
+	w.Close()
+	if buf.Len() >= len(body) {
+		return nil
+	}
+	return buf.Bytes()
+}
+
+// lookup maps a request path to a file, "/" and directories to their index.html.
+func (site *StaticSite) lookup(p string) *staticAsset {
+	name := strings.TrimPrefix(path.Clean("/"+p), "/")
+	candidates := []string{name, path.Join(name, "index.html")}
+	if name == "" {
+		candidates = []string{"index.html"}
+	}
+	for _, candidate := range candidates {
+		if !site.live {
+			if asset, ok := site.assets[candidate]; ok {
+				return asset
+			}
+			continue
+		}
+		if path.Ext(candidate) == ".go" {
+			continue
+		}
+		body, err := fs.ReadFile(site.fsys, candidate)
+		if err == nil {
+			return newStaticAsset(candidate, body)
+		}
+	}
+	return nil
+}
+
+// Handler serves GET/HEAD requests for files in the site and passes
+// everything else on to the next route.
+func (site *StaticSite) Handler() fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		asset := site.lookup(c.Path())
+		if asset == nil {
+			return c.Next()
+		}
+
+		c.Set(fiber.HeaderContentType, asset.contentType)
+		c.Set(fiber.HeaderETag, asset.etag)
+		c.Set(fiber.HeaderVary, fiber.HeaderAcceptEncoding)
+		switch {
+		case site.live || strings.HasPrefix(asset.contentType, "text/html"):
+			// Pages pick up new asset versions on the next load.
+			c.Set(fiber.HeaderCacheControl, "no-cache")
+		default:
+			c.Set(fiber.HeaderCacheControl, "public, max-age=3600")
+		}
+
+		if match := c.Get(fiber.HeaderIfNoneMatch); match != "" && strings.Contains(match, asset.etag) {
+			return c.SendStatus(fiber.StatusNotModified)
+		}
+
+		body := asset.body
+		accept := c.Get(fiber.HeaderAcceptEncoding)
+		switch {
+		case asset.brotli != nil && strings.Contains(accept, "br"):
+			c.Set(fiber.HeaderContentEncoding, "br")
+			body = asset.brotli
+		case asset.gzip != nil && strings.Contains(accept, "gzip"):
+			c.Set(fiber.HeaderContentEncoding, "gzip")
+			body = asset.gzip
+		}
+		return c.Status(fiber.StatusOK).Send(body)
+	}
+}
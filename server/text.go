@@ -0,0 +1,254 @@
+package server
+
+import (
+	"errors"
+	"net/url"
+	"time"
+	"unicode/utf8"
+
+	"github.com/google/uuid"
+	"github.com/mitchellh/mapstructure"
+)
+
+// How long a SHARE_TEXT offer waits for its targets before it is dropped.
+const textShareTTL = 10 * time.Minute
+
+// textOffer is what a target sees of a TextShare. Text is only filled in
+// the SHARE_TEXT_ACCEPT reply once the target has accepted.
+type textOffer struct {
+	ShareID   string      `json:"share_id"`
+	Sender    MinimalUser `json:"sender"`
+	Kind      string      `json:"kind"`
+	Encrypted bool        `json:"encrypted"`
+	Size      int         `json:"size"`
+	Text      string      `json:"text,omitempty"`
+}
+
+// shareText handles SHARE_TEXT. The sender either sends one text for all
+// targets, or (for end-to-end encryption, which the server can't look
+// into) one copy per target in texts, keyed by public key.
+func (ws *wsSession) shareText(msg WSMessage) {
+	s, mUser := ws.s, ws.mUser
+	var data struct {
+		PublicKeys []string          `mapstructure:"public_keys"`
+		Kind       string            `mapstructure:"kind"`
+		Text       string            `mapstructure:"text"`
+		Texts      map[string]string `mapstructure:"texts"`
+		Encrypted  bool              `mapstructure:"encrypted"`
+	}
+	if err := mapstructure.Decode(msg.Data, &data); err != nil {
+		sendUser(s, mUser, ERROR, "invalid data for SHARE_TEXT")
+		return
+	}
+	if len(data.PublicKeys) == 0 {
+		sendUser(s, mUser, ERROR, "missing public_keys")
+		return
+	}
+	if len(data.PublicKeys) > maxTargets(s, mUser.MinUser.PublicKey) {
+		ws.tooLarge("too many targets")
+		return
+	}
+	if data.Kind == "" {
+		data.Kind = "text"
+	}
+
+	texts := make(map[string]string, len(data.PublicKeys))
+	for _, key := range data.PublicKeys {
+		text, ok := data.Texts[key]
+		if !ok {
+			text = data.Text
+		}
+		if len(text) > s.Config.MaxTextSize {
+			ws.tooLarge("text too large")
+			return
+		}
+		if err := validateText(data.Kind, data.Encrypted, text); err != nil {
+			sendUser(s, mUser, ERROR, err.Error())
+			return
+		}
+		texts[key] = text
+	}
+
+	var targets []*TransactionTarget
+	for _, key := range data.PublicKeys {
+		if user := findUser(s, key); user != nil {
+			targets = append(targets, &TransactionTarget{User: user, Status: Pending, InvitedAt: time.Now()})
+		}
+	}
+	if len(targets) == 0 {
+		sendUser(s, mUser, ERROR, "no valid target users found")
+		return
+	}
+
+	share := &TextShare{
+		ID:        uuid.New().String(),
+		Sender:    mUser,
+		Kind:      data.Kind,
+		Encrypted: data.Encrypted,
+		Texts:     texts,
+		Targets:   targets,
+		CreatedAt: time.Now(),
+	}
+	// Answers from targets on other nodes come in like transaction messages.
+	unsubscribe, err := s.Backplane.Subscribe(txTopic(share.ID), func(payload []byte) {
+		handleEnvelope(s, payload)
+	})
+	if err != nil {
+		mUser.Log.Error("Failed to subscribe to text share", "share_id", share.ID, "err", err)
+		sendUser(s, mUser, ERROR, "failed to share text")
+		return
+	}
+	share.Unsubscribe = unsubscribe
+
+	s.TransactionMu.Lock()
+	s.TextShares[share.ID] = share
+	s.TransactionMu.Unlock()
+
+	sent := make([]MinimalUser, 0, len(targets))
+	for _, target := range targets {
+		sendUser(s, target.User, SHARE_TEXT, textOffer{
+			ShareID:   share.ID,
+			Sender:    mUser.MinUser,
+			Kind:      share.Kind,
+			Encrypted: share.Encrypted,
+			Size:      len(texts[target.User.MinUser.PublicKey]),
+		})
+		sent = append(sent, target.User.MinUser)
+	}
+	mUser.Log.Info("Text shared", "share_id", share.ID, "kind", share.Kind, "targets", len(targets))
+	sendUser(s, mUser, SHARE_TEXT, struct {
+		ShareID string        `json:"share_id"`
+		Targets []MinimalUser `json:"targets"`
+	}{share.ID, sent})
+}
+
+// answerText handles SHARE_TEXT_ACCEPT from a target. Accepting delivers
+// the text, either way the sender is told. The share is gone once every
+// target has answered.
+func (ws *wsSession) answerText(msg WSMessage) {
+	s, mUser := ws.s, ws.mUser
+	var data struct {
+		ShareID string `mapstructure:"share_id"`
+		Accept  bool   `mapstructure:"accept"`
+		Reason  string `mapstructure:"reason"`
+	}
+	if err := mapstructure.Decode(msg.Data, &data); err != nil {
+		sendUser(s, mUser, ERROR, "invalid data for SHARE_TEXT_ACCEPT")
+		return
+	}
+
+	s.TransactionMu.Lock()
+	share, ok := s.TextShares[data.ShareID]
+	if !ok {
+		s.TransactionMu.Unlock()
+		sendUser(s, mUser, ERROR, "share not found or expired")
+		return
+	}
+
+	var target *TransactionTarget
+	for _, t := range share.Targets {
+		if t.User.Is(mUser) {
+			target = t
+			break
+		}
+	}
+	if target == nil {
+		s.TransactionMu.Unlock()
+		sendUser(s, mUser, ERROR, "you are not a target of this share")
+		return
+	}
+	if target.Status != Pending {
+		s.TransactionMu.Unlock()
+		sendUser(s, mUser, SHARE_TEXT_ACCEPT, "response already recorded")
+		return
+	}
+	if data.Accept {
+		target.Status = Accepted
+	} else {
+		target.Status = Declined
+	}
+
+	answered := true
+	for _, t := range share.Targets {
+		if t.Status == Pending {
+			answered = false
+			break
+		}
+	}
+	if answered {
+		share.Unsubscribe()
+		delete(s.TextShares, share.ID)
+	}
+	s.TransactionMu.Unlock()
+
+	mUser.Log.Info("Text share answered", "share_id", share.ID, "accepted", data.Accept)
+	if data.Accept {
+		text := share.Texts[mUser.MinUser.PublicKey]
+		sendUser(s, mUser, SHARE_TEXT_ACCEPT, textOffer{
+			ShareID:   share.ID,
+			Sender:    share.Sender.MinUser,
+			Kind:      share.Kind,
+			Encrypted: share.Encrypted,
+			Size:      len(text),
+			Text:      text,
+		})
+	} else {
+		sendUser(s, mUser, SHARE_TEXT_ACCEPT, "response recorded")
+	}
+
+	notification := "accept_notification"
+	if !data.Accept {
+		notification = "decline_notification"
+	}
+	sendUser(s, share.Sender, SHARE_TEXT_ACCEPT, struct {
+		Type      string `json:"type"`
+		ShareID   string `json:"share_id"`
+		Username  string `json:"username"`
+		PublicKey string `json:"public_key"`
+		Accepted  bool   `json:"accepted"`
+		Reason    string `json:"reason,omitempty"`
+	}{
+		Type:      notification,
+		ShareID:   share.ID,
+		Username:  mUser.MinUser.Username,
+		PublicKey: mUser.MinUser.PublicKey,
+		Accepted:  data.Accept,
+		Reason:    data.Reason,
+	})
+}
+
+// validateText checks a plain text share. Links must be http(s) so that
+// clients can open them safely; encrypted texts are opaque.
+func validateText(kind string, encrypted bool, text string) error {
+	if kind != "text" && kind != "url" {
+		return errors.New("invalid kind, expected text or url")
+	}
+	if text == "" {
+		return errors.New("missing text")
+	}
+	if encrypted {
+		return nil
+	}
+	if !utf8.ValidString(text) {
+		return errors.New("text is not valid UTF-8")
+	}
+	if kind == "url" {
+		u, err := url.Parse(text)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return errors.New("invalid url")
+		}
+	}
+	return nil
+}
+
+// purgeTextShares drops offers nobody answered in time.
+func purgeTextShares(s *Server) {
+	s.TransactionMu.Lock()
+	defer s.TransactionMu.Unlock()
+	for id, share := range s.TextShares {
+		if time.Since(share.CreatedAt) > textShareTTL {
+			share.Unsubscribe()
+			delete(s.TextShares, id)
+		}
+	}
+}
@@ -1,8 +1,16 @@
 package server
 
 import (
+	"encoding/json"
+	"errors"
+	"math"
+	"path"
+	"slices"
+	"strings"
 	"time"
+	"unicode/utf8"
 
+	"github.com/gofiber/fiber/v2"
 	"github.com/gofiber/websocket/v2"
 	"github.com/google/uuid"
 	"github.com/mitchellh/mapstructure"
@@ -33,8 +41,60 @@ const (
 	USER_INFO             // 13
 	CONFIG_NAME           // 14
 	TRANSACTION_HOST_RECV // 15
+	REAUTH                // 16
+	SERVER_GOING_AWAY     // 17
+
+	SHARE_TEXT        // 18
+	SHARE_TEXT_ACCEPT // 19
+
+	CANCEL_TRANSFER // 20
+
+	REQUEST_FILES        // 21
+	REQUEST_FILES_STATUS // 22
+
+	CODE_ROOM         // 23
+	CODE_ROOM_JOIN    // 24
+	CODE_ROOM_PAKE    // 25
+	CODE_ROOM_CONFIRM // 26
+
+	SHARE_LINK      // 27
+	SHARE_LINK_JOIN // 28
 )
 
+// Messages dropped by the rate limiter before the socket is closed.
+const maxRateViolations = 50
+
+// Oversized payloads (too many files, targets, ...) tolerated before the
+// socket is closed with CloseMessageTooBig.
+const maxLimitViolations = 5
+
+// WSError is the structured ERROR payload for errors a client can act on,
+// plain string ERRORs are kept for everything else.
+type WSError struct {
+	Code       int    `json:"code"`
+	Message    string `json:"message"`
+	RetryAfter int    `json:"retry_after,omitempty"`
+}
+
+// How long before the JWT expires the client is asked to send REAUTH.
+const reauthWarning = time.Minute
+
+var wsTypeNames = [...]string{
+	"NONE", "ERROR", "CONFIG_DISCOVERABLE", "START_SHARING", "USER_SHARE_LIST",
+	"NEW_TRANSACTION", "INFO_TRANSACTION", "DELETE_TRANSACTION", "USER_SHARE_TARGET",
+	"FILE_SHARE_TARGET", "START_TRANSACTION", "TRANSACTION_SHARE_ACCEPT", "WEBRTC_SIGNAL",
+	"USER_INFO", "CONFIG_NAME", "TRANSACTION_HOST_RECV", "REAUTH", "SERVER_GOING_AWAY",
+	"SHARE_TEXT", "SHARE_TEXT_ACCEPT", "CANCEL_TRANSFER", "REQUEST_FILES", "REQUEST_FILES_STATUS",
+	"CODE_ROOM", "CODE_ROOM_JOIN", "CODE_ROOM_PAKE", "CODE_ROOM_CONFIRM", "SHARE_LINK", "SHARE_LINK_JOIN",
+}
+
+func (t WSType) String() string {
+	if t >= 0 && int(t) < len(wsTypeNames) {
+		return wsTypeNames[t]
+	}
+	return "UNKNOWN"
+}
+
 type WSMessage struct {
 	WSType WSType `json:"type"`
 	Data   any    `json:"data"`
@@ -48,409 +108,626 @@ type WebRTCSignal struct {
 
 // Menggunakan WriteMu dari Server untuk mencegah Concurrent Write Panic
 func sendWS(s *Server, c *websocket.Conn, t WSType, data any) {
+	start := time.Now()
 	s.WriteMu.Lock()
 	_ = c.WriteJSON(WSMessage{
 		WSType: t,
 		Data:   data,
 	})
 	s.WriteMu.Unlock()
+	s.Metrics.WSWriteLatency.Observe(time.Since(start).Seconds())
+}
+
+// sendUser writes to u's socket, or hands the message to the node holding
+// it when u is connected elsewhere in the cluster.
+func sendUser(s *Server, u *ManagedUser, t WSType, data any) {
+	if u.Conn != nil {
+		sendWS(s, u.Conn, t, data)
+		return
+	}
+	if _, err := publish(s, userTopic(u.MinUser.PublicKey), MinimalUser{}, WSMessage{t, data}); err != nil {
+		s.Log.Error("Backplane publish failed", "public_key", u.MinUser.PublicKey, "type", t.String(), "err", err)
+	}
+}
+
+// closeWS sends a close frame with code and reason and closes the connection.
+func closeWS(s *Server, c *websocket.Conn, code int, reason string) {
+	s.WriteMu.Lock()
+	_ = c.WriteMessage(
+		websocket.CloseMessage,
+		websocket.FormatCloseMessage(code, reason),
+	)
+	s.WriteMu.Unlock()
+	c.Close()
+}
+
+// wsSession is the per-socket state HandleWS keeps between messages.
+// Messages forwarded from other nodes run through a session without one.
+type wsSession struct {
+	s               *Server
+	mUser           *ManagedUser
+	renew           chan time.Time
+	limitViolations int
+	auto            bool // answers come from an auto-accept rule, see acceptFor
+}
+
+// tooLarge answers an oversized payload, repeat offenders are disconnected.
+func (ws *wsSession) tooLarge(message string) {
+	ws.limitViolations++
+	if ws.limitViolations > maxLimitViolations && ws.mUser.Conn != nil {
+		ws.mUser.Log.Warn("WS closed for oversized payloads", "reason", message)
+		closeWS(ws.s, ws.mUser.Conn, websocket.CloseMessageTooBig, message)
+		return
+	}
+	sendUser(ws.s, ws.mUser, ERROR, WSError{Code: fiber.StatusRequestEntityTooLarge, Message: message})
 }
 
 func HandleWS(s *Server, mUser *ManagedUser) {
 	done := make(chan struct{})
 	defer close(done)
 
-	startJWTExpiryWatcher(mUser.Conn, mUser.JWTExpiry, done)
+	renew := make(chan time.Time, 1)
+	startJWTExpiryWatcher(s, mUser, mUser.JWTExpiry, renew, done)
+
+	// Frames over the limit make the library close with CloseMessageTooBig.
+	mUser.Conn.SetReadLimit(s.Config.WSReadLimit)
+
+	limiter := NewTokenBucket(s.Config.WSMsgRate, s.Config.WSMsgBurst)
+	if mUser.Guest {
+		limiter = NewTokenBucket(s.Config.GuestWSMsgRate, s.Config.GuestWSMsgBurst)
+	}
+	violations := 0
+	ws := &wsSession{s: s, mUser: mUser, renew: renew}
 	for {
 		var msg WSMessage
 		if err := mUser.Conn.ReadJSON(&msg); err != nil {
 			break
 		}
 
-		switch msg.WSType {
-		// --- FITUR BARU DARI FRONTEND FRIEND ---
-		case CONFIG_NAME:
-			newname, ok := msg.Data.(string)
-			if !ok {
-				sendWS(s, mUser.Conn, ERROR, "invalid websocket message")
-				continue
-			}
-			var user User
-			res := s.DB.Where("public_key = ?", mUser.User.PublicKey).First(&user).Error
-			if res != nil {
-				sendWS(s, mUser.Conn, ERROR, "invalid public key")
-				continue
-			}
-			user.Username = newname
-			res = s.DB.Save(&user).Error
-			if res != nil {
-				sendWS(s, mUser.Conn, ERROR, "db failed to save your changes")
-				continue
+		if ok, retry := limiter.Allow(); !ok {
+			violations++
+			if violations > maxRateViolations {
+				mUser.Log.Warn("WS closed for exceeding the rate limit")
+				closeWS(s, mUser.Conn, websocket.ClosePolicyViolation, "rate limit exceeded")
+				break
 			}
+			sendWS(s, mUser.Conn, ERROR, WSError{
+				Code:       fiber.StatusTooManyRequests,
+				Message:    "rate limit exceeded",
+				RetryAfter: int(math.Ceil(retry.Seconds())),
+			})
+			continue
+		}
+		violations = 0
+		s.Metrics.WSMessages.WithLabelValues(msg.WSType.String()).Inc()
+		mUser.Log.Debug("WS message", "type", msg.WSType.String())
 
-			// Update cache di memori
-			s.CachedUserMu.Lock()
-			for _, user := range s.CachedUser {
-				if user.User.PublicKey == mUser.User.PublicKey {
-					s.MUserMu.Lock()
-					user.MinUser.Username = newname
-					user.User.Username = newname
-					s.MUserMu.Unlock()
-					break
-				}
-			}
-			s.CachedUserMu.Unlock()
-			sendWS(s, mUser.Conn, CONFIG_NAME, "success")
+		if mUser.Guest && !guestTypes[msg.WSType] {
+			sendUser(s, mUser, ERROR, "not available to guests")
+			continue
+		}
+		if mUser.LinkTx != "" && !linkGuestAllowed(msg, mUser.LinkTx) {
+			sendUser(s, mUser, ERROR, "not available through a share link")
 			continue
+		}
 
-		case USER_INFO:
-			sendWS(s, mUser.Conn, USER_INFO, mUser.User)
+		// Transactions owned by another node are handled over there.
+		if id := transactionOf(msg); id != "" && forwardTransaction(s, mUser, id, msg) {
 			continue
+		}
+		ws.handle(msg)
+	}
+}
 
-		// --- LOGIKA UTAMA (MERGE BACKEND + FRONTEND) ---
-		case CONFIG_DISCOVERABLE:
-			n, ok := msg.Data.(bool)
-			if !ok {
-				sendWS(s, mUser.Conn, ERROR, "invalid websocket message")
-				continue
-			}
-			var user User
-			res := s.DB.Where("public_key = ?", mUser.User.PublicKey).First(&user).Error
-			if res != nil {
-				sendWS(s, mUser.Conn, ERROR, "invalid public key")
-				continue
-			}
-			user.IsDiscoverable = n
-			res = s.DB.Save(&user).Error
-			if res != nil {
-				sendWS(s, mUser.Conn, ERROR, "db failed to save your changes")
-				continue
-			}
+// handle runs one message. The socket may live on another node when the
+// message was forwarded here, so replies go through sendUser.
+func (ws *wsSession) handle(msg WSMessage) {
+	s, mUser := ws.s, ws.mUser
+	switch msg.WSType {
+	// --- FITUR BARU DARI FRONTEND FRIEND ---
+	case CONFIG_NAME:
+		newname, ok := msg.Data.(string)
+		if !ok {
+			sendUser(s, mUser, ERROR, "invalid websocket message")
+			return
+		}
+		newname, err := CheckUsername(s.DB, newname, mUser.User.ID)
+		if err != nil {
+			sendUser(s, mUser, ERROR, err.Error())
+			return
+		}
+		var user User
+		res := s.DB.Where("public_key = ?", mUser.User.PublicKey).First(&user).Error
+		if res != nil {
+			sendUser(s, mUser, ERROR, "invalid public key")
+			return
+		}
+		user.Username = newname
+		res = s.DB.Save(&user).Error
+		if res != nil {
+			sendUser(s, mUser, ERROR, "db failed to save your changes")
+			return
+		}
 
-			// PENTING: Pakai Logic Backend (Add/Del CachedUser) biar list user rapi
-			s.CachedUserMu.Lock()
-			if n == false {
-				DelCachedUser(s, mUser.User.ID)
-			} else {
-				AddCachedUser(s, mUser)
-			}
-			s.CachedUserMu.Unlock()
+		// CachedUser holds the same pointers, the share list follows.
+		s.MUserMu.Lock()
+		mUser.MinUser.Username = newname
+		mUser.User.Username = newname
+		s.MUserMu.Unlock()
+		announce(s, mUser)
+		mUser.Log.Info("Username changed", "new_username", newname)
+		sendUser(s, mUser, CONFIG_NAME, "success")
+		return
+
+	case USER_INFO:
+		sendUser(s, mUser, USER_INFO, mUser.User)
+		return
+
+	case REAUTH:
+		raw, ok := msg.Data.(string)
+		if !ok {
+			sendUser(s, mUser, ERROR, "invalid websocket message")
+			return
+		}
+		claims, err := s.ParseAccessToken(raw)
+		if err != nil {
+			sendUser(s, mUser, ERROR, err.Error())
+			return
+		}
+		if pubkey, _ := claims["public_key"].(string); pubkey != mUser.User.PublicKey {
+			sendUser(s, mUser, ERROR, "token belongs to another user")
+			return
+		}
+		exp := time.Unix(int64(claims["exp"].(float64)), 0)
+		jti, _ := claims["jti"].(string)
+
+		s.MUserMu.Lock()
+		mUser.JWTExpiry = exp
+		mUser.JTI = jti
+		s.MUserMu.Unlock()
+
+		// renew has room for one pending update, newest wins.
+		select {
+		case <-ws.renew:
+		default:
+		}
+		ws.renew <- exp
 
-			sendWS(s, mUser.Conn, CONFIG_DISCOVERABLE, "success")
-			continue
+		mUser.Log.Info("Token renewed over WS", "expires_at", exp)
+		sendUser(s, mUser, REAUTH, exp.Unix())
+		return
 
-		case START_SHARING:
-			s.CachedUserMu.RLock()
-			sendWS(s, mUser.Conn, USER_SHARE_LIST, s.CachedUser)
-			s.CachedUserMu.RUnlock()
-			continue
+	// --- LOGIKA UTAMA (MERGE BACKEND + FRONTEND) ---
+	case CONFIG_DISCOVERABLE:
+		n, ok := msg.Data.(bool)
+		if !ok {
+			sendUser(s, mUser, ERROR, "invalid websocket message")
+			return
+		}
+		var user User
+		res := s.DB.Where("public_key = ?", mUser.User.PublicKey).First(&user).Error
+		if res != nil {
+			sendUser(s, mUser, ERROR, "invalid public key")
+			return
+		}
+		user.IsDiscoverable = n
+		res = s.DB.Save(&user).Error
+		if res != nil {
+			sendUser(s, mUser, ERROR, "db failed to save your changes")
+			return
+		}
 
-		case NEW_TRANSACTION:
-			txID := uuid.New().String()
-			transaction := &Transaction{
-				ID:      txID,
-				Sender:  mUser,
-				Targets: nil,
-				Files:   nil,
-				Started: false,
-			}
+		s.MUserMu.Lock()
+		mUser.User.IsDiscoverable = n
+		s.MUserMu.Unlock()
 
-			s.TransactionMu.Lock()
-			s.Transactions[txID] = transaction
-			s.TransactionMu.Unlock()
-			sendWS(s, mUser.Conn, NEW_TRANSACTION, transaction)
-			continue
+		// PENTING: Pakai Logic Backend (Add/Del CachedUser) biar list user rapi
+		s.CachedUserMu.Lock()
+		DelCachedUser(s, mUser.User.ID)
+		if n {
+			AddCachedUser(s, mUser)
+		}
+		s.CachedUserMu.Unlock()
+		announce(s, mUser)
 
-		case INFO_TRANSACTION:
-			n, ok := msg.Data.(string)
-			if !ok {
-				sendWS(s, mUser.Conn, ERROR, "invalid websocket message")
-				continue
-			}
+		sendUser(s, mUser, CONFIG_DISCOVERABLE, "success")
+		return
 
-			s.TransactionMu.RLock()
-			if s.Transactions[n] == nil {
-				sendWS(s, mUser.Conn, DELETE_TRANSACTION, n)
-				s.TransactionMu.RUnlock()
-				continue
-			}
-			sendWS(s, mUser.Conn, INFO_TRANSACTION, s.Transactions[n])
-			s.TransactionMu.RUnlock()
-			continue
+	case START_SHARING:
+		sendUser(s, mUser, USER_SHARE_LIST, shareList(s))
+		return
 
-		case DELETE_TRANSACTION:
-			var valid bool = true
-			n, ok := msg.Data.(string)
-			if !ok {
-				sendWS(s, mUser.Conn, ERROR, "invalid websocket message")
-				continue
+	case NEW_TRANSACTION:
+		// Optional request_id answers a REQUEST_FILES with this transaction.
+		var requestID string
+		if data, ok := msg.Data.(map[string]any); ok {
+			requestID, _ = data["request_id"].(string)
+		}
+		if requestID != "" {
+			if err := linkRequest(s, mUser, requestID); err != nil {
+				sendUser(s, mUser, ERROR, err.Error())
+				return
 			}
+		}
 
-			var target []*ManagedUser
+		txID := uuid.New().String()
+		transaction := &Transaction{
+			ID:        txID,
+			Sender:    mUser,
+			Targets:   nil,
+			Files:     nil,
+			Started:   false,
+			RequestID: requestID,
 
-			s.TransactionMu.Lock()
+			CreatedAt: time.Now(),
+		}
 
-			if s.Transactions[n] != nil && mUser.MinUser.PublicKey == s.Transactions[n].Sender.MinUser.PublicKey {
-				for _, user := range s.Transactions[n].Targets {
-					target = append(target, user.User)
-				}
-				delete(s.Transactions, n)
-			} else {
-				valid = false
-			}
+		// Targets on other nodes reach the transaction through its topic.
+		unsubscribe, err := s.Backplane.Subscribe(txTopic(txID), func(payload []byte) {
+			handleEnvelope(s, payload)
+		})
+		if err != nil {
+			mUser.Log.Error("Failed to subscribe to transaction", "tx_id", txID, "err", err)
+			sendUser(s, mUser, ERROR, "failed to create transaction")
+			return
+		}
+		transaction.Unsubscribe = unsubscribe
+
+		s.TransactionMu.Lock()
+		s.Transactions[txID] = transaction
+		s.TransactionMu.Unlock()
+		mUser.Log.Info("Transaction created", "tx_id", txID)
+		sendUser(s, mUser, NEW_TRANSACTION, transaction)
+		return
+
+	case INFO_TRANSACTION:
+		n, ok := msg.Data.(string)
+		if !ok {
+			sendUser(s, mUser, ERROR, "invalid websocket message")
+			return
+		}
 
-			s.TransactionMu.Unlock()
+		s.TransactionMu.RLock()
+		if s.Transactions[n] == nil {
+			sendUser(s, mUser, DELETE_TRANSACTION, n)
+			s.TransactionMu.RUnlock()
+			return
+		}
+		sendUser(s, mUser, INFO_TRANSACTION, s.Transactions[n])
+		s.TransactionMu.RUnlock()
+		return
+
+	case DELETE_TRANSACTION:
+		var valid bool = true
+		n, ok := msg.Data.(string)
+		if !ok {
+			sendUser(s, mUser, ERROR, "invalid websocket message")
+			return
+		}
 
-			if valid {
-				// Broadcast delete ke semua participant
-				for _, t := range target {
-					sendWS(s, t.Conn, DELETE_TRANSACTION, n)
-				}
-				sendWS(s, mUser.Conn, DELETE_TRANSACTION, n)
-			}
-			continue
+		var target []*ManagedUser
+		var tx *Transaction
 
-		case USER_SHARE_TARGET:
-			var data struct {
-				TransactionID string   `mapstructure:"transaction_id"`
-				PublicKey     []string `mapstructure:"public_keys"`
-			}
+		s.TransactionMu.Lock()
 
-			if err := mapstructure.Decode(msg.Data, &data); err != nil {
-				sendWS(s, mUser.Conn, ERROR, "invalid data for USER_SHARE_TARGET")
-				continue
+		if s.Transactions[n] != nil && mUser.MinUser.PublicKey == s.Transactions[n].Sender.MinUser.PublicKey {
+			tx = s.Transactions[n]
+			for _, user := range s.Transactions[n].Targets {
+				target = append(target, user.User)
 			}
+			s.Transactions[n].Unsubscribe()
+			delete(s.Transactions, n)
+			dropRooms(s, n)
+		} else {
+			valid = false
+		}
 
-			s.TransactionMu.RLock()
-			tx, exists := s.Transactions[data.TransactionID]
-			s.TransactionMu.RUnlock()
+		s.TransactionMu.Unlock()
 
-			if !exists || tx == nil {
-				sendWS(s, mUser.Conn, ERROR, "transaction not found or expired")
-				continue
+		if valid {
+			dropOffers(s, n, "")
+			mUser.Log.Info("Transaction deleted", "tx_id", n)
+			if tx.RequestID != "" {
+				reopenRequest(s, tx, "")
 			}
-
-			if mUser.User.PublicKey != tx.Sender.User.PublicKey {
-				sendWS(s, mUser.Conn, ERROR, "not authorized to modify this transaction")
-				continue
+			// Broadcast delete ke semua participant
+			for _, t := range target {
+				sendUser(s, t, DELETE_TRANSACTION, n)
 			}
+			sendUser(s, mUser, DELETE_TRANSACTION, n)
+		}
+		return
 
-			var targets []*TransactionTarget
-			s.MUserMu.RLock()
-			for _, key := range data.PublicKey {
-				for _, managedUser := range s.MUser {
-					if managedUser.User.PublicKey == key {
-						targets = append(targets, &TransactionTarget{managedUser, Pending})
-						break
-					}
-				}
-			}
-			s.MUserMu.RUnlock()
+	case USER_SHARE_TARGET:
+		var data struct {
+			TransactionID string   `mapstructure:"transaction_id"`
+			PublicKey     []string `mapstructure:"public_keys"`
+		}
 
-			if len(targets) == 0 {
-				sendWS(s, mUser.Conn, ERROR, "no valid target users found")
-				continue
-			}
+		if err := mapstructure.Decode(msg.Data, &data); err != nil {
+			sendUser(s, mUser, ERROR, "invalid data for USER_SHARE_TARGET")
+			return
+		}
 
-			s.TransactionMu.Lock()
-			if s.Transactions[data.TransactionID] != nil {
-				s.Transactions[data.TransactionID].Targets = targets
-			}
-			s.TransactionMu.Unlock()
+		if len(data.PublicKey) > maxTargets(s, mUser.User.PublicKey) {
+			ws.tooLarge("too many targets")
+			return
+		}
 
-			// Notify targets
-			s.TransactionMu.RLock()
-			for _, target := range targets {
-				sendWS(s, target.User.Conn, TRANSACTION_SHARE_ACCEPT, struct {
-					Transaction *Transaction `json:"transaction"`
-					Sender      string       `json:"sender"`
-				}{
-					Transaction: tx,
-					Sender:      mUser.MinUser.Username,
-				})
-			}
+		s.TransactionMu.RLock()
+		tx, exists := s.Transactions[data.TransactionID]
+		s.TransactionMu.RUnlock()
 
-			sendWS(s, mUser.Conn, USER_SHARE_TARGET, tx)
-			s.TransactionMu.RUnlock()
-			continue
+		if !exists || tx == nil {
+			sendUser(s, mUser, ERROR, "transaction not found or expired")
+			return
+		}
 
-		case FILE_SHARE_TARGET:
-			var data struct {
-				TransactionID string     `mapstructure:"transaction_id"`
-				Files         []FileInfo `mapstructure:"files"`
+		if mUser.User.PublicKey != tx.Sender.User.PublicKey {
+			sendUser(s, mUser, ERROR, "not authorized to modify this transaction")
+			return
+		}
+
+		// Targets who accepted or picked files keep their entry: resetting
+		// them would unlock the files they (or their rules) agreed to.
+		s.TransactionMu.RLock()
+		var kept []*TransactionTarget
+		for _, target := range tx.Targets {
+			if target.Status == Accepted || target.Files != nil {
+				kept = append(kept, target)
 			}
-			if err := mapstructure.Decode(msg.Data, &data); err != nil {
-				sendWS(s, mUser.Conn, ERROR, "invalid data for FILE_SHARE_TARGET")
+		}
+		s.TransactionMu.RUnlock()
+
+		// Registered users who aren't connected get the offer in their inbox,
+		// unless it comes from a guest: guests leave nothing in the DB.
+		queue := !isGuestKey(mUser.User.PublicKey)
+		var added []*TransactionTarget
+		var offline []*ManagedUser
+		for _, key := range data.PublicKey {
+			if slices.ContainsFunc(kept, func(t *TransactionTarget) bool { return t.User.MinUser.PublicKey == key }) {
 				continue
 			}
-
-			if data.TransactionID == "" || len(data.Files) == 0 {
-				sendWS(s, mUser.Conn, ERROR, "missing transaction_id or files")
+			if managedUser := findUser(s, key); managedUser != nil {
+				added = append(added, &TransactionTarget{User: managedUser, Status: Pending, InvitedAt: time.Now()})
+			} else if !queue {
 				continue
+			} else if managedUser := offlineUser(s, key); managedUser != nil {
+				added = append(added, &TransactionTarget{User: managedUser, Status: Pending, InvitedAt: time.Now()})
+				offline = append(offline, managedUser)
 			}
+		}
+		targets := append(slices.Clip(kept), added...)
 
-			s.TransactionMu.RLock()
-			transaction, ok := s.Transactions[data.TransactionID]
-			s.TransactionMu.RUnlock()
+		if len(added) == 0 && len(kept) == 0 {
+			sendUser(s, mUser, ERROR, "no valid target users found")
+			return
+		}
+		if len(targets) > maxTargets(s, mUser.User.PublicKey) {
+			ws.tooLarge("too many targets")
+			return
+		}
 
-			if !ok {
-				sendWS(s, mUser.Conn, ERROR, "transaction not found")
-				continue
+		if tx.RequestID != "" {
+			if err := checkRequestTargets(s, tx, targets); err != nil {
+				sendUser(s, mUser, ERROR, err.Error())
+				return
 			}
+		}
 
-			if transaction.Sender != mUser {
-				sendWS(s, mUser.Conn, ERROR, "not authorized to modify this transaction")
+		s.TransactionMu.Lock()
+		if s.Transactions[data.TransactionID] != nil {
+			s.Transactions[data.TransactionID].Targets = targets
+		}
+		s.TransactionMu.Unlock()
+
+		mUser.Log.Info("Transaction targets set", "tx_id", tx.ID, "targets", len(targets), "kept", len(kept), "offline", len(offline))
+
+		// Targets whose auto-accept rules take the offer skip the prompt.
+		auto := autoAcceptTargets(s, tx, added, offline)
+
+		// Notify targets
+		dropOffers(s, tx.ID, "")
+		s.TransactionMu.RLock()
+		offer := struct {
+			Transaction *Transaction `json:"transaction"`
+			Sender      string       `json:"sender"`
+		}{
+			Transaction: tx,
+			Sender:      mUser.MinUser.Username,
+		}
+		for _, target := range added {
+			if !auto[target.User] {
+				sendUser(s, target.User, TRANSACTION_SHARE_ACCEPT, offer)
+			}
+		}
+		for _, target := range offline {
+			if err := queueOffer(s, tx, target, offer); err != nil {
+				mUser.Log.Error("Failed to queue offer", "tx_id", tx.ID, "target", target.MinUser.PublicKey, "err", err)
 				continue
 			}
+			sendUser(s, mUser, TRANSACTION_SHARE_ACCEPT, struct {
+				Type          string `json:"type"`
+				TransactionID string `json:"transaction_id"`
+				Username      string `json:"username"`
+				PublicKey     string `json:"public_key"`
+			}{"queued_notification", tx.ID, target.MinUser.Username, target.MinUser.PublicKey})
+		}
 
-			// Convert []FileInfo to []*FileInfo
-			files := make([]*FileInfo, len(data.Files))
-			for i := range data.Files {
-				files[i] = &data.Files[i]
-			}
+		sendUser(s, mUser, USER_SHARE_TARGET, tx)
+		s.TransactionMu.RUnlock()
 
-			s.TransactionMu.Lock()
-			transaction.Files = files
-			s.TransactionMu.Unlock()
+		for user := range auto {
+			acceptFor(s, user, tx.ID)
+		}
+		return
 
-			sendWS(s, mUser.Conn, FILE_SHARE_TARGET, "files added to transaction")
-			continue
+	case FILE_SHARE_TARGET:
+		var data struct {
+			TransactionID string     `mapstructure:"transaction_id"`
+			Files         []FileInfo `mapstructure:"files"`
+		}
+		if err := mapstructure.Decode(msg.Data, &data); err != nil {
+			sendUser(s, mUser, ERROR, "invalid data for FILE_SHARE_TARGET")
+			return
+		}
 
-		case TRANSACTION_SHARE_ACCEPT:
-			var data struct {
-				TransactionID string `mapstructure:"transaction_id"`
-				Accept        bool   `mapstructure:"accept"`
-				Reason        string `mapstructure:"reason"`
-			}
-			if err := mapstructure.Decode(msg.Data, &data); err != nil {
-				sendWS(s, mUser.Conn, ERROR, "invalid data for FILE_SHARE_ACCEPT")
-				continue
-			}
+		if data.TransactionID == "" || len(data.Files) == 0 {
+			sendUser(s, mUser, ERROR, "missing transaction_id or files")
+			return
+		}
 
-			s.TransactionMu.Lock()
+		if len(data.Files) > maxFiles(s, mUser.User.PublicKey) {
+			ws.tooLarge("too many files")
+			return
+		}
+		if err := validateFiles(s, data.Files); err != nil {
+			sendUser(s, mUser, ERROR, err.Error())
+			return
+		}
 
-			tx, ok := s.Transactions[data.TransactionID]
-			if !ok {
-				s.TransactionMu.Unlock()
-				sendWS(s, mUser.Conn, ERROR, "transaction not found")
-				continue
-			}
+		s.TransactionMu.RLock()
+		transaction, ok := s.Transactions[data.TransactionID]
+		s.TransactionMu.RUnlock()
 
-			if tx.Started {
-				s.TransactionMu.Unlock()
-				sendWS(s, mUser.Conn, ERROR, "transaction has already started")
-				continue
-			}
+		if !ok {
+			sendUser(s, mUser, ERROR, "transaction not found")
+			return
+		}
 
-			var targetFound bool
-			var alreadyResponded bool
-			for _, target := range tx.Targets {
-				if target.User == mUser {
-					targetFound = true
-					if target.Status != Pending {
-						alreadyResponded = true
-						break
-					}
-					if data.Accept {
-						target.Status = Accepted
-					} else {
-						target.Status = Declined
-					}
-					break
-				}
-			}
+		if !transaction.Sender.Is(mUser) {
+			sendUser(s, mUser, ERROR, "not authorized to modify this transaction")
+			return
+		}
 
-			if !targetFound {
-				s.TransactionMu.Unlock()
-				sendWS(s, mUser.Conn, ERROR, "you are not a target of this transaction")
-				continue
+		if transaction.RequestID != "" {
+			if err := checkRequestFiles(s, transaction, data.Files); err != nil {
+				sendUser(s, mUser, ERROR, err.Error())
+				return
 			}
+		}
+
+		// Convert []FileInfo to []*FileInfo
+		files := make([]*FileInfo, len(data.Files))
+		for i := range data.Files {
+			files[i] = &data.Files[i]
+		}
 
-			if alreadyResponded {
+		// A target that accepted, or picked files by index, answered the
+		// old files; they can't be swapped under it.
+		s.TransactionMu.Lock()
+		for _, target := range transaction.Targets {
+			if target.Status == Accepted || target.Files != nil {
 				s.TransactionMu.Unlock()
-				sendWS(s, mUser.Conn, TRANSACTION_SHARE_ACCEPT, "response already recorded")
-				continue
+				sendUser(s, mUser, ERROR, "files can't change once a target accepted")
+				return
 			}
+		}
+		transaction.Files = files
+		s.TransactionMu.Unlock()
+
+		mUser.Log.Info("Transaction files set", "tx_id", transaction.ID, "files", len(files))
+		sendUser(s, mUser, FILE_SHARE_TARGET, "files added to transaction")
+		return
+
+	case TRANSACTION_SHARE_ACCEPT:
+		var data struct {
+			TransactionID string `mapstructure:"transaction_id"`
+			Accept        bool   `mapstructure:"accept"`
+			Reason        string `mapstructure:"reason"`
+			Files         []int  `mapstructure:"files"` // optional, indexes of the accepted files
+		}
+		if err := mapstructure.Decode(msg.Data, &data); err != nil {
+			sendUser(s, mUser, ERROR, "invalid data for FILE_SHARE_ACCEPT")
+			return
+		}
 
-			sendWS(s, mUser.Conn, TRANSACTION_SHARE_ACCEPT, "response recorded")
-
-			if data.Accept {
-				sendWS(s, tx.Sender.Conn, TRANSACTION_SHARE_ACCEPT, struct {
-					Type            string `json:"type"`
-					Username        string `json:"username"`
-					Accepted        bool   `json:"accepted"`
-					TransactionID   string `json:"transaction_id"`
-					SenderPublicKey string `json:"sender_public_key"`
-				}{
-					Type:            "accept_notification",
-					Username:        mUser.MinUser.Username,
-					Accepted:        true,
-					TransactionID:   data.TransactionID,
-					SenderPublicKey: mUser.MinUser.PublicKey,
-				})
-
-				// Fix Race Condition: Langsung start transaction buat user yang accept
-				payload := struct {
-					TransactionID string      `json:"transaction_id"`
-					Sender        string      `json:"sender"`
-					Files         []*FileInfo `json:"files"`
-				}{
-					TransactionID: tx.ID,
-					Sender:        tx.Sender.MinUser.Username,
-					Files:         tx.Files,
-				}
-				sendWS(s, mUser.Conn, START_TRANSACTION, payload)
-
-			} else {
-				sendWS(s, tx.Sender.Conn, TRANSACTION_SHARE_ACCEPT, struct {
-					Type          string `json:"type"`
-					Username      string `json:"username"`
-					Declined      bool   `json:"declined"`
-					TransactionID string `json:"transaction_id"`
-					Reason        string `json:"reason,omitempty"`
-				}{
-					Type:          "decline_notification",
-					Username:      mUser.MinUser.Username,
-					Declined:      true,
-					TransactionID: data.TransactionID,
-					Reason:        data.Reason,
-				})
-			}
-			s.TransactionMu.Unlock()
-			continue
+		s.TransactionMu.Lock()
 
-		case START_TRANSACTION:
-			var data struct {
-				TransactionID string `mapstructure:"transaction_id"`
-			}
-			if err := mapstructure.Decode(msg.Data, &data); err != nil {
-				sendWS(s, mUser.Conn, ERROR, "invalid data for START_TRANSACTION")
-				continue
-			}
-			s.TransactionMu.Lock()
+		tx, ok := s.Transactions[data.TransactionID]
+		if !ok {
+			s.TransactionMu.Unlock()
+			sendUser(s, mUser, ERROR, "transaction not found")
+			return
+		}
 
-			tx, ok := s.Transactions[data.TransactionID]
-			if !ok {
-				s.TransactionMu.Unlock()
-				sendWS(s, mUser.Conn, ERROR, "transaction not found")
-				continue
-			}
+		if tx.Started {
+			s.TransactionMu.Unlock()
+			sendUser(s, mUser, ERROR, "transaction has already started")
+			return
+		}
 
-			if tx.Sender != mUser {
+		if data.Accept && len(data.Files) > 0 {
+			if err := validateSelection(data.Files, len(tx.Files)); err != nil {
 				s.TransactionMu.Unlock()
-				sendWS(s, mUser.Conn, ERROR, "not authorized to start this transaction")
-				continue
+				sendUser(s, mUser, ERROR, err.Error())
+				return
 			}
+		}
 
-			var acceptedTargets []*TransactionTarget
-			for _, target := range tx.Targets {
-				if target.Status == Accepted {
-					acceptedTargets = append(acceptedTargets, target)
+		var accepted *TransactionTarget
+		var targetFound bool
+		var alreadyResponded bool
+		for _, target := range tx.Targets {
+			if target.User.Is(mUser) {
+				targetFound = true
+				if target.Status != Pending {
+					alreadyResponded = true
+					break
+				}
+				if data.Accept {
+					target.Status = Accepted
+					target.AutoAccepted = ws.auto
+					if len(data.Files) > 0 {
+						// Manifest order, the order the sender sends them in.
+						slices.Sort(data.Files)
+						target.Files = data.Files
+					}
+					accepted = target
+				} else {
+					target.Status = Declined
 				}
+				s.Metrics.TxAcceptLatency.Observe(time.Since(target.InvitedAt).Seconds())
+				break
 			}
-			tx.Targets = acceptedTargets
-			tx.Started = true
+		}
+
+		if !targetFound {
+			s.TransactionMu.Unlock()
+			sendUser(s, mUser, ERROR, "you are not a target of this transaction")
+			return
+		}
+
+		if alreadyResponded {
+			s.TransactionMu.Unlock()
+			sendUser(s, mUser, TRANSACTION_SHARE_ACCEPT, "response already recorded")
+			return
+		}
+		liveSender(s, tx)
+
+		mUser.Log.Info("Transaction answered", "tx_id", tx.ID, "accepted", data.Accept, "auto", ws.auto)
+		sendUser(s, mUser, TRANSACTION_SHARE_ACCEPT, "response recorded")
+
+		if data.Accept {
+			sendUser(s, tx.Sender, TRANSACTION_SHARE_ACCEPT, struct {
+				Type            string `json:"type"`
+				Username        string `json:"username"`
+				Accepted        bool   `json:"accepted"`
+				TransactionID   string `json:"transaction_id"`
+				SenderPublicKey string `json:"sender_public_key"`
+				Files           []int  `json:"files,omitempty"`
+				Auto            bool   `json:"auto,omitempty"`
+			}{
+				Type:            "accept_notification",
+				Username:        mUser.MinUser.Username,
+				Accepted:        true,
+				TransactionID:   data.TransactionID,
+				SenderPublicKey: mUser.MinUser.PublicKey,
+				Files:           accepted.Files,
+				Auto:            ws.auto,
+			})
 
+			// Fix Race Condition: Langsung start transaction buat user yang accept
 			payload := struct {
 				TransactionID string      `json:"transaction_id"`
 				Sender        string      `json:"sender"`
@@ -458,90 +735,438 @@ func HandleWS(s *Server, mUser *ManagedUser) {
 			}{
 				TransactionID: tx.ID,
 				Sender:        tx.Sender.MinUser.Username,
-				Files:         tx.Files,
+				Files:         accepted.SelectedFiles(tx.Files),
 			}
+			sendUser(s, mUser, START_TRANSACTION, payload)
+
+		} else {
+			sendUser(s, tx.Sender, TRANSACTION_SHARE_ACCEPT, struct {
+				Type            string `json:"type"`
+				Username        string `json:"username"`
+				Declined        bool   `json:"declined"`
+				TransactionID   string `json:"transaction_id"`
+				SenderPublicKey string `json:"sender_public_key"`
+				Reason          string `json:"reason,omitempty"`
+			}{
+				Type:            "decline_notification",
+				Username:        mUser.MinUser.Username,
+				Declined:        true,
+				TransactionID:   data.TransactionID,
+				SenderPublicKey: mUser.MinUser.PublicKey,
+				Reason:          data.Reason,
+			})
+		}
+		s.TransactionMu.Unlock()
+		dropOffers(s, tx.ID, mUser.MinUser.PublicKey)
+		if data.Accept && tx.RequestID != "" {
+			fulfilRequest(s, tx, mUser.MinUser.PublicKey)
+		}
+		return
 
-			for _, target := range tx.Targets {
-				sendWS(s, target.User.Conn, START_TRANSACTION, payload)
-			}
-			sendWS(s, mUser.Conn, START_TRANSACTION, "transaction started")
+	case START_TRANSACTION:
+		var data struct {
+			TransactionID string `mapstructure:"transaction_id"`
+		}
+		if err := mapstructure.Decode(msg.Data, &data); err != nil {
+			sendUser(s, mUser, ERROR, "invalid data for START_TRANSACTION")
+			return
+		}
+		s.TransactionMu.Lock()
+
+		tx, ok := s.Transactions[data.TransactionID]
+		if !ok {
 			s.TransactionMu.Unlock()
-			continue
+			sendUser(s, mUser, ERROR, "transaction not found")
+			return
+		}
 
-		// --- FITUR BARU DARI FRONTEND FRIEND ---
-		case TRANSACTION_HOST_RECV:
-			var data struct {
-				TransactionID string `mapstructure:"transaction_id"`
+		if !tx.Sender.Is(mUser) {
+			s.TransactionMu.Unlock()
+			sendUser(s, mUser, ERROR, "not authorized to start this transaction")
+			return
+		}
+
+		var acceptedTargets []*TransactionTarget
+		for _, target := range tx.Targets {
+			if target.Status == Accepted {
+				acceptedTargets = append(acceptedTargets, target)
 			}
-			if err := mapstructure.Decode(msg.Data, &data); err != nil {
-				sendWS(s, mUser.Conn, ERROR, "invalid data for TRANSACTION_HOST_RECV")
-				continue
+		}
+		tx.Targets = acceptedTargets
+		tx.Started = true
+		s.Metrics.TxStartLatency.Observe(time.Since(tx.CreatedAt).Seconds())
+
+		type startPayload struct {
+			TransactionID string      `json:"transaction_id"`
+			Sender        string      `json:"sender"`
+			Files         []*FileInfo `json:"files"`
+		}
+
+		// Each target only hears about the files it accepted.
+		for _, target := range tx.Targets {
+			sendUser(s, target.User, START_TRANSACTION, startPayload{
+				TransactionID: tx.ID,
+				Sender:        tx.Sender.MinUser.Username,
+				Files:         target.SelectedFiles(tx.Files),
+			})
+		}
+		mUser.Log.Info("Transaction started", "tx_id", tx.ID, "targets", len(tx.Targets))
+		sendUser(s, mUser, START_TRANSACTION, "transaction started")
+		s.TransactionMu.Unlock()
+		return
+
+	// --- FITUR BARU DARI FRONTEND FRIEND ---
+	case TRANSACTION_HOST_RECV:
+		var data struct {
+			TransactionID string `mapstructure:"transaction_id"`
+		}
+		if err := mapstructure.Decode(msg.Data, &data); err != nil {
+			sendUser(s, mUser, ERROR, "invalid data for TRANSACTION_HOST_RECV")
+			return
+		}
+		s.TransactionMu.Lock()
+
+		tx, ok := s.Transactions[data.TransactionID]
+		if !ok {
+			s.TransactionMu.Unlock()
+			sendUser(s, mUser, ERROR, "transaction not found")
+			return
+		}
+
+		if !tx.Sender.Is(mUser) {
+			s.TransactionMu.Unlock()
+			sendUser(s, mUser, ERROR, "not authorized to get this transaction")
+			return
+		}
+
+		sendUser(s, mUser, TRANSACTION_HOST_RECV, tx.Targets)
+		s.TransactionMu.Unlock()
+		return
+
+	case CANCEL_TRANSFER:
+		// The sender drops one target (public_key), a target drops itself.
+		var data struct {
+			TransactionID string `mapstructure:"transaction_id"`
+			PublicKey     string `mapstructure:"public_key"`
+			Reason        string `mapstructure:"reason"`
+		}
+		if err := mapstructure.Decode(msg.Data, &data); err != nil {
+			sendUser(s, mUser, ERROR, "invalid data for CANCEL_TRANSFER")
+			return
+		}
+
+		s.TransactionMu.Lock()
+		tx, ok := s.Transactions[data.TransactionID]
+		if !ok {
+			s.TransactionMu.Unlock()
+			sendUser(s, mUser, ERROR, "transaction not found")
+			return
+		}
+
+		by := "receiver"
+		targetKey := mUser.MinUser.PublicKey
+		if tx.Sender.Is(mUser) {
+			by = "sender"
+			targetKey = data.PublicKey
+		}
+
+		var target *TransactionTarget
+		for _, t := range tx.Targets {
+			if t.User.MinUser.PublicKey == targetKey {
+				target = t
+				break
 			}
-			s.TransactionMu.Lock()
+		}
+		if target == nil {
+			s.TransactionMu.Unlock()
+			sendUser(s, mUser, ERROR, "not a target of this transaction")
+			return
+		}
+		if !target.Active() {
+			s.TransactionMu.Unlock()
+			sendUser(s, mUser, ERROR, "transfer already ended for this target")
+			return
+		}
+		target.Status = Cancelled
 
-			tx, ok := s.Transactions[data.TransactionID]
-			if !ok {
-				s.TransactionMu.Unlock()
-				sendWS(s, mUser.Conn, ERROR, "transaction not found")
-				continue
+		active := false
+		for _, t := range tx.Targets {
+			if t.Active() {
+				active = true
+				break
 			}
+		}
+		var everyone []*ManagedUser
+		if !active {
+			for _, t := range tx.Targets {
+				everyone = append(everyone, t.User)
+			}
+			tx.Unsubscribe()
+			delete(s.Transactions, tx.ID)
+			dropRooms(s, tx.ID)
+		}
+		s.TransactionMu.Unlock()
 
-			if tx.Sender != mUser {
-				s.TransactionMu.Unlock()
-				sendWS(s, mUser.Conn, ERROR, "not authorized to get this transaction")
-				continue
+		if active {
+			dropOffers(s, tx.ID, targetKey)
+		} else {
+			dropOffers(s, tx.ID, "")
+		}
+		mUser.Log.Info("Transfer cancelled", "tx_id", tx.ID, "target", targetKey, "by", by)
+		if tx.RequestID != "" {
+			reopenRequest(s, tx, targetKey)
+		}
+		// Username is the target's, CancelledBy whoever cancelled it.
+		notice := struct {
+			TransactionID string `json:"transaction_id"`
+			PublicKey     string `json:"public_key"`
+			Username      string `json:"username"`
+			By            string `json:"by"`
+			CancelledBy   string `json:"cancelled_by"`
+			Reason        string `json:"reason,omitempty"`
+		}{
+			TransactionID: tx.ID,
+			PublicKey:     targetKey,
+			Username:      target.User.MinUser.Username,
+			By:            by,
+			CancelledBy:   mUser.MinUser.Username,
+			Reason:        data.Reason,
+		}
+		sendUser(s, target.User, CANCEL_TRANSFER, notice)
+		sendUser(s, tx.Sender, CANCEL_TRANSFER, notice)
+
+		// Nobody is left to send to, the transaction goes like with
+		// DELETE_TRANSACTION.
+		if !active {
+			mUser.Log.Info("Transaction deleted, no active targets left", "tx_id", tx.ID)
+			for _, user := range everyone {
+				sendUser(s, user, DELETE_TRANSACTION, tx.ID)
 			}
+			sendUser(s, tx.Sender, DELETE_TRANSACTION, tx.ID)
+		}
+		return
 
-			sendWS(s, mUser.Conn, TRANSACTION_HOST_RECV, tx.Targets)
-			continue
+	case REQUEST_FILES:
+		ws.requestFiles(msg)
+		return
 
-		case WEBRTC_SIGNAL:
-			var signal WebRTCSignal
-			if err := mapstructure.Decode(msg.Data, &signal); err != nil {
-				sendWS(s, mUser.Conn, ERROR, "invalid data for WEBRTC_SIGNAL")
-				continue
-			}
-			var targetUser *ManagedUser
-			s.MUserMu.RLock()
-			for _, user := range s.MUser {
-				if user.User.PublicKey == signal.TargetKey {
-					targetUser = user
-					break
-				}
-			}
-			s.MUserMu.RUnlock()
-			if targetUser == nil {
-				sendWS(s, mUser.Conn, ERROR, "target user not found or not connected")
-				continue
+	case REQUEST_FILES_STATUS:
+		ws.answerRequest(msg)
+		return
+
+	case CODE_ROOM:
+		ws.openRoom(msg)
+		return
+
+	case SHARE_LINK:
+		ws.shareLink(msg)
+		return
+
+	case SHARE_LINK_JOIN:
+		ws.joinLink(msg)
+		return
+
+	case CODE_ROOM_JOIN:
+		ws.joinRoom(msg)
+		return
+
+	case CODE_ROOM_PAKE:
+		ws.relayPake(msg)
+		return
+
+	case CODE_ROOM_CONFIRM:
+		ws.confirmRoom(msg)
+		return
+
+	case SHARE_TEXT:
+		ws.shareText(msg)
+		return
+
+	case SHARE_TEXT_ACCEPT:
+		ws.answerText(msg)
+		return
+
+	case WEBRTC_SIGNAL:
+		var signal WebRTCSignal
+		if err := mapstructure.Decode(msg.Data, &signal); err != nil {
+			sendUser(s, mUser, ERROR, "invalid data for WEBRTC_SIGNAL")
+			return
+		}
+		if raw, err := json.Marshal(signal.Data); err != nil || len(raw) > s.Config.MaxSignalSize {
+			ws.tooLarge("signal too large")
+			return
+		}
+		targetUser := findUser(s, signal.TargetKey)
+		if targetUser == nil {
+			sendUser(s, mUser, ERROR, "target user not found or not connected")
+			return
+		}
+		sendUser(s, targetUser, WEBRTC_SIGNAL, struct {
+			TransactionID string `json:"transaction_id"`
+			FromKey       string `json:"from_key"`
+			Data          any    `json:"data"`
+		}{
+			TransactionID: signal.TransactionID,
+			FromKey:       mUser.User.PublicKey,
+			Data:          signal.Data,
+		})
+		s.Metrics.SignalsRelayed.Inc()
+		mUser.Log.Debug("Signal relayed", "tx_id", signal.TransactionID, "target_key", signal.TargetKey)
+		return
+	}
+}
+
+// validateFiles checks the file list of FILE_SHARE_TARGET against the limits.
+func validateFiles(s *Server, files []FileInfo) error {
+	seen := make(map[string]bool, len(files))
+	for _, f := range files {
+		if f.Name == "" || utf8.RuneCountInString(f.Name) > s.Config.MaxFilenameLength {
+			return errors.New("invalid file name")
+		}
+		if f.Size < 0 || (f.IsDir && f.Size != 0) {
+			return errors.New("invalid file size")
+		}
+		if len(f.Type) > 255 {
+			return errors.New("invalid file type")
+		}
+		if f.ModTime < 0 || f.Mode > 0o777 {
+			return errors.New("invalid file attributes")
+		}
+
+		// Only paths are created as they are on the receiving side, a flat
+		// name is the browser's download name and is only kept in the folder.
+		p := f.Path
+		if p == "" {
+			p = f.Name
+			if err := validateName(s, p); err != nil {
+				return err
 			}
-			sendWS(s, targetUser.Conn, WEBRTC_SIGNAL, struct {
-				TransactionID string `json:"transaction_id"`
-				FromKey       string `json:"from_key"`
-				Data          any    `json:"data"`
-			}{
-				TransactionID: signal.TransactionID,
-				FromKey:       mUser.User.PublicKey,
-				Data:          signal.Data,
-			})
-			continue
+		} else if err := validatePath(s, p); err != nil {
+			return err
+		}
+		if path.Base(p) != f.Name {
+			return errors.New("file name does not match its path")
+		}
+		// Compared case-insensitively, the receiving file system may be.
+		key := strings.ToLower(p)
+		if seen[key] {
+			return errors.New("duplicate path " + p)
+		}
+		seen[key] = true
+	}
+	return nil
+}
+
+// validateSelection checks the file indexes a target accepted.
+func validateSelection(selection []int, files int) error {
+	seen := make(map[int]bool, len(selection))
+	for _, i := range selection {
+		if i < 0 || i >= files {
+			return errors.New("invalid file selection")
+		}
+		if seen[i] {
+			return errors.New("duplicate file in selection")
 		}
+		seen[i] = true
 	}
+	return nil
 }
 
-func startJWTExpiryWatcher(c *websocket.Conn, exp time.Time, done <-chan struct{}) {
+// Longest relative path accepted in a manifest, in bytes.
+const maxPathLength = 4096
+
+// validatePath rejects manifest paths that could land outside the folder
+// the receiver picked, or that some file systems can't create.
+func validatePath(s *Server, p string) error {
+	if len(p) > maxPathLength {
+		return errors.New("path too long")
+	}
+	if strings.HasPrefix(p, "/") || strings.Contains(p, "\\") {
+		return errors.New("invalid path " + p + ": must be relative")
+	}
+	for _, elem := range strings.Split(p, "/") {
+		if err := validateName(s, elem); err != nil {
+			return errors.New("invalid path " + p)
+		}
+		if strings.ContainsFunc(elem, func(r rune) bool { return strings.ContainsRune(`<>:"|?*`, r) }) {
+			return errors.New("invalid character in path " + p)
+		}
+		if strings.HasSuffix(elem, ".") || strings.HasSuffix(elem, " ") {
+			return errors.New("invalid path " + p)
+		}
+		if reservedName(elem) {
+			return errors.New("reserved name in path " + p)
+		}
+	}
+	return nil
+}
+
+// validateName rejects a single file name that isn't one, like "..", or
+// that carries a path.
+func validateName(s *Server, name string) error {
+	if name == "" || name == "." || name == ".." || strings.ContainsAny(name, "/\\") {
+		return errors.New("invalid file name " + name)
+	}
+	if utf8.RuneCountInString(name) > s.Config.MaxFilenameLength || !utf8.ValidString(name) {
+		return errors.New("invalid file name " + name)
+	}
+	if strings.ContainsFunc(name, func(r rune) bool { return r < 0x20 }) {
+		return errors.New("invalid character in file name " + name)
+	}
+	return nil
+}
+
+// reservedName reports the device names Windows refuses as file names, with
+// or without an extension.
+func reservedName(elem string) bool {
+	base, _, _ := strings.Cut(strings.ToUpper(elem), ".")
+	switch base {
+	case "CON", "PRN", "AUX", "NUL":
+		return true
+	}
+	if len(base) == 4 && (strings.HasPrefix(base, "COM") || strings.HasPrefix(base, "LPT")) {
+		return base[3] >= '1' && base[3] <= '9'
+	}
+	return false
+}
+
+// startJWTExpiryWatcher closes the socket once the JWT expires. Shortly
+// before that the client gets a REAUTH message so it can send a fresh token,
+// which arrives on renew and pushes the deadline back.
+func startJWTExpiryWatcher(s *Server, mUser *ManagedUser, exp time.Time, renew <-chan time.Time, done <-chan struct{}) {
+	c := mUser.Conn
 	go func() {
-		select { // this is switch case for channel
-		case <-time.After(time.Until(exp)):
-			_ = c.WriteMessage(
-				websocket.CloseMessage,
-				websocket.FormatCloseMessage(
-					websocket.ClosePolicyViolation,
-					"jwt expired",
-				),
-			)
-			c.Close()
-		case <-done:
-			return
+		for {
+			warn := time.NewTimer(time.Until(exp.Add(-reauthWarning)))
+			expire := time.NewTimer(time.Until(exp))
+
+			select { // this is switch case for channel
+			case <-warn.C:
+				sendWS(s, c, REAUTH, "token expiring")
+				select {
+				case <-expire.C:
+					mUser.Log.Info("WS closed, JWT expired")
+					closeWS(s, c, websocket.ClosePolicyViolation, "jwt expired")
+					return
+				case exp = <-renew:
+					expire.Stop()
+				case <-done:
+					expire.Stop()
+					return
+				}
+			case <-expire.C:
+				warn.Stop()
+				mUser.Log.Info("WS closed, JWT expired")
+				closeWS(s, c, websocket.ClosePolicyViolation, "jwt expired")
+				return
+			case exp = <-renew:
+				warn.Stop()
+				expire.Stop()
+			case <-done:
+				warn.Stop()
+				expire.Stop()
+				return
+			}
 		}
 	}()
 }
@@ -0,0 +1,253 @@
+package server
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestValidateFiles(t *testing.T) {
+	s := &Server{}
+	s.Config.MaxFilenameLength = 255
+
+	tests := []struct {
+		name  string
+		files []FileInfo
+		ok    bool
+	}{
+		{"flat name", []FileInfo{{Name: "report.pdf"}}, true},
+		// Windows rules only apply to paths that get created as they are.
+		{"flat name with colon", []FileInfo{{Name: "notes 12:30.txt"}}, true},
+		{"flat reserved name", []FileInfo{{Name: "con.txt"}}, true},
+		{"flat trailing dot", []FileInfo{{Name: "file."}}, true},
+		{"flat name with slash", []FileInfo{{Name: "a/b"}}, false},
+		{"flat name with backslash", []FileInfo{{Name: `a\b`}}, false},
+		{"flat dot dot", []FileInfo{{Name: ".."}}, false},
+		{"flat control char", []FileInfo{{Name: "a\nb"}}, false},
+		{"nested path", []FileInfo{{Name: "b.txt", Path: "dir/a/b.txt"}, {Name: "a", Path: "dir/a", IsDir: true}}, true},
+		{"path with colon", []FileInfo{{Name: "12:30.txt", Path: "dir/12:30.txt"}}, false},
+		{"path mismatch", []FileInfo{{Name: "c.txt", Path: "dir/b.txt"}}, false},
+		{"duplicate path", []FileInfo{{Name: "a", Path: "d/a"}, {Name: "A", Path: "D/A"}}, false},
+		{"negative size", []FileInfo{{Name: "a", Size: -1}}, false},
+		{"dir with size", []FileInfo{{Name: "a", Path: "a", IsDir: true, Size: 1}}, false},
+		{"bad mode", []FileInfo{{Name: "a", Mode: 0o4755}}, false},
+		{"long name", []FileInfo{{Name: strings.Repeat("a", 256)}}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := validateFiles(s, tt.files); (err == nil) != tt.ok {
+				t.Fatalf("got %v, want ok=%v", err, tt.ok)
+			}
+		})
+	}
+}
+
+func TestValidatePath(t *testing.T) {
+	s := &Server{}
+	s.Config.MaxFilenameLength = 255
+
+	tests := []struct {
+		path string
+		ok   bool
+	}{
+		{"a.txt", true},
+		{"dir/sub/a.txt", true},
+		{"dir/.hidden", true},
+		{"/etc/passwd", false},
+		{"../a", false},
+		{"dir/../../a", false},
+		{"dir/./a", false},
+		{"dir//a", false},
+		{"dir/", false},
+		{`dir\a`, false},
+		{"dir/a:b", false},
+		{"dir/a?", false},
+		{"dir/a.", false},
+		{"dir/a ", false},
+		{"dir/NUL", false},
+		{"com1.log", false},
+		{"a\x00b", false},
+		{strings.Repeat("a/", maxPathLength/2) + "a", false},
+		{"\xff", false},
+	}
+	for _, tt := range tests {
+		if err := validatePath(s, tt.path); (err == nil) != tt.ok {
+			t.Errorf("validatePath(%q) = %v, want ok=%v", tt.path, err, tt.ok)
+		}
+	}
+}
+
+func TestReservedName(t *testing.T) {
+	tests := map[string]bool{
+		"CON":        true,
+		"con":        true,
+		"Nul.txt":    true,
+		"aux.tar.gz": true,
+		"COM1":       true,
+		"lpt9.doc":   true,
+		"COM0":       false,
+		"COM10":      false,
+		"console":    false,
+		"icon":       false,
+		"LPT":        false,
+		"":           false,
+	}
+	for name, want := range tests {
+		if got := reservedName(name); got != want {
+			t.Errorf("reservedName(%q) = %v, want %v", name, got, want)
+		}
+	}
+}
+
+func TestFilesLockedOnceAccepted(t *testing.T) {
+	s := newTestServer(t)
+	alice := newTestClient(t, s, "alice")
+	bob := newTestClient(t, s, "bob")
+	carol := newTestClient(t, s, "carol")
+	files := []FileInfo{{Name: "a.txt", Size: 1}, {Name: "b.txt", Size: 2}}
+	id := newTestTransaction(alice, files, bob, carol)
+
+	// Nobody answered yet, the files may still change.
+	alice.send(FILE_SHARE_TARGET, map[string]any{"transaction_id": id, "files": files[:1]})
+	alice.expect(FILE_SHARE_TARGET)
+
+	bob.send(TRANSACTION_SHARE_ACCEPT, map[string]any{"transaction_id": id, "accept": true, "files": []int{0}})
+	bob.expect(START_TRANSACTION)
+	alice.send(FILE_SHARE_TARGET, map[string]any{"transaction_id": id, "files": files})
+	alice.expectError("files can't change")
+
+	// Still locked once the target that accepted is gone.
+	bob.send(CANCEL_TRANSFER, map[string]any{"transaction_id": id})
+	alice.expect(CANCEL_TRANSFER)
+	alice.send(FILE_SHARE_TARGET, map[string]any{"transaction_id": id, "files": files})
+	alice.expectError("files can't change")
+}
+
+func TestTargetsKeepAccepted(t *testing.T) {
+	s := newTestServer(t)
+	alice := newTestClient(t, s, "alice")
+	bob := newTestClient(t, s, "bob")
+	carol := newTestClient(t, s, "carol")
+	dave := newTestClient(t, s, "dave")
+	files := []FileInfo{{Name: "a.txt", Size: 1}}
+	id := newTestTransaction(alice, files, bob, carol)
+
+	bob.send(TRANSACTION_SHARE_ACCEPT, map[string]any{"transaction_id": id, "accept": true})
+	bob.expect(START_TRANSACTION)
+	bob.discard()
+
+	// Setting the targets again leaves bob's answer alone and only offers
+	// the files to the new target. carol, still pending, is dropped.
+	alice.send(USER_SHARE_TARGET, map[string]any{"transaction_id": id, "public_keys": []string{dave.mUser.MinUser.PublicKey}})
+	alice.expect(USER_SHARE_TARGET)
+	dave.expect(TRANSACTION_SHARE_ACCEPT)
+	bob.expectNone(TRANSACTION_SHARE_ACCEPT)
+
+	targets := s.Transactions[id].Targets
+	if len(targets) != 2 || targets[0].User.MinUser.Username != "bob" || targets[0].Status != Accepted || targets[1].User.MinUser.Username != "dave" {
+		t.Fatalf("targets = %+v", targets)
+	}
+	alice.send(FILE_SHARE_TARGET, map[string]any{"transaction_id": id, "files": []FileInfo{{Name: "b.txt", Size: 1}}})
+	alice.expectError("files can't change")
+}
+
+func TestCancelTransfer(t *testing.T) {
+	s := newTestServer(t)
+	alice := newTestClient(t, s, "alice")
+	bob := newTestClient(t, s, "bob")
+	carol := newTestClient(t, s, "carol")
+	id := newTestTransaction(alice, []FileInfo{{Name: "a.txt", Size: 1}}, bob, carol)
+
+	// The sender drops bob: the notice names bob as the target and alice
+	// as the one who cancelled.
+	alice.send(CANCEL_TRANSFER, map[string]any{"transaction_id": id, "public_key": bob.mUser.MinUser.PublicKey})
+	notice := bob.expect(CANCEL_TRANSFER)
+	if field(notice, "username") != "bob" || field(notice, "cancelled_by") != "alice" || field(notice, "by") != "sender" {
+		t.Fatalf("notice = %v", notice)
+	}
+	alice.expect(CANCEL_TRANSFER)
+	bob.expectNone(DELETE_TRANSACTION)
+
+	// carol was the last one, everyone hears the transaction is gone.
+	carol.send(CANCEL_TRANSFER, map[string]any{"transaction_id": id})
+	notice = alice.expect(CANCEL_TRANSFER)
+	if field(notice, "username") != "carol" || field(notice, "cancelled_by") != "carol" || field(notice, "by") != "receiver" {
+		t.Fatalf("notice = %v", notice)
+	}
+	for _, c := range []*testClient{alice, bob, carol} {
+		if got, _ := c.expect(DELETE_TRANSACTION).(string); got != id {
+			t.Fatalf("%s: DELETE_TRANSACTION %q", c.mUser.MinUser.Username, got)
+		}
+	}
+	if _, ok := s.Transactions[id]; ok {
+		t.Fatal("transaction still there")
+	}
+}
+
+func TestCodeRoomJoin(t *testing.T) {
+	s := newTestServer(t)
+	alice := newTestClient(t, s, "alice")
+	bob := newTestClient(t, s, "bob")
+	alice.send(NEW_TRANSACTION, nil)
+	id := field(alice.expect(NEW_TRANSACTION), "id")
+	alice.send(FILE_SHARE_TARGET, map[string]any{"transaction_id": id, "files": []FileInfo{{Name: "a.txt", Size: 1}}})
+	alice.expect(FILE_SHARE_TARGET)
+
+	alice.send(CODE_ROOM, map[string]any{"transaction_id": id})
+	nameplate := field(alice.expect(CODE_ROOM), "nameplate")
+	bob.send(CODE_ROOM_JOIN, map[string]any{"nameplate": nameplate})
+
+	// Both sides bind the transaction and each other's key into the PAKE,
+	// so both need to see them.
+	for _, side := range []struct {
+		c    *testClient
+		peer string
+	}{{alice, "bob"}, {bob, "alice"}} {
+		joined := side.c.expect(CODE_ROOM_JOIN)
+		user, _ := joined.(map[string]any)["user"]
+		if field(joined, "transaction_id") != id || field(user, "public_key") != side.peer+"-key" {
+			t.Fatalf("%s: join = %v", side.c.mUser.MinUser.Username, joined)
+		}
+	}
+}
+
+func TestCodeRoomGoesWithTransaction(t *testing.T) {
+	s := newTestServer(t)
+	alice := newTestClient(t, s, "alice")
+	bob := newTestClient(t, s, "bob")
+	alice.send(NEW_TRANSACTION, nil)
+	id := field(alice.expect(NEW_TRANSACTION), "id")
+	alice.send(CODE_ROOM, map[string]any{"transaction_id": id})
+	nameplate := field(alice.expect(CODE_ROOM), "nameplate")
+
+	alice.send(DELETE_TRANSACTION, id)
+	alice.expect(DELETE_TRANSACTION)
+	if len(s.CodeRooms) != 0 {
+		t.Fatalf("%d code rooms left after the transaction was deleted", len(s.CodeRooms))
+	}
+	bob.send(CODE_ROOM_JOIN, map[string]any{"nameplate": nameplate})
+	bob.expectError("code not found")
+}
+
+func TestLinkGuestAllowed(t *testing.T) {
+	tx := func(id string) map[string]any { return map[string]any{"transaction_id": id} }
+	for _, tc := range []struct {
+		msg  WSMessage
+		want bool
+	}{
+		{WSMessage{NONE, nil}, true},
+		{WSMessage{REAUTH, "token"}, true},
+		{WSMessage{TRANSACTION_SHARE_ACCEPT, tx("tx-1")}, true},
+		{WSMessage{WEBRTC_SIGNAL, tx("tx-1")}, true},
+		{WSMessage{CANCEL_TRANSFER, tx("tx-1")}, true},
+		{WSMessage{TRANSACTION_SHARE_ACCEPT, tx("tx-2")}, false},
+		{WSMessage{WEBRTC_SIGNAL, map[string]any{"target_key": "alice-key"}}, false},
+		{WSMessage{SHARE_LINK_JOIN, tx("tx-2")}, false},
+		{WSMessage{NEW_TRANSACTION, nil}, false},
+		{WSMessage{SHARE_TEXT, tx("tx-1")}, false},
+		{WSMessage{CODE_ROOM_JOIN, map[string]any{"nameplate": "7"}}, false},
+	} {
+		if got := linkGuestAllowed(tc.msg, "tx-1"); got != tc.want {
+			t.Errorf("%s %v: allowed = %v, want %v", tc.msg.WSType, tc.msg.Data, got, tc.want)
+		}
+	}
+}
@@ -0,0 +1,880 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	helper "gopherdrop/helper"
+	server "gopherdrop/server"
+	"io"
+	"io/fs"
+	"mime"
+	"os"
+	"os/signal"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pion/webrtc/v4"
+)
+
+// The data channel protocol is the web client's: per file a JSON "meta"
+// text message, then its content in binary chunks. Directories and empty
+// files aren't sent, the receiver creates them from the manifest.
+const (
+	chunkSize       = 16 * 1024
+	bufferThreshold = 65535
+)
+
+var rtcConfig = webrtc.Configuration{
+	ICEServers: []webrtc.ICEServer{
+		{URLs: []string{"stun:stun.l.google.com:19302", "stun:stun1.l.google.com:19302"}},
+	},
+}
+
+type fileMeta struct {
+	Type string `json:"type"`
+	Name string `json:"name"`
+	Size int64  `json:"size"`
+	Mime string `json:"mime"`
+}
+
+// rtcSignal is the data of a WEBRTC_SIGNAL, as the web client sends it.
+type rtcSignal struct {
+	Type      string                     `json:"type"`
+	SDP       *webrtc.SessionDescription `json:"sdp,omitempty"`
+	Candidate *webrtc.ICECandidateInit   `json:"candidate,omitempty"`
+}
+
+type signalEvent struct {
+	TransactionID string    `json:"transaction_id"`
+	FromKey       string    `json:"from_key"`
+	Data          rtcSignal `json:"data"`
+}
+
+// peer is the connection to one remote user of a transaction. ICE
+// candidates that come before the remote description wait in pending.
+type peer struct {
+	c    *client
+	pc   *webrtc.PeerConnection
+	txID string
+	key  string
+
+	mu        sync.Mutex
+	pending   []webrtc.ICECandidateInit
+	remoteSet bool
+
+	failed   chan struct{} // closed once the connection fails or closes
+	failOnce sync.Once
+}
+
+func newPeer(c *client, txID string, key string) (*peer, error) {
+	pc, err := webrtc.NewPeerConnection(rtcConfig)
+	if err != nil {
+		return nil, err
+	}
+	p := &peer{c: c, pc: pc, txID: txID, key: key, failed: make(chan struct{})}
+	pc.OnICECandidate(func(cand *webrtc.ICECandidate) {
+		if cand != nil {
+			init := cand.ToJSON()
+			p.signal(rtcSignal{Type: "candidate", Candidate: &init})
+		}
+	})
+	pc.OnConnectionStateChange(func(state webrtc.PeerConnectionState) {
+		if state == webrtc.PeerConnectionStateFailed || state == webrtc.PeerConnectionStateClosed {
+			p.failOnce.Do(func() { close(p.failed) })
+		}
+	})
+	return p, nil
+}
+
+func (p *peer) signal(data rtcSignal) error {
+	return p.c.send(server.WEBRTC_SIGNAL, map[string]any{
+		"transaction_id": p.txID,
+		"target_key":     p.key,
+		"data":           data,
+	})
+}
+
+// offer starts the negotiation, the sender is the initiator.
+func (p *peer) offer() error {
+	offer, err := p.pc.CreateOffer(nil)
+	if err != nil {
+		return err
+	}
+	if err := p.pc.SetLocalDescription(offer); err != nil {
+		return err
+	}
+	return p.signal(rtcSignal{Type: "offer", SDP: &offer})
+}
+
+// handle applies a signal from the remote side.
+func (p *peer) handle(data rtcSignal) error {
+	switch data.Type {
+	case "offer", "answer":
+		if data.SDP == nil {
+			return errors.New("signal without sdp")
+		}
+		if err := p.pc.SetRemoteDescription(*data.SDP); err != nil {
+			return err
+		}
+		p.mu.Lock()
+		p.remoteSet = true
+		pending := p.pending
+		p.pending = nil
+		p.mu.Unlock()
+		for _, cand := range pending {
+			p.pc.AddICECandidate(cand)
+		}
+		if data.Type == "offer" {
+			answer, err := p.pc.CreateAnswer(nil)
+			if err != nil {
+				return err
+			}
+			if err := p.pc.SetLocalDescription(answer); err != nil {
+				return err
+			}
+			return p.signal(rtcSignal{Type: "answer", SDP: &answer})
+		}
+	case "candidate":
+		if data.Candidate == nil {
+			return nil
+		}
+		p.mu.Lock()
+		if !p.remoteSet {
+			p.pending = append(p.pending, *data.Candidate)
+			p.mu.Unlock()
+			return nil
+		}
+		p.mu.Unlock()
+		return p.pc.AddICECandidate(*data.Candidate)
+	}
+	return nil
+}
+
+func (p *peer) Close() error {
+	return p.pc.Close()
+}
+
+// stringList is a flag that may be given more than once.
+type stringList []string
+
+func (l *stringList) String() string     { return strings.Join(*l, ",") }
+func (l *stringList) Set(v string) error { *l = append(*l, v); return nil }
+
+// buildManifest lists paths the way FILE_SHARE_TARGET takes them. A file
+// is sent by its name, a directory as a tree under its own name. sources
+// has the local path of every entry.
+func buildManifest(paths []string) ([]server.FileInfo, []string, error) {
+	var files []server.FileInfo
+	var sources []string
+	add := func(local string, rel string, info fs.FileInfo) {
+		f := server.FileInfo{
+			Name:    info.Name(),
+			Path:    rel,
+			IsDir:   info.IsDir(),
+			ModTime: info.ModTime().UnixMilli(),
+			Mode:    uint32(info.Mode().Perm()),
+		}
+		if !f.IsDir {
+			f.Size = info.Size()
+			f.Type = mime.TypeByExtension(filepath.Ext(f.Name))
+		}
+		files = append(files, f)
+		sources = append(sources, local)
+	}
+
+	for _, p := range paths {
+		info, err := os.Stat(p)
+		if err != nil {
+			return nil, nil, err
+		}
+		if !info.IsDir() {
+			if !info.Mode().IsRegular() {
+				return nil, nil, fmt.Errorf("%s: not a regular file", p)
+			}
+			add(p, "", info)
+			continue
+		}
+
+		root := filepath.Clean(p)
+		base := filepath.Base(root)
+		err = filepath.WalkDir(root, func(local string, d fs.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+			// Links and devices have no place in the manifest.
+			if !d.IsDir() && !d.Type().IsRegular() {
+				fmt.Fprintf(os.Stderr, "skipping %s: not a regular file\n", local)
+				return nil
+			}
+			info, err := d.Info()
+			if err != nil {
+				return err
+			}
+			rel, err := filepath.Rel(root, local)
+			if err != nil {
+				return err
+			}
+			add(local, path.Join(base, filepath.ToSlash(rel)), info)
+			return nil
+		})
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+	return files, sources, nil
+}
+
+// resolveTargets turns usernames into public keys with the share list.
+// Anything else must already be a public key, its user may be offline.
+func resolveTargets(c *client, names []string) ([]string, error) {
+	if err := c.send(server.START_SHARING, nil); err != nil {
+		return nil, err
+	}
+	var list []server.ManagedUser
+	if err := c.expect(server.USER_SHARE_LIST, &list); err != nil {
+		return nil, err
+	}
+
+	keys := make([]string, 0, len(names))
+	for _, name := range names {
+		key := ""
+		for _, u := range list {
+			if u.MinUser.Username == name || u.MinUser.PublicKey == name {
+				key = u.MinUser.PublicKey
+				break
+			}
+		}
+		if key == "" {
+			if helper.ValidatePublicKey(name) != nil {
+				return nil, fmt.Errorf("%s is neither an online user nor a public key", name)
+			}
+			key = name
+		}
+		keys = append(keys, key)
+	}
+	return keys, nil
+}
+
+func runSend(sec helper.GoDropConfig, args []string) error {
+	flags := flag.NewFlagSet("send", flag.ContinueOnError)
+	var to stringList
+	flags.Var(&to, "to", "username or public key of a recipient, may be repeated")
+	name := flags.String("name", "", "username to register the identity with on first use")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if len(to) == 0 || flags.NArg() == 0 {
+		return errors.New(usage)
+	}
+
+	files, sources, err := buildManifest(flags.Args())
+	if err != nil {
+		return err
+	}
+
+	c, err := connect(sec, *name)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+
+	keys, err := resolveTargets(c, to)
+	if err != nil {
+		return err
+	}
+
+	var tx server.Transaction
+	if err := c.send(server.NEW_TRANSACTION, nil); err != nil {
+		return err
+	}
+	if err := c.expect(server.NEW_TRANSACTION, &tx); err != nil {
+		return err
+	}
+	if err := c.send(server.FILE_SHARE_TARGET, map[string]any{"transaction_id": tx.ID, "files": files}); err != nil {
+		return err
+	}
+	if err := c.expect(server.FILE_SHARE_TARGET, nil); err != nil {
+		return err
+	}
+	if err := c.send(server.USER_SHARE_TARGET, map[string]any{"transaction_id": tx.ID, "public_keys": keys}); err != nil {
+		return err
+	}
+	if err := c.expect(server.USER_SHARE_TARGET, nil); err != nil {
+		return err
+	}
+	fmt.Printf("offered %d entries to %d recipients, waiting for answers\n", len(files), len(keys))
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	type result struct {
+		key string
+		err error
+	}
+	waiting := make(map[string]bool, len(keys))
+	for _, key := range keys {
+		waiting[key] = true
+	}
+	peers := make(map[string]*peer)
+	results := make(chan result)
+	failed := 0
+
+	for len(waiting) > 0 {
+		var ev wsEvent
+		select {
+		case <-ctx.Done():
+			c.send(server.DELETE_TRANSACTION, tx.ID)
+			return errors.New("interrupted, transaction deleted")
+		case res := <-results:
+			if res.err != nil {
+				failed++
+				fmt.Fprintf(os.Stderr, "sending to %s failed: %v\n", res.key, res.err)
+			} else {
+				fmt.Printf("sent to %s\n", res.key)
+			}
+			if p := peers[res.key]; p != nil {
+				p.Close()
+			}
+			delete(waiting, res.key)
+			continue
+		case ev = <-c.events:
+		case <-c.closed:
+			return fmt.Errorf("connection closed: %w", c.err)
+		}
+
+		switch ev.Type {
+		case server.ERROR:
+			fmt.Fprintln(os.Stderr, serverError(ev))
+
+		case server.TRANSACTION_SHARE_ACCEPT:
+			var answer struct {
+				Type      string `json:"type"`
+				Username  string `json:"username"`
+				PublicKey string `json:"public_key"`        // queued_notification
+				Responder string `json:"sender_public_key"` // accept and decline_notification
+				Files     []int  `json:"files"`
+				Reason    string `json:"reason"`
+			}
+			if json.Unmarshal(ev.Data, &answer) != nil {
+				continue
+			}
+			switch answer.Type {
+			case "queued_notification":
+				fmt.Printf("%s is offline, the offer waits in their inbox\n", answer.Username)
+			case "decline_notification":
+				if waiting[answer.Responder] {
+					fmt.Printf("%s declined%s\n", answer.Username, reasonSuffix(answer.Reason))
+					delete(waiting, answer.Responder)
+				}
+			case "accept_notification":
+				if !waiting[answer.Responder] || peers[answer.Responder] != nil {
+					continue
+				}
+				fmt.Printf("%s accepted\n", answer.Username)
+				if !hasContent(files, answer.Files) {
+					go func(key string) { results <- result{key, nil} }(answer.Responder)
+					continue
+				}
+				p, err := newPeer(c, tx.ID, answer.Responder)
+				if err != nil {
+					return err
+				}
+				peers[answer.Responder] = p
+				dc, err := p.pc.CreateDataChannel("file-transfer", nil)
+				if err != nil {
+					return err
+				}
+				go func(key string, selection []int) {
+					results <- result{key, sendFiles(p, dc, files, sources, selection)}
+				}(answer.Responder, answer.Files)
+				if err := p.offer(); err != nil {
+					return err
+				}
+			}
+
+		case server.WEBRTC_SIGNAL:
+			var sig signalEvent
+			if json.Unmarshal(ev.Data, &sig) != nil || sig.TransactionID != tx.ID {
+				continue
+			}
+			if p := peers[sig.FromKey]; p != nil {
+				if err := p.handle(sig.Data); err != nil {
+					fmt.Fprintf(os.Stderr, "signal from %s: %v\n", sig.FromKey, err)
+				}
+			}
+
+		case server.CANCEL_TRANSFER:
+			var notice struct {
+				TransactionID string `json:"transaction_id"`
+				PublicKey     string `json:"public_key"`
+				Username      string `json:"username"`
+				Reason        string `json:"reason"`
+			}
+			if json.Unmarshal(ev.Data, &notice) != nil || notice.TransactionID != tx.ID || !waiting[notice.PublicKey] {
+				continue
+			}
+			fmt.Printf("transfer to %s cancelled%s\n", notice.Username, reasonSuffix(notice.Reason))
+			if p := peers[notice.PublicKey]; p != nil {
+				p.Close()
+			}
+			failed++
+			delete(waiting, notice.PublicKey)
+
+		case server.DELETE_TRANSACTION:
+			var id string
+			if json.Unmarshal(ev.Data, &id) == nil && id == tx.ID {
+				return errors.New("transaction deleted")
+			}
+		}
+	}
+
+	if failed > 0 {
+		return fmt.Errorf("%d of %d transfers didn't complete", failed, len(keys))
+	}
+	return nil
+}
+
+func reasonSuffix(reason string) string {
+	if reason == "" {
+		return ""
+	}
+	return ": " + reason
+}
+
+// hasContent tells whether the selection has a file to stream, the
+// receiver makes the rest from the manifest alone.
+func hasContent(files []server.FileInfo, selection []int) bool {
+	for i, f := range files {
+		if !f.IsDir && f.Size > 0 && (selection == nil || slices.Contains(selection, i)) {
+			return true
+		}
+	}
+	return false
+}
+
+// sendFiles streams the selected files over dc once it opens, and waits
+// for them to leave the buffer.
+func sendFiles(p *peer, dc *webrtc.DataChannel, files []server.FileInfo, sources []string, selection []int) error {
+	opened := make(chan struct{})
+	closed := make(chan struct{})
+	var closeOnce sync.Once
+	low := make(chan struct{}, 1)
+	dc.OnOpen(func() { close(opened) })
+	dc.OnClose(func() { closeOnce.Do(func() { close(closed) }) })
+	dc.SetBufferedAmountLowThreshold(bufferThreshold / 2)
+	dc.OnBufferedAmountLow(func() {
+		select {
+		case low <- struct{}{}:
+		default:
+		}
+	})
+
+	select {
+	case <-opened:
+	case <-closed:
+		return errors.New("data channel closed")
+	case <-p.failed:
+		return errors.New("connection failed")
+	case <-time.After(time.Minute):
+		return errors.New("no connection after a minute")
+	}
+
+	selected := make(map[int]bool, len(selection))
+	for _, i := range selection {
+		selected[i] = true
+	}
+	buf := make([]byte, chunkSize)
+	for i, f := range files {
+		if (selection != nil && !selected[i]) || f.IsDir || f.Size == 0 {
+			continue
+		}
+		meta, err := json.Marshal(fileMeta{Type: "meta", Name: f.Name, Size: f.Size, Mime: f.Type})
+		if err != nil {
+			return err
+		}
+		if err := dc.SendText(string(meta)); err != nil {
+			return err
+		}
+
+		src, err := os.Open(sources[i])
+		if err != nil {
+			return err
+		}
+		var sent int64
+		for sent < f.Size {
+			for dc.BufferedAmount() > bufferThreshold {
+				select {
+				case <-low:
+				case <-closed:
+					src.Close()
+					return errors.New("data channel closed")
+				case <-time.After(100 * time.Millisecond):
+				}
+			}
+			n, err := io.ReadFull(src, buf[:min(int64(len(buf)), f.Size-sent)])
+			if err != nil {
+				src.Close()
+				return fmt.Errorf("%s changed while sending: %w", sources[i], err)
+			}
+			if err := dc.Send(buf[:n]); err != nil {
+				src.Close()
+				return err
+			}
+			sent += int64(n)
+		}
+		src.Close()
+	}
+
+	// The receiver hangs up once it has everything, possibly before the
+	// buffer is seen empty here. A browser may not hang up at all.
+	for dc.BufferedAmount() > 0 {
+		select {
+		case <-closed:
+			return nil
+		case <-time.After(100 * time.Millisecond):
+		}
+	}
+	select {
+	case <-closed:
+	case <-p.failed:
+	case <-time.After(5 * time.Second):
+	}
+	return nil
+}
+
+// receiver writes one transfer under root: it creates the directories and
+// empty files of the manifest up front, then each streamed file in turn.
+type receiver struct {
+	root  *os.Root
+	files []*server.FileInfo
+	queue []int // indexes of the files that are streamed, in order
+
+	cur     *os.File
+	written int64
+
+	done     chan error
+	doneOnce sync.Once
+}
+
+// localPath is where f goes under the receiving folder. The server checked
+// the manifest already, this doesn't rely on it.
+func localPath(f *server.FileInfo) (string, error) {
+	p := f.Path
+	if p == "" {
+		if strings.ContainsAny(f.Name, `/\`) {
+			return "", fmt.Errorf("invalid file name %q", f.Name)
+		}
+		p = f.Name
+	}
+	local := filepath.FromSlash(p)
+	if !filepath.IsLocal(local) {
+		return "", fmt.Errorf("invalid path %q", p)
+	}
+	return local, nil
+}
+
+func newReceiver(root *os.Root, files []*server.FileInfo) (*receiver, error) {
+	r := &receiver{root: root, files: files, done: make(chan error, 1)}
+	for i, f := range files {
+		p, err := localPath(f)
+		if err != nil {
+			return nil, err
+		}
+		if f.IsDir {
+			if err := root.MkdirAll(p, 0o755); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		if dir := filepath.Dir(p); dir != "." {
+			if err := root.MkdirAll(dir, 0o755); err != nil {
+				return nil, err
+			}
+		}
+		if f.Size > 0 {
+			// Nothing is overwritten, better to fail before the transfer.
+			if _, err := root.Lstat(p); err == nil {
+				return nil, fmt.Errorf("%s already exists", p)
+			}
+			r.queue = append(r.queue, i)
+			continue
+		}
+		empty, err := root.OpenFile(p, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o644)
+		if err != nil {
+			return nil, err
+		}
+		empty.Close()
+	}
+	if len(r.queue) == 0 {
+		r.finish(nil)
+	}
+	return r, nil
+}
+
+func (r *receiver) onMessage(msg webrtc.DataChannelMessage) {
+	if err := r.write(msg); err != nil {
+		if r.cur != nil {
+			r.cur.Close()
+		}
+		r.finish(err)
+	}
+}
+
+func (r *receiver) write(msg webrtc.DataChannelMessage) error {
+	if msg.IsString {
+		var meta fileMeta
+		if err := json.Unmarshal(msg.Data, &meta); err != nil || meta.Type != "meta" {
+			return nil
+		}
+		if r.cur != nil || len(r.queue) == 0 {
+			return fmt.Errorf("unexpected file %q", meta.Name)
+		}
+		f := r.files[r.queue[0]]
+		if meta.Name != f.Name || meta.Size != f.Size {
+			return fmt.Errorf("got %q, expected %q", meta.Name, f.Name)
+		}
+		p, _ := localPath(f)
+		file, err := r.root.OpenFile(p, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o644)
+		if err != nil {
+			return err
+		}
+		r.cur, r.written = file, 0
+		return nil
+	}
+
+	if r.cur == nil {
+		return errors.New("data before file metadata")
+	}
+	f := r.files[r.queue[0]]
+	if r.written+int64(len(msg.Data)) > f.Size {
+		return fmt.Errorf("%s: more data than announced", f.Name)
+	}
+	if _, err := r.cur.Write(msg.Data); err != nil {
+		return err
+	}
+	r.written += int64(len(msg.Data))
+	if r.written < f.Size {
+		return nil
+	}
+	if err := r.cur.Close(); err != nil {
+		return err
+	}
+	fmt.Printf("received %s\n", r.cur.Name())
+	r.cur = nil
+	r.queue = r.queue[1:]
+	if len(r.queue) == 0 {
+		r.finish(nil)
+	}
+	return nil
+}
+
+// finish sets the modes and times of the manifest once everything is
+// written. Directories go last, writing into them changes their time.
+func (r *receiver) finish(err error) {
+	r.doneOnce.Do(func() {
+		if err == nil {
+			for i := len(r.files) - 1; i >= 0; i-- {
+				f := r.files[i]
+				p, _ := localPath(f)
+				if f.Mode != 0 {
+					if err = r.root.Chmod(p, fs.FileMode(f.Mode)); err != nil {
+						break
+					}
+				}
+				if f.ModTime != 0 {
+					t := time.UnixMilli(f.ModTime)
+					if err = r.root.Chtimes(p, t, t); err != nil {
+						break
+					}
+				}
+			}
+		}
+		r.done <- err
+	})
+}
+
+func runReceive(sec helper.GoDropConfig, args []string) error {
+	flags := flag.NewFlagSet("receive", flag.ContinueOnError)
+	dir := flags.String("dir", ".", "folder to write the files to")
+	yes := flags.Bool("y", false, "accept the first offer without asking")
+	name := flags.String("name", "", "username to register the identity with on first use")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(*dir, 0o755); err != nil {
+		return err
+	}
+	root, err := os.OpenRoot(*dir)
+	if err != nil {
+		return err
+	}
+	defer root.Close()
+
+	c, err := connect(sec, *name)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+	fmt.Printf("waiting for an offer as %s\n", c.publicKey)
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+	stdin := bufio.NewReader(os.Stdin)
+
+	var txID string
+	var r *receiver
+	var p *peer
+	var early []signalEvent // signals that came before START_TRANSACTION
+	defer func() {
+		if p != nil {
+			p.Close()
+		}
+	}()
+
+	for {
+		var ev wsEvent
+		var done chan error
+		if r != nil {
+			done = r.done
+		}
+		select {
+		case <-ctx.Done():
+			if txID != "" {
+				c.send(server.CANCEL_TRANSFER, map[string]any{"transaction_id": txID, "reason": "interrupted"})
+			}
+			return errors.New("interrupted")
+		case err := <-done:
+			if err != nil {
+				c.send(server.CANCEL_TRANSFER, map[string]any{"transaction_id": txID, "reason": err.Error()})
+				return err
+			}
+			fmt.Printf("received %d entries into %s\n", len(r.files), *dir)
+			return nil
+		case ev = <-c.events:
+		case <-c.closed:
+			return fmt.Errorf("connection closed: %w", c.err)
+		}
+
+		switch ev.Type {
+		case server.ERROR:
+			fmt.Fprintln(os.Stderr, serverError(ev))
+
+		case server.TRANSACTION_SHARE_ACCEPT:
+			var offer struct {
+				Transaction *server.Transaction `json:"transaction"`
+				Sender      string              `json:"sender"`
+			}
+			if txID != "" || json.Unmarshal(ev.Data, &offer) != nil || offer.Transaction == nil {
+				continue
+			}
+			accept := *yes || askOffer(stdin, offer.Sender, offer.Transaction.Files)
+			c.send(server.TRANSACTION_SHARE_ACCEPT, map[string]any{"transaction_id": offer.Transaction.ID, "accept": accept})
+			if accept {
+				txID = offer.Transaction.ID
+			}
+
+		case server.START_TRANSACTION:
+			var start struct {
+				TransactionID string             `json:"transaction_id"`
+				Sender        string             `json:"sender"`
+				Files         []*server.FileInfo `json:"files"`
+			}
+			// An offer taken by one of our auto-accept rules starts here.
+			if json.Unmarshal(ev.Data, &start) != nil || r != nil || (txID != "" && start.TransactionID != txID) {
+				continue
+			}
+			txID = start.TransactionID
+			fmt.Printf("receiving %d entries from %s\n", len(start.Files), start.Sender)
+			if r, err = newReceiver(root, start.Files); err != nil {
+				c.send(server.CANCEL_TRANSFER, map[string]any{"transaction_id": txID, "reason": err.Error()})
+				return err
+			}
+			for _, sig := range early {
+				if p, err = receiveSignal(c, p, r, sig); err != nil {
+					return err
+				}
+			}
+			early = nil
+
+		case server.WEBRTC_SIGNAL:
+			var sig signalEvent
+			if json.Unmarshal(ev.Data, &sig) != nil || txID == "" || sig.TransactionID != txID {
+				continue
+			}
+			if r == nil {
+				early = append(early, sig)
+				continue
+			}
+			if p, err = receiveSignal(c, p, r, sig); err != nil {
+				return err
+			}
+
+		case server.CANCEL_TRANSFER:
+			var notice struct {
+				TransactionID string `json:"transaction_id"`
+				Reason        string `json:"reason"`
+			}
+			if json.Unmarshal(ev.Data, &notice) == nil && notice.TransactionID == txID {
+				return fmt.Errorf("transfer cancelled%s", reasonSuffix(notice.Reason))
+			}
+
+		case server.DELETE_TRANSACTION:
+			var id string
+			if json.Unmarshal(ev.Data, &id) == nil && id == txID {
+				return errors.New("the sender deleted the transaction")
+			}
+		}
+	}
+}
+
+// receiveSignal answers the sender's offer with a new peer and passes
+// everything else to the existing one.
+func receiveSignal(c *client, p *peer, r *receiver, sig signalEvent) (*peer, error) {
+	if p == nil {
+		if sig.Data.Type != "offer" {
+			return nil, nil
+		}
+		var err error
+		if p, err = newPeer(c, sig.TransactionID, sig.FromKey); err != nil {
+			return nil, err
+		}
+		p.pc.OnDataChannel(func(dc *webrtc.DataChannel) {
+			dc.OnMessage(r.onMessage)
+		})
+	} else if sig.FromKey != p.key {
+		return p, nil
+	}
+	return p, p.handle(sig.Data)
+}
+
+// askOffer prints an offer and asks whether to take it.
+func askOffer(stdin *bufio.Reader, sender string, files []*server.FileInfo) bool {
+	var size int64
+	for _, f := range files {
+		size += f.Size
+	}
+	fmt.Printf("%s offers %d entries, %d bytes:\n", sender, len(files), size)
+	for _, f := range files {
+		p := f.Path
+		if p == "" {
+			p = f.Name
+		}
+		if f.IsDir {
+			p += "/"
+		}
+		fmt.Printf("  %s\n", p)
+	}
+	fmt.Print("accept? [y/N] ")
+	answer, _ := stdin.ReadString('\n')
+	answer = strings.ToLower(strings.TrimSpace(answer))
+	return answer == "y" || answer == "yes"
+}
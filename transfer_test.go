@@ -0,0 +1,113 @@
+package main
+
+import (
+	"encoding/json"
+	server "gopherdrop/server"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/pion/webrtc/v4"
+)
+
+func TestLocalPath(t *testing.T) {
+	for _, f := range []server.FileInfo{
+		{Name: "x", Path: "../x"},
+		{Name: "x", Path: "/etc/x"},
+		{Name: "../x"},
+		{Name: `a\x`},
+	} {
+		if _, err := localPath(&f); err == nil {
+			t.Errorf("localPath(%+v) accepted", f)
+		}
+	}
+	if p, err := localPath(&server.FileInfo{Name: "b", Path: "a/b"}); err != nil || p != filepath.Join("a", "b") {
+		t.Errorf("localPath(a/b) = %q, %v", p, err)
+	}
+}
+
+// TestReceiveTree sends a tree through the receiver the way sendFiles
+// streams it and compares the result.
+func TestReceiveTree(t *testing.T) {
+	src := t.TempDir()
+	tree := filepath.Join(src, "tree")
+	for _, dir := range []string{"sub/deep", "empty"} {
+		if err := os.MkdirAll(filepath.Join(tree, dir), 0o755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	contents := map[string]string{
+		"a.txt":         "hello",
+		"sub/none":      "",
+		"sub/deep/x.sh": "#!/bin/sh\n",
+	}
+	for name, body := range contents {
+		if err := os.WriteFile(filepath.Join(tree, name), []byte(body), 0o640); err != nil {
+			t.Fatal(err)
+		}
+	}
+	mtime := time.UnixMilli(1577934245000)
+	if err := os.Chtimes(filepath.Join(tree, "sub"), mtime, mtime); err != nil {
+		t.Fatal(err)
+	}
+
+	files, sources, err := buildManifest([]string{tree})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 7 || files[0].Path != "tree" || !files[0].IsDir {
+		t.Fatalf("manifest = %+v", files)
+	}
+
+	dst := t.TempDir()
+	root, err := os.OpenRoot(dst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer root.Close()
+	manifest := make([]*server.FileInfo, len(files))
+	for i := range files {
+		manifest[i] = &files[i]
+	}
+	r, err := newReceiver(root, manifest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, f := range files {
+		if f.IsDir || f.Size == 0 {
+			continue
+		}
+		meta, _ := json.Marshal(fileMeta{Type: "meta", Name: f.Name, Size: f.Size})
+		r.onMessage(webrtc.DataChannelMessage{IsString: true, Data: meta})
+		body, err := os.ReadFile(sources[i])
+		if err != nil {
+			t.Fatal(err)
+		}
+		r.onMessage(webrtc.DataChannelMessage{Data: body})
+	}
+	if err := <-r.done; err != nil {
+		t.Fatal(err)
+	}
+
+	for name, body := range contents {
+		got, err := os.ReadFile(filepath.Join(dst, "tree", name))
+		if err != nil || string(got) != body {
+			t.Errorf("%s = %q, %v", name, got, err)
+		}
+		if info, err := os.Stat(filepath.Join(dst, "tree", name)); err != nil || info.Mode().Perm() != 0o640 {
+			t.Errorf("%s mode = %v, %v", name, info.Mode(), err)
+		}
+	}
+	if info, err := os.Stat(filepath.Join(dst, "tree", "empty")); err != nil || !info.IsDir() {
+		t.Errorf("empty directory missing: %v", err)
+	}
+	if info, err := os.Stat(filepath.Join(dst, "tree", "sub")); err != nil || !info.ModTime().Equal(mtime) {
+		t.Errorf("sub mtime = %v, %v", info.ModTime(), err)
+	}
+
+	// A second run into the same folder must not overwrite anything.
+	if _, err := newReceiver(root, manifest); err == nil {
+		t.Error("receiving over existing files succeeded")
+	}
+}